@@ -1,12 +1,19 @@
 package main
 
 import (
+	"context"
 	"log/slog"
 	"os/exec"
+	"time"
+
+	"github.com/claudegate/claudegate/internal/credentials"
 )
 
 const keepaliveSession = "claude-keepalive"
 
+// tokenCheckInterval is how often watchToken reads the OAuth token expiry.
+const tokenCheckInterval = 5 * time.Minute
+
 // startKeepalive launches a background tmux session running an interactive
 // Claude CLI session. The interactive session auto-refreshes OAuth tokens
 // (~8h expiry) while alive, preventing worker failures in long-running deployments.
@@ -20,7 +27,7 @@ func startKeepalive(claudePath string) {
 	}
 
 	// Session already exists (e.g. service restart) — nothing to do.
-	if err := exec.Command("tmux", "has-session", "-t", keepaliveSession).Run(); err == nil {
+	if keepaliveRunning() {
 		slog.Info("keepalive: session already running")
 		return
 	}
@@ -32,3 +39,101 @@ func startKeepalive(claudePath string) {
 
 	slog.Info("keepalive: started tmux session", "session", keepaliveSession)
 }
+
+// keepaliveRunning reports whether the keepalive tmux session exists.
+func keepaliveRunning() bool {
+	return exec.Command("tmux", "has-session", "-t", keepaliveSession).Run() == nil
+}
+
+// superviseKeepalive checks the keepalive session every interval and
+// relaunches it when it is gone, e.g. after the interactive CLI crashed.
+// Returns when ctx is cancelled.
+func superviseKeepalive(ctx context.Context, claudePath string, interval time.Duration) {
+	if _, err := exec.LookPath("tmux"); err != nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if keepaliveRunning() {
+			continue
+		}
+		slog.Warn("keepalive: session died, restarting", "session", keepaliveSession)
+		startKeepalive(claudePath)
+	}
+}
+
+// watchToken backs up the passive keepalive: every tokenCheckInterval it
+// reads the OAuth token expiry and, once the token is within window of
+// expiring, sends a trivial prompt into the keepalive session so the CLI
+// makes a request and refreshes the token. The session is restarted first
+// if it died. Returns when ctx is cancelled.
+func watchToken(ctx context.Context, claudePath string, window time.Duration) {
+	ticker := time.NewTicker(tokenCheckInterval)
+	defer ticker.Stop()
+	n := &tokenNudger{window: window}
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		expiresAt, ok := credentials.TokenExpiry()
+		if !ok {
+			continue
+		}
+		remaining := time.Until(expiresAt)
+		switch n.decide(expiresAt, time.Now()) {
+		case nudgeSend:
+			slog.Info("keepalive: token near expiry, nudging session", "expires_in", remaining.Truncate(time.Second).String())
+			startKeepalive(claudePath)
+			if err := exec.Command("tmux", "send-keys", "-t", keepaliveSession, "hi", "Enter").Run(); err != nil {
+				slog.Warn("keepalive: failed to nudge session", "error", err)
+			}
+		case nudgeGaveUp:
+			slog.Warn("keepalive: token not refreshed after nudge; re-authenticate the claude CLI",
+				"expires_at", expiresAt.Format(time.RFC3339))
+		}
+	}
+}
+
+// nudgeAction is what watchToken does on one tick.
+type nudgeAction int
+
+const (
+	nudgeNone   nudgeAction = iota // token not near expiry, or already handled
+	nudgeSend                      // send a prompt into the keepalive session
+	nudgeGaveUp                    // the nudge did not refresh the token; warn once
+)
+
+// tokenNudger decides when watchToken nudges the keepalive session. It nudges
+// once per token: a refresh changes expiresAt and opens a new window, while a
+// token that stays unrefreshed after its nudge is reported once and then left
+// alone instead of being prompted on every tick.
+type tokenNudger struct {
+	window    time.Duration
+	nudgedFor time.Time // expiresAt of the token last nudged
+	gaveUp    bool      // nudgedFor was reported as not refreshed
+}
+
+func (n *tokenNudger) decide(expiresAt, now time.Time) nudgeAction {
+	if expiresAt.Sub(now) > n.window {
+		return nudgeNone
+	}
+	if !expiresAt.Equal(n.nudgedFor) {
+		n.nudgedFor = expiresAt
+		n.gaveUp = false
+		return nudgeSend
+	}
+	if n.gaveUp {
+		return nudgeNone
+	}
+	n.gaveUp = true
+	return nudgeGaveUp
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenNudger_OncePerToken(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	n := &tokenNudger{window: 30 * time.Minute}
+	expiresAt := now.Add(2 * time.Hour)
+
+	if got := n.decide(expiresAt, now); got != nudgeNone {
+		t.Errorf("outside window = %v, want nudgeNone", got)
+	}
+
+	now = expiresAt.Add(-20 * time.Minute)
+	if got := n.decide(expiresAt, now); got != nudgeSend {
+		t.Errorf("entering window = %v, want nudgeSend", got)
+	}
+
+	// Later ticks on the same, unrefreshed token warn once and then stay quiet,
+	// including after it expired.
+	want := []nudgeAction{nudgeGaveUp, nudgeNone, nudgeNone}
+	for i, w := range want {
+		now = now.Add(5 * time.Minute)
+		if got := n.decide(expiresAt, now); got != w {
+			t.Errorf("tick %d = %v, want %v", i, got, w)
+		}
+	}
+
+	// A refreshed token starts a fresh window.
+	refreshed := now.Add(8 * time.Hour)
+	if got := n.decide(refreshed, now); got != nudgeNone {
+		t.Errorf("refreshed token = %v, want nudgeNone", got)
+	}
+	now = refreshed.Add(-10 * time.Minute)
+	if got := n.decide(refreshed, now); got != nudgeSend {
+		t.Errorf("refreshed token entering window = %v, want nudgeSend", got)
+	}
+}
+
+func TestTokenNudger_ExpiredToken(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	n := &tokenNudger{window: 30 * time.Minute}
+	expiresAt := now.Add(-time.Hour)
+
+	if got := n.decide(expiresAt, now); got != nudgeSend {
+		t.Errorf("already expired = %v, want nudgeSend", got)
+	}
+	if got := n.decide(expiresAt, now.Add(tokenCheckInterval)); got != nudgeGaveUp {
+		t.Errorf("still expired = %v, want nudgeGaveUp", got)
+	}
+}
@@ -2,10 +2,14 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -13,6 +17,8 @@ import (
 	"github.com/claudegate/claudegate/internal/config"
 	"github.com/claudegate/claudegate/internal/job"
 	"github.com/claudegate/claudegate/internal/queue"
+	"github.com/claudegate/claudegate/internal/webhook"
+	"github.com/claudegate/claudegate/internal/worker"
 )
 
 func main() {
@@ -26,12 +32,32 @@ func main() {
 		os.Exit(1)
 	}
 
-	store, err := job.NewSQLiteStore(cfg.DBPath)
+	for name, instruction := range cfg.ResponseFormats {
+		if err := job.RegisterResponseFormat(name, instruction); err != nil {
+			slog.Error("config", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if len(cfg.AllowedTools) > 0 {
+		slog.Warn("jobs may enable CLI tools; the security prompt is relaxed for those tools",
+			"allowed_tools", cfg.AllowedTools, "mcp_config", cfg.MCPConfig)
+	}
+
+	worker.SetMaxProcesses(cfg.MaxProcesses)
+	worker.SetEnvAllow(cfg.WorkerEnvAllow)
+	webhook.SetMaxPerHost(cfg.WebhookMaxPerHost)
+
+	store, err := openStore(cfg)
 	if err != nil {
 		slog.Error("store", "error", err)
 		os.Exit(1)
 	}
 	defer store.Close()
+	if cfg.CompressResults {
+		store.CompressResults(cfg.CompressMinBytes)
+	}
+	store.SetOwner(cfg.InstanceID)
 
 	q := queue.New(cfg, store)
 
@@ -44,21 +70,43 @@ func main() {
 	defer cancel()
 	q.Start(ctx)
 	q.StartCleanup(ctx, cfg.JobTTLHours, cfg.CleanupIntervalMinutes)
+	q.StartHeartbeat(ctx)
+	q.StartSnapshots(ctx, cfg.QueueSnapshotPath, cfg.QueueSnapshotSeconds)
 
 	if !cfg.DisableKeepalive {
 		startKeepalive(cfg.ClaudePath)
+		if cfg.KeepaliveCheckSeconds > 0 {
+			go superviseKeepalive(ctx, cfg.ClaudePath, time.Duration(cfg.KeepaliveCheckSeconds)*time.Second)
+		}
+		if cfg.KeepaliveWindowMinutes > 0 {
+			go watchToken(ctx, cfg.ClaudePath, time.Duration(cfg.KeepaliveWindowMinutes)*time.Minute)
+		}
 	}
 
 	mux := http.NewServeMux()
 	h := api.NewHandler(store, q, cfg)
+
+	// Only the read-only GET handlers go to a replica; writes, the reads that
+	// guard them, SSE and the queue use the primary so they never act on a
+	// stale or missing job.
+	if cfg.DBReadPath != "" || cfg.DBReadDSN != "" {
+		replica, err := openReadStore(cfg)
+		if err != nil {
+			slog.Error("read store", "error", err)
+			os.Exit(1)
+		}
+		defer replica.Close()
+		h.SetReadStore(job.NewReplicaStore(store, replica))
+	}
 	h.RegisterRoutes(mux)
 
 	handler := api.Chain(mux,
 		api.CORS(cfg.CORSOrigins),
 		api.RequestID,
 		api.Logging,
-		api.Auth(cfg.APIKeys),
-		api.RateLimit(cfg.RateLimit),
+		api.Compression,
+		api.Auth(cfg.APIKeys, h.PublicPaths()),
+		api.RateLimits(rateLimits(cfg), cfg.TrustedKeys, api.RateLimitBy(cfg.RateLimitBy)),
 	)
 
 	srv := &http.Server{
@@ -69,22 +117,116 @@ func main() {
 		IdleTimeout:  60 * time.Second,
 	}
 
+	shutdownDone := make(chan struct{})
 	go func() {
+		defer close(shutdownDone)
 		sigCh := make(chan os.Signal, 1)
 		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 		<-sigCh
 		slog.Info("shutting down")
-		cancel()
 		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer shutdownCancel()
 		if err := srv.Shutdown(shutdownCtx); err != nil {
 			slog.Error("shutdown error", "error", err)
 		}
+		// No new jobs can arrive now; let the running ones finish.
+		if cfg.DrainTimeoutSeconds > 0 {
+			drainCtx, drainCancel := context.WithTimeout(context.Background(), time.Duration(cfg.DrainTimeoutSeconds)*time.Second)
+			defer drainCancel()
+			slog.Info("draining running jobs", "timeout_seconds", cfg.DrainTimeoutSeconds)
+			if err := q.Drain(drainCtx); err != nil {
+				slog.Warn("drain timed out, cancelling running jobs")
+			}
+		}
+		cancel()
 	}()
 
-	slog.Info("claudegate listening", "addr", cfg.ListenAddr)
-	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+	if cfg.TLSCertFile != "" {
+		srv.TLSConfig, err = tlsConfig(cfg.TLSClientCAFile)
+		if err != nil {
+			slog.Error("tls", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("claudegate listening", "addr", cfg.ListenAddr, "tls", true, "mtls", cfg.TLSClientCAFile != "")
+		err = srv.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+	} else {
+		slog.Info("claudegate listening", "addr", cfg.ListenAddr)
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
 		slog.Error("server error", "error", err)
 		os.Exit(1)
 	}
+	<-shutdownDone
+	if cfg.QueueSnapshotPath != "" {
+		if err := q.SaveSnapshot(cfg.QueueSnapshotPath); err != nil {
+			slog.Error("queue snapshot", "error", err)
+		}
+	}
+}
+
+// tlsConfig returns the server TLS configuration. When clientCAFile is set,
+// client certificates are requested and verified against it but remain
+// optional, so API-key callers can still connect.
+func tlsConfig(clientCAFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if clientCAFile == "" {
+		return cfg, nil
+	}
+	pem, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("read client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	return cfg, nil
+}
+
+// rateLimits merges CLAUDEGATE_RATE_LIMIT (job submission: create, batch and
+// rerun) with the per-route CLAUDEGATE_RATE_LIMITS, prefixing each pattern's
+// path with the base path.
+func rateLimits(cfg *config.Config) map[string]int {
+	limits := make(map[string]int)
+	for _, path := range []string{"/api/v1/jobs", "/api/v1/jobs/batch", "/api/v1/jobs/{id}/rerun"} {
+		limits[http.MethodPost+" "+cfg.BasePath+path] = cfg.RateLimit
+	}
+	for pattern, rps := range cfg.RateLimits {
+		method, path, _ := strings.Cut(pattern, " ")
+		limits[method+" "+cfg.BasePath+path] = rps
+	}
+	return limits
+}
+
+// closableStore is a job.Store that owns a database connection.
+type closableStore interface {
+	job.Store
+	Close() error
+	CompressResults(minBytes int)
+	SetOwner(id string)
+}
+
+// openStore opens the primary job store selected by CLAUDEGATE_DB_DRIVER.
+func openStore(cfg *config.Config) (closableStore, error) {
+	if cfg.DBDriver == "postgres" {
+		return job.NewPostgresStore(cfg.DBDSN)
+	}
+	return job.NewSQLiteStoreWithOptions(cfg.DBPath, sqliteOptions(cfg))
+}
+
+// openReadStore opens the read replica configured by CLAUDEGATE_DB_READ_DSN
+// (postgres) or CLAUDEGATE_DB_READ_PATH (sqlite).
+func openReadStore(cfg *config.Config) (closableStore, error) {
+	if cfg.DBDriver == "postgres" {
+		return job.NewPostgresReadStore(cfg.DBReadDSN)
+	}
+	return job.NewSQLiteReadStoreWithOptions(cfg.DBReadPath, sqliteOptions(cfg))
+}
+
+// sqliteOptions maps the SQLite connection settings of cfg.
+func sqliteOptions(cfg *config.Config) job.SQLiteOptions {
+	return job.SQLiteOptions{BusyTimeout: time.Duration(cfg.SQLiteBusyTimeoutMS) * time.Millisecond}
 }
@@ -0,0 +1,7 @@
+//go:build postgres
+
+package main
+
+// The PostgreSQL driver is opt-in so default builds stay free of it: build
+// with -tags postgres to link it.
+import _ "github.com/jackc/pgx/v5/stdlib"
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// gzipMinBytes is the smallest response body Compression gzips; below it the
+// gzip framing costs more than it saves.
+const gzipMinBytes = 1024
+
+var gzipWriters = sync.Pool{
+	New: func() any { return gzip.NewWriter(nil) },
+}
+
+// Compression is a Middleware that gzips response bodies of at least
+// gzipMinBytes for clients sending Accept-Encoding: gzip. The SSE endpoint is
+// skipped: gzip buffering would hold events back from the stream.
+var Compression Middleware = func(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/sse") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip, i.e.
+// lists gzip or * without q=0.
+func acceptsGzip(header string) bool {
+	for part := range strings.SplitSeq(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.TrimSpace(coding)
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !ok {
+			return true
+		}
+		if v, err := strconv.ParseFloat(q, 64); err == nil && v > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter buffers the start of a response until it is known to
+// reach gzipMinBytes, then either compresses it or writes it through as is.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool // WriteHeader was called by the handler
+	decided     bool // the underlying header is written
+	gz          *gzip.Writer
+	buf         []byte
+}
+
+func (gw *gzipResponseWriter) WriteHeader(code int) {
+	if gw.wroteHeader {
+		return
+	}
+	gw.wroteHeader = true
+	gw.status = code
+	// Bodiless responses have nothing to compress.
+	if code == http.StatusNoContent || code == http.StatusNotModified {
+		gw.passThrough()
+	}
+}
+
+func (gw *gzipResponseWriter) Write(p []byte) (int, error) {
+	gw.wroteHeader = true
+	if gw.decided {
+		if gw.gz != nil {
+			return gw.gz.Write(p)
+		}
+		return gw.ResponseWriter.Write(p)
+	}
+	gw.buf = append(gw.buf, p...)
+	if len(gw.buf) < gzipMinBytes {
+		return len(p), nil
+	}
+	if err := gw.decide(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush sends what is buffered so far, uncompressed if the threshold was not
+// reached yet.
+func (gw *gzipResponseWriter) Flush() {
+	if !gw.decided {
+		if err := gw.decide(); err != nil {
+			return
+		}
+	}
+	if gw.gz != nil {
+		gw.gz.Flush() //nolint:errcheck
+	}
+	if f, ok := gw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (gw *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return gw.ResponseWriter
+}
+
+// decide writes the header and the buffered body, compressing when the
+// buffer reached gzipMinBytes and the handler did not encode the body itself.
+func (gw *gzipResponseWriter) decide() error {
+	h := gw.Header()
+	if len(gw.buf) < gzipMinBytes || h.Get("Content-Encoding") != "" {
+		gw.passThrough()
+		_, err := gw.ResponseWriter.Write(gw.consume())
+		return err
+	}
+	gw.decided = true
+	h.Set("Content-Encoding", "gzip")
+	h.Del("Content-Length")
+	gw.ResponseWriter.WriteHeader(gw.status)
+	gw.gz = gzipWriters.Get().(*gzip.Writer)
+	gw.gz.Reset(gw.ResponseWriter)
+	_, err := gw.gz.Write(gw.consume())
+	return err
+}
+
+// passThrough writes the header unchanged; later writes bypass gzip.
+func (gw *gzipResponseWriter) passThrough() {
+	gw.decided = true
+	gw.ResponseWriter.WriteHeader(gw.status)
+}
+
+func (gw *gzipResponseWriter) consume() []byte {
+	b := gw.buf
+	gw.buf = nil
+	return b
+}
+
+// close finishes the response: a body shorter than gzipMinBytes is written
+// uncompressed, a compressed one gets its gzip trailer.
+func (gw *gzipResponseWriter) close() {
+	if !gw.decided {
+		if !gw.wroteHeader {
+			// Nothing written: leave the default response to net/http.
+			return
+		}
+		gw.decide() //nolint:errcheck
+	}
+	if gw.gz != nil {
+		gw.gz.Close() //nolint:errcheck
+		gzipWriters.Put(gw.gz)
+		gw.gz = nil
+	}
+}
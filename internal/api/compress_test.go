@@ -0,0 +1,88 @@
+package api
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	t.Parallel()
+	big := strings.Repeat("x", gzipMinBytes)
+	handler := Compression(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if r.URL.Query().Get("size") == "big" {
+			io.WriteString(w, big) //nolint:errcheck
+			return
+		}
+		io.WriteString(w, "small") //nolint:errcheck
+	}))
+
+	tests := []struct {
+		name           string
+		path           string
+		acceptEncoding string
+		wantGzip       bool
+		wantBody       string
+	}{
+		{"big response", "/api/v1/jobs?size=big", "gzip, deflate", true, big},
+		{"below threshold", "/api/v1/jobs", "gzip", false, "small"},
+		{"client without gzip", "/api/v1/jobs?size=big", "", false, big},
+		{"gzip refused", "/api/v1/jobs?size=big", "gzip;q=0, br", false, big},
+		{"sse endpoint", "/api/v1/jobs/abc/sse?size=big", "gzip", false, big},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusCreated {
+				t.Errorf("status = %d, want 201", rec.Code)
+			}
+			gzipped := rec.Header().Get("Content-Encoding") == "gzip"
+			if gzipped != tt.wantGzip {
+				t.Fatalf("Content-Encoding = %q, want gzip: %v", rec.Header().Get("Content-Encoding"), tt.wantGzip)
+			}
+			body := rec.Body.String()
+			if gzipped {
+				zr, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatalf("gzip.NewReader: %v", err)
+				}
+				b, err := io.ReadAll(zr)
+				if err != nil {
+					t.Fatalf("read gzip body: %v", err)
+				}
+				body = string(b)
+			}
+			if body != tt.wantBody {
+				t.Errorf("body length = %d, want %d", len(body), len(tt.wantBody))
+			}
+		})
+	}
+}
+
+func TestCompression_FlushSendsBufferedBody(t *testing.T) {
+	t.Parallel()
+	handler := Compression(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "partial") //nolint:errcheck
+		w.(http.Flusher).Flush()
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/jobs", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if !rec.Flushed || rec.Body.String() != "partial" {
+		t.Errorf("flushed = %v, body = %q; want the buffered text flushed uncompressed", rec.Flushed, rec.Body.String())
+	}
+}
@@ -1,19 +1,34 @@
 package api
 
 import (
+	"cmp"
+	"compress/gzip"
+	"context"
+	crand "crypto/rand"
+	"crypto/sha256"
 	_ "embed"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
-	"os"
-	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/claudegate/claudegate/internal/config"
+	"github.com/claudegate/claudegate/internal/credentials"
 	"github.com/claudegate/claudegate/internal/job"
 	"github.com/claudegate/claudegate/internal/queue"
+	"github.com/claudegate/claudegate/internal/webhook"
 	"github.com/google/uuid"
+	"github.com/oklog/ulid/v2"
 )
 
 //go:embed static/index.html
@@ -21,26 +36,169 @@ var frontendHTML []byte
 
 // Handler holds the dependencies for all HTTP handlers.
 type Handler struct {
-	store job.Store
-	queue *queue.Queue
-	cfg   *config.Config
+	store   job.Store
+	reads   job.Store // list, get, facets and stats reads; see SetReadStore
+	queue   *queue.Queue
+	cfg     *config.Config
+	metrics http.Handler
+	creds   *credsCache
+
+	// maintenance rejects every write with 503 while set. It starts from
+	// CLAUDEGATE_READ_ONLY and admins toggle it with PUT /api/v1/maintenance.
+	maintenance atomic.Bool
 }
 
 // NewHandler constructs a Handler with the given dependencies.
 func NewHandler(store job.Store, q *queue.Queue, cfg *config.Config) *Handler {
-	return &Handler{store: store, queue: q, cfg: cfg}
+	h := &Handler{
+		store:   store,
+		reads:   store,
+		queue:   q,
+		cfg:     cfg,
+		metrics: q.MetricsHandler(),
+		creds:   &credsCache{ttl: credsCacheTTL},
+	}
+	h.maintenance.Store(cfg.ReadOnly)
+	return h
+}
+
+// SetReadStore sends the read-only GET handlers (job list, job get, facets
+// and stats) to reads, typically a lagging replica. Every other handler,
+// including the reads that guard a write and the SSE stream, keeps using the
+// primary store so it never acts on stale data.
+func (h *Handler) SetReadStore(reads job.Store) {
+	h.reads = reads
+}
+
+// route is a single method + path pattern registration.
+type route struct {
+	method  string
+	path    string
+	handler http.HandlerFunc
+}
+
+// routes lists every API route served by the handler.
+func (h *Handler) routes() []route {
+	var rts []route
+	if !h.cfg.DisableFrontend {
+		rts = append(rts, route{http.MethodGet, "/", h.ServeFrontend})
+	}
+	if h.cfg.WaitMetrics {
+		rts = append(rts, route{http.MethodGet, "/api/v1/stats", h.Stats})
+	}
+	return append(rts, []route{
+		{http.MethodPost, "/api/v1/jobs", h.CreateJob},
+		{http.MethodPost, "/api/v1/jobs/batch", h.CreateJobBatch},
+		{http.MethodGet, "/api/v1/jobs", h.ListJobs},
+		{http.MethodGet, "/api/v1/jobs/facets", h.JobFacets},
+		{http.MethodGet, "/api/v1/jobs/{id}", h.GetJob},
+		{http.MethodDelete, "/api/v1/jobs/{id}", h.DeleteJob},
+		{http.MethodGet, "/api/v1/jobs/{id}/sse", h.StreamSSE},
+		{http.MethodPost, "/api/v1/jobs/cancel", h.CancelJobsByMetadata},
+		{http.MethodPost, "/api/v1/jobs/{id}/cancel", h.CancelJob},
+		{http.MethodPost, "/api/v1/jobs/{id}/rerun", h.RerunJob},
+		{http.MethodPost, "/api/v1/jobs/retry", h.RetryJobs},
+		{http.MethodPost, "/api/v1/jobs/{id}/retry", h.RetryJob},
+		{http.MethodPost, "/api/v1/jobs/{id}/webhook/redeliver", h.RedeliverWebhook},
+		{http.MethodPut, "/api/v1/jobs/{id}/note", h.SetJobNote},
+		{http.MethodPost, "/api/v1/admin/jobs/{id}/boost", h.BoostJob},
+		{http.MethodPost, "/api/v1/admin/pause", h.PauseQueue},
+		{http.MethodPost, "/api/v1/admin/resume", h.ResumeQueue},
+		{http.MethodPut, "/api/v1/maintenance", h.SetMaintenance},
+		{http.MethodGet, "/api/v1/health", h.Health},
+		{http.MethodGet, "/api/v1/ready", h.Ready},
+		{http.MethodGet, "/metrics", h.Metrics},
+	}...)
+}
+
+// maintenanceExempt lists the write routes that only change in-memory server
+// state, so they keep working in maintenance mode.
+var maintenanceExempt = []string{"/api/v1/maintenance", "/api/v1/admin/pause", "/api/v1/admin/resume"}
+
+// PublicPaths returns the paths that Auth must let through without an API key.
+// The frontend is only listed when it is served.
+func (h *Handler) PublicPaths() []string {
+	paths := []string{h.path("/api/v1/health"), h.path("/api/v1/ready"), h.path("/metrics")}
+	if !h.cfg.DisableFrontend {
+		paths = append(paths, h.path("/"))
+	}
+	return paths
+}
+
+// path prefixes p with CLAUDEGATE_BASE_PATH.
+func (h *Handler) path(p string) string {
+	return h.cfg.BasePath + p
+}
+
+// fallbackMethods are the methods answered with a JSON 405 when a path exists
+// but was not registered for them.
+var fallbackMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+	http.MethodPatch, http.MethodDelete, http.MethodOptions,
 }
 
 // RegisterRoutes registers all API routes on mux.
+// Every other method on a known path gets a 405 with an Allow header, so
+// wrong-method requests get a JSON error like the rest of the API.
+// Writes other than the maintenance toggle are refused in maintenance mode.
 func (h *Handler) RegisterRoutes(mux *http.ServeMux) {
-	mux.HandleFunc("GET /", h.ServeFrontend)
-	mux.HandleFunc("POST /api/v1/jobs", h.CreateJob)
-	mux.HandleFunc("GET /api/v1/jobs", h.ListJobs)
-	mux.HandleFunc("GET /api/v1/jobs/{id}", h.GetJob)
-	mux.HandleFunc("DELETE /api/v1/jobs/{id}", h.DeleteJob)
-	mux.HandleFunc("GET /api/v1/jobs/{id}/sse", h.StreamSSE)
-	mux.HandleFunc("POST /api/v1/jobs/{id}/cancel", h.CancelJob)
-	mux.HandleFunc("GET /api/v1/health", h.Health)
+	allowed := make(map[string][]string)
+	var paths []string
+	for _, rt := range h.routes() {
+		if rt.method != http.MethodGet && !slices.Contains(maintenanceExempt, rt.path) {
+			rt.handler = h.rejectInMaintenance(rt.handler)
+		}
+		rt.path = h.path(rt.path)
+		mux.HandleFunc(rt.method+" "+rt.path, rt.handler)
+		if _, seen := allowed[rt.path]; !seen {
+			paths = append(paths, rt.path)
+		}
+		allowed[rt.path] = append(allowed[rt.path], rt.method)
+		// GET patterns also match HEAD in net/http.
+		if rt.method == http.MethodGet {
+			allowed[rt.path] = append(allowed[rt.path], http.MethodHead)
+		}
+	}
+	// A method-less fallback pattern would conflict with "GET /", so register
+	// one pattern per missing method instead.
+	for _, p := range paths {
+		handler := methodNotAllowed(allowed[p])
+		for _, m := range fallbackMethods {
+			if !slices.Contains(allowed[p], m) {
+				mux.Handle(m+" "+p, handler)
+			}
+		}
+	}
+}
+
+// rejectInMaintenance responds 503 instead of calling next while the
+// handler is in maintenance mode.
+func (h *Handler) rejectInMaintenance(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.maintenance.Load() {
+			w.Header().Set("Retry-After", "60")
+			writeError(w, http.StatusServiceUnavailable, "maintenance")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// mode reports "maintenance" or "normal" for health and stats.
+func (h *Handler) mode() string {
+	if h.maintenance.Load() {
+		return "maintenance"
+	}
+	return "normal"
+}
+
+// methodNotAllowed responds 405 with an Allow header listing methods.
+func methodNotAllowed(methods []string) http.Handler {
+	allow := strings.Join(methods, ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", allow)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	})
 }
 
 // ServeFrontend serves the embedded playground HTML.
@@ -49,62 +207,463 @@ func (h *Handler) ServeFrontend(w http.ResponseWriter, r *http.Request) {
 	w.Write(frontendHTML) //nolint:errcheck
 }
 
-// CreateJob handles POST /api/v1/jobs and responds 202 with the created job.
+// ulidEntropy makes ULIDs generated within the same millisecond strictly increasing.
+// ulid.MonotonicEntropy is not safe for concurrent use, hence ulidMu.
+var (
+	ulidMu      sync.Mutex
+	ulidEntropy = ulid.Monotonic(crand.Reader, 0)
+)
+
+// newJobID returns an ID for a new job according to CLAUDEGATE_ID_SCHEME.
+// ULIDs sort lexicographically by creation time; UUIDs (the default) are random.
+func (h *Handler) newJobID() string {
+	if h.cfg.IDScheme == "ulid" {
+		ulidMu.Lock()
+		defer ulidMu.Unlock()
+		return ulid.MustNew(ulid.Now(), ulidEntropy).String()
+	}
+	return uuid.New().String()
+}
+
+// requestBody returns the body to decode for r, limited to
+// CLAUDEGATE_MAX_BODY_BYTES unless
+// the caller uses a trusted key. A "Content-Encoding: gzip" body is transparently
+// decompressed; an error is returned when its gzip header is malformed. For
+// gzip bodies the cap applies to the decompressed size as well, so small zip
+// bombs cannot expand past it.
+func (h *Handler) requestBody(w http.ResponseWriter, r *http.Request) (io.ReadCloser, error) {
+	h.limitBody(w, r)
+	if !strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		return r.Body, nil
+	}
+	zr, err := gzip.NewReader(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if h.isTrusted(r) {
+		return zr, nil
+	}
+	return http.MaxBytesReader(w, zr, int64(h.cfg.MaxBodyBytes)), nil
+}
+
+// limitBody caps r.Body at CLAUDEGATE_MAX_BODY_BYTES unless the caller uses a
+// trusted key.
+func (h *Handler) limitBody(w http.ResponseWriter, r *http.Request) {
+	if !h.isTrusted(r) {
+		r.Body = http.MaxBytesReader(w, r.Body, int64(h.cfg.MaxBodyBytes))
+	}
+}
+
+// writeBodyError responds to a request body that failed to decode: 413 when
+// it exceeded the body limit, 400 with message otherwise.
+func writeBodyError(w http.ResponseWriter, err error, message string) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit))
+		return
+	}
+	writeError(w, http.StatusBadRequest, message)
+}
+
+// maxIdempotencyKeyLength caps the Idempotency-Key header.
+const maxIdempotencyKeyLength = 255
+
+// CreateJob handles POST /api/v1/jobs and responds 202 with the created job,
+// or only its job_id, status and created_at in minimal mode. A request
+// carrying an Idempotency-Key already used for a job gets that job back
+// instead, or 409 if its body differs from the original request.
 func (h *Handler) CreateJob(w http.ResponseWriter, r *http.Request) {
-	r.Body = http.MaxBytesReader(w, r.Body, 1<<20) // 1 MB max
-	var req job.CreateRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeError(w, http.StatusBadRequest, "invalid JSON body")
+	key := r.Header.Get("Idempotency-Key")
+	if len(key) > maxIdempotencyKeyLength {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Idempotency-Key exceeds %d characters", maxIdempotencyKeyLength))
 		return
 	}
 
-	if req.Model == "" {
-		req.Model = h.cfg.DefaultModel
+	body, err := h.requestBody(w, r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid gzip body")
+		return
 	}
+	defer body.Close()
 
-	if err := req.Validate(); err != nil {
+	var req job.CreateRequest
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		if errors.Is(err, gzip.ErrChecksum) || errors.Is(err, gzip.ErrHeader) {
+			writeError(w, http.StatusBadRequest, "invalid gzip body")
+			return
+		}
+		writeBodyError(w, err, "invalid JSON body")
+		return
+	}
+	hash := requestHash(&req)
+
+	if err := h.validateCreate(&req); err != nil {
 		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	now := time.Now().UTC()
-	j := &job.Job{
-		ID:             uuid.New().String(),
-		Prompt:         req.Prompt,
-		Model:          req.Model,
-		CallbackURL:    req.CallbackURL,
-		SystemPrompt:   req.SystemPrompt,
-		Metadata:       req.Metadata,
-		ResponseFormat: req.ResponseFormat,
-		Status:         job.StatusQueued,
-		CreatedAt:      now,
+	ctx, cancel := h.storeContext(r)
+	defer cancel()
+
+	if key != "" && h.replayIdempotent(ctx, w, r, key, hash) {
+		return
+	}
+	if err := h.checkParent(ctx, &req); err != nil {
+		if errors.Is(err, errInvalidParent) {
+			writeError(w, http.StatusBadRequest, err.Error())
+		} else {
+			h.writeStoreError(ctx, w, err, "failed to get parent job")
+		}
+		return
 	}
 
-	if err := h.store.Create(r.Context(), j); err != nil {
-		writeError(w, http.StatusInternalServerError, "failed to create job")
+	j := h.newJob(r, &req)
+	j.IdempotencyKey, j.RequestHash = key, hash
+	if err := h.store.Create(ctx, j); err != nil {
+		// A concurrent request with the same key may have won the insert.
+		if key != "" && h.replayIdempotent(ctx, w, r, key, hash) {
+			return
+		}
+		h.writeStoreError(ctx, w, err, "failed to create job")
 		return
 	}
 
-	if err := h.queue.Enqueue(j.ID); err != nil {
+	if err := h.queue.Enqueue(j.ID, j.Priority); err != nil {
+		// Remove the row so that crash recovery does not run a job the
+		// client was told failed, and so that an Idempotency-Key is freed
+		// for the client's retry.
+		h.discardJob(ctx, j)
 		if errors.Is(err, queue.ErrQueueFull) {
-			writeError(w, http.StatusServiceUnavailable, "server busy, retry later")
+			h.writeQueueFull(w)
 		} else {
 			writeError(w, http.StatusInternalServerError, "failed to enqueue job")
 		}
 		return
 	}
+	queue.LogEvent(queue.EventJobCreated, j, j.Status)
+
+	h.writeCreated(w, r, j)
+}
+
+// replayIdempotent answers a request whose Idempotency-Key already belongs
+// to a job: 202 with that job when the request body matches the original,
+// 409 otherwise. Keys older than CLAUDEGATE_IDEMPOTENCY_TTL_HOURS are
+// released first. It reports whether a response was written.
+func (h *Handler) replayIdempotent(ctx context.Context, w http.ResponseWriter, r *http.Request, key, hash string) bool {
+	if h.cfg.IdempotencyTTLHours > 0 {
+		before := time.Now().Add(-time.Duration(h.cfg.IdempotencyTTLHours) * time.Hour)
+		if err := h.store.ReleaseIdempotencyKey(ctx, key, before); err != nil {
+			h.writeStoreError(ctx, w, err, "failed to check idempotency key")
+			return true
+		}
+	}
+	j, err := h.store.GetByIdempotencyKey(ctx, key)
+	if errors.Is(err, job.ErrJobNotFound) {
+		return false
+	}
+	if err != nil {
+		h.writeStoreError(ctx, w, err, "failed to check idempotency key")
+		return true
+	}
+	if j.RequestHash != hash {
+		writeError(w, http.StatusConflict, "Idempotency-Key was already used with a different request")
+		return true
+	}
+	h.redactForCaller(r, j)
+	w.Header().Set("Idempotent-Replayed", "true")
+	h.writeCreated(w, r, j)
+	return true
+}
+
+// requestHash fingerprints a decoded create request. Hashing the re-encoded
+// struct rather than the raw body ignores whitespace and key order.
+func requestHash(req *job.CreateRequest) string {
+	data, _ := json.Marshal(req)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
 
+// writeCreated responds 202 with j, or only its job_id, status and
+// created_at in minimal mode.
+func (h *Handler) writeCreated(w http.ResponseWriter, r *http.Request, j *job.Job) {
+	if h.minimalCreateResponse(r) {
+		writeJSON(w, http.StatusAccepted, map[string]any{
+			"job_id":     j.ID,
+			"status":     j.Status,
+			"created_at": j.CreatedAt,
+		})
+		return
+	}
 	writeJSON(w, http.StatusAccepted, j)
 }
 
+// minimalCreateResponse reports whether CreateJob should skip echoing the
+// job back. ?minimal=true or false overrides CLAUDEGATE_MINIMAL_CREATE_RESPONSE.
+func (h *Handler) minimalCreateResponse(r *http.Request) bool {
+	if v, err := strconv.ParseBool(r.URL.Query().Get("minimal")); err == nil {
+		return v
+	}
+	return h.cfg.MinimalCreateResponse
+}
+
+// validateCreate fills in the default model, makes response_schema imply
+// response_format "json", and checks req, including the
+// per-deployment cap on callback URLs and the server's tool allowlist.
+func (h *Handler) validateCreate(req *job.CreateRequest) error {
+	if req.Model == "" {
+		req.Model = h.cfg.DefaultModel
+	}
+	if len(req.ResponseSchema) > 0 && req.ResponseFormat == "" && len(req.ResponseFormats) == 0 {
+		req.ResponseFormat = "json"
+	}
+	if err := req.Validate(); err != nil {
+		return err
+	}
+	if !h.cfg.AllowControlChars {
+		if err := req.CheckControlChars(); err != nil {
+			return err
+		}
+	}
+	if n := len(req.Callbacks()); h.cfg.MaxCallbackURLs > 0 && n > h.cfg.MaxCallbackURLs {
+		return fmt.Errorf("at most %d callback URLs are allowed, got %d", h.cfg.MaxCallbackURLs, n)
+	}
+	for _, u := range req.Callbacks() {
+		if err := webhook.CheckURL(u); err != nil {
+			return fmt.Errorf("callback URL %q: %w", u, err)
+		}
+	}
+	if h.cfg.MaxJobTimeoutSeconds > 0 && req.TimeoutSeconds > h.cfg.MaxJobTimeoutSeconds {
+		return fmt.Errorf("timeout_seconds must be at most %d", h.cfg.MaxJobTimeoutSeconds)
+	}
+	for _, t := range req.AllowedTools {
+		if !slices.Contains(h.cfg.AllowedTools, t) {
+			return fmt.Errorf("allowed_tools: %q is not enabled on this server (CLAUDEGATE_ALLOWED_TOOLS)", t)
+		}
+	}
+	return nil
+}
+
+// errInvalidParent wraps the reasons a parent_job_id cannot be continued.
+var errInvalidParent = errors.New("invalid parent_job_id")
+
+// checkParent verifies that the job named by req.ParentJobID, if any, exists,
+// has completed and recorded a CLI session to resume. Store failures are
+// returned as is, the other reasons wrap errInvalidParent.
+func (h *Handler) checkParent(ctx context.Context, req *job.CreateRequest) error {
+	if req.ParentJobID == "" {
+		return nil
+	}
+	parent, err := h.store.Get(ctx, req.ParentJobID)
+	if errors.Is(err, job.ErrJobNotFound) {
+		return fmt.Errorf("%w: job %s not found", errInvalidParent, req.ParentJobID)
+	}
+	if err != nil {
+		return err
+	}
+	if parent.Status != job.StatusCompleted {
+		return fmt.Errorf("%w: job %s is %s, not completed", errInvalidParent, parent.ID, parent.Status)
+	}
+	if parent.SessionID == "" {
+		return fmt.Errorf("%w: job %s has no session to resume", errInvalidParent, parent.ID)
+	}
+	return nil
+}
+
+// newJob builds the queued job for a validated create request.
+func (h *Handler) newJob(r *http.Request, req *job.CreateRequest) *job.Job {
+	j := &job.Job{
+		ID:              h.newJobID(),
+		Prompt:          req.Prompt,
+		Model:           req.Model,
+		CallbackURL:     req.CallbackURL,
+		CallbackURLs:    req.CallbackURLs,
+		CallbackHeaders: req.CallbackHeaders,
+		SystemPrompt:    req.SystemPrompt,
+		Metadata:        req.Metadata,
+		ResponseFormat:  req.ResponseFormat,
+		ResponseFormats: req.ResponseFormats,
+		OutputFormat:    req.OutputFormat,
+		MaxRetries:      req.MaxRetries,
+		TimeoutSeconds:  req.TimeoutSeconds,
+		ParentJobID:     req.ParentJobID,
+		AllowedTools:    req.AllowedTools,
+		ResponseSchema:  req.ResponseSchema,
+		Events:          req.Events,
+		Priority:        cmp.Or(req.Priority, job.PriorityNormal),
+		Status:          job.StatusQueued,
+		CreatedAt:       time.Now().UTC(),
+		CreatedBy:       clientCertFromContext(r.Context()),
+	}
+	if h.cfg.StoreRequestID {
+		j.RequestID = requestIDFromContext(r.Context())
+	}
+	return j
+}
+
+// maxBatchSize caps the number of jobs in one POST /api/v1/jobs/batch.
+const maxBatchSize = 100
+
+// batchResult reports the outcome of one item of a batch, in request order.
+type batchResult struct {
+	JobID  string `json:"job_id,omitempty"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// CreateJobBatch handles POST /api/v1/jobs/batch. Every item is validated
+// first; one invalid item rejects the whole batch with 400. The jobs are
+// then stored in one transaction and enqueued in order. When the queue
+// fills partway, the remaining jobs are deleted and reported with status
+// 503, and the response is 207 instead of 202 (503 if none was accepted).
+func (h *Handler) CreateJobBatch(w http.ResponseWriter, r *http.Request) {
+	body, err := h.requestBody(w, r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid gzip body")
+		return
+	}
+	defer body.Close()
+
+	var reqs []job.CreateRequest
+	if err := json.NewDecoder(body).Decode(&reqs); err != nil {
+		if errors.Is(err, gzip.ErrChecksum) || errors.Is(err, gzip.ErrHeader) {
+			writeError(w, http.StatusBadRequest, "invalid gzip body")
+			return
+		}
+		writeBodyError(w, err, "invalid JSON body: expected an array of jobs")
+		return
+	}
+	if len(reqs) == 0 || len(reqs) > maxBatchSize {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("batch must contain between 1 and %d jobs", maxBatchSize))
+		return
+	}
+	// The rate limit took one token for the request; each further job costs one.
+	if !chargeRateLimit(w, r, len(reqs)-1) {
+		return
+	}
+	for i := range reqs {
+		if err := h.validateCreate(&reqs[i]); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("job %d: %v", i, err))
+			return
+		}
+	}
+
+	ctx, cancel := h.storeContext(r)
+	defer cancel()
+
+	for i := range reqs {
+		if err := h.checkParent(ctx, &reqs[i]); err != nil {
+			if errors.Is(err, errInvalidParent) {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("job %d: %v", i, err))
+			} else {
+				h.writeStoreError(ctx, w, err, "failed to get parent job")
+			}
+			return
+		}
+	}
+
+	jobs := make([]*job.Job, len(reqs))
+	for i := range reqs {
+		jobs[i] = h.newJob(r, &reqs[i])
+	}
+	if err := h.store.CreateBatch(ctx, jobs); err != nil {
+		h.writeStoreError(ctx, w, err, "failed to create jobs")
+		return
+	}
+
+	results := make([]batchResult, len(jobs))
+	accepted, full := 0, false
+	for i, j := range jobs {
+		err := queue.ErrQueueFull
+		if !full {
+			err = h.queue.Enqueue(j.ID, j.Priority)
+		}
+		switch {
+		case err == nil:
+			queue.LogEvent(queue.EventJobCreated, j, j.Status)
+			results[i] = batchResult{JobID: j.ID, Status: http.StatusAccepted}
+			accepted++
+			continue
+		case errors.Is(err, queue.ErrQueueFull):
+			full = true
+			results[i] = batchResult{Status: http.StatusServiceUnavailable, Error: "server busy, retry later"}
+		default:
+			results[i] = batchResult{Status: http.StatusInternalServerError, Error: "failed to enqueue job"}
+		}
+		h.discardJob(ctx, j)
+	}
+
+	status := http.StatusMultiStatus
+	switch accepted {
+	case len(jobs):
+		status = http.StatusAccepted
+	case 0:
+		status = http.StatusServiceUnavailable
+		h.setQueueRetryAfter(w)
+	}
+	writeJSON(w, status, map[string]any{"jobs": results})
+}
+
+// discardJob deletes a job that could not be enqueued, so it is not picked
+// up later by crash recovery after the client was told it failed. It runs
+// even if the request was cancelled. If the row cannot be deleted it is
+// failed instead, which recovery skips as well.
+func (h *Handler) discardJob(ctx context.Context, j *job.Job) {
+	ctx = context.WithoutCancel(ctx)
+	err := h.store.Delete(ctx, j.ID)
+	if err == nil {
+		return
+	}
+	slog.Error("delete rejected job", "job_id", j.ID, "error", err)
+	if err := h.store.UpdateStatus(ctx, j.ID, job.StatusFailed, "", "rejected: job could not be queued"); err != nil {
+		slog.Error("fail rejected job", "job_id", j.ID, "error", err)
+	}
+}
+
 // ListJobs handles GET /api/v1/jobs and responds 200 with a paginated list of jobs.
+// Pages are selected by offset, or with ?after=<cursor> by keyset, which stays
+// fast on large tables and does not shift when jobs are created meanwhile.
+// Clients sending Accept: text/csv get the page as CSV instead.
 func (h *Handler) ListJobs(w http.ResponseWriter, r *http.Request) {
-	limit := parseIntParam(r.URL.Query().Get("limit"), 20)
-	offset := parseIntParam(r.URL.Query().Get("offset"), 0)
+	query := r.URL.Query()
+	limit := parseIntParam(query.Get("limit"), 20)
+	offset := parseIntParam(query.Get("offset"), 0)
+	status := job.Status(query.Get("status"))
+	if status != "" && !status.IsValid() {
+		writeError(w, http.StatusBadRequest, "status must be one of: queued, processing, completed, failed, cancelled")
+		return
+	}
+	var after *job.Cursor
+	if s := query.Get("after"); s != "" {
+		if query.Has("offset") {
+			writeError(w, http.StatusBadRequest, "after and offset cannot be combined")
+			return
+		}
+		c, err := job.ParseCursor(s)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid after cursor")
+			return
+		}
+		after = &c
+	}
 
-	jobs, total, err := h.store.List(r.Context(), limit, offset)
+	ctx, cancel := h.storeContext(r)
+	defer cancel()
+
+	var jobs []*job.Job
+	total := -1 // not counted in cursor mode
+	var err error
+	if after != nil {
+		jobs, err = h.reads.ListAfter(ctx, *after, limit, status)
+	} else {
+		jobs, total, err = h.reads.List(ctx, limit, offset, status)
+	}
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "failed to list jobs")
+		h.writeStoreError(ctx, w, err, "failed to list jobs")
+		return
+	}
+
+	if acceptsCSV(r) {
+		writeJobsCSV(w, jobs, total)
 		return
 	}
 
@@ -112,15 +671,106 @@ func (h *Handler) ListJobs(w http.ResponseWriter, r *http.Request) {
 	if jobs == nil {
 		jobs = []*job.Job{}
 	}
+	h.redactForCaller(r, jobs...)
+
+	resp := map[string]any{
+		"jobs":  jobs,
+		"limit": limit,
+	}
+	if after == nil {
+		resp["total"] = total
+		resp["offset"] = offset
+	}
+	// next_cursor continues after this page; an empty page ends the listing.
+	if len(jobs) > 0 {
+		resp["next_cursor"] = job.CursorAfter(jobs[len(jobs)-1]).String()
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// defaultStatsWindow is how far back GET /api/v1/stats looks without ?since=.
+const defaultStatsWindow = 24 * time.Hour
+
+// Stats handles GET /api/v1/stats: per-model queue wait (created_at to
+// started_at) for jobs created within ?since= (a Go duration, default 24h).
+func (h *Handler) Stats(w http.ResponseWriter, r *http.Request) {
+	window := defaultStatsWindow
+	if v := r.URL.Query().Get("since"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, "since must be a positive duration such as 1h or 30m")
+			return
+		}
+		window = d
+	}
 
+	ctx, cancel := h.storeContext(r)
+	defer cancel()
+
+	since := time.Now().UTC().Add(-window)
+	waits, err := h.reads.QueueWaitStats(ctx, since)
+	if err != nil {
+		h.writeStoreError(ctx, w, err, "failed to compute stats")
+		return
+	}
 	writeJSON(w, http.StatusOK, map[string]any{
-		"jobs":   jobs,
-		"total":  total,
-		"limit":  limit,
-		"offset": offset,
+		"mode":       h.mode(),
+		"since":      since,
+		"queue_wait": waits,
 	})
 }
 
+// JobFacets handles GET /api/v1/jobs/facets: the distinct models and statuses
+// present in the data, each with its job count, most common first.
+func (h *Handler) JobFacets(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := h.storeContext(r)
+	defer cancel()
+
+	facets, err := h.reads.Facets(ctx)
+	if err != nil {
+		h.writeStoreError(ctx, w, err, "failed to list facets")
+		return
+	}
+	writeJSON(w, http.StatusOK, facets)
+}
+
+// acceptsCSV reports whether the Accept header asks for text/csv.
+func acceptsCSV(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := strings.Cut(part, ";")
+		if strings.EqualFold(strings.TrimSpace(mediaType), "text/csv") {
+			return true
+		}
+	}
+	return false
+}
+
+// writeJobsCSV writes a page of jobs as CSV with a header row. duration is the
+// processing time in seconds, empty until the job has finished. The total
+// across all pages is sent in X-Total-Count unless negative (not counted).
+func writeJobsCSV(w http.ResponseWriter, jobs []*job.Job, total int) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="jobs.csv"`)
+	if total >= 0 {
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	}
+	w.WriteHeader(http.StatusOK)
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "status", "model", "created_at", "completed_at", "duration"}) //nolint:errcheck
+	for _, j := range jobs {
+		var completedAt, duration string
+		if j.CompletedAt != nil {
+			completedAt = j.CompletedAt.UTC().Format(time.RFC3339)
+			if j.StartedAt != nil {
+				duration = strconv.FormatFloat(j.CompletedAt.Sub(*j.StartedAt).Seconds(), 'f', 3, 64)
+			}
+		}
+		cw.Write([]string{j.ID, string(j.Status), j.Model, j.CreatedAt.UTC().Format(time.RFC3339), completedAt, duration}) //nolint:errcheck
+	}
+	cw.Flush()
+}
+
 // parseIntParam parses a query string integer, returning the fallback on empty or invalid input.
 func parseIntParam(s string, fallback int) int {
 	if s == "" {
@@ -137,16 +787,20 @@ func parseIntParam(s string, fallback int) int {
 func (h *Handler) GetJob(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 
-	j, err := h.store.Get(r.Context(), id)
+	ctx, cancel := h.storeContext(r)
+	defer cancel()
+
+	j, err := h.reads.Get(ctx, id)
 	if errors.Is(err, job.ErrJobNotFound) {
 		writeError(w, http.StatusNotFound, "job not found")
 		return
 	}
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "failed to get job")
+		h.writeStoreError(ctx, w, err, "failed to get job")
 		return
 	}
 
+	h.redactForCaller(r, j)
 	writeJSON(w, http.StatusOK, j)
 }
 
@@ -154,20 +808,24 @@ func (h *Handler) GetJob(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) DeleteJob(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 
-	_, err := h.store.Get(r.Context(), id)
+	ctx, cancel := h.storeContext(r)
+	defer cancel()
+
+	_, err := h.store.Get(ctx, id)
 	if errors.Is(err, job.ErrJobNotFound) {
 		writeError(w, http.StatusNotFound, "job not found")
 		return
 	}
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "failed to get job")
+		h.writeStoreError(ctx, w, err, "failed to get job")
 		return
 	}
 
-	if err := h.store.Delete(r.Context(), id); err != nil {
-		writeError(w, http.StatusInternalServerError, "failed to delete job")
+	if err := h.store.Delete(ctx, id); err != nil {
+		h.writeStoreError(ctx, w, err, "failed to delete job")
 		return
 	}
+	h.queue.CloseSubscribers(id, "job deleted")
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -177,13 +835,16 @@ func (h *Handler) DeleteJob(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) CancelJob(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 
-	j, err := h.store.Get(r.Context(), id)
+	ctx, cancel := h.storeContext(r)
+	defer cancel()
+
+	j, err := h.store.Get(ctx, id)
 	if errors.Is(err, job.ErrJobNotFound) {
 		writeError(w, http.StatusNotFound, "job not found")
 		return
 	}
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "failed to get job")
+		h.writeStoreError(ctx, w, err, "failed to get job")
 		return
 	}
 
@@ -192,8 +853,8 @@ func (h *Handler) CancelJob(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.store.UpdateStatus(r.Context(), id, job.StatusCancelled, "", "job cancelled by user"); err != nil {
-		writeError(w, http.StatusInternalServerError, "failed to cancel job")
+	if err := h.store.UpdateStatus(ctx, id, job.StatusCancelled, "", "job cancelled by user"); err != nil {
+		h.writeStoreError(ctx, w, err, "failed to cancel job")
 		return
 	}
 
@@ -203,38 +864,583 @@ func (h *Handler) CancelJob(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, map[string]string{"status": "cancelled"})
 }
 
-// Health handles GET /api/v1/health and responds 200.
-// It also reports Claude OAuth token validity from ~/.claude/.credentials.json.
-func (h *Handler) Health(w http.ResponseWriter, r *http.Request) {
-	resp := map[string]string{"status": "ok", "claude_auth": "unknown"}
+// CancelJobsByMetadata handles POST /api/v1/jobs/cancel?metadata.<key>=<value> (admin only).
+// It cancels every queued or processing job whose metadata matches all given pairs
+// and responds 200 with the number of jobs cancelled.
+func (h *Handler) CancelJobsByMetadata(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
 
-	homeDir, err := os.UserHomeDir()
-	if err == nil {
-		data, err := os.ReadFile(filepath.Join(homeDir, ".claude", ".credentials.json"))
-		if err == nil {
-			var creds struct {
-				ClaudeAiOauth struct {
-					ExpiresAt int64 `json:"expiresAt"`
-				} `json:"claudeAiOauth"`
-			}
-			if json.Unmarshal(data, &creds) == nil && creds.ClaudeAiOauth.ExpiresAt > 0 {
-				expiresAt := time.UnixMilli(creds.ClaudeAiOauth.ExpiresAt).UTC()
-				remaining := time.Until(expiresAt)
-				if remaining > 0 {
-					resp["claude_auth"] = "valid"
-				} else {
-					resp["claude_auth"] = "expired"
-					remaining = -remaining
-				}
-				resp["token_expires_at"] = expiresAt.Format(time.RFC3339)
-				resp["token_expires_in"] = remaining.Truncate(time.Second).String()
-			}
+	match := make(map[string]string)
+	for param, values := range r.URL.Query() {
+		key, ok := strings.CutPrefix(param, "metadata.")
+		if !ok || key == "" || strings.ContainsAny(key, `"\`) {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid filter %q: use metadata.<key>=<value>", param))
+			return
+		}
+		match[key] = values[0]
+	}
+	if len(match) == 0 {
+		writeError(w, http.StatusBadRequest, "at least one metadata.<key>=<value> filter is required")
+		return
+	}
+
+	ctx, cancel := h.storeContext(r)
+	defer cancel()
+
+	ids, err := h.store.CancelByMetadata(ctx, match, "job cancelled by admin")
+	if err != nil {
+		h.writeStoreError(ctx, w, err, "failed to cancel jobs")
+		return
+	}
+
+	// Stop the ones that are currently running; queued ones are skipped by processJob.
+	for _, id := range ids {
+		h.queue.Cancel(id)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int{"cancelled": len(ids)})
+}
+
+// RerunJob handles POST /api/v1/jobs/{id}/rerun.
+// It creates a new job with the source job's prompt, system prompt, response format and
+// metadata, optionally on a different model, and responds 202 with the new job.
+func (h *Handler) RerunJob(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	h.limitBody(w, r)
+	var req job.RerunRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeBodyError(w, err, "invalid JSON body")
+		return
+	}
+	if err := req.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := h.storeContext(r)
+	defer cancel()
+
+	src, err := h.store.Get(ctx, id)
+	if errors.Is(err, job.ErrJobNotFound) {
+		writeError(w, http.StatusNotFound, "job not found")
+		return
+	}
+	if err != nil {
+		h.writeStoreError(ctx, w, err, "failed to get job")
+		return
+	}
+
+	// The copy goes through the same checks as a new job: the tool allowlist
+	// or the parent may have changed since the source was created.
+	create := job.CreateRequest{
+		Prompt:          src.Prompt,
+		Model:           cmp.Or(req.Model, src.Model),
+		SystemPrompt:    src.SystemPrompt,
+		Metadata:        src.Metadata,
+		ResponseFormat:  src.ResponseFormat,
+		ResponseFormats: src.ResponseFormats,
+		OutputFormat:    src.OutputFormat,
+		MaxRetries:      src.MaxRetries,
+		TimeoutSeconds:  src.TimeoutSeconds,
+		ParentJobID:     src.ParentJobID,
+		AllowedTools:    src.AllowedTools,
+		ResponseSchema:  src.ResponseSchema,
+		Priority:        src.Priority,
+	}
+	if err := h.validateCreate(&create); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := h.checkParent(ctx, &create); err != nil {
+		if errors.Is(err, errInvalidParent) {
+			writeError(w, http.StatusBadRequest, err.Error())
+		} else {
+			h.writeStoreError(ctx, w, err, "failed to get parent job")
+		}
+		return
+	}
+	j := h.newJob(r, &create)
+	j.RerunOf = src.ID
+
+	if err := h.store.Create(ctx, j); err != nil {
+		h.writeStoreError(ctx, w, err, "failed to create job")
+		return
+	}
+
+	if err := h.queue.Enqueue(j.ID, j.Priority); err != nil {
+		h.discardJob(ctx, j)
+		if errors.Is(err, queue.ErrQueueFull) {
+			h.writeQueueFull(w)
+		} else {
+			writeError(w, http.StatusInternalServerError, "failed to enqueue job")
+		}
+		return
+	}
+	queue.LogEvent(queue.EventJobCreated, j, j.Status)
+
+	writeJSON(w, http.StatusAccepted, j)
+}
+
+// RetryJob handles POST /api/v1/jobs/{id}/retry (admin only).
+// It puts a failed or cancelled job back in the queue under the same ID, with
+// its result, error and attempts cleared, and responds 202 with the job.
+func (h *Handler) RetryJob(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	id := r.PathValue("id")
+
+	ctx, cancel := h.storeContext(r)
+	defer cancel()
+
+	j, err := h.store.Get(ctx, id)
+	if errors.Is(err, job.ErrJobNotFound) {
+		writeError(w, http.StatusNotFound, "job not found")
+		return
+	}
+	if err != nil {
+		h.writeStoreError(ctx, w, err, "failed to get job")
+		return
+	}
+	if j.Status != job.StatusFailed && j.Status != job.StatusCancelled {
+		writeError(w, http.StatusConflict, "only failed or cancelled jobs can be retried")
+		return
+	}
+
+	jobs, err := h.store.Requeue(ctx, []string{id})
+	if err != nil {
+		h.writeStoreError(ctx, w, err, "failed to requeue job")
+		return
+	}
+	if len(jobs) == 0 {
+		// The job changed state between Get and Requeue, e.g. a concurrent retry.
+		writeError(w, http.StatusConflict, "only failed or cancelled jobs can be retried")
+		return
+	}
+	if !h.enqueueRequeued(ctx, jobs[0]) {
+		h.writeQueueFull(w)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, jobs[0])
+}
+
+// RedeliverWebhook handles POST /api/v1/jobs/{id}/webhook/redeliver. It sends
+// the terminal webhook of a finished job again to its callback URLs, e.g.
+// after the receiver was down for all automatic attempts, and responds 202
+// once the delivery is started. Its outcome is reported in webhook_status.
+func (h *Handler) RedeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	ctx, cancel := h.storeContext(r)
+	defer cancel()
+
+	j, err := h.store.Get(ctx, id)
+	if errors.Is(err, job.ErrJobNotFound) {
+		writeError(w, http.StatusNotFound, "job not found")
+		return
+	}
+	if err != nil {
+		h.writeStoreError(ctx, w, err, "failed to get job")
+		return
+	}
+	if !j.Status.IsTerminal() {
+		writeError(w, http.StatusConflict, "job is not in a terminal state")
+		return
+	}
+	if len(j.Callbacks()) == 0 {
+		writeError(w, http.StatusConflict, "job has no callback URL")
+		return
+	}
+	if !j.WantsEvent(j.Status) {
+		writeError(w, http.StatusConflict, fmt.Sprintf("job events do not include %s", j.Status))
+		return
+	}
+	// A delivery still retrying would overwrite the new one's webhook_status.
+	if j.WebhookStatus == webhook.StatusPending {
+		writeError(w, http.StatusConflict, "webhook delivery already in progress")
+		return
+	}
+
+	h.queue.Redeliver(ctx, j)
+	writeJSON(w, http.StatusAccepted, map[string]string{"webhook_status": webhook.StatusPending})
+}
+
+// RetryJobs handles POST /api/v1/jobs/retry (admin only), the bulk form of
+// RetryJob: {"ids": [...]}. Jobs that are missing or not failed or cancelled
+// are skipped. It responds 200 with the IDs requeued.
+func (h *Handler) RetryJobs(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	h.limitBody(w, r)
+	var req job.RetryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err, "invalid JSON body")
+		return
+	}
+	if err := req.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := h.storeContext(r)
+	defer cancel()
+
+	jobs, err := h.store.Requeue(ctx, req.IDs)
+	if err != nil {
+		h.writeStoreError(ctx, w, err, "failed to requeue jobs")
+		return
+	}
+	ids := []string{}
+	for _, j := range jobs {
+		if h.enqueueRequeued(ctx, j) {
+			ids = append(ids, j.ID)
 		}
 	}
 
+	writeJSON(w, http.StatusOK, map[string]any{"requeued": ids})
+}
+
+// enqueueRequeued hands a job just requeued in the store to the workers. When
+// the queue is full the job is failed again, so it does not sit in "queued"
+// with no worker ever taking it, and false is returned.
+func (h *Handler) enqueueRequeued(ctx context.Context, j *job.Job) bool {
+	if err := h.queue.Enqueue(j.ID, j.Priority); err != nil {
+		if err := h.store.UpdateStatus(ctx, j.ID, job.StatusFailed, "", "retry rejected: queue full"); err != nil {
+			slog.Error("retry: fail job after queue full", "job_id", j.ID, "error", err)
+		}
+		return false
+	}
+	queue.LogEvent(queue.EventJobRequeued, j, j.Status)
+	return true
+}
+
+// SetJobNote handles PUT /api/v1/jobs/{id}/note (admin only).
+// It attaches an operator note to the job; an empty note clears it.
+func (h *Handler) SetJobNote(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	id := r.PathValue("id")
+
+	h.limitBody(w, r)
+	var req job.NoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err, "invalid JSON body")
+		return
+	}
+	if err := req.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := h.storeContext(r)
+	defer cancel()
+
+	err := h.store.SetNote(ctx, id, req.Note)
+	if errors.Is(err, job.ErrJobNotFound) {
+		writeError(w, http.StatusNotFound, "job not found")
+		return
+	}
+	if err != nil {
+		h.writeStoreError(ctx, w, err, "failed to set note")
+		return
+	}
+
+	j, err := h.store.Get(ctx, id)
+	if errors.Is(err, job.ErrJobNotFound) {
+		writeError(w, http.StatusNotFound, "job not found")
+		return
+	}
+	if err != nil {
+		h.writeStoreError(ctx, w, err, "failed to get job")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, j)
+}
+
+// BoostJob handles POST /api/v1/admin/jobs/{id}/boost (admin only).
+// It raises a queued job to high priority and moves it to the front of the
+// queue, then responds 200 with its new queue position.
+func (h *Handler) BoostJob(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	id := r.PathValue("id")
+
+	ctx, cancel := h.storeContext(r)
+	defer cancel()
+
+	j, err := h.store.Get(ctx, id)
+	if errors.Is(err, job.ErrJobNotFound) {
+		writeError(w, http.StatusNotFound, "job not found")
+		return
+	}
+	if err != nil {
+		h.writeStoreError(ctx, w, err, "failed to get job")
+		return
+	}
+	if j.Status != job.StatusQueued {
+		writeError(w, http.StatusConflict, "job is not queued")
+		return
+	}
+
+	if err := h.store.Boost(ctx, id); err != nil {
+		h.writeStoreError(ctx, w, err, "failed to boost job")
+		return
+	}
+
+	// A job waiting in this instance's queue goes first; one between retries
+	// or held by another instance only gains the boost in the store. Either
+	// way the position is the store's, as GET /api/v1/jobs/{id} reports it.
+	h.queue.Boost(id)
+	position, err := h.store.QueuePosition(ctx, id)
+	if err != nil {
+		h.writeStoreError(ctx, w, err, "failed to get queue position")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"id":             id,
+		"priority":       job.PriorityHigh,
+		"queue_position": position,
+	})
+}
+
+// Health handles GET /api/v1/health, the liveness probe: it responds 200
+// whenever the process serves requests. It also reports Claude OAuth token
+// validity from ~/.claude/.credentials.json, the queue's current load and
+// whether it is paused.
+func (h *Handler) Health(w http.ResponseWriter, r *http.Request) {
+	resp := map[string]any{"status": "ok", "mode": h.mode()}
+	for k, v := range h.claudeAuthStatus() {
+		resp[k] = v
+	}
+	stats := h.queue.Stats()
+	resp["queue_depth"] = stats.Depth
+	resp["queue_capacity"] = stats.Capacity
+	resp["active_jobs"] = stats.Active
+	resp["paused"] = h.queue.Paused()
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Ready handles GET /api/v1/ready, the readiness probe. It responds 503
+// until crash recovery has completed, while the database does not answer and
+// while the queue is full, so load balancers stop sending jobs. With
+// CLAUDEGATE_READY_REQUIRE_CLAUDE_AUTH it also requires a valid Claude OAuth token.
+func (h *Handler) Ready(w http.ResponseWriter, r *http.Request) {
+	resp := map[string]string{"recovery": "done", "database": "ok", "queue": "ok"}
+	ready := true
+	if !h.queue.Recovered() {
+		resp["recovery"], ready = "pending", false
+	}
+	ctx, cancel := h.storeContext(r)
+	err := h.store.Ping(ctx)
+	cancel()
+	if err != nil {
+		slog.Warn("ready: database ping failed", "error", err)
+		resp["database"], ready = "unreachable", false
+	}
+	if h.queue.Full() {
+		resp["queue"], ready = "full", false
+	}
+	if h.cfg.ReadyRequireClaudeAuth {
+		resp["claude_auth"] = h.claudeAuthStatus()["claude_auth"]
+		ready = ready && resp["claude_auth"] == "valid"
+	}
+
+	if !ready {
+		resp["status"] = "unavailable"
+		writeJSON(w, http.StatusServiceUnavailable, resp)
+		return
+	}
+	resp["status"] = "ready"
 	writeJSON(w, http.StatusOK, resp)
 }
 
+// SetMaintenance handles PUT /api/v1/maintenance: {"enabled": true} puts the
+// server in read-only mode, false leaves it. Admin only. The mode is not
+// persisted; a restart goes back to CLAUDEGATE_READ_ONLY.
+func (h *Handler) SetMaintenance(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+
+	h.limitBody(w, r)
+	var req struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, err, "invalid JSON body")
+		return
+	}
+	if req.Enabled == nil {
+		writeError(w, http.StatusBadRequest, "enabled is required")
+		return
+	}
+
+	h.maintenance.Store(*req.Enabled)
+	slog.Info("maintenance mode changed", "enabled", *req.Enabled)
+	writeJSON(w, http.StatusOK, map[string]string{"mode": h.mode()})
+}
+
+// PauseQueue handles POST /api/v1/admin/pause (admin only). Workers stop
+// taking jobs, e.g. during a Claude outage, while submissions keep being
+// queued. Running jobs finish. Like maintenance, the state is not persisted.
+func (h *Handler) PauseQueue(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	h.queue.Pause()
+	slog.Info("queue paused")
+	writeJSON(w, http.StatusOK, map[string]bool{"paused": true})
+}
+
+// ResumeQueue handles POST /api/v1/admin/resume (admin only), undoing PauseQueue.
+func (h *Handler) ResumeQueue(w http.ResponseWriter, r *http.Request) {
+	if !h.requireAdmin(w, r) {
+		return
+	}
+	h.queue.Resume()
+	slog.Info("queue resumed")
+	writeJSON(w, http.StatusOK, map[string]bool{"paused": false})
+}
+
+// Metrics handles GET /metrics with the queue's Prometheus metrics. Like
+// health it is public, so scrapers need no API key.
+func (h *Handler) Metrics(w http.ResponseWriter, r *http.Request) {
+	h.metrics.ServeHTTP(w, r)
+}
+
+// claudeAuthStatus reports the OAuth token expiry from ~/.claude/.credentials.json.
+// claude_auth is "valid", "expired" or "unknown" (no readable credentials).
+// The file is read at most once per credsCacheTTL; validity is computed anew.
+func (h *Handler) claudeAuthStatus() map[string]string {
+	resp := map[string]string{"claude_auth": "unknown"}
+
+	expiresAt := h.creds.expiry()
+	if expiresAt.IsZero() {
+		return resp
+	}
+	remaining := time.Until(expiresAt)
+	if remaining > 0 {
+		resp["claude_auth"] = "valid"
+	} else {
+		resp["claude_auth"] = "expired"
+		remaining = -remaining
+	}
+	resp["token_expires_at"] = expiresAt.Format(time.RFC3339)
+	resp["token_expires_in"] = remaining.Truncate(time.Second).String()
+	return resp
+}
+
+// credsCacheTTL is how long a credentials file read is reused, so that load
+// balancers probing health every second do not re-read it each time.
+const credsCacheTTL = 30 * time.Second
+
+// credsCache holds the OAuth token expiry last read from the credentials file.
+type credsCache struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	readAt    time.Time
+	expiresAt time.Time // zero when the file is missing or unreadable
+}
+
+// expiry returns the cached token expiry, re-reading the file once it is
+// older than the TTL.
+func (c *credsCache) expiry() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.readAt.IsZero() || time.Since(c.readAt) >= c.ttl {
+		c.expiresAt, _ = credentials.TokenExpiry()
+		c.readAt = time.Now()
+	}
+	return c.expiresAt
+}
+
+// requireAdmin reports whether the request was authenticated with an admin-scoped key.
+// When it was not, it writes a 403 response and returns false.
+func (h *Handler) requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if h.isAdmin(r) {
+		return true
+	}
+	writeError(w, http.StatusForbidden, "admin API key required")
+	return false
+}
+
+// isAdmin reports whether the request was authenticated with an admin-scoped key.
+func (h *Handler) isAdmin(r *http.Request) bool {
+	return keyIn(apiKeyFromContext(r.Context()), h.cfg.AdminKeys)
+}
+
+// isTrusted reports whether the request was authenticated with a trusted-scoped key.
+func (h *Handler) isTrusted(r *http.Request) bool {
+	return keyIn(apiKeyFromContext(r.Context()), h.cfg.TrustedKeys)
+}
+
+// redactForCaller clears admin-only fields from jobs about to be returned to a
+// non-admin caller. The effective system prompt contains the server's security
+// prompt, so only admins may see it.
+func (h *Handler) redactForCaller(r *http.Request, jobs ...*job.Job) {
+	if h.isAdmin(r) {
+		return
+	}
+	for _, j := range jobs {
+		j.EffectiveSystemPrompt = ""
+	}
+}
+
+// storeContext derives the context used for store calls while serving r.
+// When CLAUDEGATE_STORE_TIMEOUT_SECONDS > 0 it is bounded so a locked or slow
+// database cannot hold the request open for its whole lifetime.
+func (h *Handler) storeContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if h.cfg.StoreTimeoutSeconds <= 0 {
+		return context.WithCancel(r.Context())
+	}
+	return context.WithTimeout(r.Context(), time.Duration(h.cfg.StoreTimeoutSeconds)*time.Second)
+}
+
+// writeQueueFull responds 503 to a request whose job found the queue full.
+func (h *Handler) writeQueueFull(w http.ResponseWriter) {
+	h.setQueueRetryAfter(w)
+	writeError(w, http.StatusServiceUnavailable, "server busy, retry later")
+}
+
+// setQueueRetryAfter sets Retry-After for a queue-full 503, unless
+// CLAUDEGATE_QUEUE_RETRY_AFTER_SECONDS is 0.
+func (h *Handler) setQueueRetryAfter(w http.ResponseWriter) {
+	if h.cfg.QueueRetryAfterSeconds > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(h.cfg.QueueRetryAfterSeconds))
+	}
+}
+
+// writeStoreError responds 503 when a store call failed for a transient
+// reason worth retrying (ctx hit its store timeout, or the database was busy,
+// locked or unreachable) and 500 otherwise. 503 responses carry Retry-After
+// unless CLAUDEGATE_STORE_RETRY_AFTER_SECONDS is 0.
+func (h *Handler) writeStoreError(ctx context.Context, w http.ResponseWriter, err error, message string) {
+	timedOut := errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded)
+	if !timedOut && !job.IsTransient(err) {
+		writeError(w, http.StatusInternalServerError, message)
+		return
+	}
+	if h.cfg.StoreRetryAfterSeconds > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(h.cfg.StoreRetryAfterSeconds))
+	}
+	if timedOut {
+		writeError(w, http.StatusServiceUnavailable, "database timeout, retry later")
+		return
+	}
+	slog.Warn("store unavailable", "error", err)
+	writeError(w, http.StatusServiceUnavailable, "database busy, retry later")
+}
+
 func writeJSON(w http.ResponseWriter, status int, data any) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
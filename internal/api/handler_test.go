@@ -1,23 +1,39 @@
 package api
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"database/sql/driver"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/claudegate/claudegate/internal/config"
 	"github.com/claudegate/claudegate/internal/job"
 	"github.com/claudegate/claudegate/internal/queue"
+	"github.com/claudegate/claudegate/internal/webhook"
 )
 
 // testConfig returns a minimal config suitable for handler tests.
 func testConfig() *config.Config {
 	return &config.Config{
-		APIKeys:      []string{"test-api-key"},
+		APIKeys:      []string{"test-api-key", "test-admin-key", "test-trusted-key"},
+		AdminKeys:    []string{"test-admin-key"},
+		TrustedKeys:  []string{"test-trusted-key"},
 		DefaultModel: "haiku",
+		MaxBodyBytes: 1 << 20,
 		QueueSize:    100,
 		Concurrency:  1,
 	}
@@ -26,21 +42,29 @@ func testConfig() *config.Config {
 // newTestServer builds an httptest.Server with a real SQLiteStore, Queue and Handler.
 func newTestServer(t *testing.T) (*httptest.Server, *job.SQLiteStore) {
 	t.Helper()
+	return newTestServerWithConfig(t, testConfig())
+}
+
+// newTestServerWithConfig is like newTestServer but uses the given config.
+func newTestServerWithConfig(t *testing.T, cfg *config.Config) (*httptest.Server, *job.SQLiteStore) {
+	t.Helper()
 
 	store, err := job.NewSQLiteStore(":memory:")
 	if err != nil {
 		t.Fatalf("NewSQLiteStore: %v", err)
 	}
 
-	cfg := testConfig()
 	q := queue.New(cfg, store)
+	if err := q.Recovery(context.Background()); err != nil {
+		t.Fatalf("Recovery: %v", err)
+	}
 	h := NewHandler(store, q, cfg)
 
 	mux := http.NewServeMux()
 	h.RegisterRoutes(mux)
 
 	// Wrap with auth middleware (same as production).
-	handler := Auth(cfg.APIKeys)(mux)
+	handler := Chain(mux, RequestID, Auth(cfg.APIKeys, h.PublicPaths()))
 
 	srv := httptest.NewServer(handler)
 	t.Cleanup(func() {
@@ -51,6 +75,26 @@ func newTestServer(t *testing.T) (*httptest.Server, *job.SQLiteStore) {
 
 func apiKey() string { return "test-api-key" }
 
+func adminKey() string { return "test-admin-key" }
+
+func trustedKey() string { return "test-trusted-key" }
+
+// doRequestWithKey is like doRequest but authenticates with the given key.
+func doRequestWithKey(t *testing.T, srv *httptest.Server, method, path string, body []byte, key string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Do request: %v", err)
+	}
+	return resp
+}
+
 func doRequest(t *testing.T, srv *httptest.Server, method, path string, body []byte, withAuth bool) *http.Response {
 	t.Helper()
 	var req *http.Request
@@ -97,6 +141,259 @@ func TestCreateJob_Returns202WithJobID(t *testing.T) {
 	}
 }
 
+func TestCreateJob_IdempotencyKey(t *testing.T) {
+	t.Parallel()
+	srv, _ := newTestServer(t)
+
+	create := func(body, key string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api/v1/jobs", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-Key", apiKey())
+		req.Header.Set("Idempotency-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Do request: %v", err)
+		}
+		return resp
+	}
+	decodeID := func(resp *http.Response) string {
+		t.Helper()
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("status = %d, want 202", resp.StatusCode)
+		}
+		var j job.Job
+		if err := json.NewDecoder(resp.Body).Decode(&j); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		return j.ID
+	}
+
+	first := decodeID(create(`{"prompt": "hello"}`, "order-42"))
+
+	// Same key and same request, formatted differently: the original job.
+	resp := create(`{ "prompt":"hello" }`, "order-42")
+	if resp.Header.Get("Idempotent-Replayed") != "true" {
+		t.Error("replayed response lacks Idempotent-Replayed header")
+	}
+	if id := decodeID(resp); id != first {
+		t.Errorf("replayed job_id = %q, want %q", id, first)
+	}
+
+	conflict := create(`{"prompt": "bye"}`, "order-42")
+	conflict.Body.Close()
+	if conflict.StatusCode != http.StatusConflict {
+		t.Errorf("different body: status = %d, want 409", conflict.StatusCode)
+	}
+
+	if id := decodeID(create(`{"prompt": "hello"}`, "order-43")); id == first {
+		t.Error("another key returned the same job")
+	}
+}
+
+func TestCreateJob_MinimalResponse(t *testing.T) {
+	t.Parallel()
+	cfg := testConfig()
+	cfg.MinimalCreateResponse = true
+	srv, _ := newTestServerWithConfig(t, cfg)
+
+	body, _ := json.Marshal(map[string]any{"prompt": "a long prompt", "metadata": map[string]string{"k": "v"}})
+	for _, tt := range []struct {
+		path    string
+		minimal bool
+	}{
+		{"/api/v1/jobs", true},
+		{"/api/v1/jobs?minimal=false", false},
+	} {
+		resp := doRequest(t, srv, http.MethodPost, tt.path, body, true)
+		var result map[string]any
+		json.NewDecoder(resp.Body).Decode(&result) //nolint:errcheck
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusAccepted || result["job_id"] == nil || result["created_at"] == nil {
+			t.Fatalf("%s: status %d, body %v; want 202 with job_id and created_at", tt.path, resp.StatusCode, result)
+		}
+		if _, echoed := result["prompt"]; echoed == tt.minimal {
+			t.Errorf("%s: prompt echoed = %v, want %v", tt.path, echoed, !tt.minimal)
+		}
+		if _, echoed := result["metadata"]; echoed == tt.minimal {
+			t.Errorf("%s: metadata echoed = %v, want %v", tt.path, echoed, !tt.minimal)
+		}
+	}
+}
+
+func TestCreateJob_ControlCharacters(t *testing.T) {
+	t.Parallel()
+	body, _ := json.Marshal(map[string]string{"prompt": "raw\x00bytes"})
+
+	srv, _ := newTestServer(t)
+	resp := doRequest(t, srv, http.MethodPost, "/api/v1/jobs", body, true)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("default: status = %d, want 400", resp.StatusCode)
+	}
+
+	cfg := testConfig()
+	cfg.AllowControlChars = true
+	srv, _ = newTestServerWithConfig(t, cfg)
+	resp = doRequest(t, srv, http.MethodPost, "/api/v1/jobs", body, true)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Errorf("CLAUDEGATE_ALLOW_CONTROL_CHARS: status = %d, want 202", resp.StatusCode)
+	}
+}
+
+func TestCreateJob_CallbackURLs(t *testing.T) {
+	t.Parallel()
+	cfg := testConfig()
+	cfg.MaxCallbackURLs = 2
+	srv, _ := newTestServerWithConfig(t, cfg)
+
+	body, _ := json.Marshal(map[string]any{
+		"prompt":        "fan out",
+		"callback_url":  "https://a.example.com/hook",
+		"callback_urls": []string{"https://b.example.com/hook"},
+	})
+	resp := doRequest(t, srv, http.MethodPost, "/api/v1/jobs", body, true)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("two callbacks: status = %d, want 202", resp.StatusCode)
+	}
+
+	body, _ = json.Marshal(map[string]any{
+		"prompt":        "too many",
+		"callback_url":  "https://a.example.com/hook",
+		"callback_urls": []string{"https://b.example.com/hook", "https://c.example.com/hook"},
+	})
+	resp = doRequest(t, srv, http.MethodPost, "/api/v1/jobs", body, true)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("three callbacks over a limit of 2: status = %d, want 400", resp.StatusCode)
+	}
+
+	body, _ = json.Marshal(map[string]any{
+		"prompt":        "one internal",
+		"callback_url":  "https://a.example.com/hook",
+		"callback_urls": []string{"http://169.254.169.254/latest"},
+	})
+	resp = doRequest(t, srv, http.MethodPost, "/api/v1/jobs", body, true)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("internal callback among public ones: status = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestCreateJob_TimeoutSeconds(t *testing.T) {
+	t.Parallel()
+	cfg := testConfig()
+	cfg.MaxJobTimeoutSeconds = 600
+	srv, store := newTestServerWithConfig(t, cfg)
+
+	resp := doRequest(t, srv, http.MethodPost, "/api/v1/jobs", []byte(`{"prompt":"long","timeout_seconds":600}`), true)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202", resp.StatusCode)
+	}
+	var created struct {
+		JobID string `json:"job_id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	j, err := store.Get(context.Background(), created.JobID)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if j.TimeoutSeconds != 600 {
+		t.Errorf("TimeoutSeconds = %d, want 600", j.TimeoutSeconds)
+	}
+
+	for _, body := range []string{`{"prompt":"p","timeout_seconds":601}`, `{"prompt":"p","timeout_seconds":-1}`} {
+		resp := doRequest(t, srv, http.MethodPost, "/api/v1/jobs", []byte(body), true)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", body, resp.StatusCode)
+		}
+	}
+}
+
+func TestCreateJobBatch(t *testing.T) {
+	t.Parallel()
+	cfg := testConfig()
+	cfg.QueueSize = 2
+	srv, store := newTestServerWithConfig(t, cfg)
+
+	body := []byte(`[{"prompt": "one"}, {"prompt": "two"}, {"prompt": "three"}]`)
+	resp := doRequest(t, srv, http.MethodPost, "/api/v1/jobs/batch", body, true)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		t.Fatalf("status = %d, want 207", resp.StatusCode)
+	}
+	var got struct {
+		Jobs []struct {
+			JobID  string `json:"job_id"`
+			Status int    `json:"status"`
+		} `json:"jobs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(got.Jobs) != 3 {
+		t.Fatalf("got %d results, want 3", len(got.Jobs))
+	}
+	for i, want := range []int{http.StatusAccepted, http.StatusAccepted, http.StatusServiceUnavailable} {
+		if got.Jobs[i].Status != want {
+			t.Errorf("job %d: status = %d, want %d", i, got.Jobs[i].Status, want)
+		}
+	}
+	first, err := store.Get(context.Background(), got.Jobs[0].JobID)
+	if err != nil || first.Prompt != "one" {
+		t.Errorf("job 0 = %+v, %v; want prompt one", first, err)
+	}
+	if _, total, _ := store.List(context.Background(), 10, 0, ""); total != 2 {
+		t.Errorf("stored jobs = %d, want 2 (rejected job deleted)", total)
+	}
+}
+
+func TestCreateJob_QueueFullRetryAfter(t *testing.T) {
+	t.Parallel()
+	cfg := testConfig()
+	cfg.QueueSize = 1
+	cfg.QueueRetryAfterSeconds = 7
+	srv, store := newTestServerWithConfig(t, cfg)
+
+	body := []byte(`{"prompt": "hello"}`)
+	resp := doRequest(t, srv, http.MethodPost, "/api/v1/jobs", body, true)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("first create: status = %d, want 202", resp.StatusCode)
+	}
+	resp = doRequest(t, srv, http.MethodPost, "/api/v1/jobs", body, true)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "7" {
+		t.Errorf("create on full queue: status = %d, Retry-After = %q; want 503, 7", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if _, total, _ := store.List(context.Background(), 10, 0, ""); total != 1 {
+		t.Errorf("stored jobs = %d, want 1 (rejected job deleted)", total)
+	}
+}
+
+func TestCreateJobBatch_InvalidItemRejectsBatch(t *testing.T) {
+	t.Parallel()
+	srv, store := newTestServer(t)
+
+	body := []byte(`[{"prompt": "ok"}, {"prompt": ""}]`)
+	resp := doRequest(t, srv, http.MethodPost, "/api/v1/jobs/batch", body, true)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400", resp.StatusCode)
+	}
+	if _, total, _ := store.List(context.Background(), 10, 0, ""); total != 0 {
+		t.Errorf("stored jobs = %d, want 0", total)
+	}
+}
+
 func TestGetJob_Returns200(t *testing.T) {
 	t.Parallel()
 	srv, _ := newTestServer(t)
@@ -189,13 +486,164 @@ func TestHealth_Returns200(t *testing.T) {
 		t.Fatalf("health: status = %d, want 200", resp.StatusCode)
 	}
 
-	var result map[string]string
+	var result map[string]any
 	err := json.NewDecoder(resp.Body).Decode(&result)
 	if err != nil {
 		t.Fatalf("decode health response: %v", err)
 	}
 	if result["status"] != "ok" {
-		t.Errorf("health status = %q, want %q", result["status"], "ok")
+		t.Errorf("health status = %v, want %q", result["status"], "ok")
+	}
+	if result["claude_auth"] == nil {
+		t.Error("health is missing claude_auth")
+	}
+	// Numbers decode as float64.
+	if result["queue_depth"] != 0.0 || result["queue_capacity"] != 100.0 || result["active_jobs"] != 0.0 {
+		t.Errorf("queue stats = %v/%v, %v active, want 0/100, 0 active",
+			result["queue_depth"], result["queue_capacity"], result["active_jobs"])
+	}
+}
+
+func TestMetrics_PublicPrometheusText(t *testing.T) {
+	t.Parallel()
+	srv, _ := newTestServer(t)
+
+	resp := doRequest(t, srv, http.MethodGet, "/metrics", nil, false)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("metrics: status = %d, want 200", resp.StatusCode)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "claudegate_queue_length 0") {
+		t.Errorf("metrics body missing queue length:\n%s", body)
+	}
+}
+
+func TestStats_QueueWaitPerModel(t *testing.T) {
+	t.Parallel()
+	cfg := testConfig()
+	cfg.WaitMetrics = true
+	srv, store := newTestServerWithConfig(t, cfg)
+
+	ctx := context.Background()
+	j := &job.Job{ID: "wait-1", Prompt: "hi", Model: "sonnet", Status: job.StatusQueued, CreatedAt: time.Now().UTC().Add(-2 * time.Second)}
+	if err := store.Create(ctx, j); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := store.MarkProcessing(ctx, j.ID); err != nil {
+		t.Fatalf("MarkProcessing: %v", err)
+	}
+
+	resp := doRequest(t, srv, http.MethodGet, "/api/v1/stats?since=1h", nil, true)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	var body struct {
+		QueueWait []job.WaitStats `json:"queue_wait"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(body.QueueWait) != 1 || body.QueueWait[0].Model != "sonnet" || body.QueueWait[0].Count != 1 {
+		t.Fatalf("queue_wait = %+v, want one sonnet entry", body.QueueWait)
+	}
+	if w := body.QueueWait[0].Max; w < 1 {
+		t.Errorf("max wait = %v, want about 2s", w)
+	}
+
+	bad := doRequest(t, srv, http.MethodGet, "/api/v1/stats?since=soon", nil, true)
+	bad.Body.Close()
+	if bad.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid since: status = %d, want 400", bad.StatusCode)
+	}
+}
+
+func TestJobFacets(t *testing.T) {
+	t.Parallel()
+	srv, store := newTestServer(t)
+
+	ctx := context.Background()
+	for _, id := range []string{"f-1", "f-2"} {
+		if err := store.Create(ctx, &job.Job{ID: id, Prompt: "hi", Model: "haiku", Status: job.StatusQueued, CreatedAt: time.Now().UTC()}); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+
+	resp := doRequest(t, srv, http.MethodGet, "/api/v1/jobs/facets", nil, true)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	var f job.Facets
+	if err := json.NewDecoder(resp.Body).Decode(&f); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(f.Model) != 1 || f.Model[0] != (job.Facet{Value: "haiku", Count: 2}) {
+		t.Errorf("model facets = %+v, want haiku x2", f.Model)
+	}
+	if len(f.Status) != 1 || f.Status[0] != (job.Facet{Value: "queued", Count: 2}) {
+		t.Errorf("status facets = %+v, want queued x2", f.Status)
+	}
+}
+
+func TestStats_DisabledByDefault(t *testing.T) {
+	t.Parallel()
+	cfg := testConfig()
+	cfg.DisableFrontend = true // "GET /" would otherwise match every path
+	srv, _ := newTestServerWithConfig(t, cfg)
+
+	resp := doRequest(t, srv, http.MethodGet, "/api/v1/stats", nil, true)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestMaintenance_RejectsWritesKeepsReads(t *testing.T) {
+	t.Parallel()
+	cfg := testConfig()
+	cfg.ReadOnly = true
+	srv, _ := newTestServerWithConfig(t, cfg)
+
+	body, _ := json.Marshal(map[string]string{"prompt": "hello"})
+	resp := doRequest(t, srv, http.MethodPost, "/api/v1/jobs", body, true)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("create in maintenance: status = %d, want 503", resp.StatusCode)
+	}
+
+	resp = doRequest(t, srv, http.MethodGet, "/api/v1/jobs", nil, true)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("list in maintenance: status = %d, want 200", resp.StatusCode)
+	}
+
+	resp = doRequest(t, srv, http.MethodGet, "/api/v1/health", nil, false)
+	var health map[string]any
+	json.NewDecoder(resp.Body).Decode(&health) //nolint:errcheck
+	resp.Body.Close()
+	if health["mode"] != "maintenance" {
+		t.Errorf("health mode = %v, want maintenance", health["mode"])
+	}
+
+	off := []byte(`{"enabled": false}`)
+	resp = doRequestWithKey(t, srv, http.MethodPut, "/api/v1/maintenance", off, apiKey())
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("toggle without admin: status = %d, want 403", resp.StatusCode)
+	}
+	resp = doRequestWithKey(t, srv, http.MethodPut, "/api/v1/maintenance", off, adminKey())
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("toggle: status = %d, want 200", resp.StatusCode)
+	}
+
+	resp = doRequest(t, srv, http.MethodPost, "/api/v1/jobs", body, true)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Errorf("create after maintenance: status = %d, want 202", resp.StatusCode)
 	}
 }
 
@@ -325,6 +773,125 @@ func TestCancelJob_NotFound_Returns404(t *testing.T) {
 	}
 }
 
+func TestSetReadStore_OnlyReadEndpointsUseReplica(t *testing.T) {
+	t.Parallel()
+	cfg := testConfig()
+	primary, err := job.NewSQLiteStore(":memory:")
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	// An empty replica stands in for one that has not caught up yet.
+	lagging, err := job.NewSQLiteStore(":memory:")
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	h := NewHandler(primary, queue.New(cfg, primary), cfg)
+	h.SetReadStore(job.NewReplicaStore(primary, lagging))
+	mux := http.NewServeMux()
+	h.RegisterRoutes(mux)
+	srv := httptest.NewServer(Chain(mux, Auth(cfg.APIKeys, h.PublicPaths())))
+	t.Cleanup(srv.Close)
+
+	body, _ := json.Marshal(map[string]string{"prompt": "fresh"})
+	resp := doRequest(t, srv, http.MethodPost, "/api/v1/jobs", body, true)
+	var created map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatalf("decode create response: %v", err)
+	}
+	resp.Body.Close()
+	jobID := created["job_id"].(string)
+
+	resp = doRequest(t, srv, http.MethodGet, "/api/v1/jobs/"+jobID, nil, true)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("get: status = %d, want 404 from the lagging replica", resp.StatusCode)
+	}
+
+	// Cancel reads the job before writing it, so it must see the primary.
+	resp = doRequest(t, srv, http.MethodPost, "/api/v1/jobs/"+jobID+"/cancel", nil, true)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("cancel: status = %d, want 200", resp.StatusCode)
+	}
+	j, err := primary.Get(context.Background(), jobID)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if j.Status != job.StatusCancelled {
+		t.Errorf("status = %q, want cancelled", j.Status)
+	}
+}
+
+func TestListJobs_StatusFilter(t *testing.T) {
+	t.Parallel()
+	srv, _ := newTestServer(t)
+
+	createTestJob(t, srv, "job one")
+	createTestJob(t, srv, "job two")
+
+	for status, want := range map[string]int{"queued": 2, "failed": 0} {
+		resp := doRequest(t, srv, http.MethodGet, "/api/v1/jobs?status="+status, nil, true)
+		var page map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+			t.Fatalf("%s: decode response: %v", status, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status = %d, want 200", status, resp.StatusCode)
+		}
+		if got := int(page["total"].(float64)); got != want {
+			t.Errorf("%s: total = %d, want %d", status, got, want)
+		}
+		if got := len(page["jobs"].([]interface{})); got != want {
+			t.Errorf("%s: len(jobs) = %d, want %d", status, got, want)
+		}
+	}
+
+	resp := doRequest(t, srv, http.MethodGet, "/api/v1/jobs?status=bogus", nil, true)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid status: got %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestListJobs_CSV(t *testing.T) {
+	t.Parallel()
+	srv, _ := newTestServer(t)
+
+	createTestJob(t, srv, "job one")
+	createTestJob(t, srv, "job two")
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/v1/jobs?limit=1", nil)
+	req.Header.Set("X-API-Key", apiKey())
+	req.Header.Set("Accept", "text/csv, application/json;q=0.5")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") {
+		t.Fatalf("Content-Type = %q, want text/csv", ct)
+	}
+	if got := resp.Header.Get("X-Total-Count"); got != "2" {
+		t.Errorf("X-Total-Count = %q, want 2", got)
+	}
+	records, err := csv.NewReader(resp.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("parse csv: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want header + 1 row", len(records))
+	}
+	if got := strings.Join(records[0], ","); got != "id,status,model,created_at,completed_at,duration" {
+		t.Errorf("header = %q", got)
+	}
+	row := records[1]
+	if row[0] == "" || row[1] != "queued" || row[2] != "haiku" || row[4] != "" || row[5] != "" {
+		t.Errorf("row = %v, want a queued haiku job without completion", row)
+	}
+}
+
 func TestListJobs_Pagination(t *testing.T) {
 	t.Parallel()
 	srv, _ := newTestServer(t)
@@ -375,3 +942,1400 @@ func TestListJobs_Pagination(t *testing.T) {
 		t.Errorf("page2 total = %v, want 3", page2["total"])
 	}
 }
+
+func TestListJobs_Cursor(t *testing.T) {
+	t.Parallel()
+	srv, _ := newTestServer(t)
+
+	createTestJob(t, srv, "job one")
+	createTestJob(t, srv, "job two")
+	createTestJob(t, srv, "job three")
+
+	list := func(query string) map[string]any {
+		t.Helper()
+		resp := doRequest(t, srv, http.MethodGet, "/api/v1/jobs?"+query, nil, true)
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status = %d, want 200", query, resp.StatusCode)
+		}
+		var page map[string]any
+		if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+			t.Fatalf("decode %s: %v", query, err)
+		}
+		return page
+	}
+
+	page1 := list("limit=2")
+	cursor, _ := page1["next_cursor"].(string)
+	if cursor == "" {
+		t.Fatal("page1 has no next_cursor")
+	}
+
+	// A job created between pages must not shift the next one.
+	createTestJob(t, srv, "job four")
+
+	page2 := list("limit=2&after=" + cursor)
+	if _, ok := page2["total"]; ok {
+		t.Error("cursor page reports total, want it omitted")
+	}
+	var ids []string
+	for _, p := range []map[string]any{page1, page2} {
+		for _, j := range p["jobs"].([]any) {
+			ids = append(ids, j.(map[string]any)["job_id"].(string))
+		}
+	}
+	if len(ids) != 3 || len(slices.Compact(slices.Sorted(slices.Values(ids)))) != 3 {
+		t.Errorf("ids across pages = %v, want the 3 original jobs once each", ids)
+	}
+
+	page3 := list("limit=2&after=" + page2["next_cursor"].(string))
+	if n := len(page3["jobs"].([]any)); n != 0 {
+		t.Errorf("page3 len(jobs) = %d, want 0", n)
+	}
+	if _, ok := page3["next_cursor"]; ok {
+		t.Error("empty page has a next_cursor")
+	}
+
+	for _, query := range []string{"after=not-a-cursor", "after=" + cursor + "&offset=2"} {
+		resp := doRequest(t, srv, http.MethodGet, "/api/v1/jobs?"+query, nil, true)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", query, resp.StatusCode)
+		}
+	}
+}
+
+func TestRerunJob_Returns202WithNewModel(t *testing.T) {
+	t.Parallel()
+	srv, _ := newTestServer(t)
+
+	body, _ := json.Marshal(map[string]any{"prompt": "compare me", "system_prompt": "Be brief.", "metadata": map[string]int{"user_id": 7}})
+	createResp := doRequest(t, srv, http.MethodPost, "/api/v1/jobs", body, true)
+	defer createResp.Body.Close()
+
+	var created map[string]interface{}
+	if err := json.NewDecoder(createResp.Body).Decode(&created); err != nil {
+		t.Fatalf("decode create response: %v", err)
+	}
+	srcID := created["job_id"].(string)
+
+	rerunBody, _ := json.Marshal(map[string]string{"model": "opus"})
+	resp := doRequest(t, srv, http.MethodPost, "/api/v1/jobs/"+srcID+"/rerun", rerunBody, true)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("rerun: status = %d, want 202", resp.StatusCode)
+	}
+
+	var rerun map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&rerun); err != nil {
+		t.Fatalf("decode rerun response: %v", err)
+	}
+	if rerun["job_id"] == srcID {
+		t.Error("rerun must create a new job_id")
+	}
+	if rerun["rerun_of"] != srcID {
+		t.Errorf("rerun_of = %v, want %q", rerun["rerun_of"], srcID)
+	}
+	if rerun["model"] != "opus" {
+		t.Errorf("model = %v, want opus", rerun["model"])
+	}
+	if rerun["prompt"] != "compare me" || rerun["system_prompt"] != "Be brief." {
+		t.Errorf("prompt/system_prompt not copied: %v", rerun)
+	}
+	if rerun["metadata"] == nil {
+		t.Error("metadata not copied")
+	}
+}
+
+func TestRerunJob_InvalidModel_Returns400(t *testing.T) {
+	t.Parallel()
+	srv, _ := newTestServer(t)
+
+	body, _ := json.Marshal(map[string]string{"prompt": "compare me"})
+	createResp := doRequest(t, srv, http.MethodPost, "/api/v1/jobs", body, true)
+	defer createResp.Body.Close()
+
+	var created map[string]interface{}
+	if err := json.NewDecoder(createResp.Body).Decode(&created); err != nil {
+		t.Fatalf("decode create response: %v", err)
+	}
+
+	rerunBody, _ := json.Marshal(map[string]string{"model": "gpt-4"})
+	resp := doRequest(t, srv, http.MethodPost, "/api/v1/jobs/"+created["job_id"].(string)+"/rerun", rerunBody, true)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("rerun invalid model: status = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestRerunJob_NotFound_Returns404(t *testing.T) {
+	t.Parallel()
+	srv, _ := newTestServer(t)
+
+	body, _ := json.Marshal(map[string]string{"model": "opus"})
+	resp := doRequest(t, srv, http.MethodPost, "/api/v1/jobs/does-not-exist/rerun", body, true)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("rerun not found: status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestRerunJob_RevalidatesSource(t *testing.T) {
+	t.Parallel()
+	srv, store := newTestServer(t)
+	ctx := context.Background()
+
+	// Sources stored before the allowlist changed, or whose parent is gone.
+	for _, src := range []*job.Job{
+		{ID: "tools", Prompt: "p", Model: "haiku", AllowedTools: []string{"Bash"}},
+		{ID: "orphan", Prompt: "p", Model: "haiku", ParentJobID: "deleted-parent"},
+	} {
+		src.Status = job.StatusCompleted
+		src.CreatedAt = time.Now().UTC()
+		if err := store.Create(ctx, src); err != nil {
+			t.Fatalf("Create(%s): %v", src.ID, err)
+		}
+		resp := doRequest(t, srv, http.MethodPost, "/api/v1/jobs/"+src.ID+"/rerun", nil, true)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("rerun %s: status = %d, want 400", src.ID, resp.StatusCode)
+		}
+	}
+	if _, total, _ := store.List(ctx, 10, 0, ""); total != 2 {
+		t.Errorf("jobs = %d, want only the 2 sources", total)
+	}
+}
+
+// blockingStore wraps a Store and makes Get block until its context is done,
+// simulating a locked database.
+type blockingStore struct {
+	job.Store
+}
+
+func (b *blockingStore) Get(ctx context.Context, id string) (*job.Job, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestGetJob_StoreTimeout_Returns503(t *testing.T) {
+	t.Parallel()
+
+	store, err := job.NewSQLiteStore(":memory:")
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	cfg := testConfig()
+	cfg.StoreTimeoutSeconds = 1
+	bs := &blockingStore{Store: store}
+	h := NewHandler(bs, queue.New(cfg, bs), cfg)
+
+	mux := http.NewServeMux()
+	h.RegisterRoutes(mux)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/jobs/any", nil)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", rr.Code)
+	}
+}
+
+// failingStore wraps a Store and makes Get fail with err.
+type failingStore struct {
+	job.Store
+	err error
+}
+
+func (f *failingStore) Get(ctx context.Context, id string) (*job.Job, error) {
+	return nil, f.err
+}
+
+// undeletableStore wraps a Store and makes Delete fail.
+type undeletableStore struct {
+	job.Store
+}
+
+func (u *undeletableStore) Delete(ctx context.Context, id string) error {
+	return errors.New("database is locked")
+}
+
+func TestCreateJob_QueueFullFailsUndeletableJob(t *testing.T) {
+	t.Parallel()
+
+	store, err := job.NewSQLiteStore(":memory:")
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	cfg := testConfig()
+	cfg.QueueSize = 1
+	us := &undeletableStore{Store: store}
+	mux := http.NewServeMux()
+	NewHandler(us, queue.New(cfg, us), cfg).RegisterRoutes(mux)
+
+	var last *httptest.ResponseRecorder
+	for range 2 {
+		last = httptest.NewRecorder()
+		mux.ServeHTTP(last, httptest.NewRequest(http.MethodPost, "/api/v1/jobs", strings.NewReader(`{"prompt": "hello"}`)))
+	}
+	if last.Code != http.StatusServiceUnavailable {
+		t.Fatalf("create on full queue: status = %d, want 503", last.Code)
+	}
+
+	queued, _, err := store.List(context.Background(), 10, 0, job.StatusQueued)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(queued) != 1 {
+		t.Errorf("queued jobs = %d, want 1 (rejected job failed)", len(queued))
+	}
+}
+
+func TestGetJob_StoreUnavailable_Returns503WithRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	store, err := job.NewSQLiteStore(":memory:")
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	cfg := testConfig()
+	cfg.StoreRetryAfterSeconds = 3
+
+	for _, tt := range []struct {
+		err        error
+		status     int
+		retryAfter string
+	}{
+		{fmt.Errorf("get job any: %w", driver.ErrBadConn), http.StatusServiceUnavailable, "3"},
+		{errors.New("decode results: unexpected end of JSON input"), http.StatusInternalServerError, ""},
+	} {
+		fs := &failingStore{Store: store, err: tt.err}
+		mux := http.NewServeMux()
+		NewHandler(fs, queue.New(cfg, fs), cfg).RegisterRoutes(mux)
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/jobs/any", nil))
+		if rr.Code != tt.status {
+			t.Errorf("%v: status = %d, want %d", tt.err, rr.Code, tt.status)
+		}
+		if got := rr.Header().Get("Retry-After"); got != tt.retryAfter {
+			t.Errorf("%v: Retry-After = %q, want %q", tt.err, got, tt.retryAfter)
+		}
+	}
+}
+
+func TestSetJobNote_Admin_Returns200(t *testing.T) {
+	t.Parallel()
+	srv, _ := newTestServer(t)
+
+	body, _ := json.Marshal(map[string]string{"prompt": "annotate me"})
+	createResp := doRequest(t, srv, http.MethodPost, "/api/v1/jobs", body, true)
+	defer createResp.Body.Close()
+	var created map[string]interface{}
+	if err := json.NewDecoder(createResp.Body).Decode(&created); err != nil {
+		t.Fatalf("decode create response: %v", err)
+	}
+	jobID := created["job_id"].(string)
+
+	noteBody, _ := json.Marshal(map[string]string{"note": "investigated, CLI bug"})
+	resp := doRequestWithKey(t, srv, http.MethodPut, "/api/v1/jobs/"+jobID+"/note", noteBody, adminKey())
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("set note: status = %d, want 200", resp.StatusCode)
+	}
+
+	getResp := doRequest(t, srv, http.MethodGet, "/api/v1/jobs/"+jobID, nil, true)
+	defer getResp.Body.Close()
+	var got map[string]interface{}
+	if err := json.NewDecoder(getResp.Body).Decode(&got); err != nil {
+		t.Fatalf("decode get response: %v", err)
+	}
+	if got["note"] != "investigated, CLI bug" {
+		t.Errorf("note = %v, want %q", got["note"], "investigated, CLI bug")
+	}
+}
+
+func TestSetJobNote_NonAdmin_Returns403(t *testing.T) {
+	t.Parallel()
+	srv, _ := newTestServer(t)
+
+	noteBody, _ := json.Marshal(map[string]string{"note": "nope"})
+	resp := doRequestWithKey(t, srv, http.MethodPut, "/api/v1/jobs/any/note", noteBody, apiKey())
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("set note without admin: status = %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestSetJobNote_NotFound_Returns404(t *testing.T) {
+	t.Parallel()
+	srv, _ := newTestServer(t)
+
+	noteBody, _ := json.Marshal(map[string]string{"note": "ghost"})
+	resp := doRequestWithKey(t, srv, http.MethodPut, "/api/v1/jobs/does-not-exist/note", noteBody, adminKey())
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("set note not found: status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestBoostJob_Admin_MovesJobToFront(t *testing.T) {
+	t.Parallel()
+	srv, _ := newTestServer(t)
+
+	var ids []string
+	for _, priority := range []string{"high", "low"} {
+		body, _ := json.Marshal(map[string]string{"prompt": "wait", "priority": priority})
+		resp := doRequest(t, srv, http.MethodPost, "/api/v1/jobs", body, true)
+		var created map[string]any
+		if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+			t.Fatalf("decode create response: %v", err)
+		}
+		resp.Body.Close()
+		ids = append(ids, created["job_id"].(string))
+	}
+
+	resp := doRequestWithKey(t, srv, http.MethodPost, "/api/v1/admin/jobs/"+ids[1]+"/boost", nil, adminKey())
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("boost: status = %d, want 200", resp.StatusCode)
+	}
+	var got map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("decode boost response: %v", err)
+	}
+	if got["priority"] != "high" || got["queue_position"] != float64(1) {
+		t.Errorf("boost response = %v, want priority high at queue_position 1", got)
+	}
+
+	getResp := doRequest(t, srv, http.MethodGet, "/api/v1/jobs/"+ids[1], nil, true)
+	defer getResp.Body.Close()
+	var j map[string]any
+	if err := json.NewDecoder(getResp.Body).Decode(&j); err != nil {
+		t.Fatalf("decode get response: %v", err)
+	}
+	if j["priority"] != "high" {
+		t.Errorf("stored priority = %v, want high", j["priority"])
+	}
+}
+
+func TestBoostJob_Errors(t *testing.T) {
+	t.Parallel()
+	srv, store := newTestServer(t)
+
+	ctx := context.Background()
+	done := &job.Job{ID: "done-1", Prompt: "p", Model: "haiku", Status: job.StatusQueued, CreatedAt: time.Now().UTC()}
+	if err := store.Create(ctx, done); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := store.UpdateStatus(ctx, "done-1", job.StatusCompleted, "ok", ""); err != nil {
+		t.Fatalf("UpdateStatus: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		id   string
+		key  string
+		want int
+	}{
+		{"non-admin", "done-1", apiKey(), http.StatusForbidden},
+		{"missing", "does-not-exist", adminKey(), http.StatusNotFound},
+		{"terminal", "done-1", adminKey(), http.StatusConflict},
+	} {
+		resp := doRequestWithKey(t, srv, http.MethodPost, "/api/v1/admin/jobs/"+tt.id+"/boost", nil, tt.key)
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+	}
+}
+
+func TestRetryJob(t *testing.T) {
+	t.Parallel()
+	srv, store := newTestServer(t)
+	ctx := context.Background()
+
+	for _, id := range []string{"failed-1", "failed-2", "queued-1"} {
+		j := &job.Job{ID: id, Prompt: "p", Model: "haiku", Status: job.StatusQueued, CreatedAt: time.Now().UTC()}
+		if err := store.Create(ctx, j); err != nil {
+			t.Fatalf("Create %s: %v", id, err)
+		}
+	}
+	for _, id := range []string{"failed-1", "failed-2"} {
+		if err := store.UpdateStatus(ctx, id, job.StatusFailed, "", "token expired"); err != nil {
+			t.Fatalf("UpdateStatus %s: %v", id, err)
+		}
+	}
+
+	resp := doRequestWithKey(t, srv, http.MethodPost, "/api/v1/jobs/failed-1/retry", nil, apiKey())
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("retry without admin: status = %d, want 403", resp.StatusCode)
+	}
+
+	resp = doRequestWithKey(t, srv, http.MethodPost, "/api/v1/jobs/failed-1/retry", nil, adminKey())
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("retry: status = %d, want 202", resp.StatusCode)
+	}
+	var got map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("decode retry response: %v", err)
+	}
+	if got["status"] != "queued" || got["error"] != nil {
+		t.Errorf("retried job = status %v, error %v; want queued with no error", got["status"], got["error"])
+	}
+
+	for _, id := range []string{"failed-1", "queued-1"} {
+		resp := doRequestWithKey(t, srv, http.MethodPost, "/api/v1/jobs/"+id+"/retry", nil, adminKey())
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusConflict {
+			t.Errorf("retry queued %s: status = %d, want 409", id, resp.StatusCode)
+		}
+	}
+
+	body, _ := json.Marshal(map[string][]string{"ids": {"failed-2", "queued-1", "missing"}})
+	bulk := doRequestWithKey(t, srv, http.MethodPost, "/api/v1/jobs/retry", body, adminKey())
+	defer bulk.Body.Close()
+	if bulk.StatusCode != http.StatusOK {
+		t.Fatalf("bulk retry: status = %d, want 200", bulk.StatusCode)
+	}
+	var requeued map[string][]string
+	if err := json.NewDecoder(bulk.Body).Decode(&requeued); err != nil {
+		t.Fatalf("decode bulk response: %v", err)
+	}
+	if !slices.Equal(requeued["requeued"], []string{"failed-2"}) {
+		t.Errorf("bulk requeued = %v, want [failed-2]", requeued["requeued"])
+	}
+}
+
+func TestRedeliverWebhook(t *testing.T) {
+	t.Parallel()
+	cfg := testConfig()
+	cfg.WebhookAttempts = 1
+	srv, store := newTestServerWithConfig(t, cfg)
+	ctx := context.Background()
+
+	for id, callback := range map[string]string{
+		"done-hook":     "https://receiver.invalid/hook",
+		"done-nohook":   "",
+		"queued-hook":   "https://receiver.invalid/hook",
+		"done-filtered": "https://receiver.invalid/hook",
+		"done-pending":  "https://receiver.invalid/hook",
+	} {
+		j := &job.Job{ID: id, Prompt: "p", Model: "haiku", Status: job.StatusQueued, CallbackURL: callback, CreatedAt: time.Now().UTC()}
+		if id == "done-filtered" {
+			j.Events = []string{"failed"}
+		}
+		if err := store.Create(ctx, j); err != nil {
+			t.Fatalf("Create %s: %v", id, err)
+		}
+	}
+	for _, id := range []string{"done-hook", "done-nohook", "done-filtered", "done-pending"} {
+		if err := store.UpdateStatus(ctx, id, job.StatusCompleted, "ok", ""); err != nil {
+			t.Fatalf("UpdateStatus %s: %v", id, err)
+		}
+	}
+
+	resp := doRequest(t, srv, http.MethodPost, "/api/v1/jobs/done-hook/webhook/redeliver", nil, true)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("redeliver: status = %d, want 202", resp.StatusCode)
+	}
+	got, err := store.Get(ctx, "done-hook")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.WebhookStatus == "" || got.WebhookAttemptedAt == nil {
+		t.Errorf("webhook status after redeliver = %q at %v, want it recorded", got.WebhookStatus, got.WebhookAttemptedAt)
+	}
+
+	if err := store.SetWebhookStatus(ctx, "done-pending", webhook.StatusPending, time.Now()); err != nil {
+		t.Fatalf("SetWebhookStatus: %v", err)
+	}
+
+	for path, want := range map[string]int{
+		"/api/v1/jobs/done-nohook/webhook/redeliver":   http.StatusConflict,
+		"/api/v1/jobs/queued-hook/webhook/redeliver":   http.StatusConflict,
+		"/api/v1/jobs/done-filtered/webhook/redeliver": http.StatusConflict,
+		"/api/v1/jobs/done-pending/webhook/redeliver":  http.StatusConflict,
+		"/api/v1/jobs/missing/webhook/redeliver":       http.StatusNotFound,
+	} {
+		resp := doRequest(t, srv, http.MethodPost, path, nil, true)
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("POST %s: status = %d, want %d", path, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestPauseResume_ReportedInHealth(t *testing.T) {
+	t.Parallel()
+	srv, _ := newTestServer(t)
+
+	paused := func() any {
+		t.Helper()
+		resp := doRequest(t, srv, http.MethodGet, "/api/v1/health", nil, false)
+		defer resp.Body.Close()
+		var body map[string]any
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("decode health: %v", err)
+		}
+		return body["paused"]
+	}
+
+	resp := doRequestWithKey(t, srv, http.MethodPost, "/api/v1/admin/pause", nil, apiKey())
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("pause without admin: status = %d, want 403", resp.StatusCode)
+	}
+
+	resp = doRequestWithKey(t, srv, http.MethodPost, "/api/v1/admin/pause", nil, adminKey())
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("pause: status = %d, want 200", resp.StatusCode)
+	}
+	if p := paused(); p != true {
+		t.Errorf("health paused = %v, want true", p)
+	}
+	// Submissions are still accepted while paused.
+	createTestJob(t, srv, "queued while paused")
+
+	resp = doRequestWithKey(t, srv, http.MethodPost, "/api/v1/admin/resume", nil, adminKey())
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("resume: status = %d, want 200", resp.StatusCode)
+	}
+	if p := paused(); p != false {
+		t.Errorf("health paused = %v, want false", p)
+	}
+}
+
+func TestCreateJob_ParentJobID(t *testing.T) {
+	t.Parallel()
+	srv, store := newTestServer(t)
+	ctx := context.Background()
+
+	for _, id := range []string{"done", "no-session", "running"} {
+		j := &job.Job{ID: id, Prompt: "p", Model: "haiku", Status: job.StatusQueued, CreatedAt: time.Now().UTC()}
+		if err := store.Create(ctx, j); err != nil {
+			t.Fatalf("Create %s: %v", id, err)
+		}
+	}
+	for _, id := range []string{"done", "no-session"} {
+		if err := store.UpdateStatus(ctx, id, job.StatusCompleted, "ok", ""); err != nil {
+			t.Fatalf("UpdateStatus %s: %v", id, err)
+		}
+	}
+	if err := store.SetSessionID(ctx, "done", "sess-1"); err != nil {
+		t.Fatalf("SetSessionID: %v", err)
+	}
+
+	for _, tt := range []struct {
+		parent string
+		want   int
+	}{
+		{"done", http.StatusAccepted},
+		{"missing", http.StatusBadRequest},
+		{"running", http.StatusBadRequest},
+		{"no-session", http.StatusBadRequest},
+	} {
+		body, _ := json.Marshal(map[string]string{"prompt": "and then?", "parent_job_id": tt.parent})
+		resp := doRequest(t, srv, http.MethodPost, "/api/v1/jobs", body, true)
+		var got map[string]any
+		json.NewDecoder(resp.Body).Decode(&got) //nolint:errcheck
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("parent %s: status = %d, want %d (%v)", tt.parent, resp.StatusCode, tt.want, got)
+			continue
+		}
+		if tt.want == http.StatusAccepted && got["parent_job_id"] != tt.parent {
+			t.Errorf("parent_job_id = %v, want %s", got["parent_job_id"], tt.parent)
+		}
+	}
+}
+
+func TestCreateJob_AllowedTools(t *testing.T) {
+	t.Parallel()
+	cfg := testConfig()
+	cfg.AllowedTools = []string{"Read", "mcp__github__get_issue"}
+	srv, _ := newTestServerWithConfig(t, cfg)
+
+	for _, tt := range []struct {
+		tools []string
+		want  int
+	}{
+		{[]string{"Read", "mcp__github__get_issue"}, http.StatusAccepted},
+		{[]string{"Bash"}, http.StatusBadRequest},
+		{[]string{"--dangerously-skip-permissions"}, http.StatusBadRequest},
+		{[]string{"Read,Bash"}, http.StatusBadRequest},
+		{[]string{"Read", "Read"}, http.StatusBadRequest},
+	} {
+		body, _ := json.Marshal(map[string]any{"prompt": "look it up", "allowed_tools": tt.tools})
+		resp := doRequest(t, srv, http.MethodPost, "/api/v1/jobs", body, true)
+		var got map[string]any
+		json.NewDecoder(resp.Body).Decode(&got) //nolint:errcheck
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("tools %v: status = %d, want %d (%v)", tt.tools, resp.StatusCode, tt.want, got)
+			continue
+		}
+		if tt.want == http.StatusAccepted && len(got["allowed_tools"].([]any)) != len(tt.tools) {
+			t.Errorf("allowed_tools = %v, want %v", got["allowed_tools"], tt.tools)
+		}
+	}
+}
+
+func TestMethodNotAllowed_Returns405WithAllow(t *testing.T) {
+	t.Parallel()
+	srv, _ := newTestServer(t)
+
+	resp := doRequest(t, srv, http.MethodPost, "/api/v1/jobs/some-id", nil, true)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("status = %d, want 405", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Allow"); got != "GET, HEAD, DELETE" {
+		t.Errorf("Allow = %q, want %q", got, "GET, HEAD, DELETE")
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	var body map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if body["error"] == "" {
+		t.Error("response missing error field")
+	}
+}
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatalf("gzip write: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("gzip close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func postGzip(t *testing.T, srv *httptest.Server, body []byte) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/v1/jobs", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("X-API-Key", apiKey())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Do request: %v", err)
+	}
+	return resp
+}
+
+func TestCreateJob_GzipBody(t *testing.T) {
+	t.Parallel()
+	srv, _ := newTestServer(t)
+
+	payload, _ := json.Marshal(map[string]string{"prompt": "compressed hello"})
+
+	resp := postGzip(t, srv, gzipBytes(t, payload))
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("gzip body: status = %d, want 202", resp.StatusCode)
+	}
+	var created map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if created["prompt"] != "compressed hello" {
+		t.Errorf("prompt = %v, want %q", created["prompt"], "compressed hello")
+	}
+
+	malformed := postGzip(t, srv, payload) // plain JSON labelled as gzip
+	defer malformed.Body.Close()
+	if malformed.StatusCode != http.StatusBadRequest {
+		t.Errorf("malformed gzip: status = %d, want 400", malformed.StatusCode)
+	}
+
+	// 2 MB of prompt compresses to a few KB but must still hit the decompressed limit.
+	bomb, _ := json.Marshal(map[string]string{"prompt": strings.Repeat("a", 2<<20)})
+	big := postGzip(t, srv, gzipBytes(t, bomb))
+	defer big.Body.Close()
+	if big.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized decompressed body: status = %d, want 413", big.StatusCode)
+	}
+}
+
+func TestCreateJob_ULIDScheme(t *testing.T) {
+	t.Parallel()
+	cfg := testConfig()
+	cfg.IDScheme = "ulid"
+	srv, _ := newTestServerWithConfig(t, cfg)
+
+	var ids []string
+	for range 3 {
+		body, _ := json.Marshal(map[string]string{"prompt": "sortable"})
+		resp := doRequest(t, srv, http.MethodPost, "/api/v1/jobs", body, true)
+		var created map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+			t.Fatalf("decode response: %v", err)
+		}
+		resp.Body.Close()
+		ids = append(ids, created["job_id"].(string))
+	}
+
+	for i, id := range ids {
+		if len(id) != 26 {
+			t.Errorf("id %q: len = %d, want 26 (ULID)", id, len(id))
+		}
+		if i > 0 && ids[i-1] >= id {
+			t.Errorf("ids not increasing: %q >= %q", ids[i-1], id)
+		}
+	}
+}
+
+func TestCreateJob_StoresRequestID(t *testing.T) {
+	t.Parallel()
+	cfg := testConfig()
+	cfg.StoreRequestID = true
+	srv, store := newTestServerWithConfig(t, cfg)
+
+	body, _ := json.Marshal(map[string]string{"prompt": "trace me"})
+	resp := doRequest(t, srv, http.MethodPost, "/api/v1/jobs", body, true)
+	defer resp.Body.Close()
+	var created job.Job
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+
+	reqID := resp.Header.Get("X-Request-ID")
+	if reqID == "" || created.RequestID != reqID {
+		t.Errorf("request_id = %q, want X-Request-ID %q", created.RequestID, reqID)
+	}
+	got, err := store.Get(context.Background(), created.ID)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.RequestID != reqID {
+		t.Errorf("stored request_id = %q, want %q", got.RequestID, reqID)
+	}
+}
+
+func TestDisableFrontend(t *testing.T) {
+	t.Parallel()
+	cfg := testConfig()
+	cfg.DisableFrontend = true
+	srv, _ := newTestServerWithConfig(t, cfg)
+
+	// "/" is no longer auth-exempt.
+	resp := doRequest(t, srv, http.MethodGet, "/", nil, false)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GET / without key: status = %d, want 401", resp.StatusCode)
+	}
+
+	// Nor is it served to authenticated clients.
+	resp = doRequest(t, srv, http.MethodGet, "/", nil, true)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET / with key: status = %d, want 404", resp.StatusCode)
+	}
+
+	resp = doRequest(t, srv, http.MethodGet, "/api/v1/health", nil, false)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("health: status = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	t.Parallel()
+	cfg := testConfig()
+	cfg.BasePath = "/ai"
+	srv, _ := newTestServerWithConfig(t, cfg)
+
+	resp := doRequest(t, srv, http.MethodGet, "/ai/api/v1/health", nil, false)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("prefixed health: status = %d, want 200", resp.StatusCode)
+	}
+
+	resp = doRequest(t, srv, http.MethodGet, "/ai/", nil, false)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("prefixed frontend: status = %d, want 200", resp.StatusCode)
+	}
+
+	resp = doRequest(t, srv, http.MethodGet, "/ai/api/v1/jobs", nil, true)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("prefixed list: status = %d, want 200", resp.StatusCode)
+	}
+
+	// Unprefixed routes are gone; the public exemption moved with them.
+	resp = doRequest(t, srv, http.MethodGet, "/api/v1/health", nil, false)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unprefixed health: status = %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestStreamSSE_OmitPrompt(t *testing.T) {
+	t.Parallel()
+	cfg := testConfig()
+	cfg.SSEOmitPrompt = true
+	srv, store := newTestServerWithConfig(t, cfg)
+
+	ctx := context.Background()
+	j := &job.Job{ID: "sse-private", Prompt: "secret prompt", SystemPrompt: "secret system", Model: "haiku", CreatedAt: time.Now().UTC()}
+	if err := store.Create(ctx, j); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := store.UpdateStatus(ctx, j.ID, job.StatusCompleted, "done", ""); err != nil {
+		t.Fatalf("UpdateStatus: %v", err)
+	}
+
+	resp := doRequest(t, srv, http.MethodGet, "/api/v1/jobs/sse-private/sse", nil, true)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if !strings.Contains(string(body), `"result":"done"`) {
+		t.Fatalf("result frame missing: %s", body)
+	}
+	if strings.Contains(string(body), "secret") || strings.Contains(string(body), `"prompt"`) {
+		t.Errorf("prompt leaked in SSE frame: %s", body)
+	}
+}
+
+func TestStreamSSE_EventFilter(t *testing.T) {
+	t.Parallel()
+	srv, store := newTestServer(t)
+
+	ctx := context.Background()
+	j := &job.Job{ID: "sse-filter", Prompt: "hi", Model: "haiku", CreatedAt: time.Now().UTC()}
+	if err := store.Create(ctx, j); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := store.UpdateStatus(ctx, j.ID, job.StatusCompleted, "done", ""); err != nil {
+		t.Fatalf("UpdateStatus: %v", err)
+	}
+
+	resp := doRequest(t, srv, http.MethodGet, "/api/v1/jobs/sse-filter/sse?events=result", nil, true)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "event: result") {
+		t.Errorf("events=result: missing result frame: %s", body)
+	}
+
+	resp = doRequest(t, srv, http.MethodGet, "/api/v1/jobs/sse-filter/sse?events=status,chunk", nil, true)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if strings.Contains(string(body), "event: result") {
+		t.Errorf("events=status,chunk: result frame not filtered: %s", body)
+	}
+
+	resp = doRequest(t, srv, http.MethodGet, "/api/v1/jobs/sse-filter/sse?events=bogus", nil, true)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("events=bogus: status = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestStreamSSE_Keepalive(t *testing.T) {
+	t.Parallel()
+	cfg := testConfig()
+	cfg.SSEKeepaliveSeconds = 1
+	srv, store := newTestServerWithConfig(t, cfg)
+
+	ctx := context.Background()
+	j := &job.Job{ID: "sse-quiet", Prompt: "hi", Model: "haiku", CreatedAt: time.Now().UTC()}
+	if err := store.Create(ctx, j); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/v1/jobs/sse-quiet/sse", nil)
+	req.Header.Set("X-API-Key", apiKey())
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	defer resp.Body.Close()
+
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("no keepalive before read error: %v", err)
+		}
+		if line == ": keepalive\n" {
+			return
+		}
+	}
+}
+
+func TestStreamSSE_CoalescesChunks(t *testing.T) {
+	t.Parallel()
+	script := filepath.Join(t.TempDir(), "chatty-claude.sh")
+	content := "#!/bin/bash\n" +
+		`for w in one two three; do echo '{"type":"assistant","message":{"content":[{"type":"text","text":"'$w' "}]}}'; done` + "\n" +
+		"sleep 0.5\n" +
+		`echo '{"type":"result","result":"one two three "}'` + "\n"
+	if err := os.WriteFile(script, []byte(content), 0o755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	cfg := testConfig()
+	cfg.ClaudePath = script
+	cfg.SSECoalesceMillis = 200
+	store, err := job.NewSQLiteStore(":memory:")
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	q := queue.New(cfg, store)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	q.Start(ctx)
+	mux := http.NewServeMux()
+	NewHandler(store, q, cfg).RegisterRoutes(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	j := &job.Job{ID: "sse-chatty", Prompt: "hi", Model: "haiku", Status: job.StatusQueued, CreatedAt: time.Now().UTC()}
+	if err := store.Create(ctx, j); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(srv.URL + "/api/v1/jobs/sse-chatty/sse")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer resp.Body.Close()
+	if err := q.Enqueue(j.ID, j.Priority); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+
+	var chunks []string
+	var event string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if name, ok := strings.CutPrefix(line, "event: "); ok {
+			event = name
+		}
+		if event == "result" {
+			break
+		}
+		if data, ok := strings.CutPrefix(line, "data: "); ok && event == "chunk" {
+			chunks = append(chunks, data)
+		}
+	}
+	if len(chunks) != 1 || chunks[0] != `{"text":"one two three "}` {
+		t.Errorf("chunk frames = %q, want one merged frame", chunks)
+	}
+}
+
+func TestStreamSSE_DiagnosticsAdminOnly(t *testing.T) {
+	t.Parallel()
+	script := filepath.Join(t.TempDir(), "noisy-claude.sh")
+	content := "#!/bin/bash\n" +
+		"echo 'internal detail' >&2\n" +
+		"sleep 0.2\n" +
+		`echo '{"type":"result","result":"ok"}'` + "\n"
+	if err := os.WriteFile(script, []byte(content), 0o755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	cfg := testConfig()
+	cfg.ClaudePath = script
+	cfg.SSEDiagnostics = true
+	store, err := job.NewSQLiteStore(":memory:")
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	q := queue.New(cfg, store)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	q.Start(ctx)
+	h := NewHandler(store, q, cfg)
+	mux := http.NewServeMux()
+	h.RegisterRoutes(mux)
+	srv := httptest.NewServer(Chain(mux, Auth(cfg.APIKeys, h.PublicPaths())))
+	t.Cleanup(srv.Close)
+
+	for key, want := range map[string]bool{apiKey(): false, adminKey(): true} {
+		id := "sse-diag-" + key
+		j := &job.Job{ID: id, Prompt: "hi", Model: "haiku", Status: job.StatusQueued, CreatedAt: time.Now().UTC()}
+		if err := store.Create(ctx, j); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		resp := doRequestWithKey(t, srv, http.MethodGet, "/api/v1/jobs/"+id+"/sse?diagnostics=true", nil, key)
+		if err := q.Enqueue(j.ID, j.Priority); err != nil {
+			t.Fatalf("Enqueue: %v", err)
+		}
+		got := false
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if line := scanner.Text(); line == "event: diagnostic" {
+				got = true
+			} else if line == "event: result" {
+				break
+			}
+		}
+		resp.Body.Close()
+		if got != want {
+			t.Errorf("key %s: diagnostic events = %v, want %v", key, got, want)
+		}
+	}
+}
+
+func TestStreamSSE_QueuePosition(t *testing.T) {
+	t.Parallel()
+	cfg := testConfig()
+	cfg.SSEPositionSeconds = 1
+	srv, store := newTestServerWithConfig(t, cfg)
+
+	ctx := context.Background()
+	now := time.Now().UTC()
+	for i, id := range []string{"ahead", "waiting"} {
+		j := &job.Job{ID: id, Prompt: "hi", Model: "haiku", Status: job.StatusQueued, CreatedAt: now.Add(time.Duration(i) * time.Second)}
+		if err := store.Create(ctx, j); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+
+	resp := doRequest(t, srv, http.MethodGet, "/api/v1/jobs/waiting/sse", nil, true)
+	defer resp.Body.Close()
+
+	var positions []string
+	scanner := bufio.NewScanner(resp.Body)
+	for len(positions) < 2 && scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok || !strings.Contains(data, "queue_position") {
+			continue
+		}
+		positions = append(positions, data)
+		if len(positions) == 1 {
+			if err := store.MarkProcessing(ctx, "ahead"); err != nil {
+				t.Fatalf("MarkProcessing: %v", err)
+			}
+		}
+	}
+	want := []string{`{"status":"queued","queue_position":2}`, `{"status":"queued","queue_position":1}`}
+	if !slices.Equal(positions, want) {
+		t.Errorf("position events = %q, want %q", positions, want)
+	}
+}
+
+func TestStreamSSE_DeleteDuringStream(t *testing.T) {
+	t.Parallel()
+	srv, store := newTestServer(t)
+
+	ctx := context.Background()
+	j := &job.Job{ID: "sse-deleted", Prompt: "hi", Model: "haiku", CreatedAt: time.Now().UTC()}
+	if err := store.Create(ctx, j); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/v1/jobs/sse-deleted/sse", nil)
+	req.Header.Set("X-API-Key", apiKey())
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// The initial status frame means the stream is subscribed.
+	reader := bufio.NewReader(resp.Body)
+	if line, err := reader.ReadString('\n'); err != nil || line != "event: status\n" {
+		t.Fatalf("first line = %q, %v; want status event", line, err)
+	}
+
+	del := doRequest(t, srv, http.MethodDelete, "/api/v1/jobs/sse-deleted", nil, true)
+	del.Body.Close()
+	if del.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete: status = %d, want 204", del.StatusCode)
+	}
+
+	// The stream must end on its own rather than wait for the client timeout.
+	rest, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("read stream: %v", err)
+	}
+	if !strings.Contains(string(rest), "event: error") || !strings.Contains(string(rest), "job deleted") {
+		t.Errorf("stream did not end with a job deleted error: %s", rest)
+	}
+
+	// A stream opened after the deletion is rejected up front.
+	resp = doRequest(t, srv, http.MethodGet, "/api/v1/jobs/sse-deleted/sse", nil, true)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("after delete: status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestGetJob_EffectiveSystemPromptAdminOnly(t *testing.T) {
+	t.Parallel()
+	srv, store := newTestServer(t)
+
+	ctx := context.Background()
+	j := &job.Job{ID: "esp-1", Prompt: "hi", Model: "haiku", CreatedAt: time.Now().UTC()}
+	if err := store.Create(ctx, j); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := store.SetEffectiveSystemPrompt(ctx, j.ID, "security rules\n\nbe brief"); err != nil {
+		t.Fatalf("SetEffectiveSystemPrompt: %v", err)
+	}
+
+	for _, tc := range []struct {
+		key  string
+		want string
+	}{
+		{adminKey(), "security rules\n\nbe brief"},
+		{apiKey(), ""},
+	} {
+		resp := doRequestWithKey(t, srv, http.MethodGet, "/api/v1/jobs/esp-1", nil, tc.key)
+		var got job.Job
+		json.NewDecoder(resp.Body).Decode(&got) //nolint:errcheck
+		resp.Body.Close()
+		if got.EffectiveSystemPrompt != tc.want {
+			t.Errorf("key %s: effective_system_prompt = %q, want %q", tc.key, got.EffectiveSystemPrompt, tc.want)
+		}
+	}
+}
+
+func TestCancelJobsByMetadata(t *testing.T) {
+	t.Parallel()
+	srv, store := newTestServer(t)
+
+	ctx := context.Background()
+	for _, id := range []string{"t-1", "t-2"} {
+		j := &job.Job{ID: id, Prompt: "p", Model: "haiku", Metadata: []byte(`{"tenant":"acme"}`), CreatedAt: time.Now().UTC()}
+		if err := store.Create(ctx, j); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+
+	resp := doRequestWithKey(t, srv, http.MethodPost, "/api/v1/jobs/cancel?metadata.tenant=acme", nil, apiKey())
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("non-admin: status = %d, want 403", resp.StatusCode)
+	}
+
+	resp = doRequestWithKey(t, srv, http.MethodPost, "/api/v1/jobs/cancel", nil, adminKey())
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("no filter: status = %d, want 400", resp.StatusCode)
+	}
+
+	resp = doRequestWithKey(t, srv, http.MethodPost, "/api/v1/jobs/cancel?metadata.tenant=acme", nil, adminKey())
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("admin: status = %d, want 200", resp.StatusCode)
+	}
+	var body map[string]int
+	json.NewDecoder(resp.Body).Decode(&body) //nolint:errcheck
+	if body["cancelled"] != 2 {
+		t.Errorf("cancelled = %d, want 2", body["cancelled"])
+	}
+	if got, _ := store.Get(ctx, "t-2"); got.Status != job.StatusCancelled {
+		t.Errorf("t-2 status = %q, want cancelled", got.Status)
+	}
+}
+
+func TestReady(t *testing.T) {
+	t.Parallel()
+	cfg := testConfig()
+	cfg.QueueSize = 1
+	store, err := job.NewSQLiteStore(":memory:")
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	q := queue.New(cfg, store)
+	mux := http.NewServeMux()
+	NewHandler(store, q, cfg).RegisterRoutes(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	ready := func() (int, map[string]string) {
+		t.Helper()
+		resp := doRequest(t, srv, http.MethodGet, "/api/v1/ready", nil, false)
+		defer resp.Body.Close()
+		var body map[string]string
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		return resp.StatusCode, body
+	}
+
+	if code, body := ready(); code != http.StatusServiceUnavailable || body["recovery"] != "pending" {
+		t.Errorf("before recovery: %d %v, want 503 with recovery pending", code, body)
+	}
+	if err := q.Recovery(context.Background()); err != nil {
+		t.Fatalf("Recovery: %v", err)
+	}
+	if code, body := ready(); code != http.StatusOK || body["status"] != "ready" {
+		t.Errorf("after recovery: %d %v, want 200 ready", code, body)
+	}
+
+	if err := q.Enqueue("waiting", job.PriorityNormal); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	if code, body := ready(); code != http.StatusServiceUnavailable || body["queue"] != "full" {
+		t.Errorf("queue full: %d %v, want 503 with queue full", code, body)
+	}
+	// Liveness does not depend on any of it.
+	resp := doRequest(t, srv, http.MethodGet, "/api/v1/health", nil, false)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("health with a full queue: status = %d, want 200", resp.StatusCode)
+	}
+
+	store.Close()
+	if code, body := ready(); code != http.StatusServiceUnavailable || body["database"] != "unreachable" {
+		t.Errorf("closed database: %d %v, want 503 with database unreachable", code, body)
+	}
+}
+
+func TestReady_RequireClaudeAuth(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	cfg := testConfig()
+	cfg.ReadyRequireClaudeAuth = true
+	store, err := job.NewSQLiteStore(":memory:")
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	q := queue.New(cfg, store)
+	if err := q.Recovery(context.Background()); err != nil {
+		t.Fatalf("Recovery: %v", err)
+	}
+	h := NewHandler(store, q, cfg)
+	h.creds.ttl = 0 // re-read the credentials file on every request
+	mux := http.NewServeMux()
+	h.RegisterRoutes(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	// No credentials file: auth state unknown, not ready, but still alive.
+	resp := doRequest(t, srv, http.MethodGet, "/api/v1/ready", nil, false)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("no credentials: status = %d, want 503", resp.StatusCode)
+	}
+	resp = doRequest(t, srv, http.MethodGet, "/api/v1/health", nil, false)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("no credentials: health status = %d, want 200", resp.StatusCode)
+	}
+
+	writeCreds := func(expiresAt time.Time) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Join(home, ".claude"), 0o700); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+		data := fmt.Sprintf(`{"claudeAiOauth":{"expiresAt":%d}}`, expiresAt.UnixMilli())
+		if err := os.WriteFile(filepath.Join(home, ".claude", ".credentials.json"), []byte(data), 0o600); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	writeCreds(time.Now().Add(-time.Hour))
+	resp = doRequest(t, srv, http.MethodGet, "/api/v1/ready", nil, false)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expired token: status = %d, want 503", resp.StatusCode)
+	}
+
+	writeCreds(time.Now().Add(time.Hour))
+	resp = doRequest(t, srv, http.MethodGet, "/api/v1/ready", nil, false)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("valid token: status = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestCredsCache_ReusesReadWithinTTL(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	if err := os.MkdirAll(filepath.Join(home, ".claude"), 0o700); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	path := filepath.Join(home, ".claude", ".credentials.json")
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Millisecond).UTC()
+	data := fmt.Sprintf(`{"claudeAiOauth":{"expiresAt":%d}}`, expiresAt.UnixMilli())
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	c := &credsCache{ttl: time.Hour}
+	if got := c.expiry(); !got.Equal(expiresAt) {
+		t.Fatalf("first read = %v, want %v", got, expiresAt)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if got := c.expiry(); !got.Equal(expiresAt) {
+		t.Errorf("within TTL = %v, want cached %v", got, expiresAt)
+	}
+
+	c.ttl = 0
+	if got := c.expiry(); !got.IsZero() {
+		t.Errorf("after TTL = %v, want zero for a missing file", got)
+	}
+}
+
+func TestCreateJob_MaxBodyBytes(t *testing.T) {
+	t.Parallel()
+	cfg := testConfig()
+	cfg.MaxBodyBytes = 64
+	srv, _ := newTestServerWithConfig(t, cfg)
+
+	resp := doRequest(t, srv, http.MethodPost, "/api/v1/jobs", []byte(`{"prompt": "short"}`), true)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Errorf("small body: status = %d, want 202", resp.StatusCode)
+	}
+
+	body, _ := json.Marshal(map[string]string{"prompt": strings.Repeat("a", 64)})
+	resp = doRequest(t, srv, http.MethodPost, "/api/v1/jobs", body, true)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("large body: status = %d, want 413", resp.StatusCode)
+	}
+	var got map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got["error"] != "request body exceeds 64 bytes" {
+		t.Errorf("error = %q, want request body exceeds 64 bytes", got["error"])
+	}
+}
+
+func TestCreateJob_TrustedKeyBypassesBodyLimit(t *testing.T) {
+	t.Parallel()
+	srv, _ := newTestServer(t)
+	body, _ := json.Marshal(map[string]string{"prompt": strings.Repeat("a", testConfig().MaxBodyBytes+1)})
+
+	resp := doRequestWithKey(t, srv, http.MethodPost, "/api/v1/jobs", body, apiKey())
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("regular key: status = %d, want 413", resp.StatusCode)
+	}
+
+	resp = doRequestWithKey(t, srv, http.MethodPost, "/api/v1/jobs", body, trustedKey())
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Errorf("trusted key: status = %d, want 202", resp.StatusCode)
+	}
+}
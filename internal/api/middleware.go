@@ -12,7 +12,12 @@ import (
 
 type contextKey string
 
-const requestIDKey contextKey = "requestID"
+const (
+	requestIDKey  contextKey = "requestID"
+	apiKeyKey     contextKey = "apiKey"
+	clientCertKey contextKey = "clientCert"
+	rateLimitKey  contextKey = "rateLimit"
+)
 
 // Middleware is a function that wraps an http.Handler.
 type Middleware func(http.Handler) http.Handler
@@ -25,22 +30,29 @@ func Chain(h http.Handler, middlewares ...Middleware) http.Handler {
 	return h
 }
 
-// publicPaths are exempt from API key authentication.
-var publicPaths = map[string]bool{
-	"/api/v1/health": true,
-	"/":              true,
-}
-
 // Auth returns a Middleware that verifies the X-API-Key header against the list of valid keys.
-// The /api/v1/health endpoint is exempt from authentication.
-func Auth(validKeys []string) Middleware {
+// Requests for publicPaths (see Handler.PublicPaths) are exempt from authentication.
+// Over mTLS, a client certificate verified against CLAUDEGATE_TLS_CLIENT_CA_FILE is
+// accepted in place of a key; its CN is stored in the request context.
+func Auth(validKeys []string, publicPaths []string) Middleware {
+	public := make(map[string]bool, len(publicPaths))
+	for _, p := range publicPaths {
+		public[p] = true
+	}
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if publicPaths[r.URL.Path] {
+			if public[r.URL.Path] {
 				next.ServeHTTP(w, r)
 				return
 			}
 
+			if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+				cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+				ctx := context.WithValue(r.Context(), clientCertKey, cn)
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+
 			provided := r.Header.Get("X-API-Key")
 			if provided == "" {
 				writeError(w, http.StatusUnauthorized, "missing X-API-Key header")
@@ -49,7 +61,8 @@ func Auth(validKeys []string) Middleware {
 
 			for _, key := range validKeys {
 				if subtle.ConstantTimeCompare([]byte(provided), []byte(key)) == 1 {
-					next.ServeHTTP(w, r)
+					ctx := context.WithValue(r.Context(), apiKeyKey, key)
+					next.ServeHTTP(w, r.WithContext(ctx))
 					return
 				}
 			}
@@ -59,6 +72,39 @@ func Auth(validKeys []string) Middleware {
 	}
 }
 
+// keyIn reports whether key is one of keys, in constant time per comparison.
+// An empty key (public path) is never in the set.
+func keyIn(key string, keys []string) bool {
+	if key == "" {
+		return false
+	}
+	for _, k := range keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// apiKeyFromContext returns the API key that authenticated the request, or "" for public paths.
+func apiKeyFromContext(ctx context.Context) string {
+	key, _ := ctx.Value(apiKeyKey).(string)
+	return key
+}
+
+// clientCertFromContext returns the CN of the verified client certificate that
+// authenticated the request, or "" when it was authenticated by API key.
+func clientCertFromContext(ctx context.Context) string {
+	cn, _ := ctx.Value(clientCertKey).(string)
+	return cn
+}
+
+// requestIDFromContext returns the ID assigned by the RequestID middleware, or "".
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
 // RequestID is a Middleware that attaches a UUID request ID to the response header and request context.
 var RequestID Middleware = func(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -111,8 +157,8 @@ func CORS(allowedOrigins []string) Middleware {
 
 			if allowAll || originSet[origin] {
 				w.Header().Set("Access-Control-Allow-Origin", origin)
-				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
-				w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Key")
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+				w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Encoding, X-API-Key, Idempotency-Key")
 				w.Header().Set("Access-Control-Max-Age", "86400")
 			}
 
@@ -132,7 +178,6 @@ var Logging Middleware = func(next http.Handler) http.Handler {
 		start := time.Now()
 		sw := &statusResponseWriter{ResponseWriter: w, status: http.StatusOK}
 		next.ServeHTTP(sw, r)
-		reqID, _ := r.Context().Value(requestIDKey).(string)
-		slog.Info("request", "method", r.Method, "path", r.URL.Path, "status", sw.status, "duration", time.Since(start), "request_id", reqID)
+		slog.Info("request", "method", r.Method, "path", r.URL.Path, "status", sw.status, "duration", time.Since(start), "request_id", requestIDFromContext(r.Context()))
 	})
 }
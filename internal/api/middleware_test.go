@@ -1,8 +1,12 @@
 package api
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -72,8 +76,11 @@ func TestCORSMiddleware_Preflight(t *testing.T) {
 	if rr.Code != http.StatusNoContent {
 		t.Fatalf("preflight status = %d, want 204", rr.Code)
 	}
-	if got := rr.Header().Get("Access-Control-Allow-Methods"); got == "" {
-		t.Error("preflight missing Allow-Methods header")
+	if got := rr.Header().Get("Access-Control-Allow-Methods"); !strings.Contains(got, "PUT") {
+		t.Errorf("preflight Allow-Methods = %q, want PUT for the note and maintenance endpoints", got)
+	}
+	if got := rr.Header().Get("Access-Control-Allow-Headers"); !strings.Contains(got, "Content-Encoding") {
+		t.Errorf("preflight Allow-Headers = %q, want Content-Encoding for gzip bodies", got)
 	}
 }
 
@@ -112,3 +119,36 @@ func TestCORSMiddleware_NoOriginHeader(t *testing.T) {
 		t.Errorf("no-origin request should have no Allow-Origin header, got %q", got)
 	}
 }
+
+func TestAuth_ClientCertificate(t *testing.T) {
+	t.Parallel()
+	var gotCN, gotKey string
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotCN = clientCertFromContext(r.Context())
+		gotKey = apiKeyFromContext(r.Context())
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := Auth([]string{"k"}, nil)(inner)
+
+	// Verified client certificate, no API key.
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/jobs", nil)
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "billing-svc"}}
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rr.Code)
+	}
+	if gotCN != "billing-svc" || gotKey != "" {
+		t.Errorf("cn = %q, key = %q, want billing-svc and no key", gotCN, gotKey)
+	}
+
+	// TLS without a verified certificate still requires a key.
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/jobs", nil)
+	req.TLS = &tls.ConnectionState{}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("unverified TLS: status = %d, want 401", rr.Code)
+	}
+}
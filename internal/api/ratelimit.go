@@ -1,7 +1,11 @@
 package api
 
 import (
+	"context"
+	"fmt"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -9,13 +13,14 @@ import (
 	"golang.org/x/time/rate"
 )
 
-// ipLimiter holds a rate limiter and the last time it was seen.
+// ipLimiter holds a rate limiter and the last time it was seen. Despite the
+// name it is keyed by IP or API key, depending on RateLimitBy.
 type ipLimiter struct {
 	limiter  *rate.Limiter
 	lastSeen time.Time
 }
 
-// RateLimiter manages per-IP rate limiters for job submission.
+// RateLimiter manages per-client rate limiters for one route.
 type RateLimiter struct {
 	mu    sync.Mutex
 	ips   map[string]*ipLimiter
@@ -23,9 +28,9 @@ type RateLimiter struct {
 	burst int
 }
 
-// NewRateLimiter creates a RateLimiter allowing rps requests/second per IP.
+// NewRateLimiter creates a RateLimiter allowing rps requests/second per client.
 // Burst is set to rps (allows a short burst equal to the per-second rate).
-// Starts a background goroutine that evicts IPs not seen for 5 minutes.
+// Starts a background goroutine that evicts clients not seen for 5 minutes.
 func NewRateLimiter(rps int) *RateLimiter {
 	rl := &RateLimiter{
 		ips:   make(map[string]*ipLimiter),
@@ -36,7 +41,17 @@ func NewRateLimiter(rps int) *RateLimiter {
 	return rl
 }
 
-func (rl *RateLimiter) allow(ip string) bool {
+// limitResult is the outcome of RateLimiter.allow for one request.
+type limitResult struct {
+	allowed   bool
+	remaining int           // requests left in the bucket after this one
+	reset     time.Duration // until the bucket is full again
+	wait      time.Duration // until the next request is allowed, when rejected
+}
+
+// allow takes n tokens for ip if they are available. A rejected request does
+// not consume any.
+func (rl *RateLimiter) allow(ip string, n int) limitResult {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
@@ -45,11 +60,23 @@ func (rl *RateLimiter) allow(ip string) bool {
 		l = &ipLimiter{limiter: rate.NewLimiter(rl.rps, rl.burst)}
 		rl.ips[ip] = l
 	}
-	l.lastSeen = time.Now()
-	return l.limiter.Allow()
+	now := time.Now()
+	l.lastSeen = now
+	res := l.limiter.ReserveN(now, n)
+	delay := res.DelayFrom(now)
+	if delay > 0 {
+		res.CancelAt(now)
+	}
+	tokens := max(l.limiter.TokensAt(now), 0)
+	return limitResult{
+		allowed:   delay == 0,
+		remaining: int(tokens),
+		reset:     time.Duration((float64(rl.burst) - tokens) / float64(rl.rps) * float64(time.Second)),
+		wait:      delay,
+	}
 }
 
-// cleanup removes limiters for IPs not seen in the last 5 minutes.
+// cleanup removes limiters for clients not seen in the last 5 minutes.
 func (rl *RateLimiter) cleanup() {
 	ticker := time.NewTicker(5 * time.Minute)
 	defer ticker.Stop()
@@ -65,20 +92,55 @@ func (rl *RateLimiter) cleanup() {
 	}
 }
 
-// RateLimit returns a Middleware that limits POST /api/v1/jobs to rps req/s per IP.
-// If rps is 0 the middleware is a no-op.
-func RateLimit(rps int) Middleware {
-	if rps <= 0 {
+// RateLimitBy selects what a rate limit bucket belongs to.
+type RateLimitBy string
+
+const (
+	// RateLimitByIP gives each client IP its own buckets.
+	RateLimitByIP RateLimitBy = "ip"
+	// RateLimitByKey gives each API key its own buckets, so clients sharing
+	// an IP (e.g. behind NAT) do not throttle each other. Requests without a
+	// key, such as public paths, fall back to their IP.
+	RateLimitByKey RateLimitBy = "key"
+)
+
+// RateLimit returns a Middleware that limits POST jobsPath (normally /api/v1/jobs)
+// to rps req/s per IP. Requests authenticated with one of trustedKeys are exempt;
+// this relies on Auth running first. If rps is 0 the middleware is a no-op.
+func RateLimit(rps int, jobsPath string, trustedKeys []string) Middleware {
+	return RateLimits(map[string]int{http.MethodPost + " " + jobsPath: rps}, trustedKeys, RateLimitByIP)
+}
+
+// RateLimits returns a Middleware applying a separate per-client limit to each
+// route, where by decides whether a client is an IP or an API key. Keys are
+// ServeMux patterns such as "GET /api/v1/jobs/{id}/sse" and values are req/s;
+// each route has its own buckets. Requests matching no pattern, and those
+// authenticated with one of trustedKeys, are not limited. Both the key lookup
+// and the trusted exemption rely on Auth running first.
+// Patterns must be valid and non-conflicting, as for ServeMux.Handle.
+func RateLimits(limits map[string]int, trustedKeys []string, by RateLimitBy) Middleware {
+	mux := http.NewServeMux()
+	limiters := make(map[string]*RateLimiter)
+	for pattern, rps := range limits {
+		if rps <= 0 {
+			continue
+		}
+		mux.Handle(pattern, http.NotFoundHandler())
+		limiters[pattern] = NewRateLimiter(rps)
+	}
+	if len(limiters) == 0 {
 		return func(next http.Handler) http.Handler { return next }
 	}
-	rl := NewRateLimiter(rps)
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if r.Method == http.MethodPost && r.URL.Path == "/api/v1/jobs" {
-				ip := clientIP(r)
-				if !rl.allow(ip) {
-					writeError(w, http.StatusTooManyRequests, "rate limit exceeded, slow down")
-					return
+			if _, pattern := mux.Handler(r); pattern != "" && !keyIn(apiKeyFromContext(r.Context()), trustedKeys) {
+				if rl := limiters[pattern]; rl != nil {
+					b := rateBucket{limiter: rl, client: rateLimitClient(r, by)}
+					w.Header().Set("X-RateLimit-Limit", strconv.Itoa(rl.burst))
+					if !b.take(w, 1) {
+						return
+					}
+					r = r.WithContext(context.WithValue(r.Context(), rateLimitKey, b))
 				}
 			}
 			next.ServeHTTP(w, r)
@@ -86,6 +148,60 @@ func RateLimit(rps int) Middleware {
 	}
 }
 
+// rateBucket is the client bucket that admitted a rate-limited request.
+type rateBucket struct {
+	limiter *RateLimiter
+	client  string
+}
+
+// take takes n tokens from the bucket and sets the X-RateLimit headers. When
+// they are not available it writes a 429 and returns false.
+func (b rateBucket) take(w http.ResponseWriter, n int) bool {
+	res := b.limiter.allow(b.client, n)
+	h := w.Header()
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(res.remaining))
+	h.Set("X-RateLimit-Reset", ceilSeconds(res.reset))
+	if res.allowed {
+		return true
+	}
+	if res.wait == rate.InfDuration {
+		// More tokens than the bucket holds: waiting will never help.
+		writeError(w, http.StatusTooManyRequests, fmt.Sprintf("request exceeds the rate limit burst of %d", b.limiter.burst))
+		return false
+	}
+	h.Set("Retry-After", ceilSeconds(res.wait))
+	writeError(w, http.StatusTooManyRequests, "rate limit exceeded, slow down")
+	return false
+}
+
+// chargeRateLimit takes n more tokens from the bucket that admitted r, for a
+// request that stands for several submissions such as a batch of jobs. It
+// writes a 429 and returns false when they are not available. Requests that
+// no rate limit applies to always pass.
+func chargeRateLimit(w http.ResponseWriter, r *http.Request, n int) bool {
+	b, ok := r.Context().Value(rateLimitKey).(rateBucket)
+	if !ok || n <= 0 {
+		return true
+	}
+	return b.take(w, n)
+}
+
+// ceilSeconds formats d as whole seconds, rounded up.
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// rateLimitClient returns the bucket key of r. Keys and IPs are prefixed so
+// they can never collide.
+func rateLimitClient(r *http.Request, by RateLimitBy) string {
+	if by == RateLimitByKey {
+		if key := apiKeyFromContext(r.Context()); key != "" {
+			return "key:" + key
+		}
+	}
+	return "ip:" + clientIP(r)
+}
+
 // clientIP extracts the real client IP, respecting X-Forwarded-For when behind a proxy.
 func clientIP(r *http.Request) string {
 	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
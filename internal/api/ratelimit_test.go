@@ -1,14 +1,16 @@
 package api
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
 )
 
 func TestRateLimit_Disabled(t *testing.T) {
 	t.Parallel()
-	mw := RateLimit(0)
+	mw := RateLimit(0, "/api/v1/jobs", nil)
 	handler := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	}))
@@ -22,7 +24,7 @@ func TestRateLimit_Disabled(t *testing.T) {
 
 func TestRateLimit_AllowsUnderLimit(t *testing.T) {
 	t.Parallel()
-	mw := RateLimit(10)
+	mw := RateLimit(10, "/api/v1/jobs", nil)
 	handler := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	}))
@@ -39,7 +41,7 @@ func TestRateLimit_AllowsUnderLimit(t *testing.T) {
 func TestRateLimit_BlocksOverLimit(t *testing.T) {
 	t.Parallel()
 	// rps=1, burst=1 — second request from same IP should be blocked.
-	mw := RateLimit(1)
+	mw := RateLimit(1, "/api/v1/jobs", nil)
 	handler := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	}))
@@ -62,10 +64,74 @@ func TestRateLimit_BlocksOverLimit(t *testing.T) {
 	}
 }
 
+func TestRateLimit_RetryAfter(t *testing.T) {
+	t.Parallel()
+	// rps=1: after the burst token, the next one comes within a second.
+	mw := RateLimit(1, "/api/v1/jobs", nil)
+	handler := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/jobs", nil)
+		req.RemoteAddr = "9.9.9.9:1234"
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := send(); rr.Header().Get("Retry-After") != "" {
+		t.Errorf("allowed request: Retry-After = %q, want none", rr.Header().Get("Retry-After"))
+	}
+	// Rejected requests do not consume tokens, so the delay stays at most 1s.
+	for range 2 {
+		rr := send()
+		if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "1" {
+			t.Errorf("limited request: status = %d, Retry-After = %q; want 429, 1", rr.Code, rr.Header().Get("Retry-After"))
+		}
+	}
+}
+
+func TestRateLimit_Headers(t *testing.T) {
+	t.Parallel()
+	mw := RateLimit(2, "/api/v1/jobs", nil)
+	handler := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for i, want := range []struct {
+		code      int
+		remaining string
+	}{
+		{http.StatusOK, "1"},
+		{http.StatusOK, "0"},
+		{http.StatusTooManyRequests, "0"},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/jobs", nil)
+		req.RemoteAddr = "7.7.7.7:1234"
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		h := rr.Header()
+		if rr.Code != want.code || h.Get("X-RateLimit-Limit") != "2" || h.Get("X-RateLimit-Remaining") != want.remaining || h.Get("X-RateLimit-Reset") != "1" {
+			t.Errorf("request %d: status = %d, limit = %q, remaining = %q, reset = %q; want %d, 2, %s, 1",
+				i, rr.Code, h.Get("X-RateLimit-Limit"), h.Get("X-RateLimit-Remaining"), h.Get("X-RateLimit-Reset"), want.code, want.remaining)
+		}
+	}
+
+	// Unlimited routes get no headers.
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/jobs", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if got := rr.Header().Get("X-RateLimit-Limit"); got != "" {
+		t.Errorf("unlimited route: X-RateLimit-Limit = %q, want none", got)
+	}
+}
+
 func TestRateLimit_OnlyAppliesTo_PostJobs(t *testing.T) {
 	t.Parallel()
 	// rps=1 — but GET requests should never be rate limited.
-	mw := RateLimit(1)
+	mw := RateLimit(1, "/api/v1/jobs", nil)
 	handler := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	}))
@@ -80,3 +146,148 @@ func TestRateLimit_OnlyAppliesTo_PostJobs(t *testing.T) {
 		}
 	}
 }
+
+func TestRateLimit_TrustedKeyExempt(t *testing.T) {
+	t.Parallel()
+	mw := RateLimit(1, "/api/v1/jobs", []string{"internal-key"})
+	handler := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	send := func(key string) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/jobs", nil)
+		req.RemoteAddr = "8.8.8.8:1234"
+		req = req.WithContext(context.WithValue(req.Context(), apiKeyKey, key))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	for i := 0; i < 5; i++ {
+		if code := send("internal-key"); code != http.StatusOK {
+			t.Fatalf("trusted request %d: status = %d, want 200", i+1, code)
+		}
+	}
+	send("external-key")
+	if code := send("external-key"); code != http.StatusTooManyRequests {
+		t.Errorf("untrusted second request: status = %d, want 429", code)
+	}
+}
+
+func TestRateLimits_PerRoute(t *testing.T) {
+	t.Parallel()
+	mw := RateLimits(map[string]int{
+		"GET /api/v1/jobs":          1,
+		"GET /api/v1/jobs/{id}/sse": 1,
+	}, nil, RateLimitByIP)
+	handler := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	send := func(method, path string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = "7.7.7.7:1234"
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := send(http.MethodGet, "/api/v1/jobs"); code != http.StatusOK {
+		t.Errorf("first list: status = %d, want 200", code)
+	}
+	if code := send(http.MethodGet, "/api/v1/jobs"); code != http.StatusTooManyRequests {
+		t.Errorf("second list: status = %d, want 429", code)
+	}
+	// SSE has its own bucket, shared across job IDs.
+	if code := send(http.MethodGet, "/api/v1/jobs/a/sse"); code != http.StatusOK {
+		t.Errorf("first sse: status = %d, want 200", code)
+	}
+	if code := send(http.MethodGet, "/api/v1/jobs/b/sse"); code != http.StatusTooManyRequests {
+		t.Errorf("second sse: status = %d, want 429", code)
+	}
+	// Unlisted routes are never limited.
+	for i := 0; i < 3; i++ {
+		if code := send(http.MethodPost, "/api/v1/jobs"); code != http.StatusOK {
+			t.Errorf("POST %d: status = %d, want 200", i+1, code)
+		}
+	}
+}
+
+func TestRateLimits_ByKey(t *testing.T) {
+	t.Parallel()
+	mw := RateLimits(map[string]int{"POST /api/v1/jobs": 1}, nil, RateLimitByKey)
+	handler := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// Every request comes from the same NAT address.
+	send := func(key string) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/jobs", nil)
+		req.RemoteAddr = "9.9.9.9:1234"
+		if key != "" {
+			req = req.WithContext(context.WithValue(req.Context(), apiKeyKey, key))
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := send("alice"); code != http.StatusOK {
+		t.Errorf("alice first: status = %d, want 200", code)
+	}
+	if code := send("bob"); code != http.StatusOK {
+		t.Errorf("bob first: status = %d, want 200 (separate bucket)", code)
+	}
+	if code := send("alice"); code != http.StatusTooManyRequests {
+		t.Errorf("alice second: status = %d, want 429", code)
+	}
+	// Without a key the IP bucket applies.
+	if code := send(""); code != http.StatusOK {
+		t.Errorf("keyless first: status = %d, want 200", code)
+	}
+	if code := send(""); code != http.StatusTooManyRequests {
+		t.Errorf("keyless second: status = %d, want 429", code)
+	}
+}
+
+func TestChargeRateLimit_CountsEachBatchItem(t *testing.T) {
+	t.Parallel()
+	mw := RateLimits(map[string]int{"POST /api/v1/jobs/batch": 3}, nil, RateLimitByIP)
+	handler := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		items, _ := strconv.Atoi(r.URL.Query().Get("items"))
+		if !chargeRateLimit(w, r, items-1) {
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	send := func(items int) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/jobs/batch?items="+strconv.Itoa(items), nil)
+		req.RemoteAddr = "9.9.9.9:1234"
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := send(5); rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "" {
+		t.Fatalf("batch over burst: status = %d, Retry-After = %q, want 429 without Retry-After", rr.Code, rr.Header().Get("Retry-After"))
+	}
+	// The rejected batch still took the request's token, so 2 of 3 are left.
+	if rr := send(2); rr.Code != http.StatusAccepted {
+		t.Fatalf("batch of 2: status = %d, want 202", rr.Code)
+	}
+	rr := send(1)
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("after the bucket is drained: status = %d, want 429", rr.Code)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Error("Retry-After missing")
+	}
+}
+
+func TestChargeRateLimit_NoLimitPasses(t *testing.T) {
+	t.Parallel()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/jobs/batch", nil)
+	if !chargeRateLimit(httptest.NewRecorder(), req, 100) {
+		t.Error("chargeRateLimit rejected a request no limit applies to")
+	}
+}
@@ -5,12 +5,27 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/claudegate/claudegate/internal/job"
+	"github.com/claudegate/claudegate/internal/queue"
 )
 
 // StreamSSE handles GET /api/v1/jobs/{id}/sse.
 // It streams server-sent events for the job until it completes or the client disconnects.
+// "diagnostic" events are only forwarded when CLAUDEGATE_SSE_DIAGNOSTICS is enabled and
+// an admin client asks for them with ?diagnostics=true: CLI stderr can leak server details.
+// With CLAUDEGATE_SSE_OMIT_PROMPT the job frames leave out prompt and system_prompt.
+// ?events=result,status (comma-separated) limits the event types sent; default is all.
+// A ": keepalive" comment is sent after CLAUDEGATE_SSE_KEEPALIVE_SECONDS without events.
+// With CLAUDEGATE_SSE_COALESCE_MS, chunks arriving within that window are sent as
+// one "chunk" event; pending text is flushed before any other event.
+// Extended-thinking blocks are sent as "thinking" events, separate from "chunk".
+// While the job is queued, its queue_position is polled every
+// CLAUDEGATE_SSE_POSITION_SECONDS and sent as a "status" event when it changes.
+// A stream whose job is deleted or disappears ends with an "error" event.
 func (h *Handler) StreamSSE(w http.ResponseWriter, r *http.Request) {
 	flusher, ok := w.(http.Flusher)
 	if !ok {
@@ -18,17 +33,41 @@ func (h *Handler) StreamSSE(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	wants, err := parseEventFilter(r.URL.Query().Get("events"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	id := r.PathValue("id")
 
-	j, err := h.store.Get(r.Context(), id)
+	// Subscribe before reading the job so that a result or deletion landing
+	// between the lookup and the subscription still reaches this stream.
+	ch, unsubscribe, err := h.queue.Subscribe(id)
+	if errors.Is(err, queue.ErrTooManySubscribers) {
+		writeError(w, http.StatusTooManyRequests, "too many streams for this job")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to subscribe")
+		return
+	}
+	defer unsubscribe()
+
+	// Only the initial lookup is bounded by the store timeout; the stream itself
+	// lives for as long as the client stays connected.
+	ctx, cancel := h.storeContext(r)
+	j, err := h.store.Get(ctx, id)
+	cancel()
 	if errors.Is(err, job.ErrJobNotFound) {
 		writeError(w, http.StatusNotFound, "job not found")
 		return
 	}
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "failed to get job")
+		h.writeStoreError(ctx, w, err, "failed to get job")
 		return
 	}
+	h.redactForCaller(r, j)
 
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
@@ -36,23 +75,110 @@ func (h *Handler) StreamSSE(w http.ResponseWriter, r *http.Request) {
 
 	// If already terminal, send the result event and close immediately.
 	if j.Status.IsTerminal() {
-		writeSSEEvent(w, flusher, "result", j)
+		if wants("result") {
+			writeSSEEvent(w, flusher, "result", h.sseJob(j))
+		}
 		return
 	}
 
-	ch := h.queue.Subscribe(id)
-	defer h.queue.Unsubscribe(id, ch)
+	diagnostics := h.cfg.SSEDiagnostics && r.URL.Query().Get("diagnostics") == "true" && h.isAdmin(r)
 
 	// Send the current status so the client has an initial state.
-	writeSSEEvent(w, flusher, "status", j)
+	if wants("status") {
+		writeSSEEvent(w, flusher, "status", h.sseJob(j))
+	}
+
+	// A comment line every keepalive interval without a real event keeps
+	// proxies from closing the stream during quiet stretches of a job.
+	interval := time.Duration(h.cfg.SSEKeepaliveSeconds) * time.Second
+	var ticker *time.Ticker
+	var keepalive <-chan time.Time
+	if interval > 0 {
+		ticker = time.NewTicker(interval)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+
+	send := func(event, data string) {
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+		flusher.Flush()
+		if ticker != nil {
+			ticker.Reset(interval)
+		}
+	}
+
+	// Chunks are held back for up to the coalesce window and merged.
+	coalesce := time.Duration(h.cfg.SSECoalesceMillis) * time.Millisecond
+	var pending strings.Builder
+	var flushDue <-chan time.Time
+	flushPending := func() {
+		flushDue = nil
+		if pending.Len() == 0 {
+			return
+		}
+		data, _ := json.Marshal(map[string]string{"text": pending.String()})
+		pending.Reset()
+		send("chunk", string(data))
+	}
+
+	// Queued jobs report their place in line until the first queue event,
+	// which means the job has started or gone.
+	var positionDue <-chan time.Time
+	lastPosition := 0
+	reportPosition := func() {
+		ctx, cancel := h.storeContext(r)
+		pos, err := h.store.QueuePosition(ctx, id)
+		cancel()
+		if err != nil {
+			return // retried on the next tick
+		}
+		if pos == 0 {
+			positionDue = nil
+			return
+		}
+		if pos != lastPosition {
+			lastPosition = pos
+			send("status", fmt.Sprintf(`{"status":"queued","queue_position":%d}`, pos))
+		}
+	}
+	if every := time.Duration(h.cfg.SSEPositionSeconds) * time.Second; every > 0 && j.Status == job.StatusQueued && wants("status") {
+		positionTicker := time.NewTicker(every)
+		defer positionTicker.Stop()
+		positionDue = positionTicker.C
+		reportPosition()
+	}
 
 	for {
 		select {
 		case event, open := <-ch:
 			if !open {
+				flushPending()
 				return
 			}
-			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Event, event.Data)
+			positionDue = nil
+			if !wants(event.Event) || (event.Event == "diagnostic" && !diagnostics) {
+				continue
+			}
+			if coalesce > 0 && event.Event == "chunk" {
+				var chunk struct {
+					Text string `json:"text"`
+				}
+				if json.Unmarshal([]byte(event.Data), &chunk) == nil {
+					pending.WriteString(chunk.Text)
+					if flushDue == nil {
+						flushDue = time.After(coalesce)
+					}
+					continue
+				}
+			}
+			flushPending()
+			send(event.Event, event.Data)
+		case <-flushDue:
+			flushPending()
+		case <-positionDue:
+			reportPosition()
+		case <-keepalive:
+			fmt.Fprint(w, ": keepalive\n\n")
 			flusher.Flush()
 		case <-r.Context().Done():
 			return
@@ -60,6 +186,43 @@ func (h *Handler) StreamSSE(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// sseEventTypes are the event names a client may select with ?events=.
+var sseEventTypes = []string{"status", "chunk", "thinking", "result", "diagnostic"}
+
+// parseEventFilter parses the ?events= value into a predicate. An empty value selects all events.
+func parseEventFilter(raw string) (func(string) bool, error) {
+	if raw == "" {
+		return func(string) bool { return true }, nil
+	}
+	selected := make(map[string]bool)
+	for _, e := range strings.Split(raw, ",") {
+		e = strings.TrimSpace(e)
+		if !slices.Contains(sseEventTypes, e) {
+			return nil, fmt.Errorf("invalid event type %q: must be one of %s", e, strings.Join(sseEventTypes, ", "))
+		}
+		selected[e] = true
+	}
+	// "error" ends the stream and is always delivered.
+	return func(event string) bool { return event == "error" || selected[event] }, nil
+}
+
+// promptlessJob shadows the prompt fields of the embedded Job with empty
+// omitempty fields, so they are dropped from the JSON encoding.
+type promptlessJob struct {
+	*job.Job
+	Prompt       string `json:"prompt,omitempty"`
+	SystemPrompt string `json:"system_prompt,omitempty"`
+}
+
+// sseJob returns the value serialised in job frames, without prompts when
+// CLAUDEGATE_SSE_OMIT_PROMPT is enabled.
+func (h *Handler) sseJob(j *job.Job) any {
+	if h.cfg.SSEOmitPrompt {
+		return promptlessJob{Job: j}
+	}
+	return j
+}
+
 // writeSSEEvent serialises data as JSON and writes a single SSE event frame.
 func writeSSEEvent(w http.ResponseWriter, flusher http.Flusher, event string, data any) {
 	payload, err := json.Marshal(data)
@@ -1,8 +1,11 @@
 package config
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"net/http"
 	"os"
 	"strconv"
 	"strings"
@@ -13,18 +16,84 @@ import (
 type Config struct {
 	ListenAddr             string
 	APIKeys                []string
+	AdminKeys              []string // subset of APIKeys tagged ":admin"
+	TrustedKeys            []string // subset of APIKeys tagged ":trusted", exempt from rate and body limits
 	ClaudePath             string
 	DefaultModel           string
 	Concurrency            int
+	MaxInFlight            int // hard cap on simultaneous job executions, defaults to Concurrency
+	MaxProcesses           int // process-wide cap on live claude CLI processes, 0 = unlimited
 	DBPath                 string
+	DBDriver               string // "sqlite" or "postgres"
+	DBDSN                  string // PostgreSQL connection string, used when DBDriver is "postgres"
+	DBReadPath             string // optional read replica for API reads, "" = use DBPath
+	DBReadDSN              string // optional PostgreSQL read replica for API reads, "" = use DBDSN
+	InstanceID             string // worker_id written on the jobs this replica processes, defaults to the host name
+	LeaseSeconds           int    // a processing job whose replica has not heartbeated for this long is requeued
+	SQLiteBusyTimeoutMS    int    // how long a SQLite statement waits for a lock before failing
+	CompressResults        bool   // store large results gzip-compressed
+	CompressMinBytes       int    // results shorter than this stay uncompressed
 	QueueSize              int
+	QueueSnapshotPath      string // file holding the ordered pending job IDs, "" = disabled
+	QueueSnapshotSeconds   int    // interval between queue snapshots
 	SecurityPrompt         string
+	AllowControlChars      bool // accept control characters other than tab, CR and LF in prompts
 	JobTimeoutMinutes      int
+	MaxJobTimeoutSeconds   int      // upper bound on a job's timeout_seconds, 0 = unbounded
+	DrainTimeoutSeconds    int      // on shutdown, how long running jobs may finish before being cancelled, 0 = cancel at once
+	PartialResultOnTimeout bool     // keep streamed text as the result of timed-out jobs
+	PartialResultSeconds   int      // min interval between partial_result writes, 0 = never stored
+	DedupChunks            bool     // drop assistant text the CLI re-emits in overlapping blocks
+	SuccessExitCodes       []int    // non-zero CLI exit codes accepted when a result was captured
+	ResultProcessors       []string // ordered result post-processors, empty = none
+	AllowedTools           []string // tools jobs may enable through allowed_tools, empty = none
+	MCPConfig              string   // MCP server config passed to jobs that enable tools
+	WorkerEnvAllow         []string // env vars (or PREFIX_* patterns) passed to the CLI, empty = all but CLAUDE*
 	CORSOrigins            []string
+	WebhookSecret          string            // HMAC-SHA256 key for signing webhook deliveries, "" = unsigned
+	MaxCallbackURLs        int               // cap on webhook URLs per job, callback_url included, 0 = unlimited
+	WebhookMaxPerHost      int               // concurrent webhook attempts per receiver host, 0 = unlimited
+	WebhookAttempts        int               // delivery attempts per webhook URL
+	WebhookTimeoutSeconds  int               // time limit of one delivery attempt
+	WebhookRetryCapSeconds int               // upper bound of the jittered backoff between attempts
+	PostJobCommand         []string          // argv run after each job finishes, nil = disabled
+	PostJobTimeoutSeconds  int               // time limit of one post-job command run
+	PostJobWorkers         int               // post-job commands running at once
+	ResponseFormats        map[string]string // extra response_format values and their system-prompt instruction
+	Prices                 map[string]Price  // per-model token prices used to estimate cost_usd
 	JobTTLHours            int
 	CleanupIntervalMinutes int
+	IdempotencyTTLHours    int // how long an Idempotency-Key maps to its job, 0 = as long as the job exists
 	DisableKeepalive       bool
-	RateLimit              int // requests per second per IP, 0 = disabled
+	KeepaliveWindowMinutes int // nudge the keepalive session this close to token expiry, 0 = never
+	KeepaliveCheckSeconds  int // interval between checks that the keepalive session is alive, 0 = never
+	DisableFrontend        bool
+	ReadyRequireClaudeAuth bool // readiness returns 503 unless the Claude OAuth token is valid
+	WaitMetrics            bool // per-model queue wait histogram and GET /api/v1/stats
+	ReadOnly               bool // start in maintenance mode: writes return 503
+	RateLimit              int  // requests per second per IP, 0 = disabled
+	StoreTimeoutSeconds    int  // per-request bound on store calls made by HTTP handlers, 0 = disabled
+	StoreRetryAfterSeconds int  // Retry-After of 503s caused by a slow or busy database, 0 = omitted
+	QueueRetryAfterSeconds int  // Retry-After of 503s caused by a full queue, 0 = omitted
+	MaxBodyBytes           int  // cap on JSON request bodies, applied after gzip decompression
+	RateLimits             map[string]int
+	SSEDiagnostics         bool
+	SSEMaxSubscribers      int    // per-job cap on concurrent SSE streams, 0 = unlimited
+	SSEKeepaliveSeconds    int    // idle interval before an SSE keepalive comment, 0 = disabled
+	SSECoalesceMillis      int    // window merging consecutive SSE chunks into one frame, 0 = send each chunk at once
+	SSEPositionSeconds     int    // interval between queue_position checks for queued jobs on SSE, 0 = disabled
+	SSEOmitPrompt          bool   // drop prompt and system_prompt from SSE job frames
+	MinimalCreateResponse  bool   // POST /jobs answers with job_id, status and created_at only
+	KeepEffectivePrompt    bool   // persist the assembled system prompt (admin-visible only)
+	StoreRequestID         bool   // persist the X-Request-ID of the creating request on the job
+	OutputFormat           string // default CLI --output-format for jobs that don't set one
+	PermissionMode         string // CLI permission mode; "bypassPermissions" = --dangerously-skip-permissions
+	IDScheme               string // "uuid" or "ulid"
+	RateLimitBy            string // "ip" or "key": what each rate limit bucket belongs to
+	BasePath               string // route prefix such as "/ai", "" = serve at the root
+	TLSCertFile            string // serve HTTPS when set together with TLSKeyFile
+	TLSKeyFile             string
+	TLSClientCAFile        string // CA bundle for mTLS; a verified client cert satisfies auth
 }
 
 // defaultSecurityPrompt is a server-side guardrail prepended to every job.
@@ -43,7 +112,13 @@ func Load() (*Config, error) {
 		ListenAddr:   getEnv("CLAUDEGATE_LISTEN_ADDR", ":8080"),
 		ClaudePath:   getEnv("CLAUDEGATE_CLAUDE_PATH", "/usr/local/bin/claude"),
 		DefaultModel: getEnv("CLAUDEGATE_DEFAULT_MODEL", "haiku"),
+		DBDriver:     getEnv("CLAUDEGATE_DB_DRIVER", "sqlite"),
 		DBPath:       getEnv("CLAUDEGATE_DB_PATH", "claudegate.db"),
+		DBDSN:        getEnv("CLAUDEGATE_DB_DSN", ""),
+		DBReadDSN:    getEnv("CLAUDEGATE_DB_READ_DSN", ""),
+		DBReadPath:   getEnv("CLAUDEGATE_DB_READ_PATH", ""),
+		OutputFormat: getEnv("CLAUDEGATE_OUTPUT_FORMAT", "stream-json"),
+		IDScheme:     getEnv("CLAUDEGATE_ID_SCHEME", "uuid"),
 	}
 
 	rawKeys := getEnv("CLAUDEGATE_API_KEYS", "")
@@ -52,9 +127,20 @@ func Load() (*Config, error) {
 	}
 	for _, k := range strings.Split(rawKeys, ",") {
 		k = strings.TrimSpace(k)
-		if k != "" {
-			cfg.APIKeys = append(cfg.APIKeys, k)
+		if k == "" {
+			continue
 		}
+		key, admin, trusted := splitKeyScopes(k)
+		if key == "" {
+			return nil, fmt.Errorf("CLAUDEGATE_API_KEYS: entry %q has scopes but no key", k)
+		}
+		if admin {
+			cfg.AdminKeys = append(cfg.AdminKeys, key)
+		}
+		if trusted {
+			cfg.TrustedKeys = append(cfg.TrustedKeys, key)
+		}
+		cfg.APIKeys = append(cfg.APIKeys, key)
 	}
 	if len(cfg.APIKeys) == 0 {
 		return nil, errors.New("CLAUDEGATE_API_KEYS contains no valid keys")
@@ -69,6 +155,22 @@ func Load() (*Config, error) {
 		return nil, errors.New("CLAUDEGATE_CONCURRENCY must be > 0")
 	}
 
+	cfg.MaxInFlight, err = getEnvInt("CLAUDEGATE_MAX_IN_FLIGHT", cfg.Concurrency)
+	if err != nil {
+		return nil, fmt.Errorf("CLAUDEGATE_MAX_IN_FLIGHT: %w", err)
+	}
+	if cfg.MaxInFlight < 1 {
+		return nil, errors.New("CLAUDEGATE_MAX_IN_FLIGHT must be > 0")
+	}
+
+	cfg.MaxProcesses, err = getEnvInt("CLAUDEGATE_MAX_PROCESSES", 0)
+	if err != nil {
+		return nil, fmt.Errorf("CLAUDEGATE_MAX_PROCESSES: %w", err)
+	}
+	if cfg.MaxProcesses < 0 {
+		return nil, errors.New("CLAUDEGATE_MAX_PROCESSES must be >= 0")
+	}
+
 	cfg.QueueSize, err = getEnvInt("CLAUDEGATE_QUEUE_SIZE", 1000)
 	if err != nil {
 		return nil, fmt.Errorf("CLAUDEGATE_QUEUE_SIZE: %w", err)
@@ -78,11 +180,133 @@ func Load() (*Config, error) {
 		return nil, fmt.Errorf("CLAUDEGATE_DEFAULT_MODEL %q must be one of: haiku, sonnet, opus", cfg.DefaultModel)
 	}
 
+	if !job.IsValidOutputFormat(cfg.OutputFormat) {
+		return nil, fmt.Errorf("CLAUDEGATE_OUTPUT_FORMAT %q must be one of: stream-json, json", cfg.OutputFormat)
+	}
+
+	cfg.PermissionMode = getEnv("CLAUDEGATE_PERMISSION_MODE", "default")
+	switch cfg.PermissionMode {
+	case "default", "acceptEdits", "plan", "bypassPermissions":
+	default:
+		return nil, fmt.Errorf("CLAUDEGATE_PERMISSION_MODE %q must be one of: default, acceptEdits, plan, bypassPermissions", cfg.PermissionMode)
+	}
+
+	if cfg.IDScheme != "uuid" && cfg.IDScheme != "ulid" {
+		return nil, fmt.Errorf("CLAUDEGATE_ID_SCHEME %q must be one of: uuid, ulid", cfg.IDScheme)
+	}
+
+	switch cfg.DBDriver {
+	case "sqlite":
+		if cfg.DBReadDSN != "" {
+			return nil, errors.New("CLAUDEGATE_DB_READ_DSN is only supported with the postgres driver")
+		}
+	case "postgres":
+		if cfg.DBDSN == "" {
+			return nil, errors.New("CLAUDEGATE_DB_DSN is required when CLAUDEGATE_DB_DRIVER is postgres")
+		}
+		if cfg.DBReadPath != "" {
+			return nil, errors.New("CLAUDEGATE_DB_READ_PATH is only supported with the sqlite driver")
+		}
+	default:
+		return nil, fmt.Errorf("CLAUDEGATE_DB_DRIVER %q must be one of: sqlite, postgres", cfg.DBDriver)
+	}
+
+	cfg.InstanceID = getEnv("CLAUDEGATE_INSTANCE_ID", "")
+	if cfg.InstanceID == "" {
+		host, err := os.Hostname()
+		if err != nil || host == "" {
+			host = fmt.Sprintf("pid-%d", os.Getpid())
+		}
+		cfg.InstanceID = host
+	}
+	cfg.LeaseSeconds, err = getEnvInt("CLAUDEGATE_LEASE_SECONDS", 60)
+	if err != nil {
+		return nil, fmt.Errorf("CLAUDEGATE_LEASE_SECONDS: %w", err)
+	}
+	if cfg.LeaseSeconds < 3 {
+		return nil, errors.New("CLAUDEGATE_LEASE_SECONDS must be >= 3")
+	}
+
+	cfg.WebhookSecret = getEnv("CLAUDEGATE_WEBHOOK_SECRET", "")
+	cfg.MaxCallbackURLs, err = getEnvInt("CLAUDEGATE_MAX_CALLBACK_URLS", 5)
+	if err != nil {
+		return nil, fmt.Errorf("CLAUDEGATE_MAX_CALLBACK_URLS: %w", err)
+	}
+	if cfg.MaxCallbackURLs < 0 {
+		return nil, errors.New("CLAUDEGATE_MAX_CALLBACK_URLS must be >= 0")
+	}
+	cfg.WebhookMaxPerHost, err = getEnvInt("CLAUDEGATE_WEBHOOK_MAX_PER_HOST", 0)
+	if err != nil {
+		return nil, fmt.Errorf("CLAUDEGATE_WEBHOOK_MAX_PER_HOST: %w", err)
+	}
+	if cfg.WebhookMaxPerHost < 0 {
+		return nil, errors.New("CLAUDEGATE_WEBHOOK_MAX_PER_HOST must be >= 0")
+	}
+	cfg.WebhookAttempts, err = getEnvInt("CLAUDEGATE_WEBHOOK_MAX_ATTEMPTS", 8)
+	if err != nil {
+		return nil, fmt.Errorf("CLAUDEGATE_WEBHOOK_MAX_ATTEMPTS: %w", err)
+	}
+	if cfg.WebhookAttempts < 1 {
+		return nil, errors.New("CLAUDEGATE_WEBHOOK_MAX_ATTEMPTS must be >= 1")
+	}
+	cfg.WebhookTimeoutSeconds, err = getEnvInt("CLAUDEGATE_WEBHOOK_TIMEOUT_SECONDS", 30)
+	if err != nil {
+		return nil, fmt.Errorf("CLAUDEGATE_WEBHOOK_TIMEOUT_SECONDS: %w", err)
+	}
+	if cfg.WebhookTimeoutSeconds < 1 {
+		return nil, errors.New("CLAUDEGATE_WEBHOOK_TIMEOUT_SECONDS must be >= 1")
+	}
+	cfg.WebhookRetryCapSeconds, err = getEnvInt("CLAUDEGATE_WEBHOOK_RETRY_CAP_SECONDS", 300)
+	if err != nil {
+		return nil, fmt.Errorf("CLAUDEGATE_WEBHOOK_RETRY_CAP_SECONDS: %w", err)
+	}
+	if cfg.WebhookRetryCapSeconds < 1 {
+		return nil, errors.New("CLAUDEGATE_WEBHOOK_RETRY_CAP_SECONDS must be >= 1")
+	}
+
+	// Split on whitespace and run without a shell, so nothing in the job
+	// can be interpreted by one.
+	cfg.PostJobCommand = strings.Fields(getEnv("CLAUDEGATE_POST_JOB_COMMAND", ""))
+	cfg.PostJobTimeoutSeconds, err = getEnvInt("CLAUDEGATE_POST_JOB_TIMEOUT_SECONDS", 30)
+	if err != nil {
+		return nil, fmt.Errorf("CLAUDEGATE_POST_JOB_TIMEOUT_SECONDS: %w", err)
+	}
+	if cfg.PostJobTimeoutSeconds < 1 {
+		return nil, errors.New("CLAUDEGATE_POST_JOB_TIMEOUT_SECONDS must be >= 1")
+	}
+	cfg.PostJobWorkers, err = getEnvInt("CLAUDEGATE_POST_JOB_WORKERS", 2)
+	if err != nil {
+		return nil, fmt.Errorf("CLAUDEGATE_POST_JOB_WORKERS: %w", err)
+	}
+	if cfg.PostJobWorkers < 1 {
+		return nil, errors.New("CLAUDEGATE_POST_JOB_WORKERS must be >= 1")
+	}
+
+	cfg.TLSCertFile = getEnv("CLAUDEGATE_TLS_CERT_FILE", "")
+	cfg.TLSKeyFile = getEnv("CLAUDEGATE_TLS_KEY_FILE", "")
+	cfg.TLSClientCAFile = getEnv("CLAUDEGATE_TLS_CLIENT_CA_FILE", "")
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return nil, errors.New("CLAUDEGATE_TLS_CERT_FILE and CLAUDEGATE_TLS_KEY_FILE must be set together")
+	}
+	if cfg.TLSClientCAFile != "" && cfg.TLSCertFile == "" {
+		return nil, errors.New("CLAUDEGATE_TLS_CLIENT_CA_FILE requires CLAUDEGATE_TLS_CERT_FILE and CLAUDEGATE_TLS_KEY_FILE")
+	}
+
+	// Normalize the base path to "/prefix" (leading slash, no trailing slash).
+	cfg.BasePath = strings.Trim(strings.TrimSpace(getEnv("CLAUDEGATE_BASE_PATH", "")), "/")
+	if cfg.BasePath != "" {
+		if strings.ContainsAny(cfg.BasePath, "{} \t") {
+			return nil, fmt.Errorf("CLAUDEGATE_BASE_PATH %q must not contain braces or whitespace", cfg.BasePath)
+		}
+		cfg.BasePath = "/" + cfg.BasePath
+	}
+
 	// CLAUDEGATE_UNSAFE_NO_SECURITY_PROMPT=true disables the server-side security prompt.
 	// WARNING: disabling this gives Claude full access to the system within the service user's permissions.
 	if getEnv("CLAUDEGATE_UNSAFE_NO_SECURITY_PROMPT", "false") != "true" {
 		cfg.SecurityPrompt = defaultSecurityPrompt
 	}
+	cfg.AllowControlChars = getEnv("CLAUDEGATE_ALLOW_CONTROL_CHARS", "false") == "true"
 
 	cfg.JobTimeoutMinutes, err = getEnvInt("CLAUDEGATE_JOB_TIMEOUT_MINUTES", 0)
 	if err != nil {
@@ -91,6 +315,13 @@ func Load() (*Config, error) {
 	if cfg.JobTimeoutMinutes < 0 {
 		return nil, errors.New("CLAUDEGATE_JOB_TIMEOUT_MINUTES must be >= 0")
 	}
+	cfg.MaxJobTimeoutSeconds, err = getEnvInt("CLAUDEGATE_MAX_JOB_TIMEOUT_SECONDS", 3600)
+	if err != nil {
+		return nil, fmt.Errorf("CLAUDEGATE_MAX_JOB_TIMEOUT_SECONDS: %w", err)
+	}
+	if cfg.MaxJobTimeoutSeconds < 0 {
+		return nil, errors.New("CLAUDEGATE_MAX_JOB_TIMEOUT_SECONDS must be >= 0")
+	}
 
 	rawCORSOrigins := getEnv("CLAUDEGATE_CORS_ORIGINS", "")
 	if rawCORSOrigins != "" {
@@ -102,6 +333,83 @@ func Load() (*Config, error) {
 		}
 	}
 
+	for _, c := range strings.Split(getEnv("CLAUDEGATE_SUCCESS_EXIT_CODES", ""), ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		code, err := strconv.Atoi(c)
+		if err != nil || code <= 0 || code > 255 {
+			return nil, fmt.Errorf("CLAUDEGATE_SUCCESS_EXIT_CODES: invalid exit code %q (want 1-255)", c)
+		}
+		cfg.SuccessExitCodes = append(cfg.SuccessExitCodes, code)
+	}
+
+	cfg.ResultProcessors = []string{}
+	rawProcessors := getEnv("CLAUDEGATE_RESULT_PROCESSORS", strings.Join(job.DefaultResultProcessors, ","))
+	if rawProcessors != "none" {
+		for _, name := range strings.Split(rawProcessors, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if !job.IsValidResultProcessor(name) {
+				return nil, fmt.Errorf("CLAUDEGATE_RESULT_PROCESSORS: unknown processor %q (want strip_fences, sanitize_utf8, validate_json or none)", name)
+			}
+			cfg.ResultProcessors = append(cfg.ResultProcessors, name)
+		}
+	}
+
+	for _, name := range strings.Split(getEnv("CLAUDEGATE_WORKER_ENV_ALLOW", ""), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if strings.Contains(name, "=") || strings.Contains(strings.TrimSuffix(name, "*"), "*") {
+			return nil, fmt.Errorf("CLAUDEGATE_WORKER_ENV_ALLOW: invalid entry %q (want NAME or PREFIX*)", name)
+		}
+		cfg.WorkerEnvAllow = append(cfg.WorkerEnvAllow, name)
+	}
+
+	for _, t := range strings.Split(getEnv("CLAUDEGATE_ALLOWED_TOOLS", ""), ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		if strings.HasPrefix(t, "-") {
+			return nil, fmt.Errorf("CLAUDEGATE_ALLOWED_TOOLS: invalid tool name %q", t)
+		}
+		cfg.AllowedTools = append(cfg.AllowedTools, t)
+	}
+	cfg.MCPConfig = getEnv("CLAUDEGATE_MCP_CONFIG", "")
+	if cfg.MCPConfig != "" && len(cfg.AllowedTools) == 0 {
+		return nil, errors.New("CLAUDEGATE_MCP_CONFIG requires CLAUDEGATE_ALLOWED_TOOLS")
+	}
+
+	if raw := getEnv("CLAUDEGATE_RESPONSE_FORMATS", ""); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &cfg.ResponseFormats); err != nil {
+			return nil, fmt.Errorf("CLAUDEGATE_RESPONSE_FORMATS: must be a JSON object of format name to instruction: %w", err)
+		}
+		for name := range cfg.ResponseFormats {
+			if name == "" || name == "text" || name == "json" {
+				return nil, fmt.Errorf("CLAUDEGATE_RESPONSE_FORMATS: invalid format name %q (text and json are built in)", name)
+			}
+		}
+	}
+
+	cfg.Prices, err = parsePrices()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.DrainTimeoutSeconds, err = getEnvInt("CLAUDEGATE_DRAIN_TIMEOUT_SECONDS", 0)
+	if err != nil {
+		return nil, fmt.Errorf("CLAUDEGATE_DRAIN_TIMEOUT_SECONDS: %w", err)
+	}
+	if cfg.DrainTimeoutSeconds < 0 {
+		return nil, errors.New("CLAUDEGATE_DRAIN_TIMEOUT_SECONDS must be >= 0")
+	}
+
 	cfg.JobTTLHours, err = getEnvInt("CLAUDEGATE_JOB_TTL_HOURS", 0)
 	if err != nil {
 		return nil, fmt.Errorf("CLAUDEGATE_JOB_TTL_HOURS: %w", err)
@@ -118,7 +426,104 @@ func Load() (*Config, error) {
 		return nil, errors.New("CLAUDEGATE_CLEANUP_INTERVAL_MINUTES must be >= 1 when job TTL is enabled")
 	}
 
+	cfg.CompressResults = getEnv("CLAUDEGATE_COMPRESS_RESULTS", "false") == "true"
+	cfg.CompressMinBytes, err = getEnvInt("CLAUDEGATE_COMPRESS_MIN_BYTES", 1024)
+	if err != nil {
+		return nil, fmt.Errorf("CLAUDEGATE_COMPRESS_MIN_BYTES: %w", err)
+	}
+	if cfg.CompressMinBytes < 1 {
+		return nil, errors.New("CLAUDEGATE_COMPRESS_MIN_BYTES must be >= 1")
+	}
+
+	cfg.SQLiteBusyTimeoutMS, err = getEnvInt("CLAUDEGATE_SQLITE_BUSY_TIMEOUT_MS", 5000)
+	if err != nil {
+		return nil, fmt.Errorf("CLAUDEGATE_SQLITE_BUSY_TIMEOUT_MS: %w", err)
+	}
+	if cfg.SQLiteBusyTimeoutMS < 1 {
+		return nil, errors.New("CLAUDEGATE_SQLITE_BUSY_TIMEOUT_MS must be >= 1")
+	}
+
+	cfg.IdempotencyTTLHours, err = getEnvInt("CLAUDEGATE_IDEMPOTENCY_TTL_HOURS", 24)
+	if err != nil {
+		return nil, fmt.Errorf("CLAUDEGATE_IDEMPOTENCY_TTL_HOURS: %w", err)
+	}
+	if cfg.IdempotencyTTLHours < 0 {
+		return nil, errors.New("CLAUDEGATE_IDEMPOTENCY_TTL_HOURS must be >= 0")
+	}
+
+	cfg.QueueSnapshotPath = getEnv("CLAUDEGATE_QUEUE_SNAPSHOT_PATH", "")
+	cfg.QueueSnapshotSeconds, err = getEnvInt("CLAUDEGATE_QUEUE_SNAPSHOT_INTERVAL_SECONDS", 5)
+	if err != nil {
+		return nil, fmt.Errorf("CLAUDEGATE_QUEUE_SNAPSHOT_INTERVAL_SECONDS: %w", err)
+	}
+	if cfg.QueueSnapshotPath != "" && cfg.QueueSnapshotSeconds < 1 {
+		return nil, errors.New("CLAUDEGATE_QUEUE_SNAPSHOT_INTERVAL_SECONDS must be >= 1 when queue snapshots are enabled")
+	}
+
 	cfg.DisableKeepalive = getEnv("CLAUDEGATE_DISABLE_KEEPALIVE", "false") == "true"
+	cfg.KeepaliveWindowMinutes, err = getEnvInt("CLAUDEGATE_KEEPALIVE_WINDOW_MINUTES", 15)
+	if err != nil {
+		return nil, fmt.Errorf("CLAUDEGATE_KEEPALIVE_WINDOW_MINUTES: %w", err)
+	}
+	if cfg.KeepaliveWindowMinutes < 0 {
+		return nil, errors.New("CLAUDEGATE_KEEPALIVE_WINDOW_MINUTES must be >= 0")
+	}
+	cfg.KeepaliveCheckSeconds, err = getEnvInt("CLAUDEGATE_KEEPALIVE_CHECK_SECONDS", 60)
+	if err != nil {
+		return nil, fmt.Errorf("CLAUDEGATE_KEEPALIVE_CHECK_SECONDS: %w", err)
+	}
+	if cfg.KeepaliveCheckSeconds < 0 {
+		return nil, errors.New("CLAUDEGATE_KEEPALIVE_CHECK_SECONDS must be >= 0")
+	}
+	cfg.DisableFrontend = getEnv("CLAUDEGATE_DISABLE_FRONTEND", "false") == "true"
+	cfg.ReadyRequireClaudeAuth = getEnv("CLAUDEGATE_READY_REQUIRE_CLAUDE_AUTH", "false") == "true"
+	cfg.WaitMetrics = getEnv("CLAUDEGATE_WAIT_METRICS", "false") == "true"
+	cfg.ReadOnly = getEnv("CLAUDEGATE_READ_ONLY", "false") == "true"
+	cfg.KeepEffectivePrompt = getEnv("CLAUDEGATE_STORE_EFFECTIVE_SYSTEM_PROMPT", "false") == "true"
+	cfg.StoreRequestID = getEnv("CLAUDEGATE_STORE_REQUEST_ID", "false") == "true"
+	cfg.SSEOmitPrompt = getEnv("CLAUDEGATE_SSE_OMIT_PROMPT", "false") == "true"
+	cfg.MinimalCreateResponse = getEnv("CLAUDEGATE_MINIMAL_CREATE_RESPONSE", "false") == "true"
+	cfg.PartialResultOnTimeout = getEnv("CLAUDEGATE_PARTIAL_RESULT_ON_TIMEOUT", "false") == "true"
+	cfg.PartialResultSeconds, err = getEnvInt("CLAUDEGATE_PARTIAL_RESULT_SECONDS", 2)
+	if err != nil {
+		return nil, fmt.Errorf("CLAUDEGATE_PARTIAL_RESULT_SECONDS: %w", err)
+	}
+	if cfg.PartialResultSeconds < 0 {
+		return nil, errors.New("CLAUDEGATE_PARTIAL_RESULT_SECONDS must be >= 0")
+	}
+	cfg.DedupChunks = getEnv("CLAUDEGATE_DEDUP_CHUNKS", "false") == "true"
+
+	cfg.SSEMaxSubscribers, err = getEnvInt("CLAUDEGATE_SSE_MAX_SUBSCRIBERS", 0)
+	if err != nil {
+		return nil, fmt.Errorf("CLAUDEGATE_SSE_MAX_SUBSCRIBERS: %w", err)
+	}
+	if cfg.SSEMaxSubscribers < 0 {
+		return nil, errors.New("CLAUDEGATE_SSE_MAX_SUBSCRIBERS must be >= 0")
+	}
+
+	cfg.SSEKeepaliveSeconds, err = getEnvInt("CLAUDEGATE_SSE_KEEPALIVE_SECONDS", 15)
+	if err != nil {
+		return nil, fmt.Errorf("CLAUDEGATE_SSE_KEEPALIVE_SECONDS: %w", err)
+	}
+	if cfg.SSEKeepaliveSeconds < 0 {
+		return nil, errors.New("CLAUDEGATE_SSE_KEEPALIVE_SECONDS must be >= 0")
+	}
+
+	cfg.SSECoalesceMillis, err = getEnvInt("CLAUDEGATE_SSE_COALESCE_MS", 0)
+	if err != nil {
+		return nil, fmt.Errorf("CLAUDEGATE_SSE_COALESCE_MS: %w", err)
+	}
+	if cfg.SSECoalesceMillis < 0 {
+		return nil, errors.New("CLAUDEGATE_SSE_COALESCE_MS must be >= 0")
+	}
+
+	cfg.SSEPositionSeconds, err = getEnvInt("CLAUDEGATE_SSE_POSITION_SECONDS", 5)
+	if err != nil {
+		return nil, fmt.Errorf("CLAUDEGATE_SSE_POSITION_SECONDS: %w", err)
+	}
+	if cfg.SSEPositionSeconds < 0 {
+		return nil, errors.New("CLAUDEGATE_SSE_POSITION_SECONDS must be >= 0")
+	}
 
 	cfg.RateLimit, err = getEnvInt("CLAUDEGATE_RATE_LIMIT", 0)
 	if err != nil {
@@ -127,6 +532,47 @@ func Load() (*Config, error) {
 	if cfg.RateLimit < 0 {
 		return nil, errors.New("CLAUDEGATE_RATE_LIMIT must be >= 0")
 	}
+	cfg.RateLimitBy = getEnv("CLAUDEGATE_RATE_LIMIT_BY", "ip")
+	if cfg.RateLimitBy != "ip" && cfg.RateLimitBy != "key" {
+		return nil, fmt.Errorf("CLAUDEGATE_RATE_LIMIT_BY %q must be one of: ip, key", cfg.RateLimitBy)
+	}
+
+	cfg.RateLimits, err = parseRateLimits(getEnv("CLAUDEGATE_RATE_LIMITS", ""))
+	if err != nil {
+		return nil, fmt.Errorf("CLAUDEGATE_RATE_LIMITS: %w", err)
+	}
+
+	cfg.StoreTimeoutSeconds, err = getEnvInt("CLAUDEGATE_STORE_TIMEOUT_SECONDS", 5)
+	if err != nil {
+		return nil, fmt.Errorf("CLAUDEGATE_STORE_TIMEOUT_SECONDS: %w", err)
+	}
+	if cfg.StoreTimeoutSeconds < 0 {
+		return nil, errors.New("CLAUDEGATE_STORE_TIMEOUT_SECONDS must be >= 0")
+	}
+	cfg.StoreRetryAfterSeconds, err = getEnvInt("CLAUDEGATE_STORE_RETRY_AFTER_SECONDS", 2)
+	if err != nil {
+		return nil, fmt.Errorf("CLAUDEGATE_STORE_RETRY_AFTER_SECONDS: %w", err)
+	}
+	if cfg.StoreRetryAfterSeconds < 0 {
+		return nil, errors.New("CLAUDEGATE_STORE_RETRY_AFTER_SECONDS must be >= 0")
+	}
+	cfg.QueueRetryAfterSeconds, err = getEnvInt("CLAUDEGATE_QUEUE_RETRY_AFTER_SECONDS", 5)
+	if err != nil {
+		return nil, fmt.Errorf("CLAUDEGATE_QUEUE_RETRY_AFTER_SECONDS: %w", err)
+	}
+	if cfg.QueueRetryAfterSeconds < 0 {
+		return nil, errors.New("CLAUDEGATE_QUEUE_RETRY_AFTER_SECONDS must be >= 0")
+	}
+	cfg.MaxBodyBytes, err = getEnvInt("CLAUDEGATE_MAX_BODY_BYTES", 1<<20)
+	if err != nil {
+		return nil, fmt.Errorf("CLAUDEGATE_MAX_BODY_BYTES: %w", err)
+	}
+	if cfg.MaxBodyBytes <= 0 {
+		return nil, errors.New("CLAUDEGATE_MAX_BODY_BYTES must be > 0")
+	}
+
+	// Diagnostics expose raw CLI stderr/system output; SSE clients must still opt in per stream.
+	cfg.SSEDiagnostics = getEnv("CLAUDEGATE_SSE_DIAGNOSTICS", "false") == "true"
 
 	return cfg, nil
 }
@@ -149,3 +595,125 @@ func getEnvInt(key string, fallback int) (int, error) {
 	}
 	return n, nil
 }
+
+// Price is what a model costs, in USD per million input and output tokens.
+type Price struct {
+	InputPerMTok  float64
+	OutputPerMTok float64
+}
+
+// Cost returns the estimated price in USD of the given token counts.
+func (p Price) Cost(inputTokens, outputTokens int) float64 {
+	return (float64(inputTokens)*p.InputPerMTok + float64(outputTokens)*p.OutputPerMTok) / 1e6
+}
+
+// parsePrices reads CLAUDEGATE_PRICE_<MODEL>_IN and _OUT for every model.
+// Both must be set for a model to get a price; unpriced models are absent.
+func parsePrices() (map[string]Price, error) {
+	prices := make(map[string]Price)
+	for _, model := range []string{"haiku", "sonnet", "opus"} {
+		prefix := "CLAUDEGATE_PRICE_" + strings.ToUpper(model)
+		rawIn, rawOut := os.Getenv(prefix+"_IN"), os.Getenv(prefix+"_OUT")
+		if rawIn == "" && rawOut == "" {
+			continue
+		}
+		if rawIn == "" || rawOut == "" {
+			return nil, fmt.Errorf("%s_IN and %s_OUT must be set together", prefix, prefix)
+		}
+		in, err := parsePrice(rawIn)
+		if err != nil {
+			return nil, fmt.Errorf("%s_IN: %w", prefix, err)
+		}
+		out, err := parsePrice(rawOut)
+		if err != nil {
+			return nil, fmt.Errorf("%s_OUT: %w", prefix, err)
+		}
+		prices[model] = Price{InputPerMTok: in, OutputPerMTok: out}
+	}
+	return prices, nil
+}
+
+// parsePrice parses a non-negative USD amount.
+func parsePrice(v string) (float64, error) {
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 || math.IsInf(f, 0) || math.IsNaN(f) {
+		return 0, fmt.Errorf("invalid price %q", v)
+	}
+	return f, nil
+}
+
+// parseRateLimits parses "METHOD /path=rps" entries separated by commas into
+// per-route limits keyed by ServeMux pattern, e.g. "GET /api/v1/jobs/{id}/sse=2".
+func parseRateLimits(raw string) (map[string]int, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+	limits := make(map[string]int)
+	mux := http.NewServeMux()
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("entry %q must be METHOD /path=rps", entry)
+		}
+		pattern := strings.TrimSpace(entry[:i])
+		method, path, ok := strings.Cut(pattern, " ")
+		if !ok || method == "" || !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("pattern %q must be METHOD /path", pattern)
+		}
+		rps, err := strconv.Atoi(strings.TrimSpace(entry[i+1:]))
+		if err != nil || rps <= 0 {
+			return nil, fmt.Errorf("pattern %q: rate must be a positive integer", pattern)
+		}
+		if err := checkPattern(mux, pattern); err != nil {
+			return nil, err
+		}
+		limits[pattern] = rps
+	}
+	return limits, nil
+}
+
+// checkPattern registers pattern on mux, turning the panic ServeMux raises for
+// malformed or conflicting patterns into an error.
+func checkPattern(mux *http.ServeMux, pattern string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("pattern %q: %v", pattern, r)
+		}
+	}()
+	mux.Handle(pattern, http.NotFoundHandler())
+	return nil
+}
+
+// splitKeyScopes strips the known scope suffixes (":admin", ":trusted") from
+// an API key entry such as "secret:trusted:admin". Any other colon is part of
+// the key, so "user:pass" is a plain key.
+func splitKeyScopes(entry string) (key string, admin, trusted bool) {
+	key = entry
+	for {
+		rest, scope, ok := cutLast(key, ":")
+		if !ok {
+			return key, admin, trusted
+		}
+		switch scope {
+		case "admin":
+			admin = true
+		case "trusted":
+			trusted = true
+		default:
+			return key, admin, trusted
+		}
+		key = rest
+	}
+}
+
+// cutLast is strings.Cut around the last instance of sep.
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
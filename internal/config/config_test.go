@@ -1,6 +1,8 @@
 package config
 
 import (
+	"os"
+	"slices"
 	"testing"
 )
 
@@ -91,6 +93,7 @@ func TestLoad_Defaults(t *testing.T) {
 	t.Setenv("CLAUDEGATE_JOB_TIMEOUT_MINUTES", "")
 	t.Setenv("CLAUDEGATE_JOB_TTL_HOURS", "")
 	t.Setenv("CLAUDEGATE_CLEANUP_INTERVAL_MINUTES", "")
+	t.Setenv("CLAUDEGATE_STORE_TIMEOUT_SECONDS", "")
 
 	cfg, err := Load()
 	if err != nil {
@@ -123,4 +126,685 @@ func TestLoad_Defaults(t *testing.T) {
 	if cfg.CleanupIntervalMinutes != 60 {
 		t.Errorf("default CleanupIntervalMinutes = %d, want 60", cfg.CleanupIntervalMinutes)
 	}
+	if cfg.StoreTimeoutSeconds != 5 {
+		t.Errorf("default StoreTimeoutSeconds = %d, want 5", cfg.StoreTimeoutSeconds)
+	}
+	if cfg.PermissionMode != "default" {
+		t.Errorf("default PermissionMode = %q, want %q", cfg.PermissionMode, "default")
+	}
+}
+
+func TestLoad_InvalidPermissionMode(t *testing.T) {
+	t.Setenv("CLAUDEGATE_API_KEYS", "key1")
+	t.Setenv("CLAUDEGATE_PERMISSION_MODE", "yolo")
+
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for unknown permission mode, got nil")
+	}
+}
+
+func TestLoad_APIKeyScopes(t *testing.T) {
+	t.Setenv("CLAUDEGATE_API_KEYS", "plain, ops:admin, svc:trusted:admin")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if len(cfg.APIKeys) != 3 || cfg.APIKeys[0] != "plain" || cfg.APIKeys[1] != "ops" || cfg.APIKeys[2] != "svc" {
+		t.Errorf("APIKeys = %v, want [plain ops svc]", cfg.APIKeys)
+	}
+	if len(cfg.AdminKeys) != 2 || cfg.AdminKeys[0] != "ops" || cfg.AdminKeys[1] != "svc" {
+		t.Errorf("AdminKeys = %v, want [ops svc]", cfg.AdminKeys)
+	}
+	if len(cfg.TrustedKeys) != 1 || cfg.TrustedKeys[0] != "svc" {
+		t.Errorf("TrustedKeys = %v, want [svc]", cfg.TrustedKeys)
+	}
+
+	t.Setenv("CLAUDEGATE_API_KEYS", ":admin")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for scope without a key, got nil")
+	}
+}
+
+func TestLoad_APIKeyWithColon(t *testing.T) {
+	t.Setenv("CLAUDEGATE_API_KEYS", "user:s3cr3t, tenant:ab:cd:admin")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if len(cfg.APIKeys) != 2 || cfg.APIKeys[0] != "user:s3cr3t" || cfg.APIKeys[1] != "tenant:ab:cd" {
+		t.Errorf("APIKeys = %v, want [user:s3cr3t tenant:ab:cd]", cfg.APIKeys)
+	}
+	if len(cfg.AdminKeys) != 1 || cfg.AdminKeys[0] != "tenant:ab:cd" {
+		t.Errorf("AdminKeys = %v, want [tenant:ab:cd]", cfg.AdminKeys)
+	}
+	if len(cfg.TrustedKeys) != 0 {
+		t.Errorf("TrustedKeys = %v, want none", cfg.TrustedKeys)
+	}
+}
+
+func TestLoad_BasePath(t *testing.T) {
+	t.Setenv("CLAUDEGATE_API_KEYS", "key1")
+
+	for in, want := range map[string]string{"": "", "/": "", "ai": "/ai", "/ai/": "/ai", "/tools/ai": "/tools/ai"} {
+		t.Setenv("CLAUDEGATE_BASE_PATH", in)
+		cfg, err := Load()
+		if err != nil {
+			t.Fatalf("BasePath %q: expected no error, got: %v", in, err)
+		}
+		if cfg.BasePath != want {
+			t.Errorf("BasePath %q = %q, want %q", in, cfg.BasePath, want)
+		}
+	}
+
+	t.Setenv("CLAUDEGATE_BASE_PATH", "/{id}")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for base path with braces, got nil")
+	}
+}
+
+func TestLoad_SuccessExitCodes(t *testing.T) {
+	t.Setenv("CLAUDEGATE_API_KEYS", "key1")
+	t.Setenv("CLAUDEGATE_SUCCESS_EXIT_CODES", "1, 3")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if len(cfg.SuccessExitCodes) != 2 || cfg.SuccessExitCodes[0] != 1 || cfg.SuccessExitCodes[1] != 3 {
+		t.Errorf("SuccessExitCodes = %v, want [1 3]", cfg.SuccessExitCodes)
+	}
+
+	t.Setenv("CLAUDEGATE_SUCCESS_EXIT_CODES", "0")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for exit code 0, got nil")
+	}
+}
+
+func TestLoad_AllowedTools(t *testing.T) {
+	t.Setenv("CLAUDEGATE_API_KEYS", "key1")
+	t.Setenv("CLAUDEGATE_ALLOWED_TOOLS", "Read, mcp__github__get_issue")
+	t.Setenv("CLAUDEGATE_MCP_CONFIG", "/etc/claudegate/mcp.json")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if len(cfg.AllowedTools) != 2 || cfg.AllowedTools[0] != "Read" || cfg.AllowedTools[1] != "mcp__github__get_issue" {
+		t.Errorf("AllowedTools = %v, want [Read mcp__github__get_issue]", cfg.AllowedTools)
+	}
+	if cfg.MCPConfig != "/etc/claudegate/mcp.json" {
+		t.Errorf("MCPConfig = %q", cfg.MCPConfig)
+	}
+
+	t.Setenv("CLAUDEGATE_ALLOWED_TOOLS", "")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for CLAUDEGATE_MCP_CONFIG without tools, got nil")
+	}
+}
+
+func TestLoad_WorkerEnvAllow(t *testing.T) {
+	t.Setenv("CLAUDEGATE_API_KEYS", "key1")
+	t.Setenv("CLAUDEGATE_WORKER_ENV_ALLOW", "PATH, HOME,ANTHROPIC_*")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if !slices.Equal(cfg.WorkerEnvAllow, []string{"PATH", "HOME", "ANTHROPIC_*"}) {
+		t.Errorf("WorkerEnvAllow = %v, want [PATH HOME ANTHROPIC_*]", cfg.WorkerEnvAllow)
+	}
+
+	t.Setenv("CLAUDEGATE_WORKER_ENV_ALLOW", "A*B")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for a '*' that is not a suffix, got nil")
+	}
+}
+
+func TestLoad_WebhookRetryPolicy(t *testing.T) {
+	t.Setenv("CLAUDEGATE_API_KEYS", "key1")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if cfg.WebhookAttempts != 8 || cfg.WebhookTimeoutSeconds != 30 || cfg.WebhookRetryCapSeconds != 300 {
+		t.Errorf("webhook policy = %d attempts, %ds timeout, %ds cap; want 8, 30, 300",
+			cfg.WebhookAttempts, cfg.WebhookTimeoutSeconds, cfg.WebhookRetryCapSeconds)
+	}
+
+	t.Setenv("CLAUDEGATE_WEBHOOK_MAX_ATTEMPTS", "0")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for zero webhook attempts, got nil")
+	}
+}
+
+func TestLoad_ResultProcessors(t *testing.T) {
+	t.Setenv("CLAUDEGATE_API_KEYS", "key1")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if len(cfg.ResultProcessors) != 1 || cfg.ResultProcessors[0] != "strip_fences" {
+		t.Errorf("default ResultProcessors = %v, want [strip_fences]", cfg.ResultProcessors)
+	}
+
+	t.Setenv("CLAUDEGATE_RESULT_PROCESSORS", "none")
+	cfg, err = Load()
+	if err != nil {
+		t.Fatalf("none: expected no error, got: %v", err)
+	}
+	if len(cfg.ResultProcessors) != 0 {
+		t.Errorf("none: ResultProcessors = %v, want empty", cfg.ResultProcessors)
+	}
+
+	t.Setenv("CLAUDEGATE_RESULT_PROCESSORS", "strip_fences,bogus")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for unknown processor, got nil")
+	}
+}
+
+func TestLoad_QueueSnapshot(t *testing.T) {
+	t.Setenv("CLAUDEGATE_API_KEYS", "key1")
+	t.Setenv("CLAUDEGATE_QUEUE_SNAPSHOT_PATH", "/data/queue.json")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if cfg.QueueSnapshotPath != "/data/queue.json" || cfg.QueueSnapshotSeconds != 5 {
+		t.Errorf("snapshot = %q every %ds, want /data/queue.json every 5s", cfg.QueueSnapshotPath, cfg.QueueSnapshotSeconds)
+	}
+
+	t.Setenv("CLAUDEGATE_QUEUE_SNAPSHOT_INTERVAL_SECONDS", "0")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for zero snapshot interval, got nil")
+	}
+}
+
+func TestLoad_ResponseFormats(t *testing.T) {
+	t.Setenv("CLAUDEGATE_API_KEYS", "key1")
+	t.Setenv("CLAUDEGATE_RESPONSE_FORMATS", `{"csv":"Respond with CSV only."}`)
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if cfg.ResponseFormats["csv"] != "Respond with CSV only." {
+		t.Errorf("ResponseFormats = %v, want csv instruction", cfg.ResponseFormats)
+	}
+
+	for _, raw := range []string{`{"json":"x"}`, `["csv"]`} {
+		t.Setenv("CLAUDEGATE_RESPONSE_FORMATS", raw)
+		if _, err := Load(); err == nil {
+			t.Errorf("%s: expected error, got nil", raw)
+		}
+	}
+}
+
+func TestLoad_DBDriver(t *testing.T) {
+	t.Setenv("CLAUDEGATE_API_KEYS", "key1")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if cfg.DBDriver != "sqlite" {
+		t.Errorf("DBDriver = %q, want sqlite", cfg.DBDriver)
+	}
+
+	t.Setenv("CLAUDEGATE_DB_DRIVER", "postgres")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for postgres without DSN, got nil")
+	}
+
+	t.Setenv("CLAUDEGATE_DB_DSN", "postgres://claudegate@db/claudegate")
+	cfg, err = Load()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if cfg.DBDSN != "postgres://claudegate@db/claudegate" {
+		t.Errorf("DBDSN = %q", cfg.DBDSN)
+	}
+
+	t.Setenv("CLAUDEGATE_DB_READ_DSN", "postgres://claudegate@db-replica/claudegate")
+	cfg, err = Load()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if cfg.DBReadDSN != "postgres://claudegate@db-replica/claudegate" {
+		t.Errorf("DBReadDSN = %q", cfg.DBReadDSN)
+	}
+
+	t.Setenv("CLAUDEGATE_DB_DRIVER", "sqlite")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for read DSN with the sqlite driver, got nil")
+	}
+
+	t.Setenv("CLAUDEGATE_DB_DRIVER", "mysql")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for unknown driver, got nil")
+	}
+}
+
+func TestLoad_RateLimits(t *testing.T) {
+	t.Setenv("CLAUDEGATE_API_KEYS", "key1")
+	t.Setenv("CLAUDEGATE_RATE_LIMITS", "GET /api/v1/jobs=20, GET /api/v1/jobs/{id}/sse=2")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if cfg.RateLimits["GET /api/v1/jobs"] != 20 || cfg.RateLimits["GET /api/v1/jobs/{id}/sse"] != 2 {
+		t.Errorf("RateLimits = %v", cfg.RateLimits)
+	}
+
+	for _, raw := range []string{
+		"/api/v1/jobs=5",
+		"GET /api/v1/jobs=0",
+		"GET /api/v1/jobs",
+		"GET /api/v1/jobs/{id}=1,GET /api/v1/jobs/{x}=1",
+	} {
+		t.Setenv("CLAUDEGATE_RATE_LIMITS", raw)
+		if _, err := Load(); err == nil {
+			t.Errorf("expected error for %q, got nil", raw)
+		}
+	}
+}
+
+func TestLoad_MaxProcesses(t *testing.T) {
+	t.Setenv("CLAUDEGATE_API_KEYS", "key1")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if cfg.MaxProcesses != 0 {
+		t.Errorf("MaxProcesses = %d, want 0", cfg.MaxProcesses)
+	}
+
+	t.Setenv("CLAUDEGATE_MAX_PROCESSES", "-1")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for negative max processes, got nil")
+	}
+}
+
+func TestLoad_SSEKeepaliveSeconds(t *testing.T) {
+	t.Setenv("CLAUDEGATE_API_KEYS", "key1")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if cfg.SSEKeepaliveSeconds != 15 {
+		t.Errorf("SSEKeepaliveSeconds = %d, want 15", cfg.SSEKeepaliveSeconds)
+	}
+
+	t.Setenv("CLAUDEGATE_SSE_KEEPALIVE_SECONDS", "-1")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for negative keepalive interval, got nil")
+	}
+}
+
+func TestLoad_MaxCallbackURLs(t *testing.T) {
+	t.Setenv("CLAUDEGATE_API_KEYS", "key1")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if cfg.MaxCallbackURLs != 5 {
+		t.Errorf("MaxCallbackURLs = %d, want 5", cfg.MaxCallbackURLs)
+	}
+
+	t.Setenv("CLAUDEGATE_MAX_CALLBACK_URLS", "-1")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for negative max callback URLs, got nil")
+	}
+}
+
+func TestLoad_MaxJobTimeoutSeconds(t *testing.T) {
+	t.Setenv("CLAUDEGATE_API_KEYS", "key1")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if cfg.MaxJobTimeoutSeconds != 3600 {
+		t.Errorf("MaxJobTimeoutSeconds = %d, want 3600", cfg.MaxJobTimeoutSeconds)
+	}
+
+	t.Setenv("CLAUDEGATE_MAX_JOB_TIMEOUT_SECONDS", "-1")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for negative max job timeout, got nil")
+	}
+}
+
+func TestLoad_PostJobCommand(t *testing.T) {
+	t.Setenv("CLAUDEGATE_API_KEYS", "key1")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if len(cfg.PostJobCommand) != 0 || cfg.PostJobTimeoutSeconds != 30 || cfg.PostJobWorkers != 2 {
+		t.Errorf("defaults = %q, %d, %d, want disabled, 30, 2", cfg.PostJobCommand, cfg.PostJobTimeoutSeconds, cfg.PostJobWorkers)
+	}
+
+	t.Setenv("CLAUDEGATE_POST_JOB_COMMAND", "/usr/local/bin/index-job  --quiet")
+	if cfg, err = Load(); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if want := []string{"/usr/local/bin/index-job", "--quiet"}; !slices.Equal(cfg.PostJobCommand, want) {
+		t.Errorf("PostJobCommand = %q, want %q", cfg.PostJobCommand, want)
+	}
+
+	t.Setenv("CLAUDEGATE_POST_JOB_WORKERS", "0")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for zero post-job workers, got nil")
+	}
+	t.Setenv("CLAUDEGATE_POST_JOB_WORKERS", "2")
+	t.Setenv("CLAUDEGATE_POST_JOB_TIMEOUT_SECONDS", "0")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for zero post-job timeout, got nil")
+	}
+}
+
+func TestLoad_StoreRetryAfterSeconds(t *testing.T) {
+	t.Setenv("CLAUDEGATE_API_KEYS", "key1")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if cfg.StoreRetryAfterSeconds != 2 {
+		t.Errorf("StoreRetryAfterSeconds = %d, want 2", cfg.StoreRetryAfterSeconds)
+	}
+
+	t.Setenv("CLAUDEGATE_STORE_RETRY_AFTER_SECONDS", "-1")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for negative store Retry-After, got nil")
+	}
+}
+
+func TestLoad_QueueRetryAfterSeconds(t *testing.T) {
+	t.Setenv("CLAUDEGATE_API_KEYS", "key1")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if cfg.QueueRetryAfterSeconds != 5 {
+		t.Errorf("QueueRetryAfterSeconds = %d, want 5", cfg.QueueRetryAfterSeconds)
+	}
+
+	t.Setenv("CLAUDEGATE_QUEUE_RETRY_AFTER_SECONDS", "-1")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for negative queue Retry-After, got nil")
+	}
+}
+
+func TestLoad_InstanceAndLease(t *testing.T) {
+	t.Setenv("CLAUDEGATE_API_KEYS", "key1")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if host, _ := os.Hostname(); host != "" && cfg.InstanceID != host {
+		t.Errorf("InstanceID = %q, want host name %q", cfg.InstanceID, host)
+	}
+	if cfg.LeaseSeconds != 60 {
+		t.Errorf("LeaseSeconds = %d, want 60", cfg.LeaseSeconds)
+	}
+
+	t.Setenv("CLAUDEGATE_INSTANCE_ID", "replica-1")
+	cfg, err = Load()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if cfg.InstanceID != "replica-1" {
+		t.Errorf("InstanceID = %q, want replica-1", cfg.InstanceID)
+	}
+
+	t.Setenv("CLAUDEGATE_LEASE_SECONDS", "2")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for a lease under 3 seconds, got nil")
+	}
+}
+
+func TestLoad_MaxBodyBytes(t *testing.T) {
+	t.Setenv("CLAUDEGATE_API_KEYS", "key1")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if cfg.MaxBodyBytes != 1<<20 {
+		t.Errorf("MaxBodyBytes = %d, want %d", cfg.MaxBodyBytes, 1<<20)
+	}
+
+	t.Setenv("CLAUDEGATE_MAX_BODY_BYTES", "10485760")
+	cfg, err = Load()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if cfg.MaxBodyBytes != 10<<20 {
+		t.Errorf("MaxBodyBytes = %d, want %d", cfg.MaxBodyBytes, 10<<20)
+	}
+
+	t.Setenv("CLAUDEGATE_MAX_BODY_BYTES", "0")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for zero body limit, got nil")
+	}
+}
+
+func TestLoad_SQLiteBusyTimeoutMS(t *testing.T) {
+	t.Setenv("CLAUDEGATE_API_KEYS", "key1")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if cfg.SQLiteBusyTimeoutMS != 5000 {
+		t.Errorf("SQLiteBusyTimeoutMS = %d, want 5000", cfg.SQLiteBusyTimeoutMS)
+	}
+
+	t.Setenv("CLAUDEGATE_SQLITE_BUSY_TIMEOUT_MS", "0")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for zero busy timeout, got nil")
+	}
+}
+
+func TestLoad_WebhookMaxPerHost(t *testing.T) {
+	t.Setenv("CLAUDEGATE_API_KEYS", "key1")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if cfg.WebhookMaxPerHost != 0 {
+		t.Errorf("WebhookMaxPerHost = %d, want 0", cfg.WebhookMaxPerHost)
+	}
+
+	t.Setenv("CLAUDEGATE_WEBHOOK_MAX_PER_HOST", "4")
+	if cfg, err = Load(); err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if cfg.WebhookMaxPerHost != 4 {
+		t.Errorf("WebhookMaxPerHost = %d, want 4", cfg.WebhookMaxPerHost)
+	}
+
+	t.Setenv("CLAUDEGATE_WEBHOOK_MAX_PER_HOST", "-1")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for negative webhook max per host, got nil")
+	}
+}
+
+func TestLoad_KeepaliveWindowMinutes(t *testing.T) {
+	t.Setenv("CLAUDEGATE_API_KEYS", "key1")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if cfg.KeepaliveWindowMinutes != 15 {
+		t.Errorf("KeepaliveWindowMinutes = %d, want 15", cfg.KeepaliveWindowMinutes)
+	}
+
+	t.Setenv("CLAUDEGATE_KEEPALIVE_WINDOW_MINUTES", "-5")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for negative keepalive window, got nil")
+	}
+}
+
+func TestLoad_KeepaliveCheckSeconds(t *testing.T) {
+	t.Setenv("CLAUDEGATE_API_KEYS", "key1")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if cfg.KeepaliveCheckSeconds != 60 {
+		t.Errorf("KeepaliveCheckSeconds = %d, want 60", cfg.KeepaliveCheckSeconds)
+	}
+
+	t.Setenv("CLAUDEGATE_KEEPALIVE_CHECK_SECONDS", "-1")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for negative keepalive check interval, got nil")
+	}
+}
+
+func TestLoad_RateLimitBy(t *testing.T) {
+	t.Setenv("CLAUDEGATE_API_KEYS", "key1")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if cfg.RateLimitBy != "ip" {
+		t.Errorf("RateLimitBy = %q, want ip", cfg.RateLimitBy)
+	}
+
+	t.Setenv("CLAUDEGATE_RATE_LIMIT_BY", "user")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for unknown rate limit key, got nil")
+	}
+}
+
+func TestLoad_IdempotencyTTLHours(t *testing.T) {
+	t.Setenv("CLAUDEGATE_API_KEYS", "key1")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if cfg.IdempotencyTTLHours != 24 {
+		t.Errorf("IdempotencyTTLHours = %d, want 24", cfg.IdempotencyTTLHours)
+	}
+
+	t.Setenv("CLAUDEGATE_IDEMPOTENCY_TTL_HOURS", "-1")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for negative idempotency TTL, got nil")
+	}
+}
+
+func TestLoad_CompressResults(t *testing.T) {
+	t.Setenv("CLAUDEGATE_API_KEYS", "key1")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if cfg.CompressResults || cfg.CompressMinBytes != 1024 {
+		t.Errorf("CompressResults = %v, CompressMinBytes = %d, want false, 1024", cfg.CompressResults, cfg.CompressMinBytes)
+	}
+
+	t.Setenv("CLAUDEGATE_COMPRESS_MIN_BYTES", "0")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for zero compression threshold, got nil")
+	}
+}
+
+func TestLoad_Prices(t *testing.T) {
+	t.Setenv("CLAUDEGATE_API_KEYS", "key1")
+	t.Setenv("CLAUDEGATE_PRICE_SONNET_IN", "3")
+	t.Setenv("CLAUDEGATE_PRICE_SONNET_OUT", "15")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if got := cfg.Prices["sonnet"]; got != (Price{InputPerMTok: 3, OutputPerMTok: 15}) {
+		t.Errorf("sonnet price = %+v, want 3/15", got)
+	}
+	if _, ok := cfg.Prices["haiku"]; ok {
+		t.Error("haiku has a price, want none")
+	}
+	if got := cfg.Prices["sonnet"].Cost(1_000_000, 2_000_000); got != 33 {
+		t.Errorf("Cost = %v, want 33", got)
+	}
+
+	t.Setenv("CLAUDEGATE_PRICE_SONNET_OUT", "")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for input price without output price, got nil")
+	}
+	t.Setenv("CLAUDEGATE_PRICE_SONNET_OUT", "-1")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for negative price, got nil")
+	}
+}
+
+func TestLoad_SSECoalesceMillis(t *testing.T) {
+	t.Setenv("CLAUDEGATE_API_KEYS", "key1")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if cfg.SSECoalesceMillis != 0 {
+		t.Errorf("SSECoalesceMillis = %d, want 0", cfg.SSECoalesceMillis)
+	}
+
+	t.Setenv("CLAUDEGATE_SSE_COALESCE_MS", "-50")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for negative coalesce window, got nil")
+	}
+}
+
+func TestLoad_SSEPositionSeconds(t *testing.T) {
+	t.Setenv("CLAUDEGATE_API_KEYS", "key1")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if cfg.SSEPositionSeconds != 5 {
+		t.Errorf("SSEPositionSeconds = %d, want 5", cfg.SSEPositionSeconds)
+	}
+
+	t.Setenv("CLAUDEGATE_SSE_POSITION_SECONDS", "-1")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for negative position interval, got nil")
+	}
+}
+
+func TestLoad_DrainTimeoutSeconds(t *testing.T) {
+	t.Setenv("CLAUDEGATE_API_KEYS", "key1")
+	t.Setenv("CLAUDEGATE_DRAIN_TIMEOUT_SECONDS", "120")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if cfg.DrainTimeoutSeconds != 120 {
+		t.Errorf("DrainTimeoutSeconds = %d, want 120", cfg.DrainTimeoutSeconds)
+	}
+
+	t.Setenv("CLAUDEGATE_DRAIN_TIMEOUT_SECONDS", "-1")
+	if _, err := Load(); err == nil {
+		t.Fatal("expected error for negative drain timeout, got nil")
+	}
 }
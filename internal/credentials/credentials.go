@@ -0,0 +1,47 @@
+// Package credentials reads the Claude CLI's stored OAuth credentials.
+package credentials
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Path returns the location of the Claude CLI credentials file,
+// ~/.claude/.credentials.json.
+func Path() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homeDir, ".claude", ".credentials.json"), nil
+}
+
+// TokenExpiry reads the OAuth token expiry from the credentials file.
+// ok is false when the file is missing, unreadable or has no expiry.
+func TokenExpiry() (expiresAt time.Time, ok bool) {
+	path, err := Path()
+	if err != nil {
+		return time.Time{}, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return ParseTokenExpiry(data)
+}
+
+// ParseTokenExpiry extracts the OAuth token expiry, in UTC, from the contents
+// of a credentials file. ok is false when data is malformed or has no expiry.
+func ParseTokenExpiry(data []byte) (expiresAt time.Time, ok bool) {
+	var creds struct {
+		ClaudeAiOauth struct {
+			ExpiresAt int64 `json:"expiresAt"`
+		} `json:"claudeAiOauth"`
+	}
+	if json.Unmarshal(data, &creds) != nil || creds.ClaudeAiOauth.ExpiresAt <= 0 {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(creds.ClaudeAiOauth.ExpiresAt).UTC(), true
+}
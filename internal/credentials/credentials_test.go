@@ -0,0 +1,51 @@
+package credentials
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseTokenExpiry(t *testing.T) {
+	t.Parallel()
+	want := time.UnixMilli(1767225600123).UTC()
+	got, ok := ParseTokenExpiry([]byte(`{"claudeAiOauth":{"accessToken":"x","expiresAt":1767225600123}}`))
+	if !ok || !got.Equal(want) || got.Location() != time.UTC {
+		t.Errorf("ParseTokenExpiry = %v, %v; want %v, true", got, ok, want)
+	}
+
+	for _, data := range []string{
+		``,
+		`not json`,
+		`{}`,
+		`{"claudeAiOauth":{}}`,
+		`{"claudeAiOauth":{"expiresAt":0}}`,
+		`{"claudeAiOauth":{"expiresAt":-5}}`,
+		`{"claudeAiOauth":{"expiresAt":"soon"}}`,
+	} {
+		if got, ok := ParseTokenExpiry([]byte(data)); ok {
+			t.Errorf("ParseTokenExpiry(%q) = %v, true; want not ok", data, got)
+		}
+	}
+}
+
+func TestTokenExpiry_ReadsHomeCredentials(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	if _, ok := TokenExpiry(); ok {
+		t.Fatal("TokenExpiry without a credentials file: ok = true")
+	}
+
+	if err := os.MkdirAll(filepath.Join(home, ".claude"), 0o700); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	data := []byte(`{"claudeAiOauth":{"expiresAt":1767225600000}}`)
+	if err := os.WriteFile(filepath.Join(home, ".claude", ".credentials.json"), data, 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	got, ok := TokenExpiry()
+	if want := time.UnixMilli(1767225600000); !ok || !got.Equal(want) {
+		t.Errorf("TokenExpiry = %v, %v; want %v, true", got, ok, want)
+	}
+}
@@ -0,0 +1,46 @@
+package job
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrInvalidCursor is returned by ParseCursor for a malformed cursor.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor marks a position in the List order (created_at DESC, id DESC):
+// ListAfter returns the jobs that come after it.
+type Cursor struct {
+	CreatedAt time.Time
+	ID        string
+}
+
+// CursorAfter returns the cursor pointing just past j.
+func CursorAfter(j *Job) Cursor {
+	return Cursor{CreatedAt: j.CreatedAt, ID: j.ID}
+}
+
+// String encodes the cursor as an opaque, URL-safe token.
+func (c Cursor) String() string {
+	raw := c.CreatedAt.UTC().Format(time.RFC3339Nano) + "|" + c.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// ParseCursor decodes a token produced by Cursor.String.
+func ParseCursor(s string) (Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+	ts, id, ok := strings.Cut(string(raw), "|")
+	if !ok || id == "" {
+		return Cursor{}, ErrInvalidCursor
+	}
+	createdAt, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+	return Cursor{CreatedAt: createdAt.UTC(), ID: id}, nil
+}
@@ -0,0 +1,28 @@
+package job
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCursor_RoundTrip(t *testing.T) {
+	t.Parallel()
+	want := Cursor{CreatedAt: time.Date(2026, 3, 1, 12, 0, 0, 123456789, time.UTC), ID: "01HZX"}
+	got, err := ParseCursor(want.String())
+	if err != nil {
+		t.Fatalf("ParseCursor: %v", err)
+	}
+	if !got.CreatedAt.Equal(want.CreatedAt) || got.ID != want.ID {
+		t.Errorf("ParseCursor(String()) = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseCursor_Invalid(t *testing.T) {
+	t.Parallel()
+	for _, s := range []string{"!!", "bm8tc2VwYXJhdG9y", "bm90LWEtdGltZXxpZA"} {
+		if _, err := ParseCursor(s); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("ParseCursor(%q) err = %v, want ErrInvalidCursor", s, err)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package job
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+)
+
+// dialect identifies the SQL database behind a sqlStore. Queries are written
+// with ? placeholders and SQLite syntax; the few statements that differ
+// branch on the dialect.
+type dialect int
+
+const (
+	dialectSQLite dialect = iota
+	dialectPostgres
+)
+
+// rebind rewrites ? placeholders into the form the dialect expects.
+func (d dialect) rebind(query string) string {
+	if d != dialectPostgres || !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r != '?' {
+			b.WriteRune(r)
+			continue
+		}
+		n++
+		b.WriteByte('$')
+		b.WriteString(strconv.Itoa(n))
+	}
+	return b.String()
+}
+
+// dbConn is a *sql.DB that rebinds query placeholders for its dialect, so the
+// store's queries are shared between SQLite and PostgreSQL.
+type dbConn struct {
+	*sql.DB
+	dialect dialect
+}
+
+func (c dbConn) Exec(query string, args ...any) (sql.Result, error) {
+	return c.DB.Exec(c.dialect.rebind(query), args...)
+}
+
+func (c dbConn) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return c.DB.ExecContext(ctx, c.dialect.rebind(query), args...)
+}
+
+func (c dbConn) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return c.DB.QueryContext(ctx, c.dialect.rebind(query), args...)
+}
+
+func (c dbConn) QueryRow(query string, args ...any) *sql.Row {
+	return c.DB.QueryRow(c.dialect.rebind(query), args...)
+}
+
+func (c dbConn) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return c.DB.QueryRowContext(ctx, c.dialect.rebind(query), args...)
+}
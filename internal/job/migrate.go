@@ -0,0 +1,226 @@
+package job
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"time"
+)
+
+// migration is one versioned schema change applied by sqlStore.migrate.
+// Append new steps to migrations; never edit, remove or reorder released
+// ones, since their version is recorded in existing databases.
+type migration struct {
+	version int
+	up      func(tx *sql.Tx, d dialect) error
+}
+
+// migrations lists every schema step in version order. The same steps run on
+// SQLite and PostgreSQL.
+var migrations = []migration{
+	{1, createJobsTable},
+	{2, addColumn("jobs", "response_format", `TEXT NOT NULL DEFAULT ''`)},
+	{3, addColumn("jobs", "rerun_of", `TEXT NOT NULL DEFAULT ''`)},
+	{4, addColumn("jobs", "output_format", `TEXT NOT NULL DEFAULT ''`)},
+	{5, addColumn("jobs", "note", `TEXT`)},
+	{6, addColumn("jobs", "created_by", `TEXT NOT NULL DEFAULT ''`)},
+	{7, addColumn("jobs", "timed_out", `INTEGER NOT NULL DEFAULT 0`)},
+	{8, addColumn("jobs", "effective_system_prompt", `TEXT NOT NULL DEFAULT ''`)},
+	{9, addColumn("jobs", "response_formats", `TEXT`)},
+	{10, addColumn("jobs", "results", `TEXT`)},
+	{11, addColumn("jobs", "resolved_model", `TEXT NOT NULL DEFAULT ''`)},
+	{12, addColumn("jobs", "request_id", `TEXT NOT NULL DEFAULT ''`)},
+	{13, addColumn("jobs", "max_retries", `INTEGER NOT NULL DEFAULT 0`)},
+	{14, addColumn("jobs", "attempts", `INTEGER NOT NULL DEFAULT 0`)},
+	{15, addColumn("jobs", "priority", `TEXT NOT NULL DEFAULT 'normal'`)},
+	{16, addColumn("jobs", "callback_headers", `TEXT`)},
+	{17, addColumn("jobs", "callback_urls", `TEXT`)},
+	{18, addColumn("jobs", "partial_result", `TEXT NOT NULL DEFAULT ''`)},
+	{19, addColumn("jobs", "idempotency_key", `TEXT`)},
+	{20, addColumn("jobs", "request_hash", `TEXT NOT NULL DEFAULT ''`)},
+	{21, execStmt(`CREATE UNIQUE INDEX IF NOT EXISTS idx_jobs_idempotency_key ON jobs(idempotency_key)`)},
+	{22, addColumn("jobs", "result_compressed", `INTEGER NOT NULL DEFAULT 0`)},
+	{23, addColumn("jobs", "input_tokens", `INTEGER NOT NULL DEFAULT 0`)},
+	{24, addColumn("jobs", "output_tokens", `INTEGER NOT NULL DEFAULT 0`)},
+	{25, addColumn("jobs", "stop_reason", `TEXT NOT NULL DEFAULT ''`)},
+	{26, addColumn("jobs", "cost_usd", `DOUBLE PRECISION`)},
+	{27, addColumn("jobs", "timeout_seconds", `INTEGER NOT NULL DEFAULT 0`)},
+	{28, addColumn("jobs", "session_id", `TEXT NOT NULL DEFAULT ''`)},
+	{29, addColumn("jobs", "parent_job_id", `TEXT NOT NULL DEFAULT ''`)},
+	{30, addColumn("jobs", "allowed_tools", `TEXT`)},
+	{31, addColumn("jobs", "response_schema", `TEXT`)},
+	{32, addColumn("jobs", "events", `TEXT`)},
+	{33, addColumn("jobs", "webhook_status", `TEXT NOT NULL DEFAULT ''`)},
+	{34, func(tx *sql.Tx, d dialect) error {
+		return addColumn("jobs", "webhook_attempted_at", d.timestampType())(tx, d)
+	}},
+	{35, addColumn("jobs", "worker_id", `TEXT NOT NULL DEFAULT ''`)},
+	{36, func(tx *sql.Tx, d dialect) error {
+		return addColumn("jobs", "heartbeat_at", d.timestampType())(tx, d)
+	}},
+	{37, func(tx *sql.Tx, d dialect) error {
+		return addColumn("jobs", "boosted_at", d.timestampType())(tx, d)
+	}},
+}
+
+// timestampType is the column type used for job timestamps.
+func (d dialect) timestampType() string {
+	if d == dialectPostgres {
+		return "TIMESTAMPTZ"
+	}
+	return "DATETIME"
+}
+
+// createJobsTable is the baseline schema: the jobs table and its indexes.
+func createJobsTable(tx *sql.Tx, d dialect) error {
+	ts := d.timestampType()
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS jobs (
+			id              TEXT PRIMARY KEY,
+			prompt          TEXT NOT NULL,
+			system_prompt   TEXT NOT NULL DEFAULT '',
+			model           TEXT NOT NULL,
+			status          TEXT NOT NULL DEFAULT 'queued',
+			result          TEXT NOT NULL DEFAULT '',
+			error           TEXT NOT NULL DEFAULT '',
+			callback_url    TEXT NOT NULL DEFAULT '',
+			metadata        TEXT,
+			created_at      ` + ts + ` NOT NULL,
+			started_at      ` + ts + `,
+			completed_at    ` + ts + `
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_jobs_status       ON jobs(status)`,
+		`CREATE INDEX IF NOT EXISTS idx_jobs_created_at   ON jobs(created_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_jobs_completed_at ON jobs(completed_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_jobs_status_completed_at ON jobs(status, completed_at)`,
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumn returns a migration step adding a column. Databases created before
+// versioned migrations may already have it, in which case the step is a no-op.
+func addColumn(table, column, definition string) func(tx *sql.Tx, d dialect) error {
+	return func(tx *sql.Tx, d dialect) error {
+		if d == dialectPostgres {
+			_, err := tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s`, table, column, definition))
+			return err
+		}
+		var n int
+		err := tx.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&n)
+		if err != nil {
+			return fmt.Errorf("inspect %s: %w", table, err)
+		}
+		if n > 0 {
+			return nil
+		}
+		_, err = tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition))
+		return err
+	}
+}
+
+// execStmt returns a migration step running a single statement that is valid
+// on every dialect.
+func execStmt(stmt string) func(tx *sql.Tx, d dialect) error {
+	return func(tx *sql.Tx, _ dialect) error {
+		_, err := tx.Exec(stmt)
+		return err
+	}
+}
+
+// migrationLockKey is the PostgreSQL advisory lock key that serialises
+// migrations between replicas starting at the same time.
+const migrationLockKey = 0x636c6764 // "clgd"
+
+// migrate applies the pending steps of migrations, each in its own
+// transaction, and fails if the database was migrated by a newer binary.
+// On PostgreSQL it holds an advisory lock throughout, so concurrent replicas
+// run each step once: the others wait, then find nothing left to do.
+func (s *sqlStore) migrate() error {
+	if s.db.dialect == dialectPostgres {
+		unlock, err := s.lockMigrations(context.Background())
+		if err != nil {
+			return fmt.Errorf("lock migrations: %w", err)
+		}
+		defer unlock()
+	}
+
+	_, err := s.db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    INTEGER PRIMARY KEY,
+			applied_at ` + s.db.dialect.timestampType() + ` NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	current, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	latest := migrations[len(migrations)-1].version
+	if current > latest {
+		return fmt.Errorf("database schema version %d is newer than this binary supports (%d); upgrade claudegate", current, latest)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := s.applyMigration(m); err != nil {
+			return fmt.Errorf("migration %d: %w", m.version, err)
+		}
+	}
+	return nil
+}
+
+// lockMigrations takes the session-level advisory lock migrationLockKey on a
+// dedicated connection and returns the function that releases it.
+func (s *sqlStore) lockMigrations(ctx context.Context) (func(), error) {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return func() {
+		if _, err := conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockKey); err != nil {
+			// Drop the session rather than pooling it, which releases the lock.
+			conn.Raw(func(any) error { return driver.ErrBadConn }) //nolint:errcheck
+		}
+		conn.Close()
+	}, nil
+}
+
+func (s *sqlStore) applyMigration(m migration) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+	if err := m.up(tx, s.db.dialect); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(s.db.dialect.rebind(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`), m.version, time.Now().UTC()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SchemaVersion returns the highest migration version applied to the database,
+// or 0 for a database that predates versioned migrations.
+func (s *sqlStore) SchemaVersion() (int, error) {
+	var v sql.NullInt64
+	if err := s.db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&v); err != nil {
+		return 0, fmt.Errorf("read schema version: %w", err)
+	}
+	return int(v.Int64), nil
+}
@@ -3,7 +3,14 @@ package job
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
 	"time"
+	"unicode"
 )
 
 type Status string
@@ -19,17 +26,124 @@ const (
 // ErrJobNotFound is returned by Store.Get when the requested job does not exist.
 var ErrJobNotFound = errors.New("job not found")
 
+// ErrJobNotQueued is returned by Store.MarkProcessing when the job left
+// "queued" in the meantime, e.g. because it was cancelled.
+var ErrJobNotQueued = errors.New("job is not queued")
+
+// IsValid reports whether s is one of the known job statuses.
+func (s Status) IsValid() bool {
+	switch s {
+	case StatusQueued, StatusProcessing, StatusCompleted, StatusFailed, StatusCancelled:
+		return true
+	}
+	return false
+}
+
 // IsTerminal returns true for statuses that represent a final state.
 func (s Status) IsTerminal() bool {
 	return s == StatusCompleted || s == StatusFailed || s == StatusCancelled
 }
 
+// Priority orders queued jobs: workers take every high job before any normal
+// one, and every normal job before any low one.
+type Priority string
+
+const (
+	PriorityHigh   Priority = "high"
+	PriorityNormal Priority = "normal"
+	PriorityLow    Priority = "low"
+)
+
+// Priorities lists the priorities in dequeue order.
+var Priorities = []Priority{PriorityHigh, PriorityNormal, PriorityLow}
+
+// IsValid reports whether p is one of the known priorities.
+func (p Priority) IsValid() bool {
+	return slices.Contains(Priorities, p)
+}
+
+// Rank returns p's position in Priorities. Unknown priorities, including
+// the empty one, rank as normal.
+func (p Priority) Rank() int {
+	if i := slices.Index(Priorities, p); i >= 0 {
+		return i
+	}
+	return slices.Index(Priorities, PriorityNormal)
+}
+
 var validModels = map[string]bool{
 	"haiku":  true,
 	"sonnet": true,
 	"opus":   true,
 }
 
+var validOutputFormats = map[string]bool{
+	"stream-json": true,
+	"json":        true,
+}
+
+// IsValidOutputFormat reports whether the given CLI output format is supported.
+func IsValidOutputFormat(format string) bool {
+	return validOutputFormats[format]
+}
+
+// jsonInstruction is appended to the system prompt of jobs that want JSON output.
+const jsonInstruction = "CRITICAL: Your response must be RAW JSON only. Do NOT wrap it in ```json code fences. Do NOT add any text before or after the JSON. Do NOT use markdown formatting. Start directly with { or [ and end with } or ]. The raw output must be directly parseable by JSON.parse(). Be concise and fast."
+
+// responseFormats maps each accepted response_format to the instruction
+// appended to the system prompt. Deployments add entries with
+// RegisterResponseFormat at startup; it is read-only afterwards.
+var responseFormats = map[string]string{
+	"text": "",
+	"json": jsonInstruction,
+}
+
+// RegisterResponseFormat accepts name as a response_format whose jobs get
+// instruction appended to their system prompt. The built-in text and json
+// formats cannot be replaced. Not safe for use once requests are being served.
+func RegisterResponseFormat(name, instruction string) error {
+	if name == "" {
+		return errors.New("response format name must not be empty")
+	}
+	if name == "text" || name == "json" {
+		return fmt.Errorf("response format %q is built in", name)
+	}
+	responseFormats[name] = instruction
+	return nil
+}
+
+// IsValidResponseFormat reports whether name is a built-in or registered response_format.
+func IsValidResponseFormat(name string) bool {
+	_, ok := responseFormats[name]
+	return ok
+}
+
+// ResponseFormatInstruction returns the system-prompt instruction for a
+// response_format, or "" when it has none.
+func ResponseFormatInstruction(name string) string {
+	return responseFormats[name]
+}
+
+// CheckControlChars rejects control characters in the prompt and system
+// prompt other than tab, line feed and carriage return. NUL and friends break
+// the CLI invocation and corrupt stored text. It is not part of Validate
+// because CLAUDEGATE_ALLOW_CONTROL_CHARS can turn it off.
+func (r *CreateRequest) CheckControlChars() error {
+	if err := checkControlChars("prompt", r.Prompt); err != nil {
+		return err
+	}
+	return checkControlChars("system_prompt", r.SystemPrompt)
+}
+
+func checkControlChars(field, s string) error {
+	for i, r := range s {
+		if unicode.IsControl(r) && r != '\t' && r != '\n' && r != '\r' {
+			return fmt.Errorf("%s contains control character %U at byte %d", field, r, i)
+		}
+	}
+	return nil
+}
+
 // IsValidModel reports whether the given model name is recognised.
 func IsValidModel(model string) bool {
 	return validModels[model]
@@ -40,8 +154,11 @@ type Job struct {
 	Prompt         string          `json:"prompt"`
 	SystemPrompt   string          `json:"system_prompt,omitempty"`
 	Model          string          `json:"model"`
+	ResolvedModel  string          `json:"resolved_model,omitempty"` // model reported by the CLI, may differ on fallback
+	ActualModel    string          `json:"actual_model,omitempty"`   // ResolvedModel under its earlier name, kept for existing clients
 	Status         Status          `json:"status"`
 	Result         string          `json:"result,omitempty"`
+	PartialResult  string          `json:"partial_result,omitempty"` // text streamed so far, only while processing
 	Error          string          `json:"error,omitempty"`
 	CallbackURL    string          `json:"callback_url,omitempty"`
 	Metadata       json.RawMessage `json:"metadata,omitempty"`
@@ -49,6 +166,75 @@ type Job struct {
 	CreatedAt      time.Time       `json:"created_at"`
 	StartedAt      *time.Time      `json:"started_at,omitempty"`
 	CompletedAt    *time.Time      `json:"completed_at,omitempty"`
+	RerunOf        string          `json:"rerun_of,omitempty"`
+	ParentJobID    string          `json:"parent_job_id,omitempty"` // job whose conversation this one continues
+	SessionID      string          `json:"session_id,omitempty"`    // CLI session, resumable by follow-up jobs
+	OutputFormat   string          `json:"output_format,omitempty"`
+	Note           string          `json:"note,omitempty"`
+	CreatedBy      string          `json:"created_by,omitempty"` // client certificate CN for mTLS callers
+	RequestID      string          `json:"request_id,omitempty"` // X-Request-ID of the creating request
+	MaxRetries     int             `json:"max_retries,omitempty"`
+	TimeoutSeconds int             `json:"timeout_seconds,omitempty"` // overrides CLAUDEGATE_JOB_TIMEOUT_MINUTES when > 0
+	Priority       Priority        `json:"priority"`
+	Attempts       int             `json:"attempts,omitempty"` // CLI runs started so far, including retries
+	TimedOut       bool            `json:"timed_out,omitempty"`
+	// InputTokens and OutputTokens are summed over every attempt; StopReason
+	// is the one the CLI reported for the last attempt.
+	InputTokens  int    `json:"input_tokens,omitempty"`
+	OutputTokens int    `json:"output_tokens,omitempty"`
+	StopReason   string `json:"stop_reason,omitempty"`
+	// CostUSD estimates the price of those tokens from CLAUDEGATE_PRICE_*.
+	// It is nil when the model has no configured price.
+	CostUSD *float64 `json:"cost_usd,omitempty"`
+	// ResponseFormats and Results are set for jobs that asked for several
+	// representations of one run; Results maps each format to its variant.
+	ResponseFormats []string          `json:"response_formats,omitempty"`
+	Results         map[string]string `json:"results,omitempty"`
+	// EffectiveSystemPrompt is the assembled prompt sent to the CLI. Only stored
+	// with CLAUDEGATE_STORE_EFFECTIVE_SYSTEM_PROMPT and only shown to admin keys.
+	EffectiveSystemPrompt string `json:"effective_system_prompt,omitempty"`
+	// CallbackURLs are webhook receivers notified in addition to CallbackURL.
+	CallbackURLs []string `json:"callback_urls,omitempty"`
+	// CallbackHeaders are sent with the webhook. They often carry credentials,
+	// so they are never included in API responses.
+	CallbackHeaders map[string]string `json:"-"`
+	// IdempotencyKey is the Idempotency-Key header the job was created with.
+	// RequestHash fingerprints the request body so that reusing the key for
+	// a different request can be detected.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	RequestHash    string `json:"-"`
+	// AllowedTools are passed to the CLI as --allowedTools.
+	AllowedTools []string `json:"allowed_tools,omitempty"`
+	// ResponseSchema is the JSON Schema the result was validated against.
+	ResponseSchema json.RawMessage `json:"response_schema,omitempty"`
+	// Events are the statuses that trigger a webhook; empty means the
+	// terminal ones.
+	Events []string `json:"events,omitempty"`
+	// WebhookStatus is the delivery outcome of the terminal webhook:
+	// "pending", "delivered" or "failed" (any callback URL failed).
+	// WebhookAttemptedAt is when it last changed.
+	WebhookStatus      string     `json:"webhook_status,omitempty"`
+	WebhookAttemptedAt *time.Time `json:"webhook_attempted_at,omitempty"`
+}
+
+// webhookEvents are the statuses CreateRequest.Events may list.
+var webhookEvents = []Status{StatusProcessing, StatusCompleted, StatusFailed, StatusCancelled}
+
+// WantsEvent reports whether the job's webhook fires when it enters status.
+func (j *Job) WantsEvent(status Status) bool {
+	if len(j.Events) == 0 {
+		return status.IsTerminal()
+	}
+	return slices.Contains(j.Events, string(status))
+}
+
+// Callbacks returns every webhook URL of the job: CallbackURL first, then
+// CallbackURLs.
+func (j *Job) Callbacks() []string {
+	if j.CallbackURL == "" {
+		return j.CallbackURLs
+	}
+	return append([]string{j.CallbackURL}, j.CallbackURLs...)
 }
 
 // CreateRequest is the payload used to submit a new job.
@@ -59,6 +245,113 @@ type CreateRequest struct {
 	CallbackURL    string          `json:"callback_url,omitempty"`
 	Metadata       json.RawMessage `json:"metadata,omitempty"`
 	ResponseFormat string          `json:"response_format,omitempty"`
+	OutputFormat   string          `json:"output_format,omitempty"`
+	// ResponseFormats requests several representations of the result from a
+	// single run, e.g. ["text","json"]. Mutually exclusive with ResponseFormat.
+	ResponseFormats []string `json:"response_formats,omitempty"`
+	// MaxRetries is how many times a failed CLI run is retried before the job fails.
+	MaxRetries int `json:"max_retries,omitempty"`
+	// TimeoutSeconds replaces CLAUDEGATE_JOB_TIMEOUT_MINUTES for this job.
+	// Zero keeps the server default; the upper bound is
+	// CLAUDEGATE_MAX_JOB_TIMEOUT_SECONDS.
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
+	// Priority is "high", "normal" or "low". Empty means normal.
+	Priority Priority `json:"priority,omitempty"`
+	// CallbackURLs fans the webhook out to several receivers, in addition to
+	// CallbackURL. The total count is capped by CLAUDEGATE_MAX_CALLBACK_URLS.
+	CallbackURLs []string `json:"callback_urls,omitempty"`
+	// CallbackHeaders are extra headers sent with the webhook, e.g. an
+	// Authorization token for a proxy in front of the receiver.
+	CallbackHeaders map[string]string `json:"callback_headers,omitempty"`
+	// ParentJobID continues the conversation of a completed job: the CLI
+	// resumes the parent's session, so the prompt is a follow-up turn.
+	ParentJobID string `json:"parent_job_id,omitempty"`
+	// AllowedTools lets the CLI use these tools without asking, e.g. "Read"
+	// or "mcp__github__get_issue". Every entry must also be listed in
+	// CLAUDEGATE_ALLOWED_TOOLS.
+	AllowedTools []string `json:"allowed_tools,omitempty"`
+	// ResponseSchema is a JSON Schema the JSON result must match, or the job
+	// fails with the violation. It implies response_format "json".
+	ResponseSchema json.RawMessage `json:"response_schema,omitempty"`
+	// Events selects the status transitions that fire the webhook, among
+	// "processing", "completed", "failed" and "cancelled". Empty means the
+	// three terminal ones.
+	Events []string `json:"events,omitempty"`
+}
+
+// Callbacks returns every webhook URL of the request: CallbackURL first,
+// then CallbackURLs.
+func (r *CreateRequest) Callbacks() []string {
+	if r.CallbackURL == "" {
+		return r.CallbackURLs
+	}
+	return append([]string{r.CallbackURL}, r.CallbackURLs...)
+}
+
+// MaxCallbackURLLength caps the length of each webhook URL.
+const MaxCallbackURLLength = 2048
+
+// Limits on CreateRequest.CallbackHeaders.
+const (
+	maxCallbackHeaders     = 10
+	maxCallbackHeaderBytes = 4096 // names plus values, all headers together
+)
+
+// reservedCallbackHeaders are set by claudegate itself and cannot be overridden.
+var reservedCallbackHeaders = []string{
+	"Content-Type", "Content-Length", "Content-Encoding", "Transfer-Encoding",
+	"Host", "Connection", "User-Agent",
+}
+
+// Limits on CreateRequest.AllowedTools.
+const (
+	maxAllowedTools      = 32
+	maxAllowedToolLength = 256
+)
+
+// MaxRetriesLimit caps CreateRequest.MaxRetries.
+const MaxRetriesLimit = 5
+
+// maxNoteLength caps operator notes attached to a job.
+const maxNoteLength = 4096
+
+// NoteRequest is the payload used to set an operator note on a job.
+type NoteRequest struct {
+	Note string `json:"note"`
+}
+
+func (r *NoteRequest) Validate() error {
+	if len(r.Note) > maxNoteLength {
+		return fmt.Errorf("note must be at most %d bytes", maxNoteLength)
+	}
+	return nil
+}
+
+// maxRetryIDs caps the jobs one bulk retry request may name.
+const maxRetryIDs = 100
+
+// RetryRequest is the payload used to requeue several failed or cancelled jobs.
+type RetryRequest struct {
+	IDs []string `json:"ids"`
+}
+
+func (r *RetryRequest) Validate() error {
+	if len(r.IDs) == 0 || len(r.IDs) > maxRetryIDs {
+		return fmt.Errorf("ids must contain between 1 and %d job IDs", maxRetryIDs)
+	}
+	return nil
+}
+
+// RerunRequest is the payload used to re-run an existing job on another model.
+type RerunRequest struct {
+	Model string `json:"model,omitempty"`
+}
+
+func (r *RerunRequest) Validate() error {
+	if r.Model != "" && !validModels[r.Model] {
+		return errors.New("model must be one of: haiku, sonnet, opus")
+	}
+	return nil
 }
 
 func (r *CreateRequest) Validate() error {
@@ -68,8 +361,157 @@ func (r *CreateRequest) Validate() error {
 	if r.Model != "" && !validModels[r.Model] {
 		return errors.New("model must be one of: haiku, sonnet, opus")
 	}
-	if r.ResponseFormat != "" && r.ResponseFormat != "text" && r.ResponseFormat != "json" {
-		return errors.New("response_format must be 'text' or 'json'")
+	if r.ResponseFormat != "" && !IsValidResponseFormat(r.ResponseFormat) {
+		return fmt.Errorf("response_format must be one of: %s", strings.Join(slices.Sorted(maps.Keys(responseFormats)), ", "))
+	}
+	if r.OutputFormat != "" && !validOutputFormats[r.OutputFormat] {
+		return errors.New("output_format must be 'stream-json' or 'json'")
+	}
+	if r.MaxRetries < 0 || r.MaxRetries > MaxRetriesLimit {
+		return fmt.Errorf("max_retries must be between 0 and %d", MaxRetriesLimit)
+	}
+	if r.TimeoutSeconds < 0 {
+		return errors.New("timeout_seconds must be >= 0")
+	}
+	if r.Priority != "" && !r.Priority.IsValid() {
+		return errors.New("priority must be one of: high, normal, low")
+	}
+	if err := validateCallbackURLs(r.Callbacks()); err != nil {
+		return err
+	}
+	if len(r.CallbackHeaders) > 0 && len(r.Callbacks()) == 0 {
+		return errors.New("callback_headers requires callback_url or callback_urls")
+	}
+	if err := validateCallbackHeaders(r.CallbackHeaders); err != nil {
+		return err
+	}
+	if len(r.Events) > 0 && len(r.Callbacks()) == 0 {
+		return errors.New("events requires callback_url or callback_urls")
+	}
+	for _, e := range r.Events {
+		if !slices.Contains(webhookEvents, Status(e)) {
+			return errors.New("events entries must be one of: processing, completed, failed, cancelled")
+		}
+	}
+	if err := validateAllowedTools(r.AllowedTools); err != nil {
+		return err
+	}
+	if len(r.ResponseSchema) > 0 {
+		if len(r.ResponseSchema) > maxResponseSchemaBytes {
+			return fmt.Errorf("response_schema must be at most %d bytes", maxResponseSchemaBytes)
+		}
+		if (r.ResponseFormat != "" && r.ResponseFormat != "json") || len(r.ResponseFormats) > 0 {
+			return errors.New("response_schema requires response_format 'json'")
+		}
+		if _, err := compileResponseSchema(r.ResponseSchema); err != nil {
+			return fmt.Errorf("invalid response_schema: %w", err)
+		}
+	}
+	if len(r.ResponseFormats) > 0 {
+		if r.ResponseFormat != "" {
+			return errors.New("set either response_format or response_formats, not both")
+		}
+		seen := make(map[string]bool)
+		for _, f := range r.ResponseFormats {
+			if f != "text" && f != "json" {
+				return errors.New("response_formats entries must be 'text' or 'json'")
+			}
+			if seen[f] {
+				return fmt.Errorf("response_formats contains %q twice", f)
+			}
+			seen[f] = true
+		}
+	}
+	return nil
+}
+
+// validateCallbackURLs checks that every webhook URL is a bounded absolute
+// http(s) URL and that none is repeated. Private and internal hosts are
+// rejected by the handler (webhook.CheckURL) and again when the webhook is sent.
+func validateCallbackURLs(urls []string) error {
+	seen := make(map[string]bool, len(urls))
+	for _, raw := range urls {
+		if len(raw) > MaxCallbackURLLength {
+			return fmt.Errorf("callback URLs must be at most %d bytes", MaxCallbackURLLength)
+		}
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid callback URL %q: must be an absolute http or https URL", raw)
+		}
+		if seen[raw] {
+			return fmt.Errorf("callback URL %q is listed twice", raw)
+		}
+		seen[raw] = true
+	}
+	return nil
+}
+
+// validateAllowedTools checks that each tool name is bounded, not repeated
+// and safe to pass as a single CLI argument: it can't look like a flag or
+// contain the comma that separates the --allowedTools list.
+func validateAllowedTools(tools []string) error {
+	if len(tools) > maxAllowedTools {
+		return fmt.Errorf("allowed_tools must have at most %d entries", maxAllowedTools)
+	}
+	seen := make(map[string]bool, len(tools))
+	for _, t := range tools {
+		if t == "" || len(t) > maxAllowedToolLength {
+			return fmt.Errorf("allowed_tools entries must be 1 to %d bytes", maxAllowedToolLength)
+		}
+		if strings.HasPrefix(t, "-") || strings.ContainsRune(t, ',') || strings.IndexFunc(t, unicode.IsControl) >= 0 {
+			return fmt.Errorf("allowed_tools: invalid tool name %q", t)
+		}
+		if seen[t] {
+			return fmt.Errorf("allowed_tools contains %q twice", t)
+		}
+		seen[t] = true
+	}
+	return nil
+}
+
+// validateCallbackHeaders enforces the count and size limits, well-formed
+// names and values, and the reserved header names.
+func validateCallbackHeaders(headers map[string]string) error {
+	if len(headers) > maxCallbackHeaders {
+		return fmt.Errorf("callback_headers must have at most %d entries", maxCallbackHeaders)
+	}
+	size := 0
+	for name, value := range headers {
+		if !isHeaderToken(name) {
+			return fmt.Errorf("callback_headers: invalid header name %q", name)
+		}
+		if strings.ContainsAny(value, "\r\n\x00") {
+			return fmt.Errorf("callback_headers: value of %s contains a control character", name)
+		}
+		canonical := http.CanonicalHeaderKey(name)
+		if slices.Contains(reservedCallbackHeaders, canonical) || strings.HasPrefix(canonical, "X-Claudegate-") {
+			return fmt.Errorf("callback_headers: %s cannot be overridden", canonical)
+		}
+		size += len(name) + len(value)
+	}
+	if size > maxCallbackHeaderBytes {
+		return fmt.Errorf("callback_headers must total at most %d bytes", maxCallbackHeaderBytes)
 	}
 	return nil
 }
+
+// isHeaderToken reports whether name is a valid HTTP header field name (RFC 9110 token).
+func isHeaderToken(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range []byte(name) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// WantsJSON reports whether the job asked for JSON output, alone or among several formats.
+func (j *Job) WantsJSON() bool {
+	return j.ResponseFormat == "json" || slices.Contains(j.ResponseFormats, "json")
+}
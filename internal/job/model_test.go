@@ -1,6 +1,10 @@
 package job
 
-import "testing"
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
 
 func TestIsTerminal(t *testing.T) {
 	t.Parallel()
@@ -45,6 +49,64 @@ func TestValidate_InvalidResponseFormat(t *testing.T) {
 	}
 }
 
+func TestCheckControlChars(t *testing.T) {
+	t.Parallel()
+	if err := (&CreateRequest{Prompt: "line one\n\tline two\r\n"}).CheckControlChars(); err != nil {
+		t.Errorf("tab, CR and LF: unexpected error: %v", err)
+	}
+	for _, r := range []*CreateRequest{
+		{Prompt: "nul\x00byte"},
+		{Prompt: "escape \x1b[31m"},
+		{Prompt: "ok", SystemPrompt: "bell\a"},
+	} {
+		if err := r.CheckControlChars(); err == nil {
+			t.Errorf("CheckControlChars(%q, %q): expected error, got nil", r.Prompt, r.SystemPrompt)
+		}
+	}
+}
+
+// Not parallel: it registers a format in the package-level registry.
+func TestRegisterResponseFormat(t *testing.T) {
+	if err := RegisterResponseFormat("csv", "Respond with CSV only."); err != nil {
+		t.Fatalf("RegisterResponseFormat: %v", err)
+	}
+	r := &CreateRequest{Prompt: "hello", ResponseFormat: "csv"}
+	if err := r.Validate(); err != nil {
+		t.Errorf("registered response_format: unexpected error: %v", err)
+	}
+	if got := ResponseFormatInstruction("csv"); got != "Respond with CSV only." {
+		t.Errorf("instruction = %q, want %q", got, "Respond with CSV only.")
+	}
+	if err := RegisterResponseFormat("json", "anything"); err == nil {
+		t.Error("expected error when redefining json, got nil")
+	}
+}
+
+func TestValidate_InvalidOutputFormat(t *testing.T) {
+	t.Parallel()
+	r := &CreateRequest{Prompt: "hello", OutputFormat: "text"}
+	if err := r.Validate(); err == nil {
+		t.Error("expected error for invalid output_format, got nil")
+	}
+}
+
+func TestValidate_ResponseFormats(t *testing.T) {
+	t.Parallel()
+	valid := &CreateRequest{Prompt: "hello", ResponseFormats: []string{"text", "json"}}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("valid response_formats: unexpected error: %v", err)
+	}
+	for _, r := range []*CreateRequest{
+		{Prompt: "hello", ResponseFormats: []string{"xml"}},
+		{Prompt: "hello", ResponseFormats: []string{"json", "json"}},
+		{Prompt: "hello", ResponseFormat: "json", ResponseFormats: []string{"text"}},
+	} {
+		if err := r.Validate(); err == nil {
+			t.Errorf("response_formats %v / response_format %q: expected error, got nil", r.ResponseFormats, r.ResponseFormat)
+		}
+	}
+}
+
 func TestValidate_Valid(t *testing.T) {
 	t.Parallel()
 	tests := []struct {
@@ -55,6 +117,7 @@ func TestValidate_Valid(t *testing.T) {
 		{"with model", CreateRequest{Prompt: "hello", Model: "sonnet"}},
 		{"json format", CreateRequest{Prompt: "hello", ResponseFormat: "json"}},
 		{"text format", CreateRequest{Prompt: "hello", ResponseFormat: "text"}},
+		{"json output format", CreateRequest{Prompt: "hello", OutputFormat: "json"}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -66,3 +129,120 @@ func TestValidate_Valid(t *testing.T) {
 		})
 	}
 }
+
+func TestValidate_MaxRetries(t *testing.T) {
+	t.Parallel()
+	for _, n := range []int{-1, MaxRetriesLimit + 1} {
+		r := &CreateRequest{Prompt: "hello", MaxRetries: n}
+		if err := r.Validate(); err == nil {
+			t.Errorf("max_retries %d: expected error, got nil", n)
+		}
+	}
+	r := &CreateRequest{Prompt: "hello", MaxRetries: MaxRetriesLimit}
+	if err := r.Validate(); err != nil {
+		t.Errorf("max_retries %d: unexpected error: %v", MaxRetriesLimit, err)
+	}
+}
+
+func TestValidate_Priority(t *testing.T) {
+	t.Parallel()
+	for _, p := range []Priority{"", PriorityHigh, PriorityNormal, PriorityLow} {
+		r := &CreateRequest{Prompt: "hello", Priority: p}
+		if err := r.Validate(); err != nil {
+			t.Errorf("priority %q: unexpected error: %v", p, err)
+		}
+	}
+	r := &CreateRequest{Prompt: "hello", Priority: "urgent"}
+	if err := r.Validate(); err == nil {
+		t.Error("priority urgent: expected error, got nil")
+	}
+}
+
+func TestValidate_Events(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		req     CreateRequest
+		wantErr bool
+	}{
+		{"valid", CreateRequest{Prompt: "p", CallbackURL: "https://example.com/hook", Events: []string{"processing", "completed"}}, false},
+		{"unknown event", CreateRequest{Prompt: "p", CallbackURL: "https://example.com/hook", Events: []string{"queued"}}, true},
+		{"no callback", CreateRequest{Prompt: "p", Events: []string{"processing"}}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.req.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: Validate() = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestWantsEvent(t *testing.T) {
+	t.Parallel()
+	def := &Job{}
+	if def.WantsEvent(StatusProcessing) || !def.WantsEvent(StatusCompleted) || !def.WantsEvent(StatusFailed) {
+		t.Error("default events: want terminal statuses only")
+	}
+	j := &Job{Events: []string{"processing", "completed"}}
+	if !j.WantsEvent(StatusProcessing) || !j.WantsEvent(StatusCompleted) || j.WantsEvent(StatusFailed) {
+		t.Errorf("events %v: want processing and completed only", j.Events)
+	}
+}
+
+func TestValidate_CallbackHeaders(t *testing.T) {
+	t.Parallel()
+	many := map[string]string{}
+	for i := range maxCallbackHeaders + 1 {
+		many["X-H"+strconv.Itoa(i)] = "v"
+	}
+	tests := []struct {
+		name    string
+		headers map[string]string
+		wantErr bool
+	}{
+		{"valid", map[string]string{"Authorization": "Bearer t", "X-Tenant": "a"}, false},
+		{"content type", map[string]string{"Content-Type": "text/plain"}, true},
+		{"signature header", map[string]string{"X-Claudegate-Signature": "x"}, true},
+		{"invalid name", map[string]string{"Bad Name": "v"}, true},
+		{"crlf value", map[string]string{"X-A": "v\r\nX-B: w"}, true},
+		{"too many", many, true},
+		{"too large", map[string]string{"X-A": strings.Repeat("a", maxCallbackHeaderBytes)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &CreateRequest{Prompt: "hello", CallbackURL: "https://example.com/hook", CallbackHeaders: tt.headers}
+			if err := r.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	r := &CreateRequest{Prompt: "hello", CallbackHeaders: map[string]string{"X-A": "v"}}
+	if err := r.Validate(); err == nil {
+		t.Error("headers without callback_url: expected error, got nil")
+	}
+}
+
+func TestValidate_CallbackURLs(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		req     CreateRequest
+		wantErr bool
+	}{
+		{"single", CreateRequest{CallbackURL: "https://a.example.com/hook"}, false},
+		{"list", CreateRequest{CallbackURLs: []string{"https://a.example.com/hook", "http://b.example.com/hook"}}, false},
+		{"too long", CreateRequest{CallbackURL: "https://a.example.com/" + strings.Repeat("a", MaxCallbackURLLength)}, true},
+		{"bad scheme", CreateRequest{CallbackURLs: []string{"ftp://a.example.com/hook"}}, true},
+		{"relative", CreateRequest{CallbackURLs: []string{"/hook"}}, true},
+		{"duplicate", CreateRequest{CallbackURL: "https://a.example.com/hook", CallbackURLs: []string{"https://a.example.com/hook"}}, true},
+		{"headers with list only", CreateRequest{CallbackURLs: []string{"https://a.example.com/hook"}, CallbackHeaders: map[string]string{"X-A": "v"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.req.Prompt = "hello"
+			if err := tt.req.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package job
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// postgresDriver is the database/sql driver name PostgresStore opens. The
+// driver is only linked into binaries built with -tags postgres.
+const postgresDriver = "pgx"
+
+// ErrPostgresUnavailable is returned by NewPostgresStore when the binary was
+// built without the PostgreSQL driver.
+var ErrPostgresUnavailable = errors.New("postgres driver not compiled in; rebuild with -tags postgres")
+
+// PostgresStore is a PostgreSQL-backed implementation of Store. It runs the
+// same queries and migrations as SQLiteStore, so several claudegate
+// instances can share one database.
+type PostgresStore struct {
+	sqlStore
+}
+
+// NewPostgresStore connects to the PostgreSQL database described by dsn
+// (a URL or key=value connection string) and runs migrations.
+func NewPostgresStore(dsn string) (*PostgresStore, error) {
+	if !slices.Contains(sql.Drivers(), postgresDriver) {
+		return nil, ErrPostgresUnavailable
+	}
+
+	db, err := sql.Open(postgresDriver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open postgres db: %w", err)
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("ping postgres db: %w", err)
+	}
+
+	s := &PostgresStore{sqlStore{db: dbConn{DB: db, dialect: dialectPostgres}}}
+	if err = s.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrate: %w", err)
+	}
+	if err = s.checkWritable(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("database is not writable: %w", err)
+	}
+	return s, nil
+}
+
+// NewPostgresReadStore connects to a PostgreSQL read replica, e.g. a streaming
+// hot standby of the primary named by CLAUDEGATE_DB_DSN. No migration or write
+// check is performed; the schema is owned by the primary.
+func NewPostgresReadStore(dsn string) (*PostgresStore, error) {
+	if !slices.Contains(sql.Drivers(), postgresDriver) {
+		return nil, ErrPostgresUnavailable
+	}
+
+	db, err := sql.Open(postgresDriver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open postgres read db: %w", err)
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("ping postgres read db: %w", err)
+	}
+	return &PostgresStore{sqlStore{db: dbConn{DB: db, dialect: dialectPostgres}}}, nil
+}
@@ -0,0 +1,203 @@
+//go:build postgres
+
+package job
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// postgresTestDSN returns a DSN for a fresh schema on the server named by
+// CLAUDEGATE_TEST_POSTGRES_DSN (a postgres:// URL), skipping the test when
+// it is unset. The schema is dropped when the test ends.
+func postgresTestDSN(t *testing.T) string {
+	t.Helper()
+	dsn := os.Getenv("CLAUDEGATE_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("CLAUDEGATE_TEST_POSTGRES_DSN not set")
+	}
+	u, err := url.Parse(dsn)
+	if err != nil || (u.Scheme != "postgres" && u.Scheme != "postgresql") {
+		t.Fatalf("CLAUDEGATE_TEST_POSTGRES_DSN must be a postgres:// URL, got %q", dsn)
+	}
+
+	suffix := make([]byte, 6)
+	rand.Read(suffix) //nolint:errcheck
+	schema := "claudegate_test_" + hex.EncodeToString(suffix)
+
+	admin, err := sql.Open(postgresDriver, dsn)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if _, err := admin.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		admin.Close()
+		t.Fatalf("create schema: %v", err)
+	}
+	t.Cleanup(func() {
+		admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`) //nolint:errcheck
+		admin.Close()
+	})
+
+	q := u.Query()
+	q.Set("search_path", schema)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func newPostgresTestStore(t *testing.T, dsn string) *PostgresStore {
+	t.Helper()
+	s, err := NewPostgresStore(dsn)
+	if err != nil {
+		t.Fatalf("NewPostgresStore: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestPostgres_ConcurrentMigrations(t *testing.T) {
+	dsn := postgresTestDSN(t)
+
+	// Replicas starting together must all come up: the advisory lock makes
+	// them apply each step once.
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for range 4 {
+		wg.Go(func() {
+			s, err := NewPostgresStore(dsn)
+			if err != nil {
+				errs <- err
+				return
+			}
+			s.Close()
+		})
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("NewPostgresStore: %v", err)
+	}
+
+	s := newPostgresTestStore(t, dsn)
+	latest := migrations[len(migrations)-1].version
+	if v, err := s.SchemaVersion(); err != nil || v != latest {
+		t.Errorf("SchemaVersion = %d, %v; want %d", v, err, latest)
+	}
+
+	// A database whose columns exist but whose history is missing steps
+	// replays them through ADD COLUMN IF NOT EXISTS.
+	if _, err := s.db.Exec(`DELETE FROM schema_migrations WHERE version > 1`); err != nil {
+		t.Fatalf("trim schema_migrations: %v", err)
+	}
+	again := newPostgresTestStore(t, dsn)
+	if v, err := again.SchemaVersion(); err != nil || v != latest {
+		t.Errorf("SchemaVersion after replay = %d, %v; want %d", v, err, latest)
+	}
+}
+
+func TestPostgres_StoreRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	s := newPostgresTestStore(t, postgresTestDSN(t))
+	s.SetOwner("replica-a")
+
+	j := makeJob("pg-1", "Hello", "haiku")
+	j.Metadata = json.RawMessage(`{"batch":"7"}`)
+	j.AllowedTools = []string{"Read"}
+	if err := s.Create(ctx, j); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := s.Create(ctx, makeJob("pg-2", "World", "sonnet")); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	got, err := s.Get(ctx, "pg-1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.Prompt != "Hello" || got.Status != StatusQueued || !slices.Equal(got.AllowedTools, []string{"Read"}) {
+		t.Errorf("Get = %+v, want the created job", got)
+	}
+	if _, err := s.Get(ctx, "missing"); err != ErrJobNotFound {
+		t.Errorf("Get missing: err = %v, want ErrJobNotFound", err)
+	}
+
+	if err := s.MarkProcessing(ctx, "pg-1"); err != nil {
+		t.Fatalf("MarkProcessing: %v", err)
+	}
+	if err := s.Heartbeat(ctx); err != nil {
+		t.Fatalf("Heartbeat: %v", err)
+	}
+	if ids, err := s.ReclaimExpired(ctx, time.Now().Add(time.Second)); err != nil || len(ids) != 0 {
+		t.Errorf("ReclaimExpired of own job = %v, %v; want none", ids, err)
+	}
+	ids, err := s.ResetProcessing(ctx, time.Now().Add(-time.Minute))
+	if err != nil || !slices.Equal(ids, []string{"pg-1"}) {
+		t.Errorf("ResetProcessing = %v, %v; want [pg-1]", ids, err)
+	}
+
+	at := time.Now().UTC().Truncate(time.Second)
+	if err := s.UpdateStatus(ctx, "pg-1", StatusCompleted, "done", ""); err != nil {
+		t.Fatalf("UpdateStatus: %v", err)
+	}
+	if err := s.SetWebhookStatus(ctx, "pg-1", "delivered", at); err != nil {
+		t.Fatalf("SetWebhookStatus: %v", err)
+	}
+	got, err = s.Get(ctx, "pg-1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.Result != "done" || got.CompletedAt == nil || got.WebhookAttemptedAt == nil || !got.WebhookAttemptedAt.Equal(at) {
+		t.Errorf("finished job = %+v, want result, completed_at and webhook time set", got)
+	}
+
+	jobs, total, err := s.List(ctx, 10, 0, StatusQueued)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if total != 1 || len(jobs) != 1 || jobs[0].ID != "pg-2" {
+		t.Errorf("List queued = %d jobs (total %d), want only pg-2", len(jobs), total)
+	}
+
+	cancelled, err := s.CancelByMetadata(ctx, map[string]string{"batch": "7"}, "stop")
+	if err != nil {
+		t.Fatalf("CancelByMetadata: %v", err)
+	}
+	if len(cancelled) != 0 {
+		t.Errorf("CancelByMetadata = %v, want none (pg-1 already finished)", cancelled)
+	}
+}
+
+func TestPostgres_ReplicaStore(t *testing.T) {
+	ctx := context.Background()
+	dsn := postgresTestDSN(t)
+	primary := newPostgresTestStore(t, dsn)
+
+	// The test server has no standby; a second connection to the same schema
+	// stands in for the replica.
+	replica, err := NewPostgresReadStore(dsn)
+	if err != nil {
+		t.Fatalf("NewPostgresReadStore: %v", err)
+	}
+	t.Cleanup(func() { replica.Close() })
+
+	store := NewReplicaStore(primary, replica)
+	if err := store.Create(ctx, makeJob("pg-r", "Hello", "haiku")); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if got, err := store.Get(ctx, "pg-r"); err != nil || got.Prompt != "Hello" {
+		t.Errorf("Get via replica = %+v, %v", got, err)
+	}
+	if _, total, err := store.List(ctx, 10, 0, ""); err != nil || total != 1 {
+		t.Errorf("List via replica total = %d, %v; want 1", total, err)
+	}
+}
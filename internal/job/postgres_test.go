@@ -0,0 +1,35 @@
+package job
+
+import (
+	"database/sql"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestRebind(t *testing.T) {
+	t.Parallel()
+	query := `UPDATE jobs SET status = ? WHERE id IN (?, ?)`
+	if got := dialectSQLite.rebind(query); got != query {
+		t.Errorf("sqlite rebind = %q, want unchanged", got)
+	}
+	want := `UPDATE jobs SET status = $1 WHERE id IN ($2, $3)`
+	if got := dialectPostgres.rebind(query); got != want {
+		t.Errorf("postgres rebind = %q, want %q", got, want)
+	}
+}
+
+func TestNewPostgresStore_DriverMissing(t *testing.T) {
+	t.Parallel()
+	if slices.Contains(sql.Drivers(), postgresDriver) {
+		t.Skip("postgres driver compiled in")
+	}
+	_, err := NewPostgresStore("postgres://localhost/claudegate")
+	if !errors.Is(err, ErrPostgresUnavailable) {
+		t.Fatalf("err = %v, want ErrPostgresUnavailable", err)
+	}
+	_, err = NewPostgresReadStore("postgres://localhost/claudegate")
+	if !errors.Is(err, ErrPostgresUnavailable) {
+		t.Fatalf("read store err = %v, want ErrPostgresUnavailable", err)
+	}
+}
@@ -0,0 +1,48 @@
+package job
+
+import (
+	"context"
+	"time"
+)
+
+// ReplicaStore routes read-only queries used by the HTTP API (Get, List,
+// ListAfter, QueuePosition, Facets, QueueWaitStats) to a read replica and every other call to the
+// primary.
+//
+// Replica reads may lag behind the primary: a job created or updated a moment
+// ago can be missing or stale on the replica. Callers that need read-your-writes
+// (the queue workers, and API handlers that read a job before changing it) must
+// use the primary store directly.
+type ReplicaStore struct {
+	Store   // primary, receives all writes
+	replica Store
+}
+
+// NewReplicaStore returns a Store that reads from replica and writes to primary.
+func NewReplicaStore(primary, replica Store) *ReplicaStore {
+	return &ReplicaStore{Store: primary, replica: replica}
+}
+
+func (s *ReplicaStore) Get(ctx context.Context, id string) (*Job, error) {
+	return s.replica.Get(ctx, id)
+}
+
+func (s *ReplicaStore) List(ctx context.Context, limit, offset int, status Status) ([]*Job, int, error) {
+	return s.replica.List(ctx, limit, offset, status)
+}
+
+func (s *ReplicaStore) ListAfter(ctx context.Context, after Cursor, limit int, status Status) ([]*Job, error) {
+	return s.replica.ListAfter(ctx, after, limit, status)
+}
+
+func (s *ReplicaStore) QueuePosition(ctx context.Context, id string) (int, error) {
+	return s.replica.QueuePosition(ctx, id)
+}
+
+func (s *ReplicaStore) Facets(ctx context.Context) (*Facets, error) {
+	return s.replica.Facets(ctx)
+}
+
+func (s *ReplicaStore) QueueWaitStats(ctx context.Context, since time.Time) ([]WaitStats, error) {
+	return s.replica.QueueWaitStats(ctx, since)
+}
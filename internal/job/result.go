@@ -0,0 +1,126 @@
+package job
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ResultProcessor transforms a completed job's result before it is stored.
+// Returning an error fails the job with that error.
+type ResultProcessor interface {
+	Name() string
+	Process(j *Job, result string) (string, error)
+}
+
+// resultProcessors lists the processors selectable via CLAUDEGATE_RESULT_PROCESSORS.
+var resultProcessors = map[string]ResultProcessor{
+	"strip_fences":  stripFences{},
+	"sanitize_utf8": sanitizeUTF8{},
+	"validate_json": validateJSON{},
+}
+
+// DefaultResultProcessors is the pipeline used when none is configured.
+var DefaultResultProcessors = []string{"strip_fences"}
+
+// IsValidResultProcessor reports whether name is a known result processor.
+func IsValidResultProcessor(name string) bool {
+	_, ok := resultProcessors[name]
+	return ok
+}
+
+// ResultPipeline applies processors in order.
+type ResultPipeline []ResultProcessor
+
+// NewResultPipeline builds a pipeline from processor names, in the given order.
+func NewResultPipeline(names []string) (ResultPipeline, error) {
+	p := make(ResultPipeline, 0, len(names))
+	for _, name := range names {
+		rp, ok := resultProcessors[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown result processor %q", name)
+		}
+		p = append(p, rp)
+	}
+	return p, nil
+}
+
+// Process runs result through every processor, stopping at the first error.
+func (p ResultPipeline) Process(j *Job, result string) (string, error) {
+	for _, rp := range p {
+		var err error
+		if result, err = rp.Process(j, result); err != nil {
+			return "", fmt.Errorf("%s: %w", rp.Name(), err)
+		}
+	}
+	return result, nil
+}
+
+// FormatResults derives each requested representation from one raw result:
+// "text" is the raw output, "json" the fence-stripped output when it parses as
+// JSON. An unparseable JSON variant is left out of the map.
+func FormatResults(formats []string, raw string) map[string]string {
+	results := make(map[string]string, len(formats))
+	for _, f := range formats {
+		switch f {
+		case "text":
+			results[f] = raw
+		case "json":
+			if s := stripCodeFences(raw); json.Valid([]byte(s)) {
+				results[f] = s
+			}
+		}
+	}
+	return results
+}
+
+// stripFences removes markdown code fences from JSON-mode results
+// (LLMs sometimes ignore instructions).
+type stripFences struct{}
+
+func (stripFences) Name() string { return "strip_fences" }
+
+func (stripFences) Process(j *Job, result string) (string, error) {
+	if j.ResponseFormat != "json" {
+		return result, nil
+	}
+	return stripCodeFences(result), nil
+}
+
+// stripCodeFences removes markdown code fences that LLMs sometimes add despite instructions.
+func stripCodeFences(s string) string {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "```") {
+		// Remove opening fence (```json, ```, etc.)
+		if idx := strings.Index(s, "\n"); idx != -1 {
+			s = s[idx+1:]
+		}
+		// Remove closing fence
+		s = strings.TrimSuffix(s, "```")
+		s = strings.TrimSpace(s)
+	}
+	return s
+}
+
+// sanitizeUTF8 replaces invalid UTF-8 sequences with U+FFFD.
+type sanitizeUTF8 struct{}
+
+func (sanitizeUTF8) Name() string { return "sanitize_utf8" }
+
+func (sanitizeUTF8) Process(_ *Job, result string) (string, error) {
+	return strings.ToValidUTF8(result, "�"), nil
+}
+
+// validateJSON fails JSON-mode jobs whose result does not parse.
+// Place it after strip_fences.
+type validateJSON struct{}
+
+func (validateJSON) Name() string { return "validate_json" }
+
+func (validateJSON) Process(j *Job, result string) (string, error) {
+	if j.ResponseFormat == "json" && !json.Valid([]byte(result)) {
+		return "", errors.New("result is not valid JSON")
+	}
+	return result, nil
+}
@@ -0,0 +1,113 @@
+package job
+
+import "testing"
+
+func TestStripCodeFences(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "standard JSON fence",
+			input: "```json\n{\"key\":\"value\"}\n```",
+			want:  "{\"key\":\"value\"}",
+		},
+		{
+			name:  "plain fence",
+			input: "```\n{\"key\":\"value\"}\n```",
+			want:  "{\"key\":\"value\"}",
+		},
+		{
+			name:  "no fence unchanged",
+			input: "{\"key\":\"value\"}",
+			want:  "{\"key\":\"value\"}",
+		},
+		{
+			name:  "only whitespace trimmed",
+			input: "  {\"key\":\"value\"}  ",
+			want:  "{\"key\":\"value\"}",
+		},
+		{
+			name:  "trailing newline after closing fence",
+			input: "```json\n{\"a\":1}\n```\n",
+			want:  "{\"a\":1}",
+		},
+		{
+			name:  "empty string",
+			input: "",
+			want:  "",
+		},
+		{
+			name:  "only opening fence no newline",
+			input: "```",
+			// HasPrefix matches, no newline so opening fence is kept, but HasSuffix
+			// also matches the same "```" so the closing fence removal strips it,
+			// leaving an empty string after TrimSpace.
+			want: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got := stripCodeFences(tt.input)
+			if got != tt.want {
+				t.Errorf("stripCodeFences(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResultPipeline(t *testing.T) {
+	t.Parallel()
+	jsonJob := &Job{ResponseFormat: "json"}
+	textJob := &Job{}
+
+	p, err := NewResultPipeline([]string{"strip_fences", "validate_json"})
+	if err != nil {
+		t.Fatalf("NewResultPipeline: %v", err)
+	}
+	if got, err := p.Process(jsonJob, "```json\n{\"a\":1}\n```"); err != nil || got != `{"a":1}` {
+		t.Errorf("fenced JSON: got %q, err %v", got, err)
+	}
+	if _, err := p.Process(jsonJob, "not json"); err == nil {
+		t.Error("invalid JSON: expected error, got nil")
+	}
+	if got, err := p.Process(textJob, "```\nplain\n```"); err != nil || got != "```\nplain\n```" {
+		t.Errorf("text job must be untouched: got %q, err %v", got, err)
+	}
+
+	// Order matters: validating before stripping rejects fenced output.
+	p, _ = NewResultPipeline([]string{"validate_json", "strip_fences"})
+	if _, err := p.Process(jsonJob, "```json\n{}\n```"); err == nil {
+		t.Error("validate before strip: expected error, got nil")
+	}
+
+	p, _ = NewResultPipeline([]string{"sanitize_utf8"})
+	if got, _ := p.Process(textJob, "ok\xff"); got != "ok�" {
+		t.Errorf("sanitize_utf8: got %q", got)
+	}
+
+	if _, err := NewResultPipeline([]string{"nope"}); err == nil {
+		t.Error("unknown processor: expected error, got nil")
+	}
+}
+
+func TestFormatResults(t *testing.T) {
+	t.Parallel()
+	raw := "```json\n{\"a\":1}\n```"
+	got := FormatResults([]string{"text", "json"}, raw)
+	if got["text"] != raw || got["json"] != `{"a":1}` {
+		t.Errorf("FormatResults = %v", got)
+	}
+
+	got = FormatResults([]string{"json", "text"}, "not json")
+	if _, ok := got["json"]; ok {
+		t.Errorf("invalid JSON variant should be omitted, got %v", got)
+	}
+	if got["text"] != "not json" {
+		t.Errorf("text = %q, want raw output", got["text"])
+	}
+}
@@ -0,0 +1,62 @@
+package job
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+// maxResponseSchemaBytes caps CreateRequest.ResponseSchema.
+const maxResponseSchemaBytes = 64 * 1024
+
+// schemaURL names the compiled schema; it shows up in validation errors.
+const schemaURL = "response_schema.json"
+
+// noExternalRefs refuses every $ref outside the schema itself, so a client
+// schema can't make the server read local files or fetch URLs.
+type noExternalRefs struct{}
+
+func (noExternalRefs) Load(url string) (any, error) {
+	return nil, errors.New("external $ref is not allowed")
+}
+
+// compileResponseSchema parses and compiles a client-supplied JSON Schema.
+func compileResponseSchema(raw json.RawMessage) (*jsonschema.Schema, error) {
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	c := jsonschema.NewCompiler()
+	c.UseLoader(noExternalRefs{})
+	if err := c.AddResource(schemaURL, doc); err != nil {
+		return nil, err
+	}
+	return c.Compile(schemaURL)
+}
+
+// CheckResponseSchema validates result, minus any markdown code fences,
+// against the job's response_schema. The error describes the violation.
+func CheckResponseSchema(schema json.RawMessage, result string) error {
+	sch, err := compileResponseSchema(schema)
+	if err != nil {
+		return fmt.Errorf("response_schema: %w", err)
+	}
+	doc, err := jsonschema.UnmarshalJSON(strings.NewReader(stripCodeFences(result)))
+	if err != nil {
+		return errors.New("result is not valid JSON")
+	}
+	if err := sch.Validate(doc); err != nil {
+		return fmt.Errorf("result does not match response_schema: %w", err)
+	}
+	return nil
+}
+
+// ResponseSchemaInstruction is appended to the system prompt of jobs with a
+// response_schema, after the JSON format instruction.
+func ResponseSchemaInstruction(schema json.RawMessage) string {
+	return "The JSON must conform to this JSON Schema:\n" + string(schema)
+}
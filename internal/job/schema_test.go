@@ -0,0 +1,55 @@
+package job
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestCheckResponseSchema(t *testing.T) {
+	t.Parallel()
+	schema := json.RawMessage(`{"type":"object","required":["name"],"properties":{"name":{"type":"string"},"age":{"type":"integer"}}}`)
+
+	tests := []struct {
+		name    string
+		result  string
+		wantErr string
+	}{
+		{"valid", `{"name":"Ada","age":36}`, ""},
+		{"valid in fences", "```json\n{\"name\":\"Ada\"}\n```", ""},
+		{"missing required", `{"age":36}`, "missing property 'name'"},
+		{"wrong type", `{"name":"Ada","age":"old"}`, "/age"},
+		{"not JSON", `Ada, 36`, "not valid JSON"},
+	}
+	for _, tt := range tests {
+		err := CheckResponseSchema(schema, tt.result)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: err = %v, want it to mention %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestValidate_ResponseSchema(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		req     CreateRequest
+		wantErr bool
+	}{
+		{"valid", CreateRequest{Prompt: "p", ResponseFormat: "json", ResponseSchema: json.RawMessage(`{"type":"object"}`)}, false},
+		{"text format", CreateRequest{Prompt: "p", ResponseFormat: "text", ResponseSchema: json.RawMessage(`{"type":"object"}`)}, true},
+		{"bad keyword value", CreateRequest{Prompt: "p", ResponseFormat: "json", ResponseSchema: json.RawMessage(`{"type":"widget"}`)}, true},
+		{"external ref", CreateRequest{Prompt: "p", ResponseFormat: "json", ResponseSchema: json.RawMessage(`{"$ref":"file:///etc/passwd"}`)}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.req.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: Validate() = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -1,83 +1,276 @@
 package job
 
 import (
+	"cmp"
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	_ "modernc.org/sqlite"
 )
 
+// sqlStore implements Store on top of database/sql. SQLiteStore and
+// PostgresStore embed it and differ only in how they open the connection.
+type sqlStore struct {
+	db dbConn
+	// compressMin is the result size, in bytes, from which results are
+	// stored gzip-compressed; 0 disables compression.
+	compressMin int
+	// owner is recorded as worker_id on the jobs this instance processes.
+	owner string
+}
+
 // SQLiteStore is a SQLite-backed implementation of Store.
 type SQLiteStore struct {
-	db *sql.DB
+	sqlStore
+}
+
+// SQLiteOptions tunes the connections of a SQLiteStore. Zero fields take the
+// defaults.
+type SQLiteOptions struct {
+	// BusyTimeout is how long a statement waits for another connection's
+	// lock before failing with SQLITE_BUSY. Default 5s.
+	BusyTimeout time.Duration
+	// MaxOpenConns caps the connection pool. Default 4. In-memory databases
+	// always use a single connection, since each one would get its own database.
+	MaxOpenConns int
 }
 
-// NewSQLiteStore opens (or creates) the SQLite database at dbPath and runs migrations.
+const (
+	defaultSQLiteBusyTimeout  = 5 * time.Second
+	defaultSQLiteMaxOpenConns = 4
+)
+
+// dsn returns dbPath with the per-connection settings appended as query
+// parameters. Pragmas in the DSN run on every connection the pool opens,
+// unlike a one-off Exec, which only reaches the connection it ran on.
+// Transactions start with BEGIN IMMEDIATE when immediate is set, so writers
+// queue on the busy timeout instead of failing when upgrading a read lock.
+func (o SQLiteOptions) dsn(dbPath string, immediate bool) string {
+	busy := cmp.Or(o.BusyTimeout, defaultSQLiteBusyTimeout)
+	params := fmt.Sprintf("_pragma=busy_timeout(%d)", busy.Milliseconds())
+	if immediate {
+		params += "&_txlock=immediate"
+	}
+	if strings.Contains(dbPath, "?") {
+		return dbPath + "&" + params
+	}
+	return dbPath + "?" + params
+}
+
+// configurePool sizes db's pool. WAL lets readers run alongside the single
+// writer SQLite allows; idle connections are kept so they are not reopened.
+func (o SQLiteOptions) configurePool(db *sql.DB, dbPath string) {
+	n := cmp.Or(o.MaxOpenConns, defaultSQLiteMaxOpenConns)
+	if strings.Contains(dbPath, ":memory:") || strings.Contains(dbPath, "mode=memory") {
+		n = 1
+	}
+	db.SetMaxOpenConns(n)
+	db.SetMaxIdleConns(n)
+}
+
+// NewSQLiteStore opens (or creates) the SQLite database at dbPath with the
+// default SQLiteOptions and runs migrations.
 func NewSQLiteStore(dbPath string) (*SQLiteStore, error) {
-	db, err := sql.Open("sqlite", dbPath)
+	return NewSQLiteStoreWithOptions(dbPath, SQLiteOptions{})
+}
+
+// NewSQLiteStoreWithOptions opens (or creates) the SQLite database at dbPath and runs
+// migrations. The parent directory is created if missing, and a trivial write is
+// attempted so an unwritable location fails at startup rather than on the first job.
+func NewSQLiteStoreWithOptions(dbPath string, opts SQLiteOptions) (*SQLiteStore, error) {
+	if isFilePath(dbPath) {
+		if err := os.MkdirAll(filepath.Dir(dbPath), 0o755); err != nil {
+			return nil, fmt.Errorf("create db directory: %w", err)
+		}
+	}
+
+	db, err := sql.Open("sqlite", opts.dsn(dbPath, true))
 	if err != nil {
 		return nil, fmt.Errorf("open sqlite db: %w", err)
 	}
+	opts.configurePool(db, dbPath)
 
-	// WAL mode for better concurrent read performance.
+	// WAL mode for better concurrent read performance. It is stored in the
+	// database file, so setting it once covers every connection.
 	if _, err = db.Exec("PRAGMA journal_mode=WAL"); err != nil {
 		db.Close()
 		return nil, fmt.Errorf("enable WAL mode: %w", err)
 	}
 
-	// Avoid SQLITE_BUSY errors under concurrent reads and writes.
-	if _, err = db.Exec("PRAGMA busy_timeout = 10000"); err != nil {
-		db.Close()
-		return nil, fmt.Errorf("set busy_timeout: %w", err)
-	}
-
-	s := &SQLiteStore{db: db}
+	s := &SQLiteStore{sqlStore{db: dbConn{DB: db, dialect: dialectSQLite}}}
 	if err = s.migrate(); err != nil {
 		db.Close()
 		return nil, fmt.Errorf("migrate: %w", err)
 	}
+	if err = s.checkWritable(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("database %s is not writable: %w", dbPath, err)
+	}
 	return s, nil
 }
 
-func (s *SQLiteStore) migrate() error {
-	_, err := s.db.Exec(`
-		CREATE TABLE IF NOT EXISTS jobs (
-			id              TEXT PRIMARY KEY,
-			prompt          TEXT NOT NULL,
-			system_prompt   TEXT NOT NULL DEFAULT '',
-			model           TEXT NOT NULL,
-			status          TEXT NOT NULL DEFAULT 'queued',
-			result          TEXT NOT NULL DEFAULT '',
-			error           TEXT NOT NULL DEFAULT '',
-			callback_url    TEXT NOT NULL DEFAULT '',
-			metadata        TEXT,
-			response_format TEXT NOT NULL DEFAULT '',
-			created_at      DATETIME NOT NULL,
-			started_at      DATETIME,
-			completed_at    DATETIME
-		);
-		CREATE INDEX IF NOT EXISTS idx_jobs_status       ON jobs(status);
-		CREATE INDEX IF NOT EXISTS idx_jobs_created_at   ON jobs(created_at);
-		CREATE INDEX IF NOT EXISTS idx_jobs_completed_at ON jobs(completed_at);
-		CREATE INDEX IF NOT EXISTS idx_jobs_status_completed_at ON jobs(status, completed_at);
-	`)
+// NewSQLiteReadStore opens an existing SQLite database read-only with the
+// default SQLiteOptions.
+func NewSQLiteReadStore(dbPath string) (*SQLiteStore, error) {
+	return NewSQLiteReadStoreWithOptions(dbPath, SQLiteOptions{})
+}
+
+// NewSQLiteReadStoreWithOptions opens an existing SQLite database read-only, e.g. a
+// replica maintained by Litestream or LiteFS. No migration or write check is
+// performed; the schema is owned by the primary.
+func NewSQLiteReadStoreWithOptions(dbPath string, opts SQLiteOptions) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", opts.dsn("file:"+dbPath+"?mode=ro", false))
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite read db: %w", err)
+	}
+	opts.configurePool(db, dbPath)
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("ping sqlite read db: %w", err)
+	}
+	return &SQLiteStore{sqlStore{db: dbConn{DB: db, dialect: dialectSQLite}}}, nil
+}
+
+// isFilePath reports whether dbPath names a plain file (not :memory: or a file: URI).
+func isFilePath(dbPath string) bool {
+	return dbPath != "" && !strings.HasPrefix(dbPath, ":memory:") && !strings.HasPrefix(dbPath, "file:")
+}
+
+// checkWritable performs a write inside a transaction and rolls it back.
+// CREATE TABLE IF NOT EXISTS in migrate is a no-op on an existing database, so it
+// does not prove the database is writable.
+func (s *sqlStore) checkWritable() error {
+	tx, err := s.db.Begin()
 	if err != nil {
 		return err
 	}
-	// Idempotent column migration — error means column already exists, safe to ignore.
-	s.db.Exec(`ALTER TABLE jobs ADD COLUMN response_format TEXT NOT NULL DEFAULT ''`) //nolint:errcheck
-	return nil
+	defer tx.Rollback() //nolint:errcheck
+	_, err = tx.Exec(`CREATE TABLE claudegate_write_check (x INTEGER)`)
+	return err
 }
 
-func (s *SQLiteStore) Create(ctx context.Context, j *Job) error {
-	_, err := s.db.ExecContext(ctx, `
-		INSERT INTO jobs
-			(id, prompt, system_prompt, model, status, result, error, callback_url, metadata, response_format, created_at)
-		VALUES
-			(?, ?, ?, ?, ?, '', '', ?, ?, ?, ?)
-	`,
+// jobColumns is the column list shared by every query that returns full job rows.
+// Its order must match the Scan destinations in scanJob.
+const jobColumns = `id, prompt, system_prompt, model, status, result, error,
+		       callback_url, metadata, response_format, created_at, started_at, completed_at,
+		       rerun_of, output_format, note, created_by, timed_out,
+		       effective_system_prompt, response_formats, results, resolved_model, request_id,
+		       max_retries, attempts, priority, callback_headers, callback_urls, partial_result,
+		       idempotency_key, request_hash, result_compressed,
+		       input_tokens, output_tokens, stop_reason, cost_usd, timeout_seconds,
+		       session_id, parent_job_id, allowed_tools, response_schema, events,
+		       webhook_status, webhook_attempted_at`
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanJob reads a single row selected with jobColumns into a Job.
+func scanJob(sc rowScanner) (*Job, error) {
+	j := &Job{}
+	var metadata, note, formats, results, callbackHeaders, callbackURLs, idempotencyKey, allowedTools, responseSchema, events sql.NullString
+	var startedAt, completedAt, webhookAttemptedAt sql.NullTime
+	var resultCompressed bool
+	var cost sql.NullFloat64
+
+	if err := sc.Scan(
+		&j.ID, &j.Prompt, &j.SystemPrompt, &j.Model, &j.Status,
+		&j.Result, &j.Error, &j.CallbackURL, &metadata,
+		&j.ResponseFormat, &j.CreatedAt, &startedAt, &completedAt,
+		&j.RerunOf, &j.OutputFormat, &note, &j.CreatedBy, &j.TimedOut,
+		&j.EffectiveSystemPrompt, &formats, &results, &j.ResolvedModel, &j.RequestID,
+		&j.MaxRetries, &j.Attempts, &j.Priority, &callbackHeaders, &callbackURLs, &j.PartialResult,
+		&idempotencyKey, &j.RequestHash, &resultCompressed,
+		&j.InputTokens, &j.OutputTokens, &j.StopReason, &cost, &j.TimeoutSeconds,
+		&j.SessionID, &j.ParentJobID, &allowedTools, &responseSchema, &events,
+		&j.WebhookStatus, &webhookAttemptedAt,
+	); err != nil {
+		return nil, err
+	}
+	if resultCompressed {
+		result, err := decompressResult(j.Result)
+		if err != nil {
+			return nil, err
+		}
+		j.Result = result
+	}
+	if formats.Valid {
+		if err := json.Unmarshal([]byte(formats.String), &j.ResponseFormats); err != nil {
+			return nil, fmt.Errorf("decode response_formats: %w", err)
+		}
+	}
+	if results.Valid {
+		if err := json.Unmarshal([]byte(results.String), &j.Results); err != nil {
+			return nil, fmt.Errorf("decode results: %w", err)
+		}
+	}
+	if callbackURLs.Valid {
+		if err := json.Unmarshal([]byte(callbackURLs.String), &j.CallbackURLs); err != nil {
+			return nil, fmt.Errorf("decode callback_urls: %w", err)
+		}
+	}
+	if callbackHeaders.Valid {
+		if err := json.Unmarshal([]byte(callbackHeaders.String), &j.CallbackHeaders); err != nil {
+			return nil, fmt.Errorf("decode callback_headers: %w", err)
+		}
+	}
+	if allowedTools.Valid {
+		if err := json.Unmarshal([]byte(allowedTools.String), &j.AllowedTools); err != nil {
+			return nil, fmt.Errorf("decode allowed_tools: %w", err)
+		}
+	}
+	if events.Valid {
+		if err := json.Unmarshal([]byte(events.String), &j.Events); err != nil {
+			return nil, fmt.Errorf("decode events: %w", err)
+		}
+	}
+	j.ActualModel = j.ResolvedModel
+	j.Note = note.String
+	j.IdempotencyKey = idempotencyKey.String
+	if cost.Valid {
+		j.CostUSD = &cost.Float64
+	}
+
+	if metadata.Valid {
+		j.Metadata = []byte(metadata.String)
+	}
+	if responseSchema.Valid {
+		j.ResponseSchema = []byte(responseSchema.String)
+	}
+	if startedAt.Valid {
+		t := startedAt.Time
+		j.StartedAt = &t
+	}
+	if completedAt.Valid {
+		t := completedAt.Time
+		j.CompletedAt = &t
+	}
+	if webhookAttemptedAt.Valid {
+		t := webhookAttemptedAt.Time
+		j.WebhookAttemptedAt = &t
+	}
+	return j, nil
+}
+
+// insertJob is the INSERT shared by Create and CreateBatch; see insertArgs.
+const insertJob = `
+	INSERT INTO jobs
+		(id, prompt, system_prompt, model, status, result, error, callback_url, metadata, response_format, created_at, rerun_of, output_format, created_by, response_formats, request_id, max_retries, priority, callback_headers, callback_urls, idempotency_key, request_hash, timeout_seconds, parent_job_id, allowed_tools, response_schema, events)
+	VALUES
+		(?, ?, ?, ?, ?, '', '', ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+`
+
+// insertArgs returns the insertJob arguments for j.
+func insertArgs(j *Job) []any {
+	return []any{
 		j.ID,
 		j.Prompt,
 		j.SystemPrompt,
@@ -87,51 +280,109 @@ func (s *SQLiteStore) Create(ctx context.Context, j *Job) error {
 		nullableJSON(j.Metadata),
 		j.ResponseFormat,
 		j.CreatedAt.UTC(),
-	)
-	if err != nil {
+		j.RerunOf,
+		j.OutputFormat,
+		j.CreatedBy,
+		nullableStrings(j.ResponseFormats),
+		j.RequestID,
+		j.MaxRetries,
+		cmp.Or(j.Priority, PriorityNormal),
+		nullableMap(j.CallbackHeaders),
+		nullableStrings(j.CallbackURLs),
+		nullableString(j.IdempotencyKey),
+		j.RequestHash,
+		j.TimeoutSeconds,
+		j.ParentJobID,
+		nullableStrings(j.AllowedTools),
+		nullableJSON(j.ResponseSchema),
+		nullableStrings(j.Events),
+	}
+}
+
+func (s *sqlStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *sqlStore) Create(ctx context.Context, j *Job) error {
+	if _, err := s.db.ExecContext(ctx, insertJob, insertArgs(j)...); err != nil {
 		return fmt.Errorf("create job: %w", err)
 	}
 	return nil
 }
 
-func (s *SQLiteStore) Get(ctx context.Context, id string) (*Job, error) {
-	row := s.db.QueryRowContext(ctx, `
-		SELECT id, prompt, system_prompt, model, status, result, error,
-		       callback_url, metadata, response_format, created_at, started_at, completed_at
-		FROM jobs WHERE id = ?
-	`, id)
+func (s *sqlStore) CreateBatch(ctx context.Context, jobs []*Job) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("create jobs: begin: %w", err)
+	}
+	defer tx.Rollback() //nolint:errcheck
 
-	j := &Job{}
-	var metadata sql.NullString
-	var startedAt, completedAt sql.NullTime
+	query := s.db.dialect.rebind(insertJob)
+	for _, j := range jobs {
+		if _, err := tx.ExecContext(ctx, query, insertArgs(j)...); err != nil {
+			return fmt.Errorf("create job %s: %w", j.ID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("create jobs: commit: %w", err)
+	}
+	return nil
+}
 
-	err := row.Scan(
-		&j.ID, &j.Prompt, &j.SystemPrompt, &j.Model, &j.Status,
-		&j.Result, &j.Error, &j.CallbackURL, &metadata,
-		&j.ResponseFormat, &j.CreatedAt, &startedAt, &completedAt,
-	)
+func (s *sqlStore) Get(ctx context.Context, id string) (*Job, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+jobColumns+` FROM jobs WHERE id = ?`, id)
+
+	j, err := scanJob(row)
 	if err == sql.ErrNoRows {
 		return nil, ErrJobNotFound
 	}
 	if err != nil {
 		return nil, fmt.Errorf("get job %s: %w", id, err)
 	}
+	return j, nil
+}
 
-	if metadata.Valid {
-		j.Metadata = []byte(metadata.String)
-	}
-	if startedAt.Valid {
-		t := startedAt.Time
-		j.StartedAt = &t
+// CompressResults makes the store gzip results of at least minBytes bytes
+// before writing them; 0 disables compression. Each row records whether its
+// result is compressed, so reads work whatever the setting. Call it before
+// the store is used.
+func (s *sqlStore) CompressResults(minBytes int) {
+	s.compressMin = minBytes
+}
+
+// SetOwner names this instance in the jobs it marks processing, so that
+// replicas sharing the database recover only their own or abandoned jobs.
+// Call it before the store is used.
+func (s *sqlStore) SetOwner(id string) {
+	s.owner = id
+}
+
+func (s *sqlStore) GetByIdempotencyKey(ctx context.Context, key string) (*Job, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+jobColumns+` FROM jobs WHERE idempotency_key = ?`, key)
+
+	j, err := scanJob(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrJobNotFound
 	}
-	if completedAt.Valid {
-		t := completedAt.Time
-		j.CompletedAt = &t
+	if err != nil {
+		return nil, fmt.Errorf("get job by idempotency key: %w", err)
 	}
 	return j, nil
 }
 
-func (s *SQLiteStore) UpdateStatus(ctx context.Context, id string, status Status, result, errMsg string) error {
+func (s *sqlStore) ReleaseIdempotencyKey(ctx context.Context, key string, before time.Time) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE jobs SET idempotency_key = NULL
+		WHERE idempotency_key = ? AND created_at < ?`,
+		key, before.UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("release idempotency key: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStore) UpdateStatus(ctx context.Context, id string, status Status, result, errMsg string) error {
 	now := time.Now().UTC()
 
 	var completedAt any
@@ -139,28 +390,52 @@ func (s *SQLiteStore) UpdateStatus(ctx context.Context, id string, status Status
 		completedAt = now
 	}
 
+	compressed := 0
+	if s.compressMin > 0 && len(result) >= s.compressMin {
+		var err error
+		if result, err = compressResult(result); err != nil {
+			return fmt.Errorf("compress result for job %s: %w", id, err)
+		}
+		compressed = 1
+	}
+
 	_, err := s.db.ExecContext(ctx, `
-		UPDATE jobs SET status = ?, result = ?, error = ?, completed_at = ?
+		UPDATE jobs SET status = ?, result = ?, result_compressed = ?, error = ?, completed_at = ?, partial_result = ''
 		WHERE id = ?
-	`, status, result, errMsg, completedAt, id)
+	`, status, result, compressed, errMsg, completedAt, id)
 	if err != nil {
 		return fmt.Errorf("update status for job %s: %w", id, err)
 	}
 	return nil
 }
 
-func (s *SQLiteStore) MarkProcessing(ctx context.Context, id string) error {
+func (s *sqlStore) MarkProcessing(ctx context.Context, id string) error {
 	now := time.Now().UTC()
-	_, err := s.db.ExecContext(ctx, `
-		UPDATE jobs SET status = ?, started_at = ? WHERE id = ?
-	`, StatusProcessing, now, id)
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE jobs SET status = ?, started_at = ?, attempts = attempts + 1, partial_result = '',
+			worker_id = ?, heartbeat_at = ?, boosted_at = NULL
+		WHERE id = ? AND status = ?
+	`, StatusProcessing, now, s.owner, now, id, StatusQueued)
 	if err != nil {
 		return fmt.Errorf("mark processing for job %s: %w", id, err)
 	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrJobNotQueued
+	}
+	return nil
+}
+
+func (s *sqlStore) MarkRetrying(ctx context.Context, id, errMsg string) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE jobs SET status = ?, error = ?, started_at = NULL, partial_result = '' WHERE id = ? AND status = ?
+	`, StatusQueued, errMsg, id, StatusProcessing)
+	if err != nil {
+		return fmt.Errorf("mark retrying for job %s: %w", id, err)
+	}
 	return nil
 }
 
-func (s *SQLiteStore) Delete(ctx context.Context, id string) error {
+func (s *sqlStore) Delete(ctx context.Context, id string) error {
 	_, err := s.db.ExecContext(ctx, `DELETE FROM jobs WHERE id = ?`, id)
 	if err != nil {
 		return fmt.Errorf("delete job %s: %w", id, err)
@@ -168,17 +443,208 @@ func (s *SQLiteStore) Delete(ctx context.Context, id string) error {
 	return nil
 }
 
+func (s *sqlStore) SetNote(ctx context.Context, id, note string) error {
+	var value any
+	if note != "" {
+		value = note
+	}
+	res, err := s.db.ExecContext(ctx, `UPDATE jobs SET note = ? WHERE id = ?`, value, id)
+	if err != nil {
+		return fmt.Errorf("set note for job %s: %w", id, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrJobNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) Boost(ctx context.Context, id string) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE jobs SET priority = ?, boosted_at = ? WHERE id = ?`,
+		PriorityHigh, time.Now().UTC(), id)
+	if err != nil {
+		return fmt.Errorf("boost job %s: %w", id, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrJobNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) MarkTimedOut(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE jobs SET timed_out = 1 WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("mark timed out for job %s: %w", id, err)
+	}
+	return nil
+}
+
+func (s *sqlStore) SetResults(ctx context.Context, id string, results map[string]string) error {
+	data, err := json.Marshal(results)
+	if err != nil {
+		return fmt.Errorf("encode results for job %s: %w", id, err)
+	}
+	if _, err := s.db.ExecContext(ctx, `UPDATE jobs SET results = ? WHERE id = ?`, string(data), id); err != nil {
+		return fmt.Errorf("set results for job %s: %w", id, err)
+	}
+	return nil
+}
+
+func (s *sqlStore) SetEffectiveSystemPrompt(ctx context.Context, id, prompt string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE jobs SET effective_system_prompt = ? WHERE id = ?`, prompt, id)
+	if err != nil {
+		return fmt.Errorf("set effective system prompt for job %s: %w", id, err)
+	}
+	return nil
+}
+
+func (s *sqlStore) SetPartialResult(ctx context.Context, id, text string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE jobs SET partial_result = ? WHERE id = ? AND status = ?`, text, id, StatusProcessing)
+	if err != nil {
+		return fmt.Errorf("set partial result for job %s: %w", id, err)
+	}
+	return nil
+}
+
+func (s *sqlStore) SetSessionID(ctx context.Context, id, sessionID string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE jobs SET session_id = ? WHERE id = ?`, sessionID, id)
+	if err != nil {
+		return fmt.Errorf("set session id for job %s: %w", id, err)
+	}
+	return nil
+}
+
+func (s *sqlStore) SetWebhookStatus(ctx context.Context, id, status string, at time.Time) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE jobs SET webhook_status = ?, webhook_attempted_at = ? WHERE id = ?`, status, at.UTC(), id)
+	if err != nil {
+		return fmt.Errorf("set webhook status for job %s: %w", id, err)
+	}
+	return nil
+}
+
+func (s *sqlStore) SetResolvedModel(ctx context.Context, id, model string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE jobs SET resolved_model = ? WHERE id = ?`, model, id)
+	if err != nil {
+		return fmt.Errorf("set resolved model for job %s: %w", id, err)
+	}
+	return nil
+}
+
+func (s *sqlStore) AddUsage(ctx context.Context, id string, inputTokens, outputTokens int, stopReason string) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE jobs SET input_tokens = input_tokens + ?, output_tokens = output_tokens + ?, stop_reason = ?
+		WHERE id = ?`,
+		inputTokens, outputTokens, stopReason, id,
+	)
+	if err != nil {
+		return fmt.Errorf("add usage for job %s: %w", id, err)
+	}
+	return nil
+}
+
+func (s *sqlStore) SetCost(ctx context.Context, id string, costUSD float64) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE jobs SET cost_usd = ? WHERE id = ?`, costUSD, id)
+	if err != nil {
+		return fmt.Errorf("set cost for job %s: %w", id, err)
+	}
+	return nil
+}
+
+func (s *sqlStore) Requeue(ctx context.Context, ids []string) ([]*Job, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	args := []any{StatusQueued, StatusFailed, StatusCancelled}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	rows, err := s.db.QueryContext(ctx, `
+		UPDATE jobs SET status = ?, result = '', result_compressed = 0, error = '', results = NULL,
+		       partial_result = '', started_at = NULL, completed_at = NULL, attempts = 0, timed_out = 0,
+		       webhook_status = '', webhook_attempted_at = NULL
+		WHERE status IN (?, ?) AND id IN (?`+strings.Repeat(", ?", len(ids)-1)+`)
+		RETURNING `+jobColumns, args...)
+	if err != nil {
+		return nil, fmt.Errorf("requeue jobs: %w", err)
+	}
+	defer rows.Close()
+
+	var jobs []*Job
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan requeued job: %w", err)
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+func (s *sqlStore) CancelByMetadata(ctx context.Context, match map[string]string, errMsg string) ([]string, error) {
+	if len(match) == 0 {
+		return nil, errors.New("cancel by metadata: no match given")
+	}
+	query := `UPDATE jobs SET status = ?, error = ?, completed_at = ?
+		WHERE status IN (?, ?) AND metadata IS NOT NULL`
+	args := []any{StatusCancelled, errMsg, time.Now().UTC(), StatusQueued, StatusProcessing}
+	for k, v := range match {
+		if strings.ContainsAny(k, `"\`) {
+			return nil, fmt.Errorf("cancel by metadata: invalid key %q", k)
+		}
+		if s.db.dialect == dialectPostgres {
+			query += ` AND (metadata::jsonb ->> ?) = ?`
+			args = append(args, k, v)
+		} else {
+			query += ` AND CAST(json_extract(metadata, ?) AS TEXT) = ?`
+			args = append(args, `$."`+k+`"`, v)
+		}
+	}
+	query += ` RETURNING id`
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("cancel by metadata: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("scan cancelled id: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
 // Close closes the underlying database connection.
-func (s *SQLiteStore) Close() error {
+func (s *sqlStore) Close() error {
 	return s.db.Close()
 }
 
-// ResetProcessing moves all jobs stuck in "processing" back to "queued".
+// ResetProcessing moves the "processing" jobs owned by this instance, and
+// those whose heartbeat is older than staleBefore, back to "queued".
 // Returns the IDs of the affected jobs so the caller can re-enqueue them.
-func (s *SQLiteStore) ResetProcessing(ctx context.Context) ([]string, error) {
-	rows, err := s.db.QueryContext(ctx, `SELECT id FROM jobs WHERE status = ?`, StatusProcessing)
+func (s *sqlStore) ResetProcessing(ctx context.Context, staleBefore time.Time) ([]string, error) {
+	return s.resetProcessing(ctx, `(worker_id = ? OR heartbeat_at IS NULL OR heartbeat_at < ?)`, s.owner, staleBefore.UTC())
+}
+
+// ReclaimExpired moves the "processing" jobs of other instances whose
+// heartbeat is older than staleBefore back to "queued" and returns their IDs.
+func (s *sqlStore) ReclaimExpired(ctx context.Context, staleBefore time.Time) ([]string, error) {
+	return s.resetProcessing(ctx, `worker_id <> ? AND (heartbeat_at IS NULL OR heartbeat_at < ?)`, s.owner, staleBefore.UTC())
+}
+
+// resetProcessing requeues the processing jobs matching cond. The single
+// UPDATE ... RETURNING lets only one of several racing replicas claim a job.
+func (s *sqlStore) resetProcessing(ctx context.Context, cond string, args ...any) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		UPDATE jobs SET status = ?, started_at = NULL, partial_result = '', worker_id = '', heartbeat_at = NULL
+		WHERE status = ? AND `+cond+`
+		RETURNING id
+	`, append([]any{StatusQueued, StatusProcessing}, args...)...)
 	if err != nil {
-		return nil, fmt.Errorf("query processing jobs: %w", err)
+		return nil, fmt.Errorf("reset processing jobs: %w", err)
 	}
 	defer rows.Close()
 
@@ -191,46 +657,55 @@ func (s *SQLiteStore) ResetProcessing(ctx context.Context) ([]string, error) {
 		ids = append(ids, id)
 	}
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("iterate processing jobs: %w", err)
-	}
-
-	if len(ids) == 0 {
-		return nil, nil
+		return nil, fmt.Errorf("iterate reset jobs: %w", err)
 	}
+	return ids, nil
+}
 
-	_, err = s.db.ExecContext(ctx, `
-		UPDATE jobs SET status = ?, started_at = NULL WHERE status = ?
-	`, StatusQueued, StatusProcessing)
+// Heartbeat renews the lease of the "processing" jobs owned by this instance.
+func (s *sqlStore) Heartbeat(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE jobs SET heartbeat_at = ? WHERE status = ? AND worker_id = ?
+	`, time.Now().UTC(), StatusProcessing, s.owner)
 	if err != nil {
-		return nil, fmt.Errorf("reset processing jobs: %w", err)
+		return fmt.Errorf("heartbeat: %w", err)
 	}
-	return ids, nil
+	return nil
 }
 
-// List returns jobs ordered by created_at DESC with pagination, and the total count.
-func (s *SQLiteStore) List(ctx context.Context, limit, offset int) ([]*Job, int, error) {
+// pageLimit clamps a requested page size to 1..100, defaulting to 20.
+func pageLimit(limit int) int {
 	if limit <= 0 {
-		limit = 20
-	}
-	if limit > 100 {
-		limit = 100
+		return 20
 	}
+	return min(limit, 100)
+}
+
+// List returns jobs ordered by created_at DESC with pagination, and the total count.
+func (s *sqlStore) List(ctx context.Context, limit, offset int, status Status) ([]*Job, int, error) {
+	limit = pageLimit(limit)
 	if offset < 0 {
 		offset = 0
 	}
 
+	where := ""
+	var args []any
+	if status != "" {
+		where = "WHERE status = ?"
+		args = append(args, status)
+	}
+
 	var total int
-	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM jobs`).Scan(&total); err != nil {
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM jobs `+where, args...).Scan(&total); err != nil {
 		return nil, 0, fmt.Errorf("count jobs: %w", err)
 	}
 
 	rows, err := s.db.QueryContext(ctx, `
-		SELECT id, prompt, system_prompt, model, status, result, error,
-		       callback_url, metadata, response_format, created_at, started_at, completed_at
-		FROM jobs
-		ORDER BY created_at DESC
+		SELECT `+jobColumns+`
+		FROM jobs `+where+`
+		ORDER BY created_at DESC, id DESC
 		LIMIT ? OFFSET ?
-	`, limit, offset)
+	`, append(args, limit, offset)...)
 	if err != nil {
 		return nil, 0, fmt.Errorf("list jobs: %w", err)
 	}
@@ -238,29 +713,10 @@ func (s *SQLiteStore) List(ctx context.Context, limit, offset int) ([]*Job, int,
 
 	var jobs []*Job
 	for rows.Next() {
-		j := &Job{}
-		var metadata sql.NullString
-		var startedAt, completedAt sql.NullTime
-
-		if err := rows.Scan(
-			&j.ID, &j.Prompt, &j.SystemPrompt, &j.Model, &j.Status,
-			&j.Result, &j.Error, &j.CallbackURL, &metadata,
-			&j.ResponseFormat, &j.CreatedAt, &startedAt, &completedAt,
-		); err != nil {
+		j, err := scanJob(rows)
+		if err != nil {
 			return nil, 0, fmt.Errorf("scan job: %w", err)
 		}
-
-		if metadata.Valid {
-			j.Metadata = []byte(metadata.String)
-		}
-		if startedAt.Valid {
-			t := startedAt.Time
-			j.StartedAt = &t
-		}
-		if completedAt.Valid {
-			t := completedAt.Time
-			j.CompletedAt = &t
-		}
 		jobs = append(jobs, j)
 	}
 	if err := rows.Err(); err != nil {
@@ -270,7 +726,149 @@ func (s *SQLiteStore) List(ctx context.Context, limit, offset int) ([]*Job, int,
 	return jobs, total, nil
 }
 
-func (s *SQLiteStore) DeleteTerminalBefore(ctx context.Context, before time.Time) (int64, error) {
+// ListAfter returns the page of jobs following after in List order, using a
+// keyset condition on (created_at, id) instead of an offset.
+func (s *sqlStore) ListAfter(ctx context.Context, after Cursor, limit int, status Status) ([]*Job, error) {
+	where := "WHERE (created_at, id) < (?, ?)"
+	args := []any{after.CreatedAt, after.ID}
+	if status != "" {
+		where += " AND status = ?"
+		args = append(args, status)
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+jobColumns+`
+		FROM jobs `+where+`
+		ORDER BY created_at DESC, id DESC
+		LIMIT ?
+	`, append(args, pageLimit(limit))...)
+	if err != nil {
+		return nil, fmt.Errorf("list jobs: %w", err)
+	}
+	defer rows.Close()
+
+	var jobs []*Job
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan job: %w", err)
+		}
+		jobs = append(jobs, j)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate jobs: %w", err)
+	}
+	return jobs, nil
+}
+
+// priorityRank returns an SQL expression ranking the priority column col
+// like Priority.Rank, unknown values ranking as normal.
+func priorityRank(col string) string {
+	return `CASE ` + col + ` WHEN 'high' THEN 0 WHEN 'low' THEN 2 ELSE 1 END`
+}
+
+func (s *sqlStore) QueuePosition(ctx context.Context, id string) (int, error) {
+	var status Status
+	err := s.db.QueryRowContext(ctx, `SELECT status FROM jobs WHERE id = ?`, id).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrJobNotFound
+	}
+	if err != nil {
+		return 0, fmt.Errorf("get job status: %w", err)
+	}
+	if status != StatusQueued {
+		return 0, nil
+	}
+
+	// Jobs ahead are queued ones of a higher priority, or of the same
+	// priority and boosted more recently (Queue.Boost puts a job first), or
+	// equally boosted and created earlier; IDs break ties like enqueue order.
+	other, this := priorityRank("o.priority"), priorityRank("j.priority")
+	var ahead int
+	err = s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM jobs o JOIN jobs j ON j.id = ?
+		WHERE o.status = ? AND o.id <> j.id
+		  AND (`+other+` < `+this+`
+		       OR (`+other+` = `+this+` AND (
+		           (o.boosted_at IS NOT NULL AND j.boosted_at IS NULL)
+		           OR o.boosted_at > j.boosted_at
+		           OR ((o.boosted_at = j.boosted_at OR (o.boosted_at IS NULL AND j.boosted_at IS NULL))
+		               AND (o.created_at < j.created_at
+		                    OR (o.created_at = j.created_at AND o.id < j.id))))))
+	`, id, StatusQueued).Scan(&ahead)
+	if err != nil {
+		return 0, fmt.Errorf("count jobs ahead: %w", err)
+	}
+	return ahead + 1, nil
+}
+
+func (s *sqlStore) Facets(ctx context.Context) (*Facets, error) {
+	var f Facets
+	var err error
+	if f.Model, err = s.facet(ctx, "model"); err != nil {
+		return nil, err
+	}
+	if f.Status, err = s.facet(ctx, "status"); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// facet counts the jobs per distinct value of column, which must be a
+// trusted column name.
+func (s *sqlStore) facet(ctx context.Context, column string) ([]Facet, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+column+`, COUNT(*) FROM jobs
+		GROUP BY `+column+`
+		ORDER BY COUNT(*) DESC, `+column)
+	if err != nil {
+		return nil, fmt.Errorf("count jobs by %s: %w", column, err)
+	}
+	defer rows.Close()
+
+	facets := []Facet{}
+	for rows.Next() {
+		var f Facet
+		if err := rows.Scan(&f.Value, &f.Count); err != nil {
+			return nil, fmt.Errorf("scan %s facet: %w", column, err)
+		}
+		facets = append(facets, f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate %s facets: %w", column, err)
+	}
+	return facets, nil
+}
+
+func (s *sqlStore) QueueWaitStats(ctx context.Context, since time.Time) ([]WaitStats, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT model, created_at, started_at
+		FROM jobs
+		WHERE started_at IS NOT NULL
+		AND attempts <= 1
+		AND created_at >= ?
+	`, since.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("query queue waits: %w", err)
+	}
+	defer rows.Close()
+
+	waits := make(map[string][]time.Duration)
+	for rows.Next() {
+		var model string
+		var created, started time.Time
+		if err := rows.Scan(&model, &created, &started); err != nil {
+			return nil, fmt.Errorf("scan queue wait: %w", err)
+		}
+		waits[model] = append(waits[model], max(started.Sub(created), 0))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate queue waits: %w", err)
+	}
+	return summarizeWaits(waits), nil
+}
+
+func (s *sqlStore) DeleteTerminalBefore(ctx context.Context, before time.Time) (int64, error) {
 	res, err := s.db.ExecContext(ctx, `
 		DELETE FROM jobs
 		WHERE status IN (?, ?, ?)
@@ -290,3 +888,30 @@ func nullableJSON(b []byte) any {
 	}
 	return string(b)
 }
+
+// nullableString returns s, or NULL when it is empty, for columns where
+// several rows may lack a value despite a unique index.
+func nullableString(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// nullableMap encodes a string map as JSON, or NULL when it is empty.
+func nullableMap(m map[string]string) any {
+	if len(m) == 0 {
+		return nil
+	}
+	data, _ := json.Marshal(m)
+	return string(data)
+}
+
+// nullableStrings encodes a string list as JSON, or NULL when it is empty.
+func nullableStrings(v []string) any {
+	if len(v) == 0 {
+		return nil
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
@@ -2,6 +2,15 @@ package job
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -57,6 +66,71 @@ func TestCreateAndGet(t *testing.T) {
 	}
 }
 
+func TestCreate_ToolsAndSchemaRoundTrip(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := newTestStore(t)
+
+	j := makeJob("job-1", "Hello world", "haiku")
+	j.AllowedTools = []string{"Read", "mcp__github__get_issue"}
+	j.ResponseSchema = json.RawMessage(`{"type":"object"}`)
+	if err := store.Create(ctx, j); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	got, err := store.Get(ctx, "job-1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if !slices.Equal(got.AllowedTools, j.AllowedTools) {
+		t.Errorf("AllowedTools = %v, want %v", got.AllowedTools, j.AllowedTools)
+	}
+	if string(got.ResponseSchema) != `{"type":"object"}` {
+		t.Errorf("ResponseSchema = %s, want {\"type\":\"object\"}", got.ResponseSchema)
+	}
+}
+
+func TestSetWebhookStatus(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := newTestStore(t)
+
+	if err := store.Create(ctx, makeJob("job-1", "Hello", "haiku")); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	at := time.Now().UTC().Truncate(time.Second)
+	if err := store.SetWebhookStatus(ctx, "job-1", "delivered", at); err != nil {
+		t.Fatalf("SetWebhookStatus: %v", err)
+	}
+	got, err := store.Get(ctx, "job-1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.WebhookStatus != "delivered" || got.WebhookAttemptedAt == nil || !got.WebhookAttemptedAt.Equal(at) {
+		t.Errorf("webhook status = %q at %v, want delivered at %v", got.WebhookStatus, got.WebhookAttemptedAt, at)
+	}
+}
+
+func TestCreateBatch_AllOrNothing(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := newTestStore(t)
+
+	jobs := []*Job{makeJob("b-1", "one", "haiku"), makeJob("b-2", "two", "haiku")}
+	if err := store.CreateBatch(ctx, jobs); err != nil {
+		t.Fatalf("CreateBatch: %v", err)
+	}
+
+	// b-2 already exists, so the whole batch must be rolled back.
+	dup := []*Job{makeJob("b-3", "three", "haiku"), makeJob("b-2", "again", "haiku")}
+	if err := store.CreateBatch(ctx, dup); err == nil {
+		t.Fatal("CreateBatch with duplicate ID: expected error, got nil")
+	}
+	if _, err := store.Get(ctx, "b-3"); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("Get(b-3) error = %v, want ErrJobNotFound", err)
+	}
+}
+
 func TestGet_NotFound(t *testing.T) {
 	t.Parallel()
 	ctx := context.Background()
@@ -153,6 +227,23 @@ func TestMarkProcessing(t *testing.T) {
 	if got.StartedAt == nil {
 		t.Error("StartedAt is nil, want non-nil")
 	}
+
+	// A job that is no longer queued, e.g. cancelled, is left alone.
+	if err := store.MarkProcessing(ctx, "job-4"); !errors.Is(err, ErrJobNotQueued) {
+		t.Errorf("MarkProcessing of a processing job: err = %v, want ErrJobNotQueued", err)
+	}
+	if err := store.Create(ctx, makeJob("job-4c", "cancel me", "haiku")); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := store.UpdateStatus(ctx, "job-4c", StatusCancelled, "", "cancelled"); err != nil {
+		t.Fatalf("UpdateStatus: %v", err)
+	}
+	if err := store.MarkProcessing(ctx, "job-4c"); !errors.Is(err, ErrJobNotQueued) {
+		t.Errorf("MarkProcessing of a cancelled job: err = %v, want ErrJobNotQueued", err)
+	}
+	if got, _ := store.Get(ctx, "job-4c"); got.Status != StatusCancelled || got.Attempts != 0 {
+		t.Errorf("cancelled job = %s after %d attempts, want untouched", got.Status, got.Attempts)
+	}
 }
 
 func TestDelete(t *testing.T) {
@@ -194,7 +285,7 @@ func TestList(t *testing.T) {
 	}
 
 	// All jobs.
-	jobs, total, err := store.List(ctx, 20, 0)
+	jobs, total, err := store.List(ctx, 20, 0, "")
 	if err != nil {
 		t.Fatalf("List(20,0): %v", err)
 	}
@@ -206,7 +297,7 @@ func TestList(t *testing.T) {
 	}
 
 	// First page.
-	jobs, total, err = store.List(ctx, 2, 0)
+	jobs, total, err = store.List(ctx, 2, 0, "")
 	if err != nil {
 		t.Fatalf("List(2,0): %v", err)
 	}
@@ -218,7 +309,7 @@ func TestList(t *testing.T) {
 	}
 
 	// Second page.
-	jobs, total, err = store.List(ctx, 2, 2)
+	jobs, total, err = store.List(ctx, 2, 2, "")
 	if err != nil {
 		t.Fatalf("List(2,2): %v", err)
 	}
@@ -228,6 +319,18 @@ func TestList(t *testing.T) {
 	if total != 3 {
 		t.Errorf("List(2,2) total = %d, want 3", total)
 	}
+
+	// Status filter applies to both the page and the total.
+	if err := store.UpdateStatus(ctx, "list-2", StatusFailed, "", "boom"); err != nil {
+		t.Fatalf("UpdateStatus: %v", err)
+	}
+	jobs, total, err = store.List(ctx, 20, 0, StatusFailed)
+	if err != nil {
+		t.Fatalf("List(failed): %v", err)
+	}
+	if len(jobs) != 1 || jobs[0].ID != "list-2" || total != 1 {
+		t.Errorf("List(failed) = %d jobs, total %d; want only list-2", len(jobs), total)
+	}
 }
 
 func TestDeleteTerminalBefore(t *testing.T) {
@@ -300,6 +403,62 @@ func TestDeleteTerminalBefore(t *testing.T) {
 	}
 }
 
+func TestResetProcessing_SharedDatabase(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "shared.db")
+	open := func(owner string) *SQLiteStore {
+		s, err := NewSQLiteStore(path)
+		if err != nil {
+			t.Fatalf("NewSQLiteStore: %v", err)
+		}
+		t.Cleanup(func() { s.Close() })
+		s.SetOwner(owner)
+		return s
+	}
+	a, b := open("replica-a"), open("replica-b")
+
+	for _, id := range []string{"job-a", "job-b"} {
+		if err := a.Create(ctx, makeJob(id, "p", "haiku")); err != nil {
+			t.Fatalf("Create %s: %v", id, err)
+		}
+	}
+	if err := a.MarkProcessing(ctx, "job-a"); err != nil {
+		t.Fatalf("MarkProcessing job-a: %v", err)
+	}
+	if err := b.MarkProcessing(ctx, "job-b"); err != nil {
+		t.Fatalf("MarkProcessing job-b: %v", err)
+	}
+
+	// Replica b restarts: it recovers its own job and leaves a's running one.
+	fresh := time.Now().Add(-time.Minute)
+	ids, err := b.ResetProcessing(ctx, fresh)
+	if err != nil {
+		t.Fatalf("ResetProcessing: %v", err)
+	}
+	if !slices.Equal(ids, []string{"job-b"}) {
+		t.Errorf("ResetProcessing = %v, want [job-b]", ids)
+	}
+	if ids, _ := b.ReclaimExpired(ctx, fresh); len(ids) != 0 {
+		t.Errorf("ReclaimExpired with a live lease = %v, want none", ids)
+	}
+	if err := a.Heartbeat(ctx); err != nil {
+		t.Fatalf("Heartbeat: %v", err)
+	}
+
+	// Once a's lease is older than the cutoff, b takes its job over, once.
+	expired := time.Now().Add(time.Second)
+	if ids, _ := b.ReclaimExpired(ctx, expired); !slices.Equal(ids, []string{"job-a"}) {
+		t.Errorf("ReclaimExpired after expiry = %v, want [job-a]", ids)
+	}
+	if ids, _ := b.ReclaimExpired(ctx, expired); len(ids) != 0 {
+		t.Errorf("second ReclaimExpired = %v, want none", ids)
+	}
+	if got, _ := a.Get(ctx, "job-a"); got.Status != StatusQueued {
+		t.Errorf("job-a status = %s, want queued", got.Status)
+	}
+}
+
 func TestResetProcessing(t *testing.T) {
 	t.Parallel()
 	ctx := context.Background()
@@ -320,7 +479,7 @@ func TestResetProcessing(t *testing.T) {
 		t.Fatalf("MarkProcessing j2: %v", err)
 	}
 
-	ids, err := store.ResetProcessing(ctx)
+	ids, err := store.ResetProcessing(ctx, time.Now().Add(-time.Minute))
 	if err != nil {
 		t.Fatalf("ResetProcessing: %v", err)
 	}
@@ -349,3 +508,735 @@ func TestResetProcessing(t *testing.T) {
 		t.Errorf("j1 Status = %q, want %q", got1.Status, StatusQueued)
 	}
 }
+
+func TestSetNote(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := newTestStore(t)
+
+	if err := store.Create(ctx, makeJob("note-1", "prompt", "haiku")); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	if err := store.SetNote(ctx, "note-1", "checked by ops"); err != nil {
+		t.Fatalf("SetNote: %v", err)
+	}
+	got, err := store.Get(ctx, "note-1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.Note != "checked by ops" {
+		t.Errorf("Note = %q, want %q", got.Note, "checked by ops")
+	}
+
+	// Empty note clears it.
+	if err := store.SetNote(ctx, "note-1", ""); err != nil {
+		t.Fatalf("SetNote clear: %v", err)
+	}
+	got, _ = store.Get(ctx, "note-1")
+	if got.Note != "" {
+		t.Errorf("Note after clear = %q, want empty", got.Note)
+	}
+
+	if err := store.SetNote(ctx, "missing", "x"); err != ErrJobNotFound {
+		t.Errorf("SetNote missing: err = %v, want ErrJobNotFound", err)
+	}
+}
+
+func TestList_TieBreaksOnID(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := newTestStore(t)
+
+	now := time.Now().UTC()
+	for _, id := range []string{"01B", "01C", "01A"} {
+		j := makeJob(id, "same instant", "haiku")
+		j.CreatedAt = now
+		if err := store.Create(ctx, j); err != nil {
+			t.Fatalf("Create %s: %v", id, err)
+		}
+	}
+
+	jobs, _, err := store.List(ctx, 20, 0, "")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	var got []string
+	for _, j := range jobs {
+		got = append(got, j.ID)
+	}
+	if want := []string{"01C", "01B", "01A"}; !slices.Equal(got, want) {
+		t.Errorf("List order = %v, want %v", got, want)
+	}
+}
+
+func TestListAfter(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := newTestStore(t)
+
+	// Two jobs share a timestamp, so the cursor must tie-break on ID.
+	base := time.Now().UTC()
+	for i, id := range []string{"a", "b", "c", "d"} {
+		j := makeJob(id, "p", "haiku")
+		j.CreatedAt = base.Add(time.Duration(min(i, 2)) * time.Second)
+		if err := store.Create(ctx, j); err != nil {
+			t.Fatalf("Create %s: %v", id, err)
+		}
+	}
+	if err := store.UpdateStatus(ctx, "b", StatusCompleted, "ok", ""); err != nil {
+		t.Fatalf("UpdateStatus: %v", err)
+	}
+
+	var got []string
+	after := Cursor{CreatedAt: base.Add(time.Hour), ID: ""}
+	for {
+		jobs, err := store.ListAfter(ctx, after, 1, "")
+		if err != nil {
+			t.Fatalf("ListAfter: %v", err)
+		}
+		if len(jobs) == 0 {
+			break
+		}
+		got = append(got, jobs[0].ID)
+		after = CursorAfter(jobs[0])
+	}
+	if want := []string{"d", "c", "b", "a"}; !slices.Equal(got, want) {
+		t.Errorf("pages = %v, want %v", got, want)
+	}
+
+	jobs, err := store.ListAfter(ctx, CursorAfter(&Job{ID: "d", CreatedAt: base.Add(2 * time.Second)}), 10, StatusQueued)
+	if err != nil {
+		t.Fatalf("ListAfter with status: %v", err)
+	}
+	if len(jobs) != 2 || jobs[0].ID != "c" || jobs[1].ID != "a" {
+		t.Errorf("queued after d = %v, want [c a]", jobs)
+	}
+}
+
+func TestRequeue(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := newTestStore(t)
+
+	for _, id := range []string{"failed-1", "cancelled-1", "queued-1"} {
+		if err := store.Create(ctx, makeJob(id, "p", "haiku")); err != nil {
+			t.Fatalf("Create %s: %v", id, err)
+		}
+	}
+	if err := store.MarkProcessing(ctx, "failed-1"); err != nil {
+		t.Fatalf("MarkProcessing: %v", err)
+	}
+	if err := store.UpdateStatus(ctx, "failed-1", StatusFailed, "", "token expired"); err != nil {
+		t.Fatalf("UpdateStatus: %v", err)
+	}
+	if err := store.UpdateStatus(ctx, "cancelled-1", StatusCancelled, "", "job cancelled by user"); err != nil {
+		t.Fatalf("UpdateStatus: %v", err)
+	}
+
+	jobs, err := store.Requeue(ctx, []string{"failed-1", "cancelled-1", "queued-1", "missing"})
+	if err != nil {
+		t.Fatalf("Requeue: %v", err)
+	}
+	var ids []string
+	for _, j := range jobs {
+		ids = append(ids, j.ID)
+	}
+	slices.Sort(ids)
+	if want := []string{"cancelled-1", "failed-1"}; !slices.Equal(ids, want) {
+		t.Errorf("requeued = %v, want %v", ids, want)
+	}
+
+	got, err := store.Get(ctx, "failed-1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.Status != StatusQueued || got.Error != "" || got.CompletedAt != nil || got.StartedAt != nil || got.Attempts != 0 {
+		t.Errorf("requeued job = status %s, error %q, completed_at %v, started_at %v, attempts %d; want a fresh queued job",
+			got.Status, got.Error, got.CompletedAt, got.StartedAt, got.Attempts)
+	}
+}
+
+func TestNewSQLiteStore_CreatesParentDirectory(t *testing.T) {
+	t.Parallel()
+	dbPath := filepath.Join(t.TempDir(), "nested", "data", "claudegate.db")
+
+	store, err := NewSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	defer store.Close()
+
+	if _, err := os.Stat(dbPath); err != nil {
+		t.Errorf("database file not created: %v", err)
+	}
+}
+
+func TestNewSQLiteStore_ReadOnlyDirectory(t *testing.T) {
+	t.Parallel()
+	if os.Geteuid() == 0 {
+		t.Skip("root bypasses file permissions")
+	}
+	dir := filepath.Join(t.TempDir(), "ro")
+	if err := os.Mkdir(dir, 0o555); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+
+	if store, err := NewSQLiteStore(filepath.Join(dir, "claudegate.db")); err == nil {
+		store.Close()
+		t.Fatal("expected error for read-only directory, got nil")
+	}
+}
+
+func TestReplicaStore_RoutesReadsToReplica(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	primary := newTestStore(t)
+	replica := newTestStore(t)
+	store := NewReplicaStore(primary, replica)
+
+	if err := store.Create(ctx, makeJob("r-1", "hello", "haiku")); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := primary.Get(ctx, "r-1"); err != nil {
+		t.Fatalf("write did not reach primary: %v", err)
+	}
+	// Replica has not caught up yet: reads must not fall back to the primary.
+	if _, err := store.Get(ctx, "r-1"); err != ErrJobNotFound {
+		t.Errorf("Get err = %v, want ErrJobNotFound from replica", err)
+	}
+
+	if err := replica.Create(ctx, makeJob("r-1", "hello", "haiku")); err != nil {
+		t.Fatalf("replica Create: %v", err)
+	}
+	if _, err := store.Get(ctx, "r-1"); err != nil {
+		t.Errorf("Get after replication: %v", err)
+	}
+	if _, total, err := store.List(ctx, 10, 0, ""); err != nil || total != 1 {
+		t.Errorf("List total = %d, err = %v, want 1", total, err)
+	}
+}
+
+func TestNewSQLiteReadStore(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	dbPath := filepath.Join(t.TempDir(), "claudegate.db")
+	primary, err := NewSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	defer primary.Close()
+	if err := primary.Create(ctx, makeJob("ro-1", "hello", "haiku")); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	ro, err := NewSQLiteReadStore(dbPath)
+	if err != nil {
+		t.Fatalf("NewSQLiteReadStore: %v", err)
+	}
+	defer ro.Close()
+
+	if _, err := ro.Get(ctx, "ro-1"); err != nil {
+		t.Errorf("Get from read store: %v", err)
+	}
+	if err := ro.Create(ctx, makeJob("ro-2", "hello", "haiku")); err == nil {
+		t.Error("expected write to read-only store to fail")
+	}
+}
+
+func TestCancelByMetadata(t *testing.T) {
+	t.Parallel()
+	store := newTestStore(t)
+	ctx := context.Background()
+
+	for id, meta := range map[string]string{
+		"acme-1":  `{"tenant":"acme","user_id":42}`,
+		"acme-2":  `{"tenant":"acme","user_id":7}`,
+		"acme-ok": `{"tenant":"acme","user_id":42}`,
+		"other":   `{"tenant":"globex","user_id":42}`,
+	} {
+		j := makeJob(id, "p", "haiku")
+		j.Metadata = []byte(meta)
+		if err := store.Create(ctx, j); err != nil {
+			t.Fatalf("Create %s: %v", id, err)
+		}
+	}
+	if err := store.Create(ctx, makeJob("no-meta", "p", "haiku")); err != nil {
+		t.Fatalf("Create no-meta: %v", err)
+	}
+	// Terminal jobs are left alone.
+	if err := store.UpdateStatus(ctx, "acme-ok", StatusCompleted, "done", ""); err != nil {
+		t.Fatalf("UpdateStatus: %v", err)
+	}
+
+	ids, err := store.CancelByMetadata(ctx, map[string]string{"tenant": "acme", "user_id": "42"}, "offboarded")
+	if err != nil {
+		t.Fatalf("CancelByMetadata: %v", err)
+	}
+	if len(ids) != 1 || ids[0] != "acme-1" {
+		t.Fatalf("cancelled = %v, want [acme-1]", ids)
+	}
+	got, _ := store.Get(ctx, "acme-1")
+	if got.Status != StatusCancelled || got.Error != "offboarded" || got.CompletedAt == nil {
+		t.Errorf("acme-1 = %q / %q / %v, want cancelled with error and completed_at", got.Status, got.Error, got.CompletedAt)
+	}
+
+	ids, _ = store.CancelByMetadata(ctx, map[string]string{"tenant": "acme"}, "offboarded")
+	if len(ids) != 1 || ids[0] != "acme-2" {
+		t.Errorf("second pass cancelled = %v, want [acme-2]", ids)
+	}
+	if got, _ := store.Get(ctx, "acme-ok"); got.Status != StatusCompleted {
+		t.Errorf("terminal job status = %q, want completed", got.Status)
+	}
+
+	if _, err := store.CancelByMetadata(ctx, nil, "x"); err == nil {
+		t.Error("empty match: expected error, got nil")
+	}
+}
+
+func TestResponseFormatsAndResults(t *testing.T) {
+	t.Parallel()
+	store := newTestStore(t)
+	ctx := context.Background()
+
+	j := makeJob("multi-1", "p", "haiku")
+	j.ResponseFormats = []string{"text", "json"}
+	if err := store.Create(ctx, j); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := store.SetResults(ctx, j.ID, map[string]string{"text": "raw", "json": "{}"}); err != nil {
+		t.Fatalf("SetResults: %v", err)
+	}
+
+	got, err := store.Get(ctx, j.ID)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if len(got.ResponseFormats) != 2 || got.ResponseFormats[1] != "json" {
+		t.Errorf("ResponseFormats = %v, want [text json]", got.ResponseFormats)
+	}
+	if got.Results["text"] != "raw" || got.Results["json"] != "{}" {
+		t.Errorf("Results = %v", got.Results)
+	}
+}
+
+func TestSetPartialResult(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := newTestStore(t)
+
+	if err := store.Create(ctx, makeJob("job-1", "hello", "haiku")); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	// Ignored while the job is still queued.
+	if err := store.SetPartialResult(ctx, "job-1", "early"); err != nil {
+		t.Fatalf("SetPartialResult: %v", err)
+	}
+	if got, _ := store.Get(ctx, "job-1"); got.PartialResult != "" {
+		t.Errorf("queued job partial_result = %q, want empty", got.PartialResult)
+	}
+
+	if err := store.MarkProcessing(ctx, "job-1"); err != nil {
+		t.Fatalf("MarkProcessing: %v", err)
+	}
+	if err := store.SetPartialResult(ctx, "job-1", "so far"); err != nil {
+		t.Fatalf("SetPartialResult: %v", err)
+	}
+	if got, _ := store.Get(ctx, "job-1"); got.PartialResult != "so far" {
+		t.Errorf("partial_result = %q, want so far", got.PartialResult)
+	}
+
+	if err := store.UpdateStatus(ctx, "job-1", StatusCompleted, "done", ""); err != nil {
+		t.Fatalf("UpdateStatus: %v", err)
+	}
+	if got, _ := store.Get(ctx, "job-1"); got.PartialResult != "" {
+		t.Errorf("completed job partial_result = %q, want empty", got.PartialResult)
+	}
+}
+
+func TestSetResolvedModel(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := newTestStore(t)
+
+	if err := store.Create(ctx, makeJob("model-1", "prompt", "opus")); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := store.SetResolvedModel(ctx, "model-1", "claude-sonnet-4"); err != nil {
+		t.Fatalf("SetResolvedModel: %v", err)
+	}
+	got, err := store.Get(ctx, "model-1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.Model != "opus" || got.ResolvedModel != "claude-sonnet-4" {
+		t.Errorf("model = %q, resolved = %q; want opus, claude-sonnet-4", got.Model, got.ResolvedModel)
+	}
+	data, err := json.Marshal(got)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	for _, field := range []string{`"resolved_model":"claude-sonnet-4"`, `"actual_model":"claude-sonnet-4"`} {
+		if !strings.Contains(string(data), field) {
+			t.Errorf("JSON %s lacks %s", data, field)
+		}
+	}
+}
+
+func TestCallbacks(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := newTestStore(t)
+
+	j := makeJob("job-1", "hello", "haiku")
+	j.CallbackURL = "https://example.com/hook"
+	j.CallbackURLs = []string{"https://example.org/hook"}
+	j.CallbackHeaders = map[string]string{"Authorization": "Bearer t"}
+	if err := store.Create(ctx, j); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	got, err := store.Get(ctx, "job-1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.CallbackHeaders["Authorization"] != "Bearer t" {
+		t.Errorf("CallbackHeaders = %v, want Authorization header", got.CallbackHeaders)
+	}
+	if want := []string{"https://example.com/hook", "https://example.org/hook"}; !slices.Equal(got.Callbacks(), want) {
+		t.Errorf("Callbacks() = %v, want %v", got.Callbacks(), want)
+	}
+}
+
+func TestMigrate_FreshDatabaseAtLatestVersion(t *testing.T) {
+	t.Parallel()
+	store := newTestStore(t)
+
+	v, err := store.SchemaVersion()
+	if err != nil {
+		t.Fatalf("SchemaVersion: %v", err)
+	}
+	if latest := migrations[len(migrations)-1].version; v != latest {
+		t.Errorf("SchemaVersion = %d, want %d", v, latest)
+	}
+}
+
+func TestMigrate_AdoptsUnversionedDatabase(t *testing.T) {
+	t.Parallel()
+	dbPath := filepath.Join(t.TempDir(), "legacy.db")
+
+	// A database created before versioned migrations, with some columns already added.
+	legacy, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	_, err = legacy.Exec(`CREATE TABLE jobs (
+		id TEXT PRIMARY KEY, prompt TEXT NOT NULL, system_prompt TEXT NOT NULL DEFAULT '',
+		model TEXT NOT NULL, status TEXT NOT NULL DEFAULT 'queued', result TEXT NOT NULL DEFAULT '',
+		error TEXT NOT NULL DEFAULT '', callback_url TEXT NOT NULL DEFAULT '', metadata TEXT,
+		response_format TEXT NOT NULL DEFAULT '', created_at DATETIME NOT NULL,
+		started_at DATETIME, completed_at DATETIME, rerun_of TEXT NOT NULL DEFAULT '')`)
+	if err != nil {
+		t.Fatalf("create legacy table: %v", err)
+	}
+	legacy.Close()
+
+	store, err := NewSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.Create(context.Background(), makeJob("legacy-1", "prompt", "haiku")); err != nil {
+		t.Fatalf("Create after migration: %v", err)
+	}
+	if _, err := store.Get(context.Background(), "legacy-1"); err != nil {
+		t.Fatalf("Get after migration: %v", err)
+	}
+}
+
+func TestMigrate_RejectsNewerSchema(t *testing.T) {
+	t.Parallel()
+	dbPath := filepath.Join(t.TempDir(), "newer.db")
+
+	store, err := NewSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	if _, err := store.db.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (9999, ?)`, time.Now()); err != nil {
+		t.Fatalf("insert future version: %v", err)
+	}
+	store.Close()
+
+	if _, err := NewSQLiteStore(dbPath); err == nil || !strings.Contains(err.Error(), "newer than this binary") {
+		t.Errorf("NewSQLiteStore err = %v, want newer schema error", err)
+	}
+}
+
+func TestFacets(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := newTestStore(t)
+
+	for id, model := range map[string]string{"job-0": "haiku", "job-1": "opus", "job-2": "haiku"} {
+		if err := store.Create(ctx, makeJob(id, "hello", model)); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+	if err := store.UpdateStatus(ctx, "job-1", StatusCompleted, "done", ""); err != nil {
+		t.Fatalf("UpdateStatus: %v", err)
+	}
+
+	f, err := store.Facets(ctx)
+	if err != nil {
+		t.Fatalf("Facets: %v", err)
+	}
+	wantModel := []Facet{{"haiku", 2}, {"opus", 1}}
+	if !slices.Equal(f.Model, wantModel) {
+		t.Errorf("model facets = %+v, want %+v", f.Model, wantModel)
+	}
+	wantStatus := []Facet{{"queued", 2}, {"completed", 1}}
+	if !slices.Equal(f.Status, wantStatus) {
+		t.Errorf("status facets = %+v, want %+v", f.Status, wantStatus)
+	}
+}
+
+func TestSQLiteStore_ConcurrentWriters(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store, err := NewSQLiteStoreWithOptions(filepath.Join(t.TempDir(), "jobs.db"), SQLiteOptions{MaxOpenConns: 8})
+	if err != nil {
+		t.Fatalf("NewSQLiteStoreWithOptions: %v", err)
+	}
+	defer store.Close()
+
+	// Every pooled connection must wait for the write lock rather than fail
+	// with "database is locked".
+	var wg sync.WaitGroup
+	errs := make(chan error, 8*20)
+	for w := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 20 {
+				id := fmt.Sprintf("w%d-%d", w, i)
+				if err := store.Create(ctx, makeJob(id, "p", "haiku")); err != nil {
+					errs <- err
+					return
+				}
+				if err := store.UpdateStatus(ctx, id, StatusCompleted, "done", ""); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestQueuePosition(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := newTestStore(t)
+
+	now := time.Now().UTC()
+	for i, id := range []string{"old", "new", "urgent"} {
+		j := makeJob(id, "hello", "haiku")
+		j.CreatedAt = now.Add(time.Duration(i) * time.Second)
+		if id == "urgent" {
+			j.Priority = PriorityHigh
+		}
+		if err := store.Create(ctx, j); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+
+	for id, want := range map[string]int{"urgent": 1, "old": 2, "new": 3} {
+		if got, err := store.QueuePosition(ctx, id); err != nil || got != want {
+			t.Errorf("QueuePosition(%s) = %d, %v, want %d", id, got, err, want)
+		}
+	}
+
+	if err := store.MarkProcessing(ctx, "urgent"); err != nil {
+		t.Fatalf("MarkProcessing: %v", err)
+	}
+	for id, want := range map[string]int{"urgent": 0, "old": 1, "new": 2} {
+		if got, err := store.QueuePosition(ctx, id); err != nil || got != want {
+			t.Errorf("after start: QueuePosition(%s) = %d, %v, want %d", id, got, err, want)
+		}
+	}
+
+	if _, err := store.QueuePosition(ctx, "missing"); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("QueuePosition(missing) error = %v, want ErrJobNotFound", err)
+	}
+}
+
+func TestQueuePosition_Boost(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := newTestStore(t)
+
+	now := time.Now().UTC()
+	for i, id := range []string{"urgent", "old", "new"} {
+		j := makeJob(id, "hello", "haiku")
+		j.CreatedAt = now.Add(time.Duration(i) * time.Second)
+		if id == "urgent" {
+			j.Priority = PriorityHigh
+		}
+		if err := store.Create(ctx, j); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+
+	// Like Queue.Boost, each boost goes ahead of every earlier job,
+	// including high-priority ones and earlier boosts.
+	for _, id := range []string{"old", "new"} {
+		if err := store.Boost(ctx, id); err != nil {
+			t.Fatalf("Boost(%s): %v", id, err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	for id, want := range map[string]int{"new": 1, "old": 2, "urgent": 3} {
+		if got, err := store.QueuePosition(ctx, id); err != nil || got != want {
+			t.Errorf("QueuePosition(%s) = %d, %v, want %d", id, got, err, want)
+		}
+	}
+	if got, _ := store.Get(ctx, "old"); got.Priority != PriorityHigh {
+		t.Errorf("boosted priority = %q, want high", got.Priority)
+	}
+
+	// A job that ran and came back queued is no longer boosted.
+	if err := store.MarkProcessing(ctx, "new"); err != nil {
+		t.Fatalf("MarkProcessing: %v", err)
+	}
+	if _, err := store.ResetProcessing(ctx, time.Now()); err != nil {
+		t.Fatalf("ResetProcessing: %v", err)
+	}
+	if got, err := store.QueuePosition(ctx, "new"); err != nil || got != 3 {
+		t.Errorf("requeued QueuePosition(new) = %d, %v, want 3", got, err)
+	}
+
+	if err := store.Boost(ctx, "missing"); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("Boost(missing) error = %v, want ErrJobNotFound", err)
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := newTestStore(t)
+
+	j := makeJob("job-1", "hello", "haiku")
+	j.IdempotencyKey, j.RequestHash = "key-1", "hash-1"
+	if err := store.Create(ctx, j); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	// Jobs without a key do not collide on the unique index.
+	for _, id := range []string{"job-2", "job-3"} {
+		if err := store.Create(ctx, makeJob(id, "hello", "haiku")); err != nil {
+			t.Fatalf("Create %s: %v", id, err)
+		}
+	}
+
+	got, err := store.GetByIdempotencyKey(ctx, "key-1")
+	if err != nil {
+		t.Fatalf("GetByIdempotencyKey: %v", err)
+	}
+	if got.ID != "job-1" || got.RequestHash != "hash-1" {
+		t.Errorf("got job %s with hash %q, want job-1 with hash-1", got.ID, got.RequestHash)
+	}
+
+	dup := makeJob("job-4", "hello", "haiku")
+	dup.IdempotencyKey = "key-1"
+	if err := store.Create(ctx, dup); err == nil {
+		t.Error("Create with a used key succeeded, want unique violation")
+	}
+
+	// Not yet expired: the key stays.
+	if err := store.ReleaseIdempotencyKey(ctx, "key-1", j.CreatedAt.Add(-time.Minute)); err != nil {
+		t.Fatalf("ReleaseIdempotencyKey: %v", err)
+	}
+	if _, err := store.GetByIdempotencyKey(ctx, "key-1"); err != nil {
+		t.Fatalf("key released too early: %v", err)
+	}
+
+	if err := store.ReleaseIdempotencyKey(ctx, "key-1", time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("ReleaseIdempotencyKey: %v", err)
+	}
+	if _, err := store.GetByIdempotencyKey(ctx, "key-1"); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("after release: err = %v, want ErrJobNotFound", err)
+	}
+	if err := store.Create(ctx, dup); err != nil {
+		t.Errorf("Create with a released key: %v", err)
+	}
+}
+
+func TestCompressResults(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := newTestStore(t)
+	store.CompressResults(100)
+
+	long := strings.Repeat("a verbose line of output\n", 200)
+	for id, result := range map[string]string{"job-long": long, "job-short": "short"} {
+		if err := store.Create(ctx, makeJob(id, "hello", "haiku")); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		if err := store.UpdateStatus(ctx, id, StatusCompleted, result, ""); err != nil {
+			t.Fatalf("UpdateStatus: %v", err)
+		}
+		got, err := store.Get(ctx, id)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if got.Result != result {
+			t.Errorf("%s: result not restored (got %d bytes, want %d)", id, len(got.Result), len(result))
+		}
+	}
+
+	var stored string
+	var compressed bool
+	row := store.db.QueryRow(`SELECT result, result_compressed FROM jobs WHERE id = ?`, "job-long")
+	if err := row.Scan(&stored, &compressed); err != nil {
+		t.Fatalf("read raw row: %v", err)
+	}
+	if !compressed || len(stored) >= len(long)/4 {
+		t.Errorf("long result stored as %d bytes (compressed=%v), want compressed", len(stored), compressed)
+	}
+	row = store.db.QueryRow(`SELECT result_compressed FROM jobs WHERE id = ?`, "job-short")
+	if err := row.Scan(&compressed); err != nil {
+		t.Fatalf("read raw row: %v", err)
+	}
+	if compressed {
+		t.Error("short result was compressed")
+	}
+}
+
+func TestAddUsage(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := newTestStore(t)
+
+	if err := store.Create(ctx, makeJob("job-1", "hello", "haiku")); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	// Two attempts: tokens add up, the last stop reason wins.
+	if err := store.AddUsage(ctx, "job-1", 100, 20, "max_tokens"); err != nil {
+		t.Fatalf("AddUsage: %v", err)
+	}
+	if err := store.AddUsage(ctx, "job-1", 120, 30, "end_turn"); err != nil {
+		t.Fatalf("AddUsage: %v", err)
+	}
+
+	got, err := store.Get(ctx, "job-1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.InputTokens != 220 || got.OutputTokens != 50 || got.StopReason != "end_turn" {
+		t.Errorf("usage = %d in, %d out, stop %q; want 220, 50, end_turn", got.InputTokens, got.OutputTokens, got.StopReason)
+	}
+}
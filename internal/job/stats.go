@@ -0,0 +1,60 @@
+package job
+
+import (
+	"cmp"
+	"math"
+	"slices"
+	"time"
+)
+
+// WaitStats summarizes how long one model's jobs waited in the queue, from
+// created_at to started_at. Durations are in seconds.
+type WaitStats struct {
+	Model string  `json:"model"`
+	Count int     `json:"count"`
+	Mean  float64 `json:"mean_seconds"`
+	P50   float64 `json:"p50_seconds"`
+	P95   float64 `json:"p95_seconds"`
+	Max   float64 `json:"max_seconds"`
+}
+
+// Facet is one distinct value of a job column and the number of jobs having it.
+type Facet struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// Facets lists the distinct values present in the jobs table, most common
+// first, for building filter UIs.
+type Facets struct {
+	Model  []Facet `json:"model"`
+	Status []Facet `json:"status"`
+}
+
+// summarizeWaits turns per-model wait samples into WaitStats sorted by model.
+func summarizeWaits(waits map[string][]time.Duration) []WaitStats {
+	stats := make([]WaitStats, 0, len(waits))
+	for model, ds := range waits {
+		slices.Sort(ds)
+		var sum time.Duration
+		for _, d := range ds {
+			sum += d
+		}
+		stats = append(stats, WaitStats{
+			Model: model,
+			Count: len(ds),
+			Mean:  (sum / time.Duration(len(ds))).Seconds(),
+			P50:   percentile(ds, 0.50).Seconds(),
+			P95:   percentile(ds, 0.95).Seconds(),
+			Max:   ds[len(ds)-1].Seconds(),
+		})
+	}
+	slices.SortFunc(stats, func(a, b WaitStats) int { return cmp.Compare(a.Model, b.Model) })
+	return stats
+}
+
+// percentile returns the nearest-rank p-th percentile of the sorted ds.
+func percentile(ds []time.Duration, p float64) time.Duration {
+	i := int(math.Ceil(p*float64(len(ds)))) - 1
+	return ds[max(i, 0)]
+}
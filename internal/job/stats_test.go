@@ -0,0 +1,29 @@
+package job
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSummarizeWaits(t *testing.T) {
+	t.Parallel()
+	var sonnet []time.Duration
+	for i := 1; i <= 20; i++ {
+		sonnet = append(sonnet, time.Duration(i)*time.Second)
+	}
+	stats := summarizeWaits(map[string][]time.Duration{
+		"sonnet": sonnet,
+		"haiku":  {3 * time.Second},
+	})
+
+	if len(stats) != 2 || stats[0].Model != "haiku" || stats[1].Model != "sonnet" {
+		t.Fatalf("stats = %+v, want haiku then sonnet", stats)
+	}
+	want := WaitStats{Model: "sonnet", Count: 20, Mean: 10.5, P50: 10, P95: 19, Max: 20}
+	if stats[1] != want {
+		t.Errorf("sonnet = %+v, want %+v", stats[1], want)
+	}
+	if h := stats[0]; h.P50 != 3 || h.P95 != 3 || h.Max != 3 {
+		t.Errorf("haiku = %+v, want every statistic 3s", h)
+	}
+}
@@ -8,15 +8,94 @@ import (
 // Store persists and retrieves jobs.
 type Store interface {
 	Create(ctx context.Context, j *Job) error
+	// CreateBatch creates all jobs in one transaction: either every job is
+	// stored or none is.
+	CreateBatch(ctx context.Context, jobs []*Job) error
 	Get(ctx context.Context, id string) (*Job, error)
+	// Ping checks that the database answers.
+	Ping(ctx context.Context) error
+	// GetByIdempotencyKey returns the job created with the given
+	// Idempotency-Key, or ErrJobNotFound.
+	GetByIdempotencyKey(ctx context.Context, key string) (*Job, error)
+	// ReleaseIdempotencyKey detaches key from a job created before the given
+	// time, so that the key can be used again.
+	ReleaseIdempotencyKey(ctx context.Context, key string, before time.Time) error
 	UpdateStatus(ctx context.Context, id string, status Status, result, errMsg string) error
+	// MarkProcessing moves a queued job to "processing" and counts the
+	// attempt. Returns ErrJobNotQueued if the job is no longer queued.
 	MarkProcessing(ctx context.Context, id string) error
+	// MarkRetrying moves a processing job back to "queued" after a failed
+	// attempt, keeping errMsg as the last error.
+	MarkRetrying(ctx context.Context, id, errMsg string) error
 	Delete(ctx context.Context, id string) error
-	// ResetProcessing moves all "processing" jobs back to "queued" and returns their IDs.
-	// Called at startup to recover jobs that were interrupted by a crash.
-	ResetProcessing(ctx context.Context) ([]string, error)
+	// SetNote sets the operator note on a job; an empty note clears it.
+	// Returns ErrJobNotFound if the job does not exist.
+	SetNote(ctx context.Context, id, note string) error
+	// Boost raises a job to high priority and records when, so QueuePosition
+	// ranks it ahead of the other high-priority jobs, the most recent boost
+	// first, as Queue.Boost does in memory. Starting the job clears the boost.
+	// Returns ErrJobNotFound if the job does not exist.
+	Boost(ctx context.Context, id string) error
+	// MarkTimedOut flags a job as having hit the per-job timeout.
+	MarkTimedOut(ctx context.Context, id string) error
+	// SetResults stores the per-format results of a multi-format job.
+	SetResults(ctx context.Context, id string, results map[string]string) error
+	// SetEffectiveSystemPrompt records the system prompt actually sent to the CLI.
+	SetEffectiveSystemPrompt(ctx context.Context, id, prompt string) error
+	// SetPartialResult stores the text streamed so far by a processing job.
+	// It is a no-op once the job has left "processing", and the text is
+	// cleared whenever the job changes status.
+	SetPartialResult(ctx context.Context, id, text string) error
+	// SetSessionID records the CLI session of a job's run, which follow-up
+	// jobs resume.
+	SetSessionID(ctx context.Context, id, sessionID string) error
+	// SetWebhookStatus records the delivery status of a job's terminal webhook.
+	SetWebhookStatus(ctx context.Context, id, status string, at time.Time) error
+	// SetResolvedModel records the model the CLI reported in its init message.
+	SetResolvedModel(ctx context.Context, id, model string) error
+	// AddUsage adds the tokens of one CLI run to the job's totals and records
+	// its stop reason.
+	AddUsage(ctx context.Context, id string, inputTokens, outputTokens int, stopReason string) error
+	// SetCost records the estimated cost of the job's tokens in USD.
+	SetCost(ctx context.Context, id string, costUSD float64) error
+	// CancelByMetadata marks every queued or processing job whose metadata has all
+	// the given top-level key/value pairs (compared as text) as cancelled, and
+	// returns their IDs.
+	CancelByMetadata(ctx context.Context, match map[string]string, errMsg string) ([]string, error)
+	// Requeue moves the given jobs that are failed or cancelled back to
+	// "queued" as if newly created: result, error, timestamps and attempts are
+	// cleared, token totals are kept. It returns the jobs it requeued; the
+	// others are left untouched.
+	Requeue(ctx context.Context, ids []string) ([]*Job, error)
+	// ResetProcessing moves the "processing" jobs of this instance (see
+	// SetOwner), and those of any instance whose heartbeat is older than
+	// staleBefore, back to "queued" and returns their IDs. Called at startup
+	// to recover jobs that were interrupted by a crash; jobs other replicas
+	// are still running are left alone.
+	ResetProcessing(ctx context.Context, staleBefore time.Time) ([]string, error)
+	// ReclaimExpired is ResetProcessing restricted to other instances' jobs
+	// whose heartbeat is older than staleBefore, i.e. whose replica died.
+	ReclaimExpired(ctx context.Context, staleBefore time.Time) ([]string, error)
+	// Heartbeat renews the lease of this instance's "processing" jobs.
+	Heartbeat(ctx context.Context) error
 	// List returns a page of jobs ordered by created_at DESC, plus the total count.
-	List(ctx context.Context, limit, offset int) ([]*Job, int, error)
+	// Jobs created at the same instant are ordered by ID DESC, which keeps
+	// pages stable and, with ULID IDs, follows creation order.
+	// A non-empty status restricts both the page and the count to that status.
+	List(ctx context.Context, limit, offset int, status Status) ([]*Job, int, error)
+	// ListAfter returns the page of jobs that follow after in List order. It
+	// does not count the jobs, and rows inserted meanwhile cannot shift pages.
+	ListAfter(ctx context.Context, after Cursor, limit int, status Status) ([]*Job, error)
+	// QueuePosition returns the 1-based place of a queued job in dequeue
+	// order (priority, then age), or 0 once the job has left "queued".
+	// Returns ErrJobNotFound if the job does not exist.
+	QueuePosition(ctx context.Context, id string) (int, error)
+	// Facets returns the distinct models and statuses of all jobs with their counts.
+	Facets(ctx context.Context) (*Facets, error)
+	// QueueWaitStats summarizes, per model, how long jobs created since the
+	// given time waited before starting. Retried jobs are left out because
+	// started_at only records their last attempt.
+	QueueWaitStats(ctx context.Context, since time.Time) ([]WaitStats, error)
 	// DeleteTerminalBefore deletes terminal jobs (completed, failed, cancelled) older than the given time.
 	// Returns the number of deleted rows.
 	DeleteTerminalBefore(ctx context.Context, before time.Time) (int64, error)
@@ -0,0 +1,58 @@
+package job
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsTransient_SQLiteBusy(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "busy.db")
+	dsn := "file:" + path + "?_pragma=busy_timeout(0)"
+
+	holder, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer holder.Close()
+	if _, err := holder.Exec(`CREATE TABLE t (x INTEGER)`); err != nil {
+		t.Fatalf("CREATE TABLE: %v", err)
+	}
+	tx, err := holder.Begin()
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+	if _, err := tx.Exec(`INSERT INTO t VALUES (1)`); err != nil {
+		t.Fatalf("INSERT: %v", err)
+	}
+
+	other, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer other.Close()
+	_, err = other.Exec(`INSERT INTO t VALUES (2)`)
+	if err == nil {
+		t.Fatal("expected a busy error while another connection holds the write lock")
+	}
+	if !IsTransient(fmt.Errorf("create job: %w", err)) {
+		t.Errorf("IsTransient(%v) = false, want true", err)
+	}
+}
+
+func TestIsTransient_Others(t *testing.T) {
+	t.Parallel()
+	if !IsTransient(fmt.Errorf("get job: %w", driver.ErrBadConn)) {
+		t.Error("IsTransient(ErrBadConn) = false, want true")
+	}
+	for _, err := range []error{ErrJobNotFound, errors.New("decode results: bad JSON"), sql.ErrNoRows} {
+		if IsTransient(err) {
+			t.Errorf("IsTransient(%v) = true, want false", err)
+		}
+	}
+}
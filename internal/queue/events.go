@@ -0,0 +1,38 @@
+package queue
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/claudegate/claudegate/internal/job"
+)
+
+// Job lifecycle log events. Each is logged as the slog message with the same
+// field schema, so dashboards and alerts can filter on msg alone:
+// job_id, model, status, attempt, plus duration_ms on terminal events and
+// error on job.failed and job.retrying.
+const (
+	EventJobCreated   = "job.created"
+	EventJobStarted   = "job.started"
+	EventJobCompleted = "job.completed"
+	EventJobFailed    = "job.failed"
+	EventJobCancelled = "job.cancelled"
+	EventJobRetrying  = "job.retrying"
+	EventJobRequeued  = "job.requeued"
+)
+
+// LogEvent emits a lifecycle event for j. status is passed explicitly because
+// j is usually a snapshot taken before the transition being logged.
+func LogEvent(event string, j *job.Job, status job.Status, attrs ...any) {
+	level := slog.LevelInfo
+	if event == EventJobFailed || event == EventJobRetrying {
+		level = slog.LevelWarn
+	}
+	args := append([]any{
+		"job_id", j.ID,
+		"model", j.Model,
+		"status", string(status),
+		"attempt", max(j.Attempts, 1),
+	}, attrs...)
+	slog.Log(context.Background(), level, event, args...)
+}
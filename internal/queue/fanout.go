@@ -0,0 +1,141 @@
+package queue
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// ErrTooManySubscribers is returned by Subscribe when the job already has
+// CLAUDEGATE_SSE_MAX_SUBSCRIBERS listeners. Callers should map this to HTTP 429.
+var ErrTooManySubscribers = errors.New("too many subscribers")
+
+// subscriberBuffer is how many events a subscriber may lag behind before
+// notify starts dropping events for it.
+const subscriberBuffer = 64
+
+// subscriber is one SSE listener. notify drops events into inbox without
+// blocking; pump forwards them to out at the pace the client reads, so a slow
+// client never holds a lock that publishers or other subscribers need.
+type subscriber struct {
+	inbox chan SSEEvent
+	out   chan SSEEvent
+	stop  chan struct{}
+}
+
+// pump forwards inbox to out until the inbox is closed or the subscriber leaves.
+func (s *subscriber) pump() {
+	defer close(s.out)
+	for event := range s.inbox {
+		select {
+		case s.out <- event:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// fanout holds the subscribers of one job. Its lock is only held for
+// non-blocking sends, never while an event is written to a client.
+type fanout struct {
+	mu   sync.Mutex
+	subs []*subscriber
+}
+
+// Subscribe registers an SSE listener for a job. It returns the event channel,
+// which is closed after the final "result" event, and a func that must be
+// called once the caller stops reading.
+func (q *Queue) Subscribe(jobID string) (<-chan SSEEvent, func(), error) {
+	q.subsMu.Lock()
+	defer q.subsMu.Unlock()
+
+	f := q.subs[jobID]
+	if f == nil {
+		f = &fanout{}
+		q.subs[jobID] = f
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if limit := q.cfg.SSEMaxSubscribers; limit > 0 && len(f.subs) >= limit {
+		return nil, nil, fmt.Errorf("%w: job %s", ErrTooManySubscribers, jobID)
+	}
+
+	s := &subscriber{
+		inbox: make(chan SSEEvent, subscriberBuffer),
+		out:   make(chan SSEEvent),
+		stop:  make(chan struct{}),
+	}
+	f.subs = append(f.subs, s)
+	go s.pump()
+
+	var once sync.Once
+	return s.out, func() { once.Do(func() { q.unsubscribe(jobID, f, s) }) }, nil
+}
+
+// unsubscribe stops a subscriber's pump and removes it from the job's fanout.
+func (q *Queue) unsubscribe(jobID string, f *fanout, s *subscriber) {
+	close(s.stop)
+
+	q.subsMu.Lock()
+	defer q.subsMu.Unlock()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if i := slices.Index(f.subs, s); i >= 0 {
+		f.subs = slices.Delete(f.subs, i, i+1)
+	}
+	if len(f.subs) == 0 && q.subs[jobID] == f {
+		delete(q.subs, jobID)
+	}
+}
+
+// CloseSubscribers ends every SSE stream of a job with an "error" event, for
+// jobs that will never produce a result, e.g. deleted while queued.
+func (q *Queue) CloseSubscribers(jobID, reason string) {
+	data, _ := json.Marshal(map[string]string{"error": reason})
+	q.notifyAndClose(jobID, SSEEvent{Event: "error", Data: string(data)})
+}
+
+// notify sends an event to all subscribers of a job without blocking. A
+// subscriber whose inbox is full misses the event.
+func (q *Queue) notify(jobID string, event SSEEvent) {
+	q.subsMu.RLock()
+	f := q.subs[jobID]
+	q.subsMu.RUnlock()
+	if f == nil {
+		return
+	}
+
+	// Holding f.mu keeps notifyAndClose from closing an inbox mid-loop.
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, s := range f.subs {
+		select {
+		case s.inbox <- event:
+		default:
+		}
+	}
+}
+
+// notifyAndClose sends the final event and closes all channels for the job.
+func (q *Queue) notifyAndClose(jobID string, event SSEEvent) {
+	q.subsMu.Lock()
+	f := q.subs[jobID]
+	delete(q.subs, jobID)
+	q.subsMu.Unlock()
+	if f == nil {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, s := range f.subs {
+		select {
+		case s.inbox <- event:
+		default:
+		}
+		close(s.inbox)
+	}
+	f.subs = nil
+}
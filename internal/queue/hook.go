@@ -0,0 +1,84 @@
+package queue
+
+import (
+	"context"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/claudegate/claudegate/internal/job"
+	"github.com/claudegate/claudegate/internal/worker"
+)
+
+// hookBacklog caps the finished jobs waiting for a post-job command. Beyond
+// it the command is skipped for new jobs rather than holding up workers.
+const hookBacklog = 100
+
+// hookRun is one pending invocation of CLAUDEGATE_POST_JOB_COMMAND.
+type hookRun struct {
+	jobID  string
+	status job.Status
+}
+
+// startHooks launches the CLAUDEGATE_POST_JOB_WORKERS goroutines running the
+// post-job command. It is a no-op when no command is configured.
+func (q *Queue) startHooks(ctx context.Context) {
+	if q.hooks == nil {
+		return
+	}
+	for range q.cfg.PostJobWorkers {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case run := <-q.hooks:
+					q.runHook(ctx, run)
+				}
+			}
+		}()
+	}
+}
+
+// queueHook schedules the post-job command for a finished job, dropping it
+// with a warning when the backlog is full.
+func (q *Queue) queueHook(jobID string, status job.Status) {
+	if q.hooks == nil {
+		return
+	}
+	select {
+	case q.hooks <- hookRun{jobID: jobID, status: status}:
+	default:
+		slog.Warn("post-job command: backlog full, skipping", "job_id", jobID)
+	}
+}
+
+// runHook executes the post-job command. The job is identified through the
+// CLAUDEGATE_JOB_ID and CLAUDEGATE_JOB_STATUS environment variables only;
+// the command reads anything else, such as the result, from the API.
+func (q *Queue) runHook(ctx context.Context, run hookRun) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(q.cfg.PostJobTimeoutSeconds)*time.Second)
+	defer cancel()
+
+	argv := q.cfg.PostJobCommand
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	// Same environment as the CLI: no CLAUDE* variables such as the API keys
+	// unless CLAUDEGATE_WORKER_ENV_ALLOW lets them through.
+	cmd.Env = append(worker.FilteredEnv(),
+		"CLAUDEGATE_JOB_ID="+run.jobID,
+		"CLAUDEGATE_JOB_STATUS="+string(run.status),
+	)
+	// Its own process group, killed as a whole on timeout; WaitDelay keeps a
+	// background child holding the output pipe from blocking the hook worker.
+	stopKill := worker.StartInGroup(cmd)
+	out, err := cmd.CombinedOutput()
+	stopKill()
+	if err != nil {
+		if len(out) > 1024 {
+			out = out[:1024]
+		}
+		slog.Error("post-job command failed", "job_id", run.jobID, "error", err,
+			"output", strings.TrimSpace(string(out)))
+	}
+}
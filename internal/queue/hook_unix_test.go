@@ -0,0 +1,52 @@
+//go:build unix
+
+package queue
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/claudegate/claudegate/internal/job"
+)
+
+func TestRunHook_TimeoutKillsProcessGroup(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "child.pid")
+	hook := filepath.Join(dir, "hook.sh")
+	// The background child inherits the output pipe; only killing the whole
+	// group lets CombinedOutput return at the timeout.
+	content := "#!/bin/bash\nsleep 30 &\necho $! > " + pidFile + "\nwait\n"
+	if err := os.WriteFile(hook, []byte(content), 0o755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	cfg := testConfig("")
+	cfg.PostJobCommand = []string{hook}
+	cfg.PostJobTimeoutSeconds = 1
+	q := New(cfg, newMockStore())
+
+	start := time.Now()
+	q.runHook(context.Background(), hookRun{jobID: "hooked", status: job.StatusCompleted})
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("runHook took %v, want about the 1s timeout", elapsed)
+	}
+
+	raw, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(raw)))
+	for deadline := time.Now().Add(2 * time.Second); syscall.Kill(pid, 0) == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			syscall.Kill(pid, syscall.SIGKILL) //nolint:errcheck
+			t.Fatalf("hook child %d still running after timeout", pid)
+		}
+	}
+}
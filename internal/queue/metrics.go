@@ -0,0 +1,66 @@
+package queue
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/claudegate/claudegate/internal/job"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// jobsFinished counts jobs reaching a terminal status, by status.
+	jobsFinished = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "claudegate_jobs_finished_total",
+		Help: "Jobs that reached a terminal status.",
+	}, []string{"status"})
+
+	// jobDuration observes the processing time of each finished job, from
+	// MarkProcessing to the terminal status.
+	jobDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "claudegate_job_duration_seconds",
+		Help:    "Time spent processing a job, from start to terminal status.",
+		Buckets: []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800},
+	}, []string{"status"})
+
+	// queueWait observes, per model, how long a job waited between creation
+	// and its first start. Only registered with CLAUDEGATE_WAIT_METRICS.
+	queueWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "claudegate_queue_wait_seconds",
+		Help:    "Time a job waited in the queue before its first attempt, by model.",
+		Buckets: []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 1800},
+	}, []string{"model"})
+)
+
+// observeJob records a finished job's processing time.
+func observeJob(status job.Status, took time.Duration) {
+	jobDuration.WithLabelValues(string(status)).Observe(took.Seconds())
+}
+
+// observeWait records how long j waited before its first attempt.
+func observeWait(j *job.Job, started time.Time) {
+	queueWait.WithLabelValues(j.Model).Observe(started.Sub(j.CreatedAt).Seconds())
+}
+
+// MetricsHandler returns an http.Handler serving the queue's metrics in the
+// Prometheus text format: queue length, finished jobs by status and job
+// durations, plus the Go runtime collectors. Per-model queue wait is added
+// when CLAUDEGATE_WAIT_METRICS is on.
+func (q *Queue) MetricsHandler() http.Handler {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		jobsFinished,
+		jobDuration,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "claudegate_queue_length",
+			Help: "Jobs waiting for a worker.",
+		}, func() float64 { return float64(q.Len()) }),
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	if q.cfg.WaitMetrics {
+		reg.MustRegister(queueWait)
+	}
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+}
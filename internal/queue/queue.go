@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -16,35 +17,71 @@ import (
 	"github.com/claudegate/claudegate/internal/worker"
 )
 
-// ErrQueueFull is returned by Enqueue when the job channel is at capacity.
+// ErrQueueFull is returned by Enqueue when CLAUDEGATE_QUEUE_SIZE jobs are waiting.
 // Callers should map this to HTTP 503 Service Unavailable.
 var ErrQueueFull = errors.New("queue full")
 
 // SSEEvent represents a Server-Sent Events event.
 type SSEEvent struct {
-	Event string // "status", "chunk", "result"
+	Event string // "status", "chunk", "thinking", "result", "diagnostic", "error"
 	Data  string // JSON string
 }
 
 // Queue manages the job queue and workers.
 type Queue struct {
-	jobs    chan string
-	store   job.Store
-	subs    map[string][]chan SSEEvent
-	cancels map[string]context.CancelFunc
-	mu      sync.RWMutex
-	cfg     *config.Config
+	waiting  [][]string    // queued IDs per priority rank, FIFO within a rank; guarded by mu
+	held     []string      // queued IDs outside waiting: in retry backoff or waiting for an in-flight slot; guarded by mu
+	ready    *sync.Cond    // signalled on mu when a job is enqueued or the workers stop
+	inFlight chan struct{} // semaphore capping simultaneous executions
+	results  job.ResultPipeline
+	backoff  time.Duration // delay before a retry, multiplied by the attempts made so far
+	store    job.Store
+	subs     map[string]*fanout // SSE subscribers per job, guarded by subsMu
+	subsMu   sync.RWMutex
+	cancels  map[string]context.CancelFunc
+	mu       sync.RWMutex
+	draining bool           // set by Drain: workers stop taking jobs; guarded by mu
+	paused   bool           // set by Pause: workers wait instead of taking jobs; guarded by mu
+	restored bool           // set once Recovery has finished; guarded by mu
+	hooks    chan hookRun   // finished jobs waiting for the post-job command, nil when disabled
+	active   sync.WaitGroup // processJob calls in progress, counted when next hands out a job
+	cfg      *config.Config
+
+	// deliver sends one webhook: webhook.Send, replaced in tests.
+	deliver func(ctx context.Context, url string, payload []byte, opts webhook.Options)
 }
 
 // New creates a new Queue.
 func New(cfg *config.Config, store job.Store) *Queue {
-	return &Queue{
-		jobs:    make(chan string, cfg.QueueSize),
-		store:   store,
-		subs:    make(map[string][]chan SSEEvent),
-		cancels: make(map[string]context.CancelFunc),
-		cfg:     cfg,
+	maxInFlight := cfg.MaxInFlight
+	if maxInFlight <= 0 {
+		maxInFlight = cfg.Concurrency
 	}
+	names := cfg.ResultProcessors
+	if names == nil {
+		names = job.DefaultResultProcessors
+	}
+	// Names are validated by config.Load; an error here means a hand-built config.
+	results, err := job.NewResultPipeline(names)
+	if err != nil {
+		slog.Error("queue: result processors", "error", err)
+	}
+	q := &Queue{
+		waiting:  make([][]string, len(job.Priorities)),
+		inFlight: make(chan struct{}, max(maxInFlight, 1)),
+		results:  results,
+		backoff:  2 * time.Second,
+		store:    store,
+		subs:     make(map[string]*fanout),
+		cancels:  make(map[string]context.CancelFunc),
+		deliver:  webhook.Send,
+		cfg:      cfg,
+	}
+	q.ready = sync.NewCond(&q.mu)
+	if len(cfg.PostJobCommand) > 0 {
+		q.hooks = make(chan hookRun, hookBacklog)
+	}
+	return q
 }
 
 // Cancel cancels a running job by its ID. Returns true if the job was found and cancelled.
@@ -59,63 +96,281 @@ func (q *Queue) Cancel(jobID string) bool {
 	return false
 }
 
-// Enqueue adds a job ID to the queue. Returns an error if the queue is full.
-func (q *Queue) Enqueue(jobID string) error {
-	select {
-	case q.jobs <- jobID:
-		return nil
-	default:
+// Enqueue adds a job ID to the queue behind the jobs of the same or a higher
+// priority. Returns an error if the queue is full.
+func (q *Queue) Enqueue(jobID string, priority job.Priority) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.releaseLocked(jobID)
+	if q.lenLocked() >= q.cfg.QueueSize {
 		return fmt.Errorf("%w: job %s", ErrQueueFull, jobID)
 	}
+	rank := priority.Rank()
+	q.waiting[rank] = append(q.waiting[rank], jobID)
+	q.ready.Signal()
+	return nil
 }
 
-// Start launches N workers (cfg.Concurrency) as goroutines.
-func (q *Queue) Start(ctx context.Context) {
-	for range q.cfg.Concurrency {
-		go q.runWorker(ctx)
+// putBack returns a job handed out by next to the front of its priority, as
+// if it had never left. Unlike Enqueue it ignores QueueSize: the slot it
+// frees was counted when the job was first enqueued.
+func (q *Queue) putBack(jobID string, priority job.Priority) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.releaseLocked(jobID)
+	rank := priority.Rank()
+	q.waiting[rank] = slices.Insert(q.waiting[rank], 0, jobID)
+}
+
+// hold records a queued job that is out of waiting for a while, so that
+// Pending, and with it the snapshot, still lists it. Enqueue and putBack
+// forget it again when it returns. next holds the jobs it hands out itself.
+func (q *Queue) hold(jobID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.held = append(q.held, jobID)
+}
+
+// release forgets a job recorded by hold that is no longer queued.
+func (q *Queue) release(jobID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.releaseLocked(jobID)
+}
+
+func (q *Queue) releaseLocked(jobID string) {
+	if i := slices.Index(q.held, jobID); i >= 0 {
+		q.held = slices.Delete(q.held, i, i+1)
 	}
 }
 
-// Subscribe creates a buffered SSE channel for a job and returns it.
-func (q *Queue) Subscribe(jobID string) chan SSEEvent {
-	ch := make(chan SSEEvent, 64)
+// Boost moves a waiting job to the front of the queue, ahead of every other
+// job including the high-priority ones, so that the next free worker takes
+// it. It reports whether the job was waiting; a job in its retry backoff or
+// already handed to a worker is left alone.
+func (q *Queue) Boost(jobID string) bool {
 	q.mu.Lock()
-	q.subs[jobID] = append(q.subs[jobID], ch)
-	q.mu.Unlock()
-	return ch
+	defer q.mu.Unlock()
+	for rank, ids := range q.waiting {
+		i := slices.Index(ids, jobID)
+		if i < 0 {
+			continue
+		}
+		q.waiting[rank] = slices.Delete(ids, i, i+1)
+		q.waiting[0] = slices.Insert(q.waiting[0], 0, jobID)
+		return true
+	}
+	return false
 }
 
-// Unsubscribe removes an SSE channel from the map.
-func (q *Queue) Unsubscribe(jobID string, ch chan SSEEvent) {
+// Pause stops the workers from taking jobs until Resume. Running jobs finish
+// normally and Enqueue keeps accepting new ones.
+func (q *Queue) Pause() {
 	q.mu.Lock()
 	defer q.mu.Unlock()
+	q.paused = true
+}
+
+// Resume lets the workers take jobs again after Pause.
+func (q *Queue) Resume() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.paused = false
+	q.ready.Broadcast()
+}
+
+// Paused reports whether the queue is paused.
+func (q *Queue) Paused() bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.paused
+}
+
+// Len returns the number of jobs waiting for a worker.
+func (q *Queue) Len() int {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.lenLocked()
+}
+
+// Full reports whether Enqueue would currently reject a job.
+func (q *Queue) Full() bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.lenLocked() >= q.cfg.QueueSize
+}
+
+// Recovered reports whether Recovery has completed.
+func (q *Queue) Recovered() bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.restored
+}
 
-	chans := q.subs[jobID]
-	for i, c := range chans {
-		if c == ch {
-			q.subs[jobID] = append(chans[:i], chans[i+1:]...)
-			break
+// Stats is a point-in-time view of the queue's load.
+type Stats struct {
+	Depth    int // jobs waiting for a worker
+	Capacity int // CLAUDEGATE_QUEUE_SIZE
+	Active   int // jobs being processed
+}
+
+// Stats returns the current queue depth, capacity and running jobs.
+func (q *Queue) Stats() Stats {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return Stats{Depth: q.lenLocked(), Capacity: q.cfg.QueueSize, Active: len(q.cancels)}
+}
+
+func (q *Queue) lenLocked() int {
+	n := 0
+	for _, ids := range q.waiting {
+		n += len(ids)
+	}
+	return n
+}
+
+// next blocks until a job is waiting and the queue is not paused, and removes
+// the highest-priority job. It returns false once ctx is done or the queue is
+// draining. The job is
+// counted in q.active; the caller must call q.active.Done when finished.
+func (q *Queue) next(ctx context.Context) (string, bool) {
+	// Wake the wait below when ctx ends, so the worker can exit.
+	stop := context.AfterFunc(ctx, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.ready.Broadcast()
+	})
+	defer stop()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		if ctx.Err() != nil || q.draining {
+			return "", false
+		}
+		for rank, ids := range q.waiting {
+			if len(ids) > 0 && !q.paused {
+				q.waiting[rank] = ids[1:]
+				// Held until processJob marks it processing or drops it.
+				q.held = append(q.held, ids[0])
+				q.active.Add(1)
+				return ids[0], true
+			}
 		}
+		q.ready.Wait()
+	}
+}
+
+// Drain stops the workers from taking new jobs and waits for the running
+// ones to finish. Jobs still waiting stay in the queue, where SaveSnapshot
+// can persist them. It returns ctx.Err() if ctx ends first; the running jobs
+// are then left to the caller, which typically cancels the worker context.
+func (q *Queue) Drain(ctx context.Context) error {
+	q.mu.Lock()
+	q.draining = true
+	q.ready.Broadcast()
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	if len(q.subs[jobID]) == 0 {
-		delete(q.subs, jobID)
+}
+
+// Start launches N workers (cfg.Concurrency) as goroutines, plus the
+// post-job command workers when CLAUDEGATE_POST_JOB_COMMAND is set.
+func (q *Queue) Start(ctx context.Context) {
+	for range q.cfg.Concurrency {
+		go q.runWorker(ctx)
 	}
+	q.startHooks(ctx)
 }
 
-// Recovery resets "processing" jobs and re-enqueues them.
+// Recovery resets this instance's "processing" jobs, and those whose lease
+// expired, and re-enqueues them. When queue snapshots are enabled, the jobs
+// that were still waiting follow in their saved order.
 func (q *Queue) Recovery(ctx context.Context) error {
-	ids, err := q.store.ResetProcessing(ctx)
+	ids, err := q.store.ResetProcessing(ctx, q.leaseCutoff())
 	if err != nil {
 		return fmt.Errorf("reset processing: %w", err)
 	}
-	for _, id := range ids {
-		if err := q.Enqueue(id); err != nil {
-			slog.Error("recovery: failed to enqueue job", "job_id", id, "error", err)
+	q.enqueueRecovered(ctx, "recovery", ids)
+	if q.cfg.QueueSnapshotPath != "" {
+		if err := q.restoreSnapshot(ctx, q.cfg.QueueSnapshotPath, ids); err != nil {
+			return fmt.Errorf("restore queue snapshot: %w", err)
 		}
 	}
+	q.mu.Lock()
+	q.restored = true
+	q.mu.Unlock()
 	return nil
 }
 
+// enqueueRecovered re-enqueues jobs just moved back to "queued".
+func (q *Queue) enqueueRecovered(ctx context.Context, op string, ids []string) {
+	for _, id := range ids {
+		j, err := q.store.Get(ctx, id)
+		if err != nil {
+			slog.Error(op+": failed to load job", "job_id", id, "error", err)
+			continue
+		}
+		if err := q.Enqueue(id, j.Priority); err != nil {
+			slog.Error(op+": failed to enqueue job", "job_id", id, "error", err)
+		}
+	}
+}
+
+// leaseCutoff is the heartbeat time before which a processing job counts as
+// abandoned by its replica.
+func (q *Queue) leaseCutoff() time.Time {
+	return time.Now().Add(-time.Duration(q.cfg.LeaseSeconds) * time.Second)
+}
+
+// StartHeartbeat launches a background goroutine that renews the lease of
+// this instance's running jobs every third of CLAUDEGATE_LEASE_SECONDS and
+// requeues the jobs of replicas whose lease expired. It is a no-op when
+// LeaseSeconds is 0.
+func (q *Queue) StartHeartbeat(ctx context.Context) {
+	if q.cfg.LeaseSeconds <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(q.cfg.LeaseSeconds) * time.Second / 3)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				q.heartbeat(ctx)
+			}
+		}
+	}()
+}
+
+// heartbeat runs one StartHeartbeat tick.
+func (q *Queue) heartbeat(ctx context.Context) {
+	if err := q.store.Heartbeat(ctx); err != nil {
+		slog.Error("heartbeat", "error", err)
+	}
+	ids, err := q.store.ReclaimExpired(ctx, q.leaseCutoff())
+	if err != nil {
+		slog.Error("heartbeat: reclaim expired jobs", "error", err)
+		return
+	}
+	if len(ids) > 0 {
+		slog.Warn("heartbeat: requeued jobs of an unresponsive replica", "count", len(ids))
+	}
+	q.enqueueRecovered(ctx, "heartbeat", ids)
+}
+
 // StartCleanup launches a background goroutine that periodically deletes old terminal jobs.
 func (q *Queue) StartCleanup(ctx context.Context, ttlHours, intervalMinutes int) {
 	if ttlHours <= 0 {
@@ -145,57 +400,149 @@ func (q *Queue) StartCleanup(ctx context.Context, ttlHours, intervalMinutes int)
 // runWorker is a worker loop: dequeues jobs and processes them.
 func (q *Queue) runWorker(ctx context.Context) {
 	for {
-		select {
-		case <-ctx.Done():
+		jobID, ok := q.next(ctx)
+		if !ok {
 			return
-		case jobID := <-q.jobs:
-			q.processJob(ctx, jobID)
 		}
+		q.processJob(ctx, jobID)
+		q.active.Done()
 	}
 }
 
 // chunkWriter implements worker.ChunkWriter, forwarding chunks to SSE subscribers.
+// It also buffers the streamed text so a timed-out job can keep its partial output,
+// and stores it as the job's partial_result at most once per CLAUDEGATE_PARTIAL_RESULT_SECONDS.
+// WriteChunk is only called from the goroutine running worker.Run, so no locking is needed.
 type chunkWriter struct {
+	ctx   context.Context
 	q     *Queue
 	jobID string
+	buf   strings.Builder
+	model string // model reported by the CLI init message
+	saved time.Time
+	usage *worker.Usage // tokens and stop reason reported by the CLI result
+	sid   string        // CLI session ID, resumable by follow-up jobs
 }
 
 func (cw *chunkWriter) WriteChunk(text string) {
+	cw.buf.WriteString(text)
 	data, _ := json.Marshal(map[string]string{"text": text})
 	cw.q.notify(cw.jobID, SSEEvent{Event: "chunk", Data: string(data)})
+
+	interval := time.Duration(cw.q.cfg.PartialResultSeconds) * time.Second
+	if interval > 0 && time.Since(cw.saved) >= interval {
+		cw.saved = time.Now()
+		if err := cw.q.store.SetPartialResult(cw.ctx, cw.jobID, cw.buf.String()); err != nil {
+			slog.Error("worker: set partial result", "job_id", cw.jobID, "error", err)
+		}
+	}
+}
+
+// WriteThinking implements worker.ThinkingWriter. Thinking is only streamed:
+// it is kept out of buf, so it never lands in the partial or final result.
+func (cw *chunkWriter) WriteThinking(text string) {
+	data, _ := json.Marshal(map[string]string{"text": text})
+	cw.q.notify(cw.jobID, SSEEvent{Event: "thinking", Data: string(data)})
+}
+
+// ReportModel implements worker.ModelReporter.
+func (cw *chunkWriter) ReportModel(model string) {
+	cw.model = model
+}
+
+// ReportSession implements worker.SessionReporter.
+func (cw *chunkWriter) ReportSession(sessionID string) {
+	cw.sid = sessionID
+}
+
+// ReportUsage implements worker.UsageReporter.
+func (cw *chunkWriter) ReportUsage(u worker.Usage) {
+	cw.usage = &u
+}
+
+// diagnosticChunkWriter extends chunkWriter with worker.DiagnosticWriter.
+// Only used when CLAUDEGATE_SSE_DIAGNOSTICS is enabled.
+type diagnosticChunkWriter struct {
+	*chunkWriter
+}
+
+func (dw *diagnosticChunkWriter) WriteDiagnostic(source, text string) {
+	data, _ := json.Marshal(map[string]string{"source": source, "text": text})
+	dw.q.notify(dw.jobID, SSEEvent{Event: "diagnostic", Data: string(data)})
 }
 
 func (q *Queue) processJob(ctx context.Context, jobID string) {
 	// Check if job was cancelled while waiting in the queue channel.
 	j, err := q.store.Get(ctx, jobID)
 	if errors.Is(err, job.ErrJobNotFound) {
+		q.release(jobID)
 		slog.Warn("worker: job not found", "job_id", jobID)
+		q.CloseSubscribers(jobID, "job not found")
 		return
 	}
 	if err != nil {
+		q.release(jobID)
 		slog.Error("worker: get job", "job_id", jobID, "error", err)
 		return
 	}
 	if j.Status == job.StatusCancelled {
+		q.release(jobID)
 		slog.Info("worker: job already cancelled, skipping", "job_id", jobID)
 		return
 	}
 
-	if err := q.store.MarkProcessing(ctx, jobID); err != nil {
+	// Global ceiling on executions, independent of how many workers are
+	// running. The job stays held by next meanwhile, so a snapshot still
+	// lists it until MarkProcessing.
+	select {
+	case q.inFlight <- struct{}{}:
+		defer func() { <-q.inFlight }()
+	case <-ctx.Done():
+		// Keep its place so a snapshot saves it.
+		q.putBack(jobID, j.Priority)
+		return
+	}
+
+	// MarkProcessing only takes a job that is still queued: one cancelled
+	// while it waited for a slot above must not run.
+	err = q.store.MarkProcessing(ctx, jobID)
+	q.release(jobID)
+	if errors.Is(err, job.ErrJobNotQueued) {
+		slog.Info("worker: job left the queue while waiting, skipping", "job_id", jobID)
+		return
+	} else if err != nil {
 		slog.Error("worker: mark processing", "job_id", jobID, "error", err)
 		return
 	}
 
+	j.Attempts++ // mirror the count MarkProcessing just stored
+	started := time.Now()
+	if q.cfg.WaitMetrics && j.Attempts == 1 {
+		observeWait(j, started)
+	}
+	LogEvent(EventJobStarted, j, job.StatusProcessing)
 	q.notify(jobID, SSEEvent{Event: "status", Data: `{"status":"processing"}`})
+	if j.WantsEvent(job.StatusProcessing) {
+		q.sendWebhooks(ctx, j, false, map[string]any{
+			"event":   string(job.StatusProcessing),
+			"job_id":  j.ID,
+			"status":  string(job.StatusProcessing),
+			"attempt": j.Attempts,
+		})
+	}
 
 	// Create cancellable context for this job.
 	jobCtx, jobCancel := context.WithCancel(ctx)
 	defer jobCancel()
 
-	// Apply per-job timeout if configured.
-	if q.cfg.JobTimeoutMinutes > 0 {
+	// Apply per-job timeout if configured, the job's own one first.
+	timeout := time.Duration(q.cfg.JobTimeoutMinutes) * time.Minute
+	if j.TimeoutSeconds > 0 {
+		timeout = time.Duration(j.TimeoutSeconds) * time.Second
+	}
+	if timeout > 0 {
 		var timeoutCancel context.CancelFunc
-		jobCtx, timeoutCancel = context.WithTimeout(jobCtx, time.Duration(q.cfg.JobTimeoutMinutes)*time.Minute)
+		jobCtx, timeoutCancel = context.WithTimeout(jobCtx, timeout)
 		defer timeoutCancel()
 	}
 
@@ -209,21 +556,98 @@ func (q *Queue) processJob(ctx context.Context, jobID string) {
 		q.mu.Unlock()
 	}()
 
-	cw := &chunkWriter{q: q, jobID: jobID}
+	chunks := &chunkWriter{ctx: ctx, q: q, jobID: jobID}
+	var cw worker.ChunkWriter = chunks
+	if q.cfg.SSEDiagnostics {
+		cw = &diagnosticChunkWriter{chunkWriter: chunks}
+	}
 
 	systemPrompt := q.cfg.SecurityPrompt
-	if j.ResponseFormat == "json" {
-		systemPrompt = systemPrompt + "\n\nCRITICAL: Your response must be RAW JSON only. Do NOT wrap it in ```json code fences. Do NOT add any text before or after the JSON. Do NOT use markdown formatting. Start directly with { or [ and end with } or ]. The raw output must be directly parseable by JSON.parse(). Be concise and fast."
+	if len(j.AllowedTools) > 0 {
+		slog.Warn("worker: job enables CLI tools", "job_id", jobID, "allowed_tools", j.AllowedTools)
+		if systemPrompt != "" {
+			// Otherwise the security rules forbid the very tools the job asked for.
+			systemPrompt = systemPrompt + "\n\nException: for this job you may use only these tools: " +
+				strings.Join(j.AllowedTools, ", ") + ". Every other rule still applies."
+		}
+	}
+	format := j.ResponseFormat
+	if j.WantsJSON() {
+		format = "json"
+	}
+	if instruction := job.ResponseFormatInstruction(format); instruction != "" {
+		systemPrompt = systemPrompt + "\n\n" + instruction
+	}
+	if len(j.ResponseSchema) > 0 {
+		systemPrompt = systemPrompt + "\n\n" + job.ResponseSchemaInstruction(j.ResponseSchema)
 	}
 	if j.SystemPrompt != "" {
 		systemPrompt = systemPrompt + "\n\n" + j.SystemPrompt
 	}
+	if q.cfg.KeepEffectivePrompt {
+		if err := q.store.SetEffectiveSystemPrompt(ctx, jobID, systemPrompt); err != nil {
+			slog.Error("worker: store effective system prompt", "job_id", jobID, "error", err)
+		}
+	}
 
-	result, runErr := worker.Run(jobCtx, q.cfg.ClaudePath, j.Model, j.Prompt, systemPrompt, cw)
+	opts := worker.Options{
+		OutputFormat:     j.OutputFormat,
+		SuccessExitCodes: q.cfg.SuccessExitCodes,
+		DedupChunks:      q.cfg.DedupChunks,
+		PermissionMode:   q.cfg.PermissionMode,
+		AllowedTools:     j.AllowedTools,
+		MCPConfig:        q.cfg.MCPConfig,
+	}
+	if opts.OutputFormat == "" {
+		opts.OutputFormat = q.cfg.OutputFormat
+	}
+	if j.ParentJobID != "" {
+		// The parent was checked at creation but may have been deleted since.
+		parent, err := q.store.Get(ctx, j.ParentJobID)
+		if err != nil || parent.SessionID == "" {
+			q.finalizeJob(ctx, j, job.StatusFailed, "", fmt.Sprintf("parent job %s has no session to resume", j.ParentJobID))
+			return
+		}
+		opts.ResumeSessionID = parent.SessionID
+	}
+
+	result, runErr := worker.Run(jobCtx, q.cfg.ClaudePath, j.Model, j.Prompt, systemPrompt, cw, opts)
+	if chunks.model != "" {
+		if err := q.store.SetResolvedModel(ctx, jobID, chunks.model); err != nil {
+			slog.Error("worker: set resolved model", "job_id", jobID, "error", err)
+		}
+	}
+	if chunks.sid != "" {
+		if err := q.store.SetSessionID(ctx, jobID, chunks.sid); err != nil {
+			slog.Error("worker: set session id", "job_id", jobID, "error", err)
+		}
+	}
+	if u := chunks.usage; u != nil {
+		if err := q.store.AddUsage(ctx, jobID, u.InputTokens, u.OutputTokens, u.StopReason); err != nil {
+			slog.Error("worker: add usage", "job_id", jobID, "error", err)
+		}
+		// Mirror the totals AddUsage just stored, for finalizeJob's cost.
+		j.InputTokens += u.InputTokens
+		j.OutputTokens += u.OutputTokens
+		j.StopReason = u.StopReason
+	}
 
-	// Strip markdown code fences if JSON mode (LLMs sometimes ignore instructions)
-	if j.ResponseFormat == "json" && runErr == nil {
-		result = stripCodeFences(result)
+	if runErr == nil {
+		result, runErr = q.results.Process(j, result)
+	}
+	if runErr == nil && len(j.ResponseSchema) > 0 {
+		runErr = job.CheckResponseSchema(j.ResponseSchema, result)
+	}
+	if runErr == nil && len(j.ResponseFormats) > 0 {
+		results := job.FormatResults(j.ResponseFormats, result)
+		if err := q.store.SetResults(ctx, jobID, results); err != nil {
+			slog.Error("worker: set results", "job_id", jobID, "error", err)
+		}
+		// A json variant that did not parse is missing: keep the raw output
+		// rather than completing the job with an empty result.
+		if r, ok := results[j.ResponseFormats[0]]; ok {
+			result = r
+		}
 	}
 
 	var status job.Status
@@ -236,7 +660,20 @@ func (q *Queue) processJob(ctx context.Context, jobID string) {
 		case errors.Is(runErr, context.DeadlineExceeded):
 			status = job.StatusFailed
 			errMsg = fmt.Sprintf("job timed out after %dm", q.cfg.JobTimeoutMinutes)
+			if j.TimeoutSeconds > 0 {
+				errMsg = fmt.Sprintf("job timed out after %ds", j.TimeoutSeconds)
+			}
+			if q.cfg.PartialResultOnTimeout {
+				result = chunks.buf.String()
+			}
+			if err := q.store.MarkTimedOut(ctx, jobID); err != nil {
+				slog.Error("worker: mark timed out", "job_id", jobID, "error", err)
+			}
 		default:
+			if j.Attempts <= j.MaxRetries {
+				q.retry(ctx, j, runErr.Error(), time.Since(started))
+				return
+			}
 			status = job.StatusFailed
 			errMsg = runErr.Error()
 		}
@@ -244,12 +681,52 @@ func (q *Queue) processJob(ctx context.Context, jobID string) {
 		status = job.StatusCompleted
 	}
 
-	q.finalizeJob(ctx, jobID, status, result, errMsg, j.CallbackURL)
+	q.finalizeJob(ctx, j, status, result, errMsg)
+
+	took := time.Since(started)
+	observeJob(status, took)
+	attrs := []any{"duration_ms", took.Milliseconds()}
+	switch status {
+	case job.StatusCompleted:
+		LogEvent(EventJobCompleted, j, status, attrs...)
+	case job.StatusCancelled:
+		LogEvent(EventJobCancelled, j, status, attrs...)
+	default:
+		LogEvent(EventJobFailed, j, status, append(attrs, "error", errMsg)...)
+	}
 }
 
-func (q *Queue) finalizeJob(ctx context.Context, jobID string, status job.Status, result, errMsg, callbackURL string) {
-	if err := q.store.UpdateStatus(ctx, jobID, status, result, errMsg); err != nil {
-		slog.Error("worker: update status", "job_id", jobID, "error", err)
+// retry puts a job whose attempt failed back in the queue after a backoff
+// that grows with each attempt.
+func (q *Queue) retry(ctx context.Context, j *job.Job, errMsg string, took time.Duration) {
+	if err := q.store.MarkRetrying(ctx, j.ID, errMsg); err != nil {
+		slog.Error("worker: mark retrying", "job_id", j.ID, "error", err)
+	}
+	LogEvent(EventJobRetrying, j, job.StatusQueued, "duration_ms", took.Milliseconds(), "error", errMsg)
+	q.notify(j.ID, SSEEvent{Event: "status", Data: `{"status":"queued"}`})
+
+	// Queued again in the store: hold it through the backoff so a snapshot
+	// taken meanwhile saves it.
+	q.hold(j.ID)
+	time.AfterFunc(q.backoff*time.Duration(j.Attempts), func() {
+		if err := q.Enqueue(j.ID, j.Priority); err != nil {
+			slog.Error("worker: re-enqueue for retry", "job_id", j.ID, "error", err)
+			q.finalizeJob(context.WithoutCancel(ctx), j, job.StatusFailed, "", errMsg)
+		}
+	})
+}
+
+func (q *Queue) finalizeJob(ctx context.Context, j *job.Job, status job.Status, result, errMsg string) {
+	if err := q.store.UpdateStatus(ctx, j.ID, status, result, errMsg); err != nil {
+		slog.Error("worker: update status", "job_id", j.ID, "error", err)
+	}
+	jobsFinished.WithLabelValues(string(status)).Inc()
+
+	cost, priced := q.estimateCost(j)
+	if priced {
+		if err := q.store.SetCost(ctx, j.ID, cost); err != nil {
+			slog.Error("worker: set cost", "job_id", j.ID, "error", err)
+		}
 	}
 
 	data, _ := json.Marshal(map[string]string{
@@ -257,60 +734,111 @@ func (q *Queue) finalizeJob(ctx context.Context, jobID string, status job.Status
 		"result": result,
 		"error":  errMsg,
 	})
-	q.notifyAndClose(jobID, SSEEvent{Event: "result", Data: string(data)})
-
-	if callbackURL != "" {
-		payload, _ := json.Marshal(map[string]string{
-			"job_id": jobID,
-			"status": string(status),
-			"result": result,
-			"error":  errMsg,
-		})
-		webhook.Send(context.WithoutCancel(ctx), callbackURL, payload)
+	q.notifyAndClose(j.ID, SSEEvent{Event: "result", Data: string(data)})
+
+	if j.WantsEvent(status) {
+		fields := terminalFields(j.ID, status, result, errMsg)
+		if priced {
+			fields["cost_usd"] = cost
+		}
+		q.sendWebhooks(ctx, j, true, fields)
 	}
+	q.queueHook(j.ID, status)
 }
 
-// stripCodeFences removes markdown code fences that LLMs sometimes add despite instructions.
-func stripCodeFences(s string) string {
-	s = strings.TrimSpace(s)
-	if strings.HasPrefix(s, "```") {
-		// Remove opening fence (```json, ```, etc.)
-		if idx := strings.Index(s, "\n"); idx != -1 {
-			s = s[idx+1:]
-		}
-		// Remove closing fence
-		s = strings.TrimSuffix(s, "```")
-		s = strings.TrimSpace(s)
+// Redeliver sends the terminal webhook of the finished job j again to all of
+// its callback URLs, with the payload finalizeJob sent, and tracks the new
+// delivery in webhook_status. It does not wait for the deliveries.
+func (q *Queue) Redeliver(ctx context.Context, j *job.Job) {
+	fields := terminalFields(j.ID, j.Status, j.Result, j.Error)
+	if j.CostUSD != nil {
+		fields["cost_usd"] = *j.CostUSD
 	}
-	return s
+	q.sendWebhooks(ctx, j, true, fields)
 }
 
-// notify sends an event to all subscribers of a job without blocking.
-// The RLock is held for the entire iteration to prevent notifyAndClose from
-// closing channels between the slice copy and the send (send on closed channel panic).
-func (q *Queue) notify(jobID string, event SSEEvent) {
-	q.mu.RLock()
-	defer q.mu.RUnlock()
-	for _, ch := range q.subs[jobID] {
-		select {
-		case ch <- event:
-		default:
+// terminalFields builds the webhook payload announcing that a job ended
+// with status.
+func terminalFields(jobID string, status job.Status, result, errMsg string) map[string]any {
+	return map[string]any{
+		"event":  string(status),
+		"job_id": jobID,
+		"status": string(status),
+		"result": result,
+		"error":  errMsg,
+	}
+}
+
+// sendWebhooks delivers fields as JSON to every callback URL of j. The
+// deliveries outlive ctx. With track, their combined outcome is stored as
+// the job's webhook_status.
+func (q *Queue) sendWebhooks(ctx context.Context, j *job.Job, track bool, fields map[string]any) {
+	callbacks := j.Callbacks()
+	if len(callbacks) == 0 {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	payload, _ := json.Marshal(fields)
+	opts := webhook.Options{
+		Secret:   q.cfg.WebhookSecret,
+		Headers:  j.CallbackHeaders,
+		Attempts: q.cfg.WebhookAttempts,
+		Timeout:  time.Duration(q.cfg.WebhookTimeoutSeconds) * time.Second,
+		RetryCap: time.Duration(q.cfg.WebhookRetryCapSeconds) * time.Second,
+	}
+	if track {
+		ds := &deliveryStatus{pending: len(callbacks)}
+		record := func(status string) {
+			if err := q.store.SetWebhookStatus(ctx, j.ID, status, time.Now()); err != nil {
+				slog.Error("worker: set webhook status", "job_id", j.ID, "error", err)
+			}
 		}
+		record(webhook.StatusPending)
+		opts.Report = func(status string) {
+			ds.mu.Lock()
+			defer ds.mu.Unlock()
+			record(ds.update(status))
+		}
+	}
+	for _, u := range callbacks {
+		q.deliver(ctx, u, payload, opts)
 	}
 }
 
-// notifyAndClose sends the final event and closes all channels for the job.
-func (q *Queue) notifyAndClose(jobID string, event SSEEvent) {
-	q.mu.Lock()
-	chans := q.subs[jobID]
-	delete(q.subs, jobID)
-	q.mu.Unlock()
+// deliveryStatus combines the outcomes of one webhook sent to several URLs:
+// failed as soon as one URL fails, delivered once all of them succeed and
+// pending until then.
+type deliveryStatus struct {
+	mu      sync.Mutex // also orders the store writes of concurrent deliveries
+	pending int
+	failed  bool
+}
 
-	for _, ch := range chans {
-		select {
-		case ch <- event:
-		default:
-		}
-		close(ch)
+// update folds in one delivery's status and returns the combined one.
+func (d *deliveryStatus) update(status string) string {
+	switch status {
+	case webhook.StatusDelivered:
+		d.pending--
+	case webhook.StatusFailed:
+		d.pending--
+		d.failed = true
+	}
+	switch {
+	case d.failed:
+		return webhook.StatusFailed
+	case d.pending > 0:
+		return webhook.StatusPending
+	}
+	return webhook.StatusDelivered
+}
+
+// estimateCost prices j's token totals with the CLAUDEGATE_PRICE_* entry for
+// its model. It reports false when the model has no price or no tokens were
+// reported, in which case cost_usd is left unset.
+func (q *Queue) estimateCost(j *job.Job) (float64, bool) {
+	price, ok := q.cfg.Prices[j.Model]
+	if !ok || (j.InputTokens == 0 && j.OutputTokens == 0) {
+		return 0, false
 	}
+	return price.Cost(j.InputTokens, j.OutputTokens), true
 }
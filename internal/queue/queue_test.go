@@ -1,73 +1,25 @@
 package queue
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/claudegate/claudegate/internal/config"
 	"github.com/claudegate/claudegate/internal/job"
+	"github.com/claudegate/claudegate/internal/webhook"
 )
 
-func TestStripCodeFences(t *testing.T) {
-	t.Parallel()
-	tests := []struct {
-		name  string
-		input string
-		want  string
-	}{
-		{
-			name:  "standard JSON fence",
-			input: "```json\n{\"key\":\"value\"}\n```",
-			want:  "{\"key\":\"value\"}",
-		},
-		{
-			name:  "plain fence",
-			input: "```\n{\"key\":\"value\"}\n```",
-			want:  "{\"key\":\"value\"}",
-		},
-		{
-			name:  "no fence unchanged",
-			input: "{\"key\":\"value\"}",
-			want:  "{\"key\":\"value\"}",
-		},
-		{
-			name:  "only whitespace trimmed",
-			input: "  {\"key\":\"value\"}  ",
-			want:  "{\"key\":\"value\"}",
-		},
-		{
-			name:  "trailing newline after closing fence",
-			input: "```json\n{\"a\":1}\n```\n",
-			want:  "{\"a\":1}",
-		},
-		{
-			name:  "empty string",
-			input: "",
-			want:  "",
-		},
-		{
-			name:  "only opening fence no newline",
-			input: "```",
-			// HasPrefix matches, no newline so opening fence is kept, but HasSuffix
-			// also matches the same "```" so the closing fence removal strips it,
-			// leaving an empty string after TrimSpace.
-			want: "",
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			t.Parallel()
-			got := stripCodeFences(tt.input)
-			if got != tt.want {
-				t.Errorf("stripCodeFences(%q) = %q, want %q", tt.input, got, tt.want)
-			}
-		})
-	}
-}
-
 // mockStore implements job.Store for testing.
 type mockStore struct {
 	mu   sync.Mutex
@@ -85,6 +37,13 @@ func (m *mockStore) Create(ctx context.Context, j *job.Job) error {
 	return nil
 }
 
+func (m *mockStore) CreateBatch(ctx context.Context, jobs []*job.Job) error {
+	for _, j := range jobs {
+		m.Create(ctx, j) //nolint:errcheck
+	}
+	return nil
+}
+
 func (m *mockStore) Get(ctx context.Context, id string) (*job.Job, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -92,7 +51,8 @@ func (m *mockStore) Get(ctx context.Context, id string) (*job.Job, error) {
 	if !ok {
 		return nil, job.ErrJobNotFound
 	}
-	return j, nil
+	c := *j
+	return &c, nil
 }
 
 func (m *mockStore) UpdateStatus(ctx context.Context, id string, status job.Status, result, errMsg string) error {
@@ -102,6 +62,7 @@ func (m *mockStore) UpdateStatus(ctx context.Context, id string, status job.Stat
 		j.Status = status
 		j.Result = result
 		j.Error = errMsg
+		j.PartialResult = ""
 	}
 	return nil
 }
@@ -109,8 +70,22 @@ func (m *mockStore) UpdateStatus(ctx context.Context, id string, status job.Stat
 func (m *mockStore) MarkProcessing(ctx context.Context, id string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	if j, ok := m.jobs[id]; ok {
-		j.Status = job.StatusProcessing
+	j, ok := m.jobs[id]
+	if !ok || j.Status != job.StatusQueued {
+		return job.ErrJobNotQueued
+	}
+	j.Status = job.StatusProcessing
+	j.Attempts++
+	return nil
+}
+
+func (m *mockStore) MarkRetrying(ctx context.Context, id, errMsg string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if j, ok := m.jobs[id]; ok && j.Status == job.StatusProcessing {
+		j.Status = job.StatusQueued
+		j.Error = errMsg
+		j.StartedAt = nil
 	}
 	return nil
 }
@@ -122,11 +97,161 @@ func (m *mockStore) Delete(ctx context.Context, id string) error {
 	return nil
 }
 
-func (m *mockStore) List(ctx context.Context, limit, offset int) ([]*job.Job, int, error) {
+func (m *mockStore) MarkTimedOut(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if j, ok := m.jobs[id]; ok {
+		j.TimedOut = true
+	}
+	return nil
+}
+
+func (m *mockStore) SetEffectiveSystemPrompt(ctx context.Context, id, prompt string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if j, ok := m.jobs[id]; ok {
+		j.EffectiveSystemPrompt = prompt
+	}
+	return nil
+}
+
+func (m *mockStore) SetPartialResult(ctx context.Context, id, text string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if j, ok := m.jobs[id]; ok && j.Status == job.StatusProcessing {
+		j.PartialResult = text
+	}
+	return nil
+}
+
+func (m *mockStore) AddUsage(ctx context.Context, id string, inputTokens, outputTokens int, stopReason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if j, ok := m.jobs[id]; ok {
+		j.InputTokens += inputTokens
+		j.OutputTokens += outputTokens
+		j.StopReason = stopReason
+	}
+	return nil
+}
+
+func (m *mockStore) SetCost(ctx context.Context, id string, costUSD float64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if j, ok := m.jobs[id]; ok {
+		j.CostUSD = &costUSD
+	}
+	return nil
+}
+
+func (m *mockStore) SetResolvedModel(ctx context.Context, id, model string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if j, ok := m.jobs[id]; ok {
+		j.ResolvedModel = model
+	}
+	return nil
+}
+
+func (m *mockStore) CancelByMetadata(ctx context.Context, match map[string]string, errMsg string) ([]string, error) {
+	return nil, nil
+}
+
+func (m *mockStore) SetResults(ctx context.Context, id string, results map[string]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if j, ok := m.jobs[id]; ok {
+		j.Results = results
+	}
+	return nil
+}
+
+func (m *mockStore) Boost(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return job.ErrJobNotFound
+	}
+	j.Priority = job.PriorityHigh
+	return nil
+}
+
+func (m *mockStore) SetWebhookStatus(ctx context.Context, id, status string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if j, ok := m.jobs[id]; ok {
+		j.WebhookStatus = status
+		j.WebhookAttemptedAt = &at
+	}
+	return nil
+}
+
+func (m *mockStore) SetSessionID(ctx context.Context, id, sessionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if j, ok := m.jobs[id]; ok {
+		j.SessionID = sessionID
+	}
+	return nil
+}
+
+func (m *mockStore) SetNote(ctx context.Context, id, note string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return job.ErrJobNotFound
+	}
+	j.Note = note
+	return nil
+}
+
+func (m *mockStore) GetByIdempotencyKey(ctx context.Context, key string) (*job.Job, error) {
+	return nil, job.ErrJobNotFound
+}
+
+func (m *mockStore) ReleaseIdempotencyKey(ctx context.Context, key string, before time.Time) error {
+	return nil
+}
+
+func (m *mockStore) QueuePosition(ctx context.Context, id string) (int, error) {
+	return 0, nil
+}
+
+func (m *mockStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (m *mockStore) Facets(ctx context.Context) (*job.Facets, error) {
+	return &job.Facets{}, nil
+}
+
+func (m *mockStore) QueueWaitStats(ctx context.Context, since time.Time) ([]job.WaitStats, error) {
+	return nil, nil
+}
+
+func (m *mockStore) List(ctx context.Context, limit, offset int, status job.Status) ([]*job.Job, int, error) {
 	return nil, 0, nil
 }
 
-func (m *mockStore) ResetProcessing(ctx context.Context) ([]string, error) {
+func (m *mockStore) ListAfter(ctx context.Context, after job.Cursor, limit int, status job.Status) ([]*job.Job, error) {
+	return nil, nil
+}
+
+func (m *mockStore) Requeue(ctx context.Context, ids []string) ([]*job.Job, error) {
+	return nil, nil
+}
+
+func (m *mockStore) ReclaimExpired(ctx context.Context, staleBefore time.Time) ([]string, error) {
+	return nil, nil
+}
+
+func (m *mockStore) Heartbeat(ctx context.Context) error {
+	return nil
+}
+
+func (m *mockStore) ResetProcessing(ctx context.Context, staleBefore time.Time) ([]string, error) {
 	return nil, nil
 }
 
@@ -145,16 +270,18 @@ func testConfig(claudePath string) *config.Config {
 func TestNotify_NoRaceWithNotifyAndClose(t *testing.T) {
 	t.Parallel()
 	// Verify that concurrent notify + notifyAndClose do not panic.
-	q := &Queue{
-		subs: make(map[string][]chan SSEEvent),
-		jobs: make(chan string, 10),
-	}
+	q := New(testConfig(""), newMockStore())
 
 	jobID := "race-test"
-	ch := make(chan SSEEvent, 64)
-	q.mu.Lock()
-	q.subs[jobID] = []chan SSEEvent{ch}
-	q.mu.Unlock()
+	ch, unsubscribe, err := q.Subscribe(jobID)
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	defer unsubscribe()
+	go func() {
+		for range ch {
+		}
+	}()
 
 	var wg sync.WaitGroup
 	// Goroutine 1: spam notify
@@ -183,17 +310,894 @@ func TestSubscribeUnsubscribe(t *testing.T) {
 	cfg := testConfig("")
 	q := New(cfg, store)
 
-	ch := q.Subscribe("job-1")
-	if ch == nil {
-		t.Fatal("Subscribe returned nil channel")
+	ch, unsubscribe, err := q.Subscribe("job-1")
+	if err != nil || ch == nil {
+		t.Fatalf("Subscribe = %v, %v; want a channel", ch, err)
 	}
 
-	q.Unsubscribe("job-1", ch)
+	unsubscribe()
+	unsubscribe() // must be safe to call twice
 
-	q.mu.RLock()
+	q.subsMu.RLock()
 	_, ok := q.subs["job-1"]
-	q.mu.RUnlock()
+	q.subsMu.RUnlock()
 	if ok {
 		t.Error("expected subs[job-1] to be cleaned up after unsubscribe")
 	}
 }
+
+func TestSubscribe_DeliversInOrderThenCloses(t *testing.T) {
+	t.Parallel()
+	q := New(testConfig(""), newMockStore())
+
+	ch, unsubscribe, err := q.Subscribe("job-1")
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	defer unsubscribe()
+
+	q.notify("job-1", SSEEvent{Event: "chunk", Data: "1"})
+	q.notify("job-1", SSEEvent{Event: "chunk", Data: "2"})
+	q.notifyAndClose("job-1", SSEEvent{Event: "result", Data: "done"})
+
+	var got []string
+	for event := range ch {
+		got = append(got, event.Data)
+	}
+	if want := []string{"1", "2", "done"}; !slices.Equal(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+}
+
+func TestSubscribe_MaxSubscribers(t *testing.T) {
+	t.Parallel()
+	cfg := testConfig("")
+	cfg.SSEMaxSubscribers = 1
+	q := New(cfg, newMockStore())
+
+	_, unsubscribe, err := q.Subscribe("job-1")
+	if err != nil {
+		t.Fatalf("first Subscribe: %v", err)
+	}
+	if _, _, err := q.Subscribe("job-1"); !errors.Is(err, ErrTooManySubscribers) {
+		t.Fatalf("second Subscribe err = %v, want ErrTooManySubscribers", err)
+	}
+	if _, unsubscribeOther, err := q.Subscribe("job-2"); err != nil {
+		t.Errorf("other job: %v", err)
+	} else {
+		unsubscribeOther()
+	}
+
+	unsubscribe()
+	if _, again, err := q.Subscribe("job-1"); err != nil {
+		t.Errorf("Subscribe after unsubscribe: %v", err)
+	} else {
+		again()
+	}
+}
+
+func TestProcessJob_WaitsForInFlightSlot(t *testing.T) {
+	t.Parallel()
+	store := newMockStore()
+	cfg := testConfig("")
+	cfg.Concurrency = 2
+	cfg.MaxInFlight = 1
+	q := New(cfg, store)
+
+	if cap(q.inFlight) != 1 {
+		t.Fatalf("inFlight capacity = %d, want 1", cap(q.inFlight))
+	}
+
+	_ = store.Create(context.Background(), &job.Job{ID: "j1", Status: job.StatusQueued})
+
+	// Occupy the only slot: processJob must not start the job, and must
+	// give up when its context ends.
+	q.inFlight <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	q.processJob(ctx, "j1")
+
+	got, _ := store.Get(context.Background(), "j1")
+	if got.Status != job.StatusQueued {
+		t.Errorf("status = %q, want queued while no slot is free", got.Status)
+	}
+	if pending := q.Pending(); !slices.Equal(pending, []string{"j1"}) {
+		t.Errorf("Pending = %v, want j1 put back after giving up", pending)
+	}
+}
+
+func TestProcessJob_CancelledWhileWaitingForSlot(t *testing.T) {
+	t.Parallel()
+	store := newMockStore()
+	cfg := testConfig("/nonexistent/claude")
+	cfg.MaxInFlight = 1
+	q := New(cfg, store)
+	_ = store.Create(context.Background(), &job.Job{ID: "j1", Model: "haiku", Prompt: "p", Status: job.StatusQueued})
+
+	q.inFlight <- struct{}{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		q.processJob(context.Background(), "j1")
+	}()
+
+	// Cancel the way CancelJob does while processJob waits for the slot:
+	// the store says cancelled and the queue has no cancel func yet.
+	time.Sleep(20 * time.Millisecond)
+	if err := store.UpdateStatus(context.Background(), "j1", job.StatusCancelled, "", "cancelled"); err != nil {
+		t.Fatalf("UpdateStatus: %v", err)
+	}
+	if q.Cancel("j1") {
+		t.Error("Cancel found a running job, want none while it waits")
+	}
+	<-q.inFlight
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("processJob did not return")
+	}
+	got, _ := store.Get(context.Background(), "j1")
+	if got.Status != job.StatusCancelled || got.Attempts != 0 {
+		t.Errorf("job = %s after %d attempts, want cancelled and never started", got.Status, got.Attempts)
+	}
+}
+
+func TestLogEvent_FieldSchema(t *testing.T) {
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	j := &job.Job{ID: "evt-1", Model: "haiku"}
+	LogEvent(EventJobFailed, j, job.StatusFailed, "duration_ms", int64(42), "error", "boom")
+
+	var rec map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("decode log line %q: %v", buf.String(), err)
+	}
+	want := map[string]any{
+		"msg": "job.failed", "level": "WARN", "job_id": "evt-1", "model": "haiku",
+		"status": "failed", "attempt": float64(1), "duration_ms": float64(42), "error": "boom",
+	}
+	for k, v := range want {
+		if rec[k] != v {
+			t.Errorf("%s = %v, want %v", k, rec[k], v)
+		}
+	}
+}
+
+func TestProcessJob_TimeoutKeepsPartialResult(t *testing.T) {
+	t.Parallel()
+	script := filepath.Join(t.TempDir(), "slow-claude.sh")
+	content := "#!/bin/bash\n" +
+		`echo '{"type":"assistant","message":{"content":[{"type":"text","text":"partial answer"}]}}'` + "\n" +
+		"exec sleep 5\n"
+	if err := os.WriteFile(script, []byte(content), 0o755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	store := newMockStore()
+	cfg := testConfig(script)
+	cfg.PartialResultOnTimeout = true
+	q := New(cfg, store)
+	_ = store.Create(context.Background(), &job.Job{ID: "slow", Model: "haiku", Prompt: "p", Status: job.StatusQueued})
+
+	// The job context derives from ctx, so its deadline behaves like the per-job timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	q.processJob(ctx, "slow")
+
+	got, _ := store.Get(context.Background(), "slow")
+	if got.Status != job.StatusFailed {
+		t.Errorf("status = %q, want failed", got.Status)
+	}
+	if got.Result != "partial answer" {
+		t.Errorf("result = %q, want partial answer", got.Result)
+	}
+	if !got.TimedOut {
+		t.Error("expected TimedOut to be set")
+	}
+}
+
+func TestProcessJob_PerJobTimeout(t *testing.T) {
+	t.Parallel()
+	script := filepath.Join(t.TempDir(), "slow-claude.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/bash\nexec sleep 5\n"), 0o755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	store := newMockStore()
+	cfg := testConfig(script)
+	cfg.JobTimeoutMinutes = 30
+	q := New(cfg, store)
+	_ = store.Create(context.Background(), &job.Job{ID: "short", Model: "haiku", Prompt: "p", Status: job.StatusQueued, TimeoutSeconds: 1})
+
+	start := time.Now()
+	q.processJob(context.Background(), "short")
+	if took := time.Since(start); took > 4*time.Second {
+		t.Errorf("processJob took %v, want about the job's 1s timeout", took)
+	}
+
+	got, _ := store.Get(context.Background(), "short")
+	if got.Status != job.StatusFailed || !got.TimedOut {
+		t.Errorf("status = %q, timed_out = %v, want failed and timed out", got.Status, got.TimedOut)
+	}
+	if got.Error != "job timed out after 1s" {
+		t.Errorf("error = %q, want job timed out after 1s", got.Error)
+	}
+}
+
+func TestProcessJob_ResumesParentSession(t *testing.T) {
+	t.Parallel()
+	script := filepath.Join(t.TempDir(), "session-claude.sh")
+	content := "#!/bin/bash\n" +
+		`resume=none; while [ $# -gt 0 ]; do [ "$1" = --resume ] && resume=$2; shift; done` + "\n" +
+		`echo '{"type":"result","result":"resumed '$resume'","session_id":"sess-child"}'` + "\n"
+	if err := os.WriteFile(script, []byte(content), 0o755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	store := newMockStore()
+	q := New(testConfig(script), store)
+	ctx := context.Background()
+	_ = store.Create(ctx, &job.Job{ID: "parent", Model: "haiku", Prompt: "p", Status: job.StatusCompleted, SessionID: "sess-parent"})
+	_ = store.Create(ctx, &job.Job{ID: "child", Model: "haiku", Prompt: "and then?", Status: job.StatusQueued, ParentJobID: "parent"})
+	_ = store.Create(ctx, &job.Job{ID: "orphan", Model: "haiku", Prompt: "p", Status: job.StatusQueued, ParentJobID: "deleted"})
+
+	q.processJob(ctx, "child")
+	got, _ := store.Get(ctx, "child")
+	if got.Status != job.StatusCompleted || got.Result != "resumed sess-parent" {
+		t.Errorf("child = %s %q, want completed with the parent session resumed", got.Status, got.Result)
+	}
+	if got.SessionID != "sess-child" {
+		t.Errorf("child session_id = %q, want sess-child", got.SessionID)
+	}
+
+	q.processJob(ctx, "orphan")
+	got, _ = store.Get(ctx, "orphan")
+	if got.Status != job.StatusFailed {
+		t.Errorf("orphan status = %s, want failed", got.Status)
+	}
+}
+
+func TestFinalizeJob_RunsPostJobCommand(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	out := filepath.Join(dir, "hook.out")
+	hook := filepath.Join(dir, "hook.sh")
+	content := "#!/bin/bash\n" + `echo "$CLAUDEGATE_JOB_ID $CLAUDEGATE_JOB_STATUS $# $1" > "` + out + `"` + "\n"
+	if err := os.WriteFile(hook, []byte(content), 0o755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	store := newMockStore()
+	cfg := testConfig("")
+	cfg.PostJobCommand = []string{hook, "--flag"}
+	cfg.PostJobTimeoutSeconds = 5
+	cfg.PostJobWorkers = 1
+	q := New(cfg, store)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q.startHooks(ctx)
+
+	j := &job.Job{ID: "hooked", Model: "haiku", Prompt: "p", Status: job.StatusProcessing}
+	_ = store.Create(ctx, j)
+	q.finalizeJob(ctx, j, job.StatusCompleted, "secret result; rm -rf /", "")
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		data, err := os.ReadFile(out)
+		if err == nil && len(data) > 0 {
+			if got, want := string(data), "hooked completed 1 --flag\n"; got != want {
+				t.Errorf("hook saw %q, want %q", got, want)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("post-job command did not run")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// Not parallel: sets an environment variable.
+func TestRunHook_FiltersEnvironment(t *testing.T) {
+	t.Setenv("CLAUDEGATE_API_KEYS", "secret")
+	t.Setenv("HOOK_TEST_VISIBLE", "yes")
+	dir := t.TempDir()
+	out := filepath.Join(dir, "hook.out")
+	hook := filepath.Join(dir, "hook.sh")
+	content := "#!/bin/bash\n" + `echo "${CLAUDEGATE_API_KEYS-unset} $HOOK_TEST_VISIBLE $CLAUDEGATE_JOB_ID" > "` + out + `"` + "\n"
+	if err := os.WriteFile(hook, []byte(content), 0o755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	cfg := testConfig("")
+	cfg.PostJobCommand = []string{hook}
+	cfg.PostJobTimeoutSeconds = 5
+	q := New(cfg, newMockStore())
+	q.runHook(context.Background(), hookRun{jobID: "hooked", status: job.StatusCompleted})
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if got, want := string(data), "unset yes hooked\n"; got != want {
+		t.Errorf("hook saw %q, want %q", got, want)
+	}
+}
+
+func TestProcessJob_StoresPartialResultWhileProcessing(t *testing.T) {
+	t.Parallel()
+	script := filepath.Join(t.TempDir(), "slow-claude.sh")
+	content := "#!/bin/bash\n" +
+		`echo '{"type":"assistant","message":{"content":[{"type":"text","text":"so far"}]}}'` + "\n" +
+		"exec sleep 5\n"
+	if err := os.WriteFile(script, []byte(content), 0o755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	store := newMockStore()
+	cfg := testConfig(script)
+	cfg.PartialResultSeconds = 1
+	q := New(cfg, store)
+	_ = store.Create(context.Background(), &job.Job{ID: "live", Model: "haiku", Prompt: "p", Status: job.StatusQueued})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		q.processJob(ctx, "live")
+	}()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		got, _ := store.Get(context.Background(), "live")
+		if got.PartialResult == "so far" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("partial_result = %q, want so far", got.PartialResult)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	cancel()
+	<-done
+	if got, _ := store.Get(context.Background(), "live"); got.PartialResult != "" {
+		t.Errorf("partial_result after finish = %q, want empty", got.PartialResult)
+	}
+}
+
+func TestProcessJob_RecordsUsage(t *testing.T) {
+	t.Parallel()
+	script := filepath.Join(t.TempDir(), "usage-claude.sh")
+	content := "#!/bin/bash\n" +
+		`echo '{"type":"result","result":"ok","stop_reason":"end_turn","usage":{"input_tokens":12,"output_tokens":5}}'` + "\n"
+	if err := os.WriteFile(script, []byte(content), 0o755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	store := newMockStore()
+	cfg := testConfig(script)
+	cfg.Prices = map[string]config.Price{"haiku": {InputPerMTok: 1, OutputPerMTok: 5}}
+	q := New(cfg, store)
+	_ = store.Create(context.Background(), &job.Job{ID: "usage", Model: "haiku", Prompt: "p", Status: job.StatusQueued})
+	_ = store.Create(context.Background(), &job.Job{ID: "unpriced", Model: "opus", Prompt: "p", Status: job.StatusQueued})
+	q.processJob(context.Background(), "usage")
+	q.processJob(context.Background(), "unpriced")
+
+	got, _ := store.Get(context.Background(), "usage")
+	if got.InputTokens != 12 || got.OutputTokens != 5 || got.StopReason != "end_turn" {
+		t.Errorf("usage = %d in, %d out, stop %q; want 12, 5, end_turn", got.InputTokens, got.OutputTokens, got.StopReason)
+	}
+	// 12 * $1/M + 5 * $5/M
+	if want := 37e-6; got.CostUSD == nil || math.Abs(*got.CostUSD-want) > 1e-12 {
+		t.Errorf("cost_usd = %v, want %v", got.CostUSD, want)
+	}
+	if got, _ := store.Get(context.Background(), "unpriced"); got.CostUSD != nil {
+		t.Errorf("unpriced model cost_usd = %v, want unset", *got.CostUSD)
+	}
+}
+
+// delivery is one webhook handed to Queue.deliver.
+type delivery struct {
+	url     string
+	payload map[string]any
+	tracked bool
+}
+
+// recordDeliveries replaces q.deliver with a recorder and returns the
+// deliveries made so far.
+func recordDeliveries(t *testing.T, q *Queue) func() []delivery {
+	t.Helper()
+	var mu sync.Mutex
+	var got []delivery
+	q.deliver = func(_ context.Context, url string, payload []byte, opts webhook.Options) {
+		var fields map[string]any
+		if err := json.Unmarshal(payload, &fields); err != nil {
+			t.Errorf("webhook payload %q: %v", payload, err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, delivery{url: url, payload: fields, tracked: opts.Report != nil})
+	}
+	return func() []delivery {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(got)
+	}
+}
+
+func TestProcessJob_WebhookEvents(t *testing.T) {
+	t.Parallel()
+	script := filepath.Join(t.TempDir(), "ok-claude.sh")
+	content := "#!/bin/bash\n" + `echo '{"type":"result","result":"ok"}'` + "\n"
+	if err := os.WriteFile(script, []byte(content), 0o755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		events []string
+		want   []string // event of each delivery, in order
+	}{
+		{"default terminal only", nil, []string{"completed"}},
+		{"processing subscribed", []string{"processing", "completed"}, []string{"processing", "completed"}},
+		{"processing only", []string{"processing"}, []string{"processing"}},
+		{"other terminal status", []string{"failed"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			store := newMockStore()
+			q := New(testConfig(script), store)
+			deliveries := recordDeliveries(t, q)
+			_ = store.Create(context.Background(), &job.Job{
+				ID: "hooked", Model: "haiku", Prompt: "p", Status: job.StatusQueued,
+				CallbackURL: "https://example.com/hook", Events: tt.events,
+			})
+			q.processJob(context.Background(), "hooked")
+
+			got := deliveries()
+			var events []string
+			for _, d := range got {
+				event, _ := d.payload["event"].(string)
+				events = append(events, event)
+				if d.url != "https://example.com/hook" {
+					t.Errorf("delivered to %q, want the callback URL", d.url)
+				}
+				if d.payload["job_id"] != "hooked" || d.payload["status"] != event {
+					t.Errorf("payload = %v, want job_id hooked and status %q", d.payload, event)
+				}
+				// Only terminal deliveries are tracked in webhook_status.
+				if d.tracked != (event != "processing") {
+					t.Errorf("%s delivery tracked = %v", event, d.tracked)
+				}
+				if event == "processing" && d.payload["attempt"] != float64(1) {
+					t.Errorf("processing payload attempt = %v, want 1", d.payload["attempt"])
+				}
+			}
+			if !slices.Equal(events, tt.want) {
+				t.Errorf("delivered events = %q, want %q", events, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessJob_ResponseSchemaViolationFailsJob(t *testing.T) {
+	t.Parallel()
+	script := filepath.Join(t.TempDir(), "json-claude.sh")
+	content := "#!/bin/bash\n" +
+		`echo '{"type":"result","result":"{\"name\":42}"}'` + "\n"
+	if err := os.WriteFile(script, []byte(content), 0o755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	store := newMockStore()
+	q := New(testConfig(script), store)
+	schema := json.RawMessage(`{"type":"object","properties":{"name":{"type":"string"}}}`)
+	_ = store.Create(context.Background(), &job.Job{ID: "schema", Model: "haiku", Prompt: "p", ResponseFormat: "json", ResponseSchema: schema, Status: job.StatusQueued})
+	q.processJob(context.Background(), "schema")
+
+	got, _ := store.Get(context.Background(), "schema")
+	if got.Status != job.StatusFailed || !strings.Contains(got.Error, "response_schema") || !strings.Contains(got.Error, "/name") {
+		t.Errorf("status = %s, error = %q; want failed with the schema violation at /name", got.Status, got.Error)
+	}
+}
+
+func TestProcessJob_UnparseableFirstFormatKeepsRawResult(t *testing.T) {
+	t.Parallel()
+	script := filepath.Join(t.TempDir(), "text-claude.sh")
+	content := "#!/bin/bash\n" +
+		`echo '{"type":"result","result":"not json at all"}'` + "\n"
+	if err := os.WriteFile(script, []byte(content), 0o755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	store := newMockStore()
+	q := New(testConfig(script), store)
+	_ = store.Create(context.Background(), &job.Job{ID: "formats", Model: "haiku", Prompt: "p", ResponseFormats: []string{"json", "text"}, Status: job.StatusQueued})
+	q.processJob(context.Background(), "formats")
+
+	got, _ := store.Get(context.Background(), "formats")
+	if got.Status != job.StatusCompleted || got.Result != "not json at all" {
+		t.Errorf("status = %s, result = %q; want completed with the raw output", got.Status, got.Result)
+	}
+	if _, ok := got.Results["json"]; ok || got.Results["text"] != "not json at all" {
+		t.Errorf("results = %v, want text only", got.Results)
+	}
+}
+
+func TestDeliveryStatus(t *testing.T) {
+	t.Parallel()
+	d := &deliveryStatus{pending: 2}
+	for _, step := range []struct{ in, want string }{
+		{webhook.StatusPending, webhook.StatusPending},
+		{webhook.StatusDelivered, webhook.StatusPending},
+		{webhook.StatusDelivered, webhook.StatusDelivered},
+	} {
+		if got := d.update(step.in); got != step.want {
+			t.Errorf("update(%s) = %s, want %s", step.in, got, step.want)
+		}
+	}
+
+	d = &deliveryStatus{pending: 2}
+	d.update(webhook.StatusFailed)
+	if got := d.update(webhook.StatusDelivered); got != webhook.StatusFailed {
+		t.Errorf("one of two URLs failed: status = %s, want failed", got)
+	}
+}
+
+func TestDrain_FinishesRunningJobOnly(t *testing.T) {
+	t.Parallel()
+	script := filepath.Join(t.TempDir(), "slow-claude.sh")
+	content := "#!/bin/bash\n" +
+		"sleep 0.3\n" +
+		`echo '{"type":"result","result":"done"}'` + "\n"
+	if err := os.WriteFile(script, []byte(content), 0o755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	store := newMockStore()
+	q := New(testConfig(script), store)
+	for _, id := range []string{"running", "waiting"} {
+		_ = store.Create(context.Background(), &job.Job{ID: id, Model: "haiku", Prompt: "p", Status: job.StatusQueued})
+		if err := q.Enqueue(id, job.PriorityNormal); err != nil {
+			t.Fatalf("Enqueue: %v", err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q.Start(ctx)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if got, _ := store.Get(context.Background(), "running"); got.Status == job.StatusProcessing {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("first job never started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer drainCancel()
+	if err := q.Drain(drainCtx); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+	if got, _ := store.Get(context.Background(), "running"); got.Status != job.StatusCompleted {
+		t.Errorf("running job status = %q, want completed", got.Status)
+	}
+	if got, _ := store.Get(context.Background(), "waiting"); got.Status != job.StatusQueued {
+		t.Errorf("waiting job status = %q, want queued", got.Status)
+	}
+	if q.Len() != 1 {
+		t.Errorf("Len = %d, want 1 job left waiting", q.Len())
+	}
+}
+
+func TestDrain_TimesOut(t *testing.T) {
+	t.Parallel()
+	script := filepath.Join(t.TempDir(), "stuck-claude.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/bash\nexec sleep 5\n"), 0o755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	store := newMockStore()
+	q := New(testConfig(script), store)
+	_ = store.Create(context.Background(), &job.Job{ID: "stuck", Model: "haiku", Prompt: "p", Status: job.StatusQueued})
+	if err := q.Enqueue("stuck", job.PriorityNormal); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q.Start(ctx)
+	time.Sleep(100 * time.Millisecond)
+
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer drainCancel()
+	if err := q.Drain(drainCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Drain = %v, want DeadlineExceeded", err)
+	}
+}
+
+func TestRecovery_RestoresSnapshotOrder(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "queue.json")
+	cfg := testConfig("")
+	cfg.QueueSnapshotPath = path
+
+	store := newMockStore()
+	for _, id := range []string{"a", "b", "c", "done"} {
+		_ = store.Create(context.Background(), &job.Job{ID: id, Status: job.StatusQueued})
+	}
+	before := New(cfg, store)
+	for _, id := range []string{"done", "c", "a", "b"} {
+		if err := before.Enqueue(id, job.PriorityNormal); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if id, _ := before.next(context.Background()); id != "done" {
+		t.Fatalf("dequeued %q, want done", id)
+	}
+	if err := before.SaveSnapshot(path); err != nil {
+		t.Fatalf("SaveSnapshot: %v", err)
+	}
+	_ = store.UpdateStatus(context.Background(), "done", job.StatusCompleted, "ok", "")
+	_ = store.UpdateStatus(context.Background(), "b", job.StatusCancelled, "", "")
+
+	after := New(cfg, store)
+	if err := after.Recovery(context.Background()); err != nil {
+		t.Fatalf("Recovery: %v", err)
+	}
+	got := after.Pending()
+	want := []string{"c", "a"}
+	if !slices.Equal(got, want) {
+		t.Errorf("pending = %v, want %v", got, want)
+	}
+	for _, id := range want {
+		if next, _ := after.next(context.Background()); next != id {
+			t.Errorf("dequeued %q, want %q", next, id)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	t.Parallel()
+	cfg := testConfig("")
+	cfg.QueueSize = 10
+	q := New(cfg, newMockStore())
+
+	for _, id := range []string{"a", "b"} {
+		if err := q.Enqueue(id, job.PriorityNormal); err != nil {
+			t.Fatalf("Enqueue(%s): %v", id, err)
+		}
+	}
+	q.mu.Lock()
+	q.cancels["running"] = func() {}
+	q.mu.Unlock()
+
+	if got, want := q.Stats(), (Stats{Depth: 2, Capacity: 10, Active: 1}); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+}
+
+func TestEnqueue_HigherPriorityFirst(t *testing.T) {
+	t.Parallel()
+	cfg := testConfig("")
+	cfg.QueueSize = 4
+	q := New(cfg, newMockStore())
+
+	for _, e := range []struct {
+		id       string
+		priority job.Priority
+	}{
+		{"low-1", job.PriorityLow},
+		{"normal-1", ""},
+		{"high-1", job.PriorityHigh},
+		{"normal-2", job.PriorityNormal},
+	} {
+		if err := q.Enqueue(e.id, e.priority); err != nil {
+			t.Fatalf("Enqueue(%s): %v", e.id, err)
+		}
+	}
+	if err := q.Enqueue("overflow", job.PriorityHigh); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Enqueue past QueueSize: err = %v, want ErrQueueFull", err)
+	}
+
+	want := []string{"high-1", "normal-1", "normal-2", "low-1"}
+	if got := q.Pending(); !slices.Equal(got, want) {
+		t.Errorf("pending = %v, want %v", got, want)
+	}
+	for _, id := range want {
+		if next, _ := q.next(context.Background()); next != id {
+			t.Errorf("dequeued %q, want %q", next, id)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, ok := q.next(ctx); ok {
+		t.Error("next on an empty queue with a done context returned a job")
+	}
+}
+
+func TestPause_HoldsJobsUntilResume(t *testing.T) {
+	t.Parallel()
+	q := New(testConfig(""), newMockStore())
+
+	q.Pause()
+	if err := q.Enqueue("job-1", ""); err != nil {
+		t.Fatalf("Enqueue while paused: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if id, ok := q.next(ctx); ok {
+		t.Fatalf("next while paused returned %q", id)
+	}
+
+	got := make(chan string, 1)
+	go func() {
+		id, _ := q.next(context.Background())
+		got <- id
+	}()
+	q.Resume()
+	select {
+	case id := <-got:
+		if id != "job-1" {
+			t.Errorf("next after Resume = %q, want job-1", id)
+		}
+		q.active.Done()
+	case <-time.After(2 * time.Second):
+		t.Fatal("worker did not take the job after Resume")
+	}
+}
+
+func TestBoost_MovesJobToFront(t *testing.T) {
+	t.Parallel()
+	q := New(testConfig(""), newMockStore())
+
+	for _, id := range []string{"high-1", "normal-1", "low-1"} {
+		priority, _, _ := strings.Cut(id, "-")
+		if err := q.Enqueue(id, job.Priority(priority)); err != nil {
+			t.Fatalf("Enqueue(%s): %v", id, err)
+		}
+	}
+
+	if !q.Boost("low-1") {
+		t.Fatal("Boost(low-1) = false, want true")
+	}
+	if q.Boost("missing") {
+		t.Error("Boost(missing) = true, want false")
+	}
+
+	want := []string{"low-1", "high-1", "normal-1"}
+	if got := q.Pending(); !slices.Equal(got, want) {
+		t.Errorf("pending = %v, want %v", got, want)
+	}
+}
+
+func TestPending_ListsHeldJobs(t *testing.T) {
+	t.Parallel()
+	store := newMockStore()
+	cfg := testConfig("")
+	cfg.MaxInFlight = 1
+	q := New(cfg, store)
+	q.backoff = time.Hour
+	_ = store.Create(context.Background(), &job.Job{ID: "slot", Status: job.StatusQueued})
+	_ = store.Create(context.Background(), &job.Job{ID: "retry", Status: job.StatusProcessing, Attempts: 1})
+
+	// A job handed to a worker that waits for an in-flight slot is still
+	// queued in the store, and must still be saved by a snapshot.
+	if err := q.Enqueue("slot", ""); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	id, _ := q.next(context.Background())
+	q.inFlight <- struct{}{}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		q.processJob(ctx, id)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if got := q.Pending(); !slices.Equal(got, []string{"slot"}) {
+		t.Errorf("pending while waiting for a slot = %v, want [slot]", got)
+	}
+	cancel()
+	<-done
+	q.active.Done()
+	if got := q.Pending(); !slices.Equal(got, []string{"slot"}) {
+		t.Errorf("pending after putBack = %v, want [slot] once", got)
+	}
+
+	// So must a job waiting out its retry backoff.
+	j, _ := store.Get(context.Background(), "retry")
+	q.retry(context.Background(), j, "boom", 0)
+	if got := q.Pending(); !slices.Equal(got, []string{"slot", "retry"}) {
+		t.Errorf("pending during retry backoff = %v, want [slot retry]", got)
+	}
+}
+
+// BenchmarkNotify_ManySubscribers publishes chunks to a job with many slow
+// readers while other streams keep subscribing and leaving. Publishers and
+// subscription churn only contend on short, non-blocking critical sections.
+func BenchmarkNotify_ManySubscribers(b *testing.B) {
+	q := New(testConfig(""), newMockStore())
+	for range 200 {
+		ch, unsubscribe, err := q.Subscribe("hot")
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer unsubscribe()
+		go func() {
+			for range ch {
+				time.Sleep(time.Millisecond) // a client on a slow connection
+			}
+		}()
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				if _, unsubscribe, err := q.Subscribe("hot"); err == nil {
+					unsubscribe()
+				}
+			}
+		}
+	}()
+
+	event := SSEEvent{Event: "chunk", Data: `{"text":"hi"}`}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			q.notify("hot", event)
+		}
+	})
+}
+
+func TestProcessJob_RetriesFailedAttempt(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	script := filepath.Join(dir, "flaky-claude.sh")
+	// Fails on the first run, succeeds on the second.
+	content := "#!/bin/bash\n" +
+		"marker=" + filepath.Join(dir, "ran") + "\n" +
+		`if [ ! -f "$marker" ]; then touch "$marker"; echo 'auth hiccup' >&2; exit 1; fi` + "\n" +
+		`echo '{"type":"result","result":"second try"}'` + "\n"
+	if err := os.WriteFile(script, []byte(content), 0o755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	store := newMockStore()
+	q := New(testConfig(script), store)
+	q.backoff = time.Millisecond
+	_ = store.Create(context.Background(), &job.Job{ID: "flaky", Model: "haiku", Prompt: "p", Status: job.StatusQueued, MaxRetries: 1})
+
+	q.processJob(context.Background(), "flaky")
+	got, _ := store.Get(context.Background(), "flaky")
+	if got.Status != job.StatusQueued || got.Attempts != 1 || !strings.Contains(got.Error, "auth hiccup") {
+		t.Fatalf("after first attempt: status = %q, attempts = %d, error = %q; want queued, 1, last error", got.Status, got.Attempts, got.Error)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	id, ok := q.next(ctx)
+	if !ok {
+		t.Fatal("job was not re-enqueued")
+	}
+	q.processJob(context.Background(), id)
+	got, _ = store.Get(context.Background(), "flaky")
+	if got.Status != job.StatusCompleted || got.Result != "second try" || got.Attempts != 2 {
+		t.Errorf("after retry: status = %q, result = %q, attempts = %d; want completed, second try, 2", got.Status, got.Result, got.Attempts)
+	}
+}
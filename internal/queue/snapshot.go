@@ -0,0 +1,115 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/claudegate/claudegate/internal/job"
+)
+
+// Pending returns the IDs waiting in the queue, in the order workers will pick
+// them up: by priority, then by arrival. The queued jobs held out of the queue,
+// those in their retry backoff or waiting for an in-flight slot, follow.
+func (q *Queue) Pending() []string {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	var ids []string
+	for _, rank := range q.waiting {
+		ids = append(ids, rank...)
+	}
+	return append(ids, q.held...)
+}
+
+// SaveSnapshot writes the pending job IDs to path as a JSON array. The file is
+// replaced atomically so a crash mid-write never leaves a truncated snapshot.
+func (q *Queue) SaveSnapshot(path string) error {
+	data, err := json.Marshal(q.Pending())
+	if err != nil {
+		return fmt.Errorf("marshal snapshot: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("create snapshot: %w", err)
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close() //nolint:errcheck
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close snapshot: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("rename snapshot: %w", err)
+	}
+	return nil
+}
+
+// loadSnapshot reads the job IDs saved by SaveSnapshot. A missing file yields no IDs.
+func loadSnapshot(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read snapshot: %w", err)
+	}
+	var ids []string
+	if err := json.Unmarshal(data, &ids); err != nil {
+		return nil, fmt.Errorf("parse snapshot: %w", err)
+	}
+	return ids, nil
+}
+
+// restoreSnapshot re-enqueues the still-queued jobs from the snapshot at path,
+// in their saved order and with their stored priority. IDs in skip were
+// already enqueued by the caller.
+func (q *Queue) restoreSnapshot(ctx context.Context, path string, skip []string) error {
+	ids, err := loadSnapshot(path)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if slices.Contains(skip, id) {
+			continue
+		}
+		j, err := q.store.Get(ctx, id)
+		if err != nil || j == nil || j.Status != job.StatusQueued {
+			continue
+		}
+		if err := q.Enqueue(id, j.Priority); err != nil {
+			slog.Error("recovery: failed to enqueue job", "job_id", id, "error", err)
+		}
+	}
+	return nil
+}
+
+// StartSnapshots launches a background goroutine that periodically saves the
+// pending job order to path.
+func (q *Queue) StartSnapshots(ctx context.Context, path string, intervalSeconds int) {
+	if path == "" {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(intervalSeconds) * time.Second)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := q.SaveSnapshot(path); err != nil {
+					slog.Error("queue snapshot", "error", err)
+				}
+			}
+		}
+	}()
+}
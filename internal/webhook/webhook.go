@@ -2,86 +2,320 @@ package webhook
 
 import (
 	"bytes"
+	"cmp"
 	"context"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log/slog"
 	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+// Delivery defaults, used when Options leaves the matching field zero.
 const (
-	retryAttempts = 8
-	retryBase     = time.Second
-	retryCap      = 5 * time.Minute
+	defaultAttempts = 8
+	defaultTimeout  = 30 * time.Second
+	defaultRetryCap = 5 * time.Minute
+	retryBase       = time.Second
 )
 
+// Headers set on signed deliveries.
+const (
+	HeaderSignature = "X-Claudegate-Signature"
+	HeaderTimestamp = "X-Claudegate-Timestamp"
+	HeaderNonce     = "X-Claudegate-Nonce"
+)
+
+// Options holds per-delivery settings.
+type Options struct {
+	// Secret signs every attempt with HMAC-SHA256 when set. Empty sends
+	// unsigned deliveries.
+	Secret string
+	// Headers are added to every attempt. Content-Type and the signature
+	// headers are set afterwards, so they cannot be overridden.
+	Headers map[string]string
+	// Attempts is the number of delivery attempts. Zero means 8.
+	Attempts int
+	// Timeout bounds each attempt. Zero means 30s.
+	Timeout time.Duration
+	// RetryCap caps the jittered backoff between attempts. Zero means 5 minutes.
+	RetryCap time.Duration
+	// Report, when set, is called after every attempt with the delivery
+	// status: StatusPending while attempts remain, then StatusDelivered or
+	// StatusFailed. A URL rejected before any attempt reports StatusFailed.
+	Report func(status string)
+}
+
+// Delivery statuses passed to Options.Report.
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusFailed    = "failed"
+)
+
+// report calls opts.Report, if set.
+func (opts Options) report(status string) {
+	if opts.Report != nil {
+		opts.Report(status)
+	}
+}
+
+// hostLimiter caps concurrent delivery attempts per receiver host, so one
+// slow receiver cannot tie up the deliveries of every other one.
+var hostLimiter = struct {
+	sync.Mutex
+	max   int
+	hosts map[string]*hostSlots
+}{hosts: make(map[string]*hostSlots)}
+
+// hostSlots is the semaphore of one host. users counts the deliveries
+// holding or waiting for a slot, so the entry is dropped once idle.
+type hostSlots struct {
+	slots chan struct{}
+	users int
+}
+
+// SetMaxPerHost caps the delivery attempts in flight to any one host
+// (host:port of the callback URL). Further deliveries to that host wait for
+// a slot. n <= 0 removes the cap. Call it before the first Send.
+func SetMaxPerHost(n int) {
+	hostLimiter.Lock()
+	defer hostLimiter.Unlock()
+	hostLimiter.max = n
+	hostLimiter.hosts = make(map[string]*hostSlots)
+}
+
+// acquireHost waits for a delivery slot for host. The returned func releases it.
+func acquireHost(ctx context.Context, host string) (func(), error) {
+	hostLimiter.Lock()
+	if hostLimiter.max <= 0 {
+		hostLimiter.Unlock()
+		return func() {}, nil
+	}
+	h, ok := hostLimiter.hosts[host]
+	if !ok {
+		h = &hostSlots{slots: make(chan struct{}, hostLimiter.max)}
+		hostLimiter.hosts[host] = h
+	}
+	h.users++
+	hostLimiter.Unlock()
+
+	done := func() {
+		hostLimiter.Lock()
+		defer hostLimiter.Unlock()
+		if h.users--; h.users == 0 && hostLimiter.hosts[host] == h {
+			delete(hostLimiter.hosts, host)
+		}
+	}
+	select {
+	case h.slots <- struct{}{}:
+		return func() {
+			<-h.slots
+			done()
+		}, nil
+	case <-ctx.Done():
+		done()
+		return nil, ctx.Err()
+	}
+}
+
 // Send dispatches the JSON payload to callbackURL asynchronously.
-// 8 retries max with full-jitter exponential backoff (cap 5 min). 30s timeout per request.
+// By default 8 attempts max with full-jitter exponential backoff (cap 5 min)
+// and a 30s timeout per request; see Options.
 // ctx should be context.WithoutCancel(jobCtx) so retries survive job cancellation but
 // stop on server shutdown.
-func Send(ctx context.Context, callbackURL string, payload []byte) {
-	if err := validateURL(callbackURL); err != nil {
+func Send(ctx context.Context, callbackURL string, payload []byte, opts Options) {
+	addrs, err := validateURL(callbackURL)
+	if err != nil {
 		slog.Warn("webhook: rejected callback URL", "url", callbackURL, "error", err)
+		opts.report(StatusFailed)
 		return
 	}
-	go send(ctx, callbackURL, payload)
+	go send(ctx, callbackURL, addrs, payload, opts)
+}
+
+// Sign returns the X-Claudegate-Signature value for a delivery: "sha256=" and
+// the hex HMAC-SHA256, keyed by secret, of "<timestamp>.<nonce>.<payload>".
+// Binding the timestamp and nonce lets receivers reject stale or replayed
+// deliveries without trusting unsigned headers.
+func Sign(secret, timestamp, nonce string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + nonce + "."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// ErrInvalidSignature is returned by Verify when a delivery's signature
+// headers are missing, malformed, stale or do not match the payload.
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// Verify checks a signed delivery as received: the signature must match
+// Sign over the timestamp, nonce and payload, and the timestamp must lie
+// within tolerance of now. Receivers should also reject nonces they have
+// already accepted within tolerance; Verify does not track them.
+func Verify(secret string, h http.Header, payload []byte, tolerance time.Duration) error {
+	timestamp, nonce, signature := h.Get(HeaderTimestamp), h.Get(HeaderNonce), h.Get(HeaderSignature)
+	if timestamp == "" || nonce == "" || signature == "" {
+		return fmt.Errorf("%w: missing signature headers", ErrInvalidSignature)
+	}
+	want := Sign(secret, timestamp, nonce, payload)
+	if !hmac.Equal([]byte(signature), []byte(want)) {
+		return fmt.Errorf("%w: signature mismatch", ErrInvalidSignature)
+	}
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: malformed timestamp", ErrInvalidSignature)
+	}
+	if age := time.Since(time.Unix(sec, 0)); age > tolerance || age < -tolerance {
+		return fmt.Errorf("%w: timestamp outside tolerance", ErrInvalidSignature)
+	}
+	return nil
+}
+
+// newNonce returns 16 random bytes, hex-encoded.
+func newNonce() string {
+	b := make([]byte, 16)
+	crand.Read(b) //nolint:errcheck // never fails on supported platforms
+	return hex.EncodeToString(b)
 }
 
-// validateURL blocks non-HTTPS schemes and private/internal IP ranges.
-func validateURL(rawURL string) error {
+// validateURL blocks non-HTTPS schemes and private/internal IP ranges. It
+// returns the vetted IPs of the host, which deliveries must dial instead of
+// resolving the name again.
+func validateURL(rawURL string) ([]string, error) {
 	u, err := url.Parse(rawURL)
 	if err != nil {
-		return fmt.Errorf("invalid URL: %w", err)
+		return nil, fmt.Errorf("invalid URL: %w", err)
 	}
 
 	if u.Scheme != "https" && u.Scheme != "http" {
-		return fmt.Errorf("unsupported scheme: %s", u.Scheme)
+		return nil, fmt.Errorf("unsupported scheme: %s", u.Scheme)
 	}
 
 	host := u.Hostname()
 	ips, err := net.LookupHost(host)
 	if err != nil {
-		return fmt.Errorf("DNS lookup failed: %w", err)
+		return nil, fmt.Errorf("DNS lookup failed: %w", err)
 	}
 
+	var addrs []string
 	for _, ipStr := range ips {
 		ip := net.ParseIP(ipStr)
 		if ip == nil {
 			continue
 		}
-		if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
-			return fmt.Errorf("private/internal IP blocked: %s", ipStr)
+		if blockedIP(ip) {
+			return nil, fmt.Errorf("private/internal IP blocked: %s", ipStr)
 		}
+		addrs = append(addrs, ip.String())
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no usable IP for host %s", host)
 	}
 
+	return addrs, nil
+}
+
+// blockedIP reports whether ip is loopback, private, link-local or unspecified.
+func blockedIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+// CheckURL rejects callback URLs that are internal without a DNS lookup:
+// literal private/internal IPs and localhost names. It lets job creation
+// refuse them up front; host names are still vetted by Send at delivery.
+func CheckURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %w", err)
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("internal host blocked: %s", host)
+	}
+	if ip := net.ParseIP(host); ip != nil && blockedIP(ip) {
+		return fmt.Errorf("private/internal IP blocked: %s", host)
+	}
 	return nil
 }
 
-func send(ctx context.Context, callbackURL string, payload []byte) {
-	client := &http.Client{Timeout: 30 * time.Second}
+// pinnedClient returns an HTTP client that only connects to addrs, whatever
+// the callback host resolves to at delivery time. A DNS record switched to an
+// internal IP after validateURL (DNS rebinding) thus cannot redirect the
+// delivery, redirects included. TLS still verifies the certificate against
+// the URL's host name. Proxies are not used: they would be dialed at a vetted
+// address too.
+func pinnedClient(addrs []string, timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		var errs []error
+		for _, ip := range addrs {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+			errs = append(errs, err)
+		}
+		return nil, errors.Join(errs...)
+	}
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+func send(ctx context.Context, callbackURL string, addrs []string, payload []byte, opts Options) {
+	attempts := cmp.Or(opts.Attempts, defaultAttempts)
+	retryCap := cmp.Or(opts.RetryCap, defaultRetryCap)
+	client := pinnedClient(addrs, cmp.Or(opts.Timeout, defaultTimeout))
+	// The transport belongs to this delivery only: retries may reuse its
+	// connection, but nothing else can once it returns.
+	defer client.CloseIdleConnections()
+	host := callbackURL
+	if u, err := url.Parse(callbackURL); err == nil {
+		host = strings.ToLower(u.Host)
+	}
 
-	for attempt := 1; attempt <= retryAttempts; attempt++ {
+	for attempt := 1; attempt <= attempts; attempt++ {
 		if ctx.Err() != nil {
 			return
 		}
-		err := post(ctx, client, callbackURL, payload)
+		release, err := acquireHost(ctx, host)
+		if err != nil {
+			return
+		}
+		err = post(ctx, client, callbackURL, payload, opts)
+		release()
 		if err == nil {
+			opts.report(StatusDelivered)
 			return
 		}
 		slog.Warn("webhook attempt failed", "attempt", attempt, "url", callbackURL, "error", err)
-		if attempt < retryAttempts {
-			time.Sleep(jitter(attempt))
+		if attempt < attempts {
+			opts.report(StatusPending)
+			time.Sleep(jitter(attempt, retryCap))
 		}
 	}
 	slog.Error("webhook: all retries exhausted", "url", callbackURL)
+	opts.report(StatusFailed)
 }
 
 // jitter returns a random duration between 0 and min(retryCap, retryBase * 2^attempt).
 // Full jitter prevents synchronized retries when multiple webhooks fail at the same time.
-func jitter(attempt int) time.Duration {
+func jitter(attempt int, retryCap time.Duration) time.Duration {
 	exp := retryBase * (1 << attempt) // base * 2^attempt
 	if exp > retryCap {
 		exp = retryCap
@@ -89,12 +323,24 @@ func jitter(attempt int) time.Duration {
 	return time.Duration(rand.Int63n(int64(exp)))
 }
 
-func post(ctx context.Context, client *http.Client, callbackURL string, payload []byte) error {
+// post makes one delivery attempt. Each attempt is signed with a fresh
+// timestamp and nonce, so retries are not rejected as replays.
+func post(ctx context.Context, client *http.Client, callbackURL string, payload []byte, opts Options) error {
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackURL, bytes.NewReader(payload))
 	if err != nil {
 		return fmt.Errorf("create request: %w", err)
 	}
+	for name, value := range opts.Headers {
+		req.Header.Set(name, value)
+	}
 	req.Header.Set("Content-Type", "application/json")
+	if opts.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		nonce := newNonce()
+		req.Header.Set(HeaderTimestamp, timestamp)
+		req.Header.Set(HeaderNonce, nonce)
+		req.Header.Set(HeaderSignature, Sign(opts.Secret, timestamp, nonce, payload))
+	}
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -1,7 +1,21 @@
 package webhook
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestValidateURL(t *testing.T) {
@@ -46,10 +60,268 @@ func TestValidateURL(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
-			err := validateURL(tt.url)
+			_, err := validateURL(tt.url)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("validateURL(%q) error = %v, wantErr %v", tt.url, err, tt.wantErr)
 			}
 		})
 	}
 }
+
+func TestCheckURL(t *testing.T) {
+	t.Parallel()
+	for url, wantErr := range map[string]bool{
+		"https://example.com/hook":      false,
+		"http://93.184.216.34/hook":     false,
+		"http://127.0.0.1/hook":         true,
+		"http://[::1]:8080/hook":        true,
+		"http://10.1.2.3/hook":          true,
+		"http://169.254.169.254/latest": true,
+		"http://localhost:9000/hook":    true,
+		"http://api.localhost/hook":     true,
+	} {
+		if err := CheckURL(url); (err != nil) != wantErr {
+			t.Errorf("CheckURL(%q) error = %v, wantErr %v", url, err, wantErr)
+		}
+	}
+}
+
+func TestSend_HonoursAttempts(t *testing.T) {
+	t.Parallel()
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	var reports []string
+	report := func(status string) { reports = append(reports, status) }
+	send(context.Background(), srv.URL, loopback, []byte(`{}`), Options{Attempts: 3, RetryCap: time.Millisecond, Report: report})
+	if got := hits.Load(); got != 3 {
+		t.Errorf("attempts = %d, want 3", got)
+	}
+	if got := strings.Join(reports, ","); got != "pending,pending,failed" {
+		t.Errorf("reports = %s, want pending,pending,failed", got)
+	}
+}
+
+func TestSend_ReportsDelivered(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	var reports []string
+	report := func(status string) { reports = append(reports, status) }
+	send(context.Background(), srv.URL, loopback, []byte(`{}`), Options{Report: report})
+	if got := strings.Join(reports, ","); got != "delivered" {
+		t.Errorf("reports = %s, want delivered", got)
+	}
+}
+
+func TestSend_ClosesConnectionWhenDone(t *testing.T) {
+	t.Parallel()
+	var closed atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed.Add(1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	send(context.Background(), srv.URL, loopback, []byte(`{}`), Options{})
+	for deadline := time.Now().Add(2 * time.Second); closed.Load() == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("delivery left its connection open")
+		}
+	}
+}
+
+func TestPost_SignsWithTimestampAndNonce(t *testing.T) {
+	t.Parallel()
+	payload := []byte(`{"job_id":"abc","status":"completed"}`)
+	headers := make(chan http.Header, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != string(payload) {
+			t.Errorf("body = %s, want %s", body, payload)
+		}
+		headers <- r.Header.Clone()
+	}))
+	defer srv.Close()
+
+	opts := Options{Secret: "s3cret"}
+	for range 2 {
+		if err := post(context.Background(), srv.Client(), srv.URL, payload, opts); err != nil {
+			t.Fatalf("post: %v", err)
+		}
+	}
+
+	first, second := <-headers, <-headers
+	for _, h := range []http.Header{first, second} {
+		ts, nonce := h.Get(HeaderTimestamp), h.Get(HeaderNonce)
+		if ts == "" || nonce == "" {
+			t.Fatalf("missing timestamp or nonce: %v", h)
+		}
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write([]byte(ts + "." + nonce + "." + string(payload)))
+		if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); h.Get(HeaderSignature) != want {
+			t.Errorf("signature = %q, want %q", h.Get(HeaderSignature), want)
+		}
+	}
+	if first.Get(HeaderNonce) == second.Get(HeaderNonce) {
+		t.Error("retries reused the same nonce")
+	}
+}
+
+func TestPost_UnsignedWithoutSecret(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range []string{HeaderSignature, HeaderTimestamp, HeaderNonce} {
+			if v := r.Header.Get(name); v != "" {
+				t.Errorf("%s = %q, want unset", name, v)
+			}
+		}
+	}))
+	defer srv.Close()
+
+	if err := post(context.Background(), srv.Client(), srv.URL, []byte(`{}`), Options{}); err != nil {
+		t.Fatalf("post: %v", err)
+	}
+}
+
+func TestPost_CustomHeaders(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer token" {
+			t.Errorf("Authorization = %q, want %q", got, "Bearer token")
+		}
+		if got := r.Header.Get("Content-Type"); got != "application/json" {
+			t.Errorf("Content-Type = %q, want application/json", got)
+		}
+	}))
+	defer srv.Close()
+
+	opts := Options{Headers: map[string]string{
+		"Authorization": "Bearer token",
+		"Content-Type":  "text/plain",
+	}}
+	if err := post(context.Background(), srv.Client(), srv.URL, []byte(`{}`), opts); err != nil {
+		t.Fatalf("post: %v", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	t.Parallel()
+	payload := []byte(`{"job_id":"abc"}`)
+	signed := func(secret string, at time.Time) http.Header {
+		h := http.Header{}
+		ts := strconv.FormatInt(at.Unix(), 10)
+		h.Set(HeaderTimestamp, ts)
+		h.Set(HeaderNonce, "n1")
+		h.Set(HeaderSignature, Sign(secret, ts, "n1", payload))
+		return h
+	}
+
+	if err := Verify("s3cret", signed("s3cret", time.Now()), payload, 5*time.Minute); err != nil {
+		t.Errorf("valid delivery: %v", err)
+	}
+	tests := map[string]struct {
+		h       http.Header
+		payload []byte
+	}{
+		"wrong secret":     {signed("other", time.Now()), payload},
+		"tampered payload": {signed("s3cret", time.Now()), []byte(`{"job_id":"xyz"}`)},
+		"stale":            {signed("s3cret", time.Now().Add(-10*time.Minute)), payload},
+		"unsigned":         {http.Header{}, payload},
+	}
+	for name, tt := range tests {
+		if err := Verify("s3cret", tt.h, tt.payload, 5*time.Minute); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("%s: err = %v, want ErrInvalidSignature", name, err)
+		}
+	}
+}
+
+func TestValidateURL_ReturnsVettedIPs(t *testing.T) {
+	t.Parallel()
+	addrs, err := validateURL("https://93.184.216.34/hook")
+	if err != nil {
+		t.Fatalf("validateURL: %v", err)
+	}
+	if len(addrs) != 1 || addrs[0] != "93.184.216.34" {
+		t.Errorf("addrs = %v, want [93.184.216.34]", addrs)
+	}
+}
+
+func TestPinnedClient_IgnoresDNSAtDeliveryTime(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+
+	// The .invalid name never resolves: the request can only succeed by
+	// dialing the vetted address.
+	target := "http://rebind.invalid:" + u.Port() + "/hook"
+	resp, err := pinnedClient([]string{u.Hostname()}, defaultTimeout).Get(target)
+	if err != nil {
+		t.Fatalf("Get through pinned client: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+}
+
+// loopback pins test deliveries to httptest servers, which validateURL
+// would reject.
+var loopback = []string{"127.0.0.1"}
+
+// Not parallel: SetMaxPerHost changes package-wide state.
+func TestSend_MaxPerHostIsolatesSlowReceiver(t *testing.T) {
+	SetMaxPerHost(2)
+	t.Cleanup(func() { SetMaxPerHost(0) })
+
+	var inFlight, peak atomic.Int32
+	unblock := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		<-unblock
+	}))
+	defer slow.Close()
+	defer close(unblock)
+
+	fastDone := make(chan struct{})
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(fastDone)
+	}))
+	defer fast.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for range 4 {
+		go send(ctx, slow.URL, loopback, []byte(`{}`), Options{})
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for inFlight.Load() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("slow receiver never got 2 deliveries")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	go send(ctx, fast.URL, loopback, []byte(`{}`), Options{})
+	select {
+	case <-fastDone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("delivery to a healthy host was blocked by the slow one")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if p := peak.Load(); p != 2 {
+		t.Errorf("peak concurrent deliveries to slow host = %d, want 2", p)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package worker
+
+import (
+	"os/exec"
+	"time"
+)
+
+// StartInGroup cannot create a process group on this platform: only the
+// process itself is killed when its context ends. WaitDelay still keeps a
+// child that inherited its output from holding Wait open forever. The
+// returned stop is a no-op.
+func StartInGroup(cmd *exec.Cmd) (stop func()) {
+	cmd.WaitDelay = killGrace + time.Second
+	return func() {}
+}
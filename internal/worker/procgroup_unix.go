@@ -0,0 +1,52 @@
+//go:build unix
+
+package worker
+
+import (
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// StartInGroup makes cmd the leader of a new process group and, when its
+// context ends, sends SIGTERM to the whole group, then SIGKILL after
+// killGrace. Children the command spawned are stopped with it instead of
+// being orphaned. cmd must come from exec.CommandContext.
+//
+// The returned stop must be called once Wait has returned: it cancels a
+// pending SIGKILL, whose process group ID may otherwise have been reused.
+func StartInGroup(cmd *exec.Cmd) (stop func()) {
+	g := startInGroup(cmd)
+	return func() { g.stop() }
+}
+
+// groupKill is the delayed SIGKILL armed by a cancelled process group.
+type groupKill struct {
+	mu    sync.Mutex
+	timer *time.Timer // nil until the context ends
+}
+
+func startInGroup(cmd *exec.Cmd) *groupKill {
+	g := &groupKill{}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		pgid := cmd.Process.Pid
+		g.mu.Lock()
+		g.timer = time.AfterFunc(killGrace, func() {
+			syscall.Kill(-pgid, syscall.SIGKILL) //nolint:errcheck // the group may be gone already
+		})
+		g.mu.Unlock()
+		return syscall.Kill(-pgid, syscall.SIGTERM)
+	}
+	// Don't let a child that inherited stderr hold Wait open forever.
+	cmd.WaitDelay = killGrace + time.Second
+	return g
+}
+
+// stop cancels the pending SIGKILL and reports whether there was one.
+func (g *groupKill) stop() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.timer != nil && g.timer.Stop()
+}
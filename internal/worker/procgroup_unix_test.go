@@ -0,0 +1,107 @@
+//go:build unix
+
+package worker
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Not parallel: changes killGrace.
+func TestRun_CancelKillsProcessGroup(t *testing.T) {
+	old := killGrace
+	killGrace = 200 * time.Millisecond
+	t.Cleanup(func() { killGrace = old })
+
+	// Both the script and its child ignore SIGTERM, so only the group
+	// SIGKILL after the grace period stops them.
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "child.pid")
+	script := filepath.Join(dir, "spawning-claude.sh")
+	content := "#!/bin/bash\ntrap '' TERM\nsleep 30 &\necho $! > " + pidFile + "\nwait\n"
+	if err := os.WriteFile(script, []byte(content), 0o755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := Run(ctx, script, "haiku", "p", "", &testChunkWriter{}, Options{})
+		done <- err
+	}()
+
+	var pid int
+	for deadline := time.Now().Add(5 * time.Second); pid == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("child pid never written")
+		}
+		raw, _ := os.ReadFile(pidFile)
+		pid, _ = strconv.Atoi(strings.TrimSpace(string(raw)))
+	}
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Run: err = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+	for deadline := time.Now().Add(2 * time.Second); processAlive(pid); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("child %d still running after cancel", pid)
+		}
+	}
+}
+
+func TestStartInGroup_StopCancelsPendingKill(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := exec.CommandContext(ctx, "sleep", "30")
+	g := startInGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	cancel()
+	// sleep exits on SIGTERM, well before killGrace: the SIGKILL is still
+	// pending when Wait returns and must not outlive it.
+	cmd.Wait() //nolint:errcheck
+	if !g.stop() {
+		t.Error("stop after Wait = false, want a pending SIGKILL cancelled")
+	}
+	if g.stop() {
+		t.Error("second stop = true, want false")
+	}
+
+	// Without a cancelled context there is nothing to stop.
+	cmd = exec.CommandContext(context.Background(), "true")
+	g = startInGroup(cmd)
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if g.stop() {
+		t.Error("stop without cancel = true, want false")
+	}
+}
+
+// processAlive reports whether pid exists and is not a zombie awaiting its reaper.
+func processAlive(pid int) bool {
+	if syscall.Kill(pid, 0) != nil {
+		return false
+	}
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return true
+	}
+	_, rest, _ := strings.Cut(string(stat), ") ")
+	return !strings.HasPrefix(rest, "Z")
+}
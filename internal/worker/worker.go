@@ -5,41 +5,204 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"slices"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 // maxOutputBytes caps the total stdout read from the Claude CLI per job (10 MB).
 // Prevents a runaway/verbose LLM response from filling RAM.
 const maxOutputBytes = 10 * 1024 * 1024
 
+// killGrace is how long a cancelled CLI process group has to exit after
+// SIGTERM before it gets SIGKILL.
+var killGrace = 5 * time.Second
+
+// ErrProcessKilled is returned (wrapped) by Run when the CLI was terminated by a
+// signal it did not ask for, typically the OOM killer or a cgroup limit.
+var ErrProcessKilled = errors.New("claude process killed by signal")
+
 // ChunkWriter receives text chunks as they stream from the CLI.
 type ChunkWriter interface {
 	WriteChunk(text string)
 }
 
-// Run executes the Claude CLI and returns the complete result.
-func Run(ctx context.Context, claudePath, model, prompt, systemPrompt string, w ChunkWriter) (string, error) {
-	args := []string{
-		"--print",
-		"--verbose",
+// DiagnosticWriter is optionally implemented by a ChunkWriter that also wants
+// CLI diagnostics: stderr lines and "system" messages from the JSON stream.
+// source is "stderr" or "system".
+type DiagnosticWriter interface {
+	WriteDiagnostic(source, text string)
+}
+
+// ModelReporter is optionally implemented by a ChunkWriter that wants the model
+// the CLI reported in its "system"/"init" message, which can differ from the
+// requested one when the CLI falls back.
+type ModelReporter interface {
+	ReportModel(model string)
+}
+
+// ThinkingWriter is optionally implemented by a ChunkWriter that wants the
+// extended-thinking blocks of the stream, which are not part of the answer
+// and so never reach WriteChunk or the result.
+type ThinkingWriter interface {
+	WriteThinking(text string)
+}
+
+// SessionReporter is optionally implemented by a ChunkWriter that wants the
+// ID of the CLI session, which Options.ResumeSessionID can continue later.
+type SessionReporter interface {
+	ReportSession(sessionID string)
+}
+
+// Usage is the token consumption and stop reason the CLI reports in its
+// final "result" message.
+type Usage struct {
+	InputTokens  int
+	OutputTokens int
+	StopReason   string
+}
+
+// UsageReporter is optionally implemented by a ChunkWriter that wants the
+// Usage of the run. ReportUsage is only called when the result message
+// carries usage or a stop reason.
+type UsageReporter interface {
+	ReportUsage(u Usage)
+}
+
+// Output formats accepted by Options.OutputFormat.
+const (
+	OutputFormatStreamJSON = "stream-json"
+	OutputFormatJSON       = "json"
+)
+
+// PermissionModeBypass skips every CLI permission check
+// (--dangerously-skip-permissions). Other modes are passed as --permission-mode.
+const PermissionModeBypass = "bypassPermissions"
+
+// Options holds per-run CLI settings beyond model and prompts.
+type Options struct {
+	// OutputFormat selects the CLI --output-format. Empty means stream-json.
+	// With "json" the CLI prints a single document once done, so no chunks are emitted.
+	OutputFormat string
+	// SuccessExitCodes lists non-zero CLI exit codes that still count as success
+	// when a result was captured. Empty means any non-zero exit is a failure.
+	SuccessExitCodes []int
+	// DedupChunks forwards only the new part of assistant blocks that repeat or
+	// extend text already streamed, for CLI versions that re-emit overlapping text.
+	DedupChunks bool
+	// ResumeSessionID continues an earlier CLI session (--resume), so the
+	// prompt is read as the next turn of that conversation.
+	ResumeSessionID string
+	// PermissionMode is the CLI permission mode: "default", "acceptEdits",
+	// "plan" or PermissionModeBypass. Empty leaves the CLI's own default.
+	PermissionMode string
+	// AllowedTools pre-approves these tools (--allowedTools). Since bypassing
+	// permissions would allow every other tool too, it turns
+	// PermissionModeBypass into the CLI default.
+	AllowedTools []string
+	// MCPConfig is the path of an MCP server config file (--mcp-config). It is
+	// only passed when AllowedTools is set, since MCP tools must be allowed too.
+	MCPConfig string
+}
+
+// procSlots caps the claude processes alive across all callers of Run; nil means no cap.
+var procSlots atomic.Pointer[chan struct{}]
+
+// SetMaxProcesses caps the number of claude processes Run keeps alive at once,
+// process-wide. Callers beyond the cap wait for a slot or for their context to
+// end. n <= 0 removes the cap. Call it before the first Run.
+func SetMaxProcesses(n int) {
+	if n <= 0 {
+		procSlots.Store(nil)
+		return
+	}
+	slots := make(chan struct{}, n)
+	procSlots.Store(&slots)
+}
+
+// acquireProcess waits for a process slot. The returned func releases it.
+func acquireProcess(ctx context.Context) (func(), error) {
+	p := procSlots.Load()
+	if p == nil {
+		return func() {}, nil
+	}
+	slots := *p
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Run executes the Claude CLI and returns the complete result. It blocks until
+// a process slot is free when SetMaxProcesses set a cap.
+func Run(ctx context.Context, claudePath, model, prompt, systemPrompt string, w ChunkWriter, opts Options) (string, error) {
+	format := opts.OutputFormat
+	if format == "" {
+		format = OutputFormatStreamJSON
+	}
+
+	args := []string{"--print"}
+	// --verbose is only needed (and required) for stream-json.
+	if format == OutputFormatStreamJSON {
+		args = append(args, "--verbose")
+	}
+	args = append(args,
 		"--model", model,
-		"--output-format", "stream-json",
-		"--dangerously-skip-permissions",
+		"--output-format", format,
+	)
+	mode := opts.PermissionMode
+	if len(opts.AllowedTools) > 0 {
+		// In --print mode the CLI denies any tool that isn't pre-approved.
+		args = append(args, "--allowedTools", strings.Join(opts.AllowedTools, ","))
+		if opts.MCPConfig != "" {
+			args = append(args, "--mcp-config", opts.MCPConfig)
+		}
+		if mode == PermissionModeBypass {
+			mode = ""
+		}
+	}
+	switch mode {
+	case "":
+	case PermissionModeBypass:
+		args = append(args, "--dangerously-skip-permissions")
+	default:
+		args = append(args, "--permission-mode", mode)
 	}
 	if systemPrompt != "" {
 		args = append(args, "--system-prompt", systemPrompt)
 	}
+	if opts.ResumeSessionID != "" {
+		args = append(args, "--resume", opts.ResumeSessionID)
+	}
 	args = append(args, prompt)
 
+	release, err := acquireProcess(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
 	cmd := exec.CommandContext(ctx, claudePath, args...)
-	cmd.Env = filteredEnv()
+	cmd.Env = FilteredEnv()
+	stopKill := StartInGroup(cmd)
 
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
+	rep := reportersOf(w)
+	var fwd *stderrForwarder
+	if rep.dw != nil {
+		fwd = &stderrForwarder{w: rep.dw}
+		cmd.Stderr = io.MultiWriter(&stderr, fwd)
+	}
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
@@ -51,63 +214,267 @@ func Run(ctx context.Context, claudePath, model, prompt, systemPrompt string, w
 	}
 
 	var finalResult string
-	scanner := bufio.NewScanner(io.LimitReader(stdout, maxOutputBytes))
+	if format == OutputFormatJSON {
+		finalResult = readJSON(io.LimitReader(stdout, maxOutputBytes), rep)
+	} else {
+		if opts.DedupChunks && w != nil {
+			w = &dedupWriter{w: w}
+		}
+		finalResult = readStream(io.LimitReader(stdout, maxOutputBytes), w, rep)
+	}
+
+	err = cmd.Wait()
+	stopKill()
+	if fwd != nil {
+		// Wait has copied all of stderr; a last line without '\n' is still buffered.
+		fwd.Flush()
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+				return "", killedError(ws.Signal())
+			}
+			if finalResult != "" && slices.Contains(opts.SuccessExitCodes, exitErr.ExitCode()) {
+				return finalResult, nil
+			}
+		}
+		// The CLI often reports errors in stdout (JSON stream) rather than stderr.
+		// Prefer finalResult when available as it contains the actual error message.
+		detail := stderr.String()
+		if detail == "" && finalResult != "" {
+			detail = finalResult
+		}
+		return "", fmt.Errorf("claude exited: %w — %s", err, detail)
+	}
+
+	return finalResult, nil
+}
+
+// killedError describes a signal-terminated CLI. SIGKILL is what the OOM killer
+// and cgroup memory limits send, hence the hint.
+func killedError(sig syscall.Signal) error {
+	if sig == syscall.SIGKILL {
+		return fmt.Errorf("%w: %s (possible OOM)", ErrProcessKilled, sig)
+	}
+	return fmt.Errorf("%w: %s", ErrProcessKilled, sig)
+}
+
+// reporters holds the optional interfaces a ChunkWriter implements; nil
+// fields are not implemented.
+type reporters struct {
+	dw DiagnosticWriter
+	mr ModelReporter
+	ur UsageReporter
+	tw ThinkingWriter
+	sr SessionReporter
+}
+
+func reportersOf(w ChunkWriter) reporters {
+	var rep reporters
+	rep.dw, _ = w.(DiagnosticWriter)
+	rep.mr, _ = w.(ModelReporter)
+	rep.ur, _ = w.(UsageReporter)
+	rep.tw, _ = w.(ThinkingWriter)
+	rep.sr, _ = w.(SessionReporter)
+	return rep
+}
+
+// report forwards what a parsed message carries besides text and result.
+// line is the raw message, forwarded as is for system diagnostics.
+func (rep reporters) report(sl streamLine, line []byte) {
+	if sl.System && rep.dw != nil {
+		rep.dw.WriteDiagnostic("system", string(line))
+	}
+	if sl.Model != "" && rep.mr != nil {
+		rep.mr.ReportModel(sl.Model)
+	}
+	if sl.Usage != nil && rep.ur != nil {
+		rep.ur.ReportUsage(*sl.Usage)
+	}
+	if sl.SessionID != "" && rep.sr != nil {
+		rep.sr.ReportSession(sl.SessionID)
+	}
+}
+
+// readStream consumes stream-json output line by line, forwarding assistant text
+// to w and thinking to rep.tw as they arrive, and returns the final result.
+func readStream(r io.Reader, w ChunkWriter, rep reporters) string {
+	var finalResult string
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		line := scanner.Bytes()
 		if len(line) == 0 {
 			continue
 		}
 
-		text, result, ok := parseLine(line)
+		sl, ok := parseLine(line)
 		if !ok {
 			continue
 		}
-		if result != "" {
-			finalResult = result
+		if sl.Result != "" {
+			finalResult = sl.Result
+		}
+		if sl.Thinking != "" && rep.tw != nil {
+			rep.tw.WriteThinking(sl.Thinking)
 		}
-		if text != "" && w != nil {
-			w.WriteChunk(text)
+		if sl.Text != "" && w != nil {
+			w.WriteChunk(sl.Text)
 		}
+		rep.report(sl, line)
 	}
+	return finalResult
+}
 
-	if err := cmd.Wait(); err != nil {
-		if ctx.Err() != nil {
-			return "", ctx.Err()
+// dedupMinOverlap is the shortest repeat or overlap dedupWriter drops. Shorter
+// matches, such as a block starting with the same punctuation the last one
+// ended with, are far more likely to be genuine text.
+const dedupMinOverlap = 16
+
+// dedupWriter wraps a ChunkWriter and strips text that was already streamed:
+// a block that restates everything so far plus more, a block repeating the
+// tail of the stream, or a block whose start overlaps the tail.
+type dedupWriter struct {
+	w   ChunkWriter
+	acc strings.Builder
+}
+
+func (d *dedupWriter) WriteChunk(text string) {
+	delta := newText(d.acc.String(), text)
+	if delta == "" {
+		return
+	}
+	d.acc.WriteString(delta)
+	d.w.WriteChunk(delta)
+}
+
+// newText returns the part of text not already present at the end of acc.
+func newText(acc, text string) string {
+	if acc == "" {
+		return text
+	}
+	if strings.HasPrefix(text, acc) {
+		return text[len(acc):]
+	}
+	if len(text) >= dedupMinOverlap && strings.HasSuffix(acc, text) {
+		return ""
+	}
+	for k := min(len(acc), len(text)-1); k >= dedupMinOverlap; k-- {
+		if strings.HasSuffix(acc, text[:k]) {
+			return text[k:]
 		}
-		// The CLI often reports errors in stdout (JSON stream) rather than stderr.
-		// Prefer finalResult when available as it contains the actual error message.
-		detail := stderr.String()
-		if detail == "" && finalResult != "" {
-			detail = finalResult
+	}
+	return text
+}
+
+// readJSON consumes --output-format json output and returns the final result.
+// The CLI prints either a single result object or, with --verbose, an array of
+// every message; both shapes are accepted.
+func readJSON(r io.Reader, rep reporters) string {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return ""
+	}
+	data = bytes.TrimSpace(data)
+
+	var messages []json.RawMessage
+	if err := json.Unmarshal(data, &messages); err != nil {
+		messages = []json.RawMessage{data}
+	}
+
+	var finalResult string
+	for _, m := range messages {
+		sl, ok := parseLine(m)
+		if !ok {
+			continue
 		}
-		return "", fmt.Errorf("claude exited: %w — %s", err, detail)
+		if sl.Result != "" {
+			finalResult = sl.Result
+		}
+		rep.report(sl, m)
 	}
+	return finalResult
+}
 
-	return finalResult, nil
+// envAllow lists the variables passed to the CLI; nil means all but CLAUDE*.
+var envAllow atomic.Pointer[[]string]
+
+// SetEnvAllow restricts the environment of the claude processes to the
+// variables matching allow: exact names, or prefixes ending in "*" such as
+// "ANTHROPIC_*". Variables starting with CLAUDE only pass when named exactly.
+// An empty allow restores the default of forwarding everything but CLAUDE*.
+// Call it before the first Run.
+func SetEnvAllow(allow []string) {
+	if len(allow) == 0 {
+		envAllow.Store(nil)
+		return
+	}
+	envAllow.Store(&allow)
 }
 
-// filteredEnv returns os.Environ() without variables starting with CLAUDE.
-func filteredEnv() []string {
-	env := os.Environ()
+// FilteredEnv returns the environment of the claude processes: os.Environ()
+// filtered by SetEnvAllow. The post-job command gets the same environment.
+func FilteredEnv() []string {
+	var allow []string
+	if p := envAllow.Load(); p != nil {
+		allow = *p
+	}
+	return filterEnv(os.Environ(), allow)
+}
+
+// filterEnv keeps the KEY=value entries of env that allow matches, or every
+// entry not starting with CLAUDE when allow is empty.
+func filterEnv(env, allow []string) []string {
 	filtered := make([]string, 0, len(env))
 	for _, kv := range env {
-		if !strings.HasPrefix(kv, "CLAUDE") {
+		name, _, _ := strings.Cut(kv, "=")
+		if envAllowed(name, allow) {
 			filtered = append(filtered, kv)
 		}
 	}
 	return filtered
 }
 
+func envAllowed(name string, allow []string) bool {
+	if len(allow) == 0 {
+		return !strings.HasPrefix(name, "CLAUDE")
+	}
+	for _, a := range allow {
+		if prefix, ok := strings.CutSuffix(a, "*"); ok {
+			if strings.HasPrefix(name, prefix) && !strings.HasPrefix(name, "CLAUDE") {
+				return true
+			}
+		} else if name == a {
+			return true
+		}
+	}
+	return false
+}
+
+// streamLine is what parseLine extracts from one line of the CLI JSON stream.
+type streamLine struct {
+	Text      string // concatenated assistant text blocks
+	Thinking  string // concatenated assistant thinking blocks
+	Result    string // final result string
+	System    bool   // line is a "system" message (init, hooks, ...)
+	Model     string // model reported by a "system"/"init" or "result" message
+	SessionID string // session reported by a "system"/"init" or "result" message
+	Usage     *Usage // tokens and stop reason from a "result" message, if reported
+}
+
 // parseLine extracts the assistant text and/or final result from a JSON line.
-func parseLine(line []byte) (text, result string, ok bool) {
+func parseLine(line []byte) (streamLine, bool) {
 	var raw map[string]json.RawMessage
 	if err := json.Unmarshal(line, &raw); err != nil {
-		return "", "", false
+		return streamLine{}, false
 	}
 
 	var msgType string
 	if err := json.Unmarshal(raw["type"], &msgType); err != nil {
-		return "", "", false
+		return streamLine{}, false
 	}
 
 	switch msgType {
@@ -117,40 +484,119 @@ func parseLine(line []byte) (text, result string, ok bool) {
 			Content json.RawMessage `json:"content"`
 		}
 		if err := json.Unmarshal(raw["message"], &msg); err != nil {
-			return "", "", false
+			return streamLine{}, false
 		}
-		text = extractAssistantText(msg.Content)
-		return text, "", true
+		text, thinking := extractAssistantText(msg.Content)
+		return streamLine{Text: text, Thinking: thinking}, true
 
 	case "result":
+		var result string
 		if err := json.Unmarshal(raw["result"], &result); err != nil {
-			return "", "", false
+			return streamLine{}, false
 		}
-		return "", result, true
+		// A resolved model here matters for json output, which has no init message.
+		var model, session string
+		json.Unmarshal(raw["model"], &model)        //nolint:errcheck
+		json.Unmarshal(raw["session_id"], &session) //nolint:errcheck
+		return streamLine{Result: result, Model: model, SessionID: session, Usage: parseUsage(raw)}, true
+
+	case "system":
+		var subtype, model, session string
+		json.Unmarshal(raw["subtype"], &subtype) //nolint:errcheck
+		if subtype == "init" {
+			json.Unmarshal(raw["model"], &model)        //nolint:errcheck
+			json.Unmarshal(raw["session_id"], &session) //nolint:errcheck
+		}
+		return streamLine{System: true, Model: model, SessionID: session}, true
 	}
 
-	return "", "", false
+	return streamLine{}, false
 }
 
-// extractAssistantText iterates the content array and concatenates all "text" blocks.
-func extractAssistantText(raw json.RawMessage) string {
+// parseUsage extracts the usage object and stop_reason of a "result" message.
+// It returns nil when the message carries neither.
+func parseUsage(raw map[string]json.RawMessage) *Usage {
+	if raw["usage"] == nil && raw["stop_reason"] == nil {
+		return nil
+	}
+	var tokens struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	}
+	var u Usage
+	json.Unmarshal(raw["usage"], &tokens)             //nolint:errcheck
+	json.Unmarshal(raw["stop_reason"], &u.StopReason) //nolint:errcheck
+	u.InputTokens, u.OutputTokens = tokens.InputTokens, tokens.OutputTokens
+	return &u
+}
+
+// maxStderrLine caps a stderr line held by stderrForwarder; longer lines are
+// forwarded in pieces of this size so a CLI writing without newlines cannot
+// grow the buffer without bound.
+const maxStderrLine = 64 * 1024
+
+// stderrForwarder splits CLI stderr into lines and forwards each one as a diagnostic.
+// Flush forwards a trailing line that did not end in a newline.
+type stderrForwarder struct {
+	w   DiagnosticWriter
+	buf []byte
+}
+
+func (f *stderrForwarder) Write(p []byte) (int, error) {
+	f.buf = append(f.buf, p...)
+	for {
+		idx := bytes.IndexByte(f.buf, '\n')
+		if idx == -1 {
+			break
+		}
+		f.forward(f.buf[:idx])
+		f.buf = f.buf[idx+1:]
+	}
+	for len(f.buf) >= maxStderrLine {
+		f.forward(f.buf[:maxStderrLine])
+		f.buf = f.buf[maxStderrLine:]
+	}
+	// Drop the consumed prefix so the backing array does not keep growing.
+	f.buf = append([]byte(nil), f.buf...)
+	return len(p), nil
+}
+
+// Flush forwards whatever is buffered as a final line.
+func (f *stderrForwarder) Flush() {
+	f.forward(f.buf)
+	f.buf = nil
+}
+
+func (f *stderrForwarder) forward(line []byte) {
+	if s := strings.TrimSpace(string(line)); s != "" {
+		f.w.WriteDiagnostic("stderr", s)
+	}
+}
+
+// extractAssistantText iterates the content array and concatenates all "text"
+// blocks, and separately all "thinking" blocks.
+func extractAssistantText(raw json.RawMessage) (text, thinking string) {
 	if raw == nil {
-		return ""
+		return "", ""
 	}
 
 	var blocks []struct {
-		Type string `json:"type"`
-		Text string `json:"text"`
+		Type     string `json:"type"`
+		Text     string `json:"text"`
+		Thinking string `json:"thinking"`
 	}
 	if err := json.Unmarshal(raw, &blocks); err != nil {
-		return ""
+		return "", ""
 	}
 
-	var sb strings.Builder
+	var sb, tb strings.Builder
 	for _, b := range blocks {
-		if b.Type == "text" {
+		switch b.Type {
+		case "text":
 			sb.WriteString(b.Text)
+		case "thinking":
+			tb.WriteString(b.Thinking)
 		}
 	}
-	return sb.String()
+	return sb.String(), tb.String()
 }
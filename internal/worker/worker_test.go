@@ -2,11 +2,16 @@ package worker
 
 import (
 	"context"
+	"errors"
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 // mockClaudePath returns the absolute path to the mock-claude.sh script
@@ -37,7 +42,7 @@ func TestRun_MockClaude_ReturnsResult(t *testing.T) {
 
 	cw := &testChunkWriter{}
 
-	result, err := Run(ctx, claudePath, "haiku", "say hello", "", cw)
+	result, err := Run(ctx, claudePath, "haiku", "say hello", "", cw, Options{})
 	if err != nil {
 		t.Fatalf("Run: %v", err)
 	}
@@ -61,7 +66,7 @@ func TestRun_ContextCancelled_ReturnsError(t *testing.T) {
 
 	claudePath := mockClaudePath(t)
 
-	_, err := Run(ctx, claudePath, "haiku", "say hello", "", nil)
+	_, err := Run(ctx, claudePath, "haiku", "say hello", "", nil, Options{})
 	if err == nil {
 		t.Fatal("expected error when context is cancelled, got nil")
 	}
@@ -78,12 +83,54 @@ func TestRun_CLIError_ReturnsError(t *testing.T) {
 	}
 
 	ctx := context.Background()
-	_, err := Run(ctx, script, "haiku", "hello", "", nil)
+	_, err := Run(ctx, script, "haiku", "hello", "", nil, Options{})
 	if err == nil {
 		t.Fatal("expected error from non-zero exit, got nil")
 	}
 }
 
+func TestRun_KilledBySignal(t *testing.T) {
+	t.Parallel()
+	script := filepath.Join(t.TempDir(), "oom-claude.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/bash\nkill -KILL $$\n"), 0o755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	_, err := Run(context.Background(), script, "haiku", "hello", "", nil, Options{})
+	if !errors.Is(err, ErrProcessKilled) {
+		t.Fatalf("err = %v, want ErrProcessKilled", err)
+	}
+	if want := "claude process killed by signal: killed (possible OOM)"; err.Error() != want {
+		t.Errorf("err = %q, want %q", err.Error(), want)
+	}
+}
+
+func TestRun_SuccessExitCodes(t *testing.T) {
+	t.Parallel()
+	tmpDir := t.TempDir()
+	withResult := filepath.Join(tmpDir, "quirky-claude.sh")
+	content := "#!/bin/bash\necho '{\"type\":\"result\",\"result\":\"fine\"}'\nexit 3\n"
+	if err := os.WriteFile(withResult, []byte(content), 0o755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	noResult := filepath.Join(tmpDir, "silent-claude.sh")
+	if err := os.WriteFile(noResult, []byte("#!/bin/bash\nexit 3\n"), 0o755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	ctx := context.Background()
+
+	result, err := Run(ctx, withResult, "haiku", "hello", "", nil, Options{SuccessExitCodes: []int{3}})
+	if err != nil || result != "fine" {
+		t.Errorf("accepted exit code: result = %q, err = %v, want fine and nil", result, err)
+	}
+	if _, err := Run(ctx, withResult, "haiku", "hello", "", nil, Options{SuccessExitCodes: []int{2}}); err == nil {
+		t.Error("unlisted exit code: expected error, got nil")
+	}
+	if _, err := Run(ctx, noResult, "haiku", "hello", "", nil, Options{SuccessExitCodes: []int{3}}); err == nil {
+		t.Error("accepted exit code without result: expected error, got nil")
+	}
+}
+
 func TestRun_LargeOutput_HandledGracefully(t *testing.T) {
 	t.Parallel()
 	// Script that emits many chunks — verifies we handle large output without panicking.
@@ -102,7 +149,7 @@ func TestRun_LargeOutput_HandledGracefully(t *testing.T) {
 
 	ctx := context.Background()
 	cw := &testChunkWriter{}
-	result, err := Run(ctx, script, "haiku", "hello", "", cw)
+	result, err := Run(ctx, script, "haiku", "hello", "", cw, Options{})
 	if err != nil {
 		t.Fatalf("Run: %v", err)
 	}
@@ -113,3 +160,377 @@ func TestRun_LargeOutput_HandledGracefully(t *testing.T) {
 		t.Errorf("chunks = %d, want 100", len(cw.chunks))
 	}
 }
+
+type testDiagnosticWriter struct {
+	testChunkWriter
+	mu          sync.Mutex
+	diagnostics []string
+}
+
+func (w *testDiagnosticWriter) WriteDiagnostic(source, text string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.diagnostics = append(w.diagnostics, source+": "+text)
+}
+
+func TestRun_DiagnosticWriter_ReceivesStderrAndSystem(t *testing.T) {
+	t.Parallel()
+	tmpDir := t.TempDir()
+	script := filepath.Join(tmpDir, "diag-claude.sh")
+	content := "#!/bin/bash\n" +
+		"echo 'warming up' >&2\n" +
+		`echo '{"type":"system","subtype":"init","model":"claude-haiku"}'` + "\n" +
+		`echo '{"type":"result","result":"ok"}'` + "\n"
+	if err := os.WriteFile(script, []byte(content), 0o755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	dw := &testDiagnosticWriter{}
+	if _, err := Run(context.Background(), script, "haiku", "hello", "", dw, Options{}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	var sawStderr, sawSystem bool
+	for _, d := range dw.diagnostics {
+		if d == "stderr: warming up" {
+			sawStderr = true
+		}
+		if strings.HasPrefix(d, "system: ") && strings.Contains(d, `"subtype":"init"`) {
+			sawSystem = true
+		}
+	}
+	if !sawStderr || !sawSystem {
+		t.Errorf("diagnostics = %v, want stderr and system entries", dw.diagnostics)
+	}
+}
+
+func TestRun_DiagnosticWriter_FlushesTrailingStderr(t *testing.T) {
+	t.Parallel()
+	tmpDir := t.TempDir()
+	script := filepath.Join(tmpDir, "partial-claude.sh")
+	content := "#!/bin/bash\n" +
+		`echo '{"type":"result","result":"ok"}'` + "\n" +
+		"printf 'first\\nlast words' >&2\n"
+	if err := os.WriteFile(script, []byte(content), 0o755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	dw := &testDiagnosticWriter{}
+	if _, err := Run(context.Background(), script, "haiku", "hello", "", dw, Options{}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	want := []string{"stderr: first", "stderr: last words"}
+	if !slices.Equal(dw.diagnostics, want) {
+		t.Errorf("diagnostics = %q, want %q", dw.diagnostics, want)
+	}
+}
+
+func TestStderrForwarder_CapsLineLength(t *testing.T) {
+	t.Parallel()
+	dw := &testDiagnosticWriter{}
+	f := &stderrForwarder{w: dw}
+
+	long := strings.Repeat("x", maxStderrLine)
+	for range 3 {
+		f.Write([]byte(long[:maxStderrLine/2])) //nolint:errcheck
+	}
+	if len(f.buf) >= maxStderrLine {
+		t.Errorf("buffered %d bytes, want fewer than %d", len(f.buf), maxStderrLine)
+	}
+	f.Write([]byte("tail\n")) //nolint:errcheck
+	f.Flush()
+
+	if len(dw.diagnostics) != 2 {
+		t.Fatalf("diagnostics = %d, want 2", len(dw.diagnostics))
+	}
+	if got := dw.diagnostics[0]; got != "stderr: "+long {
+		t.Errorf("first piece has %d bytes, want %d", len(got)-len("stderr: "), maxStderrLine)
+	}
+	if got, want := dw.diagnostics[1], "stderr: "+long[:maxStderrLine/2]+"tail"; got != want {
+		t.Errorf("second piece has %d bytes, want %d", len(got), len(want))
+	}
+}
+
+func TestRun_JSONOutputFormat(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name   string
+		output string
+	}{
+		{"single object", `{"type":"result","result":"json done"}`},
+		{"verbose array", `[{"type":"system","subtype":"init"},{"type":"assistant","message":{"content":[{"type":"text","text":"json done"}]}},{"type":"result","result":"json done"}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			script := filepath.Join(t.TempDir(), "json-claude.sh")
+			// Fail unless the CLI is asked for the json format.
+			content := "#!/bin/bash\n" +
+				`[[ " $* " == *" --output-format json "* ]] || exit 3` + "\n" +
+				"echo '" + tt.output + "'\n"
+			if err := os.WriteFile(script, []byte(content), 0o755); err != nil {
+				t.Fatalf("WriteFile: %v", err)
+			}
+
+			cw := &testChunkWriter{}
+			result, err := Run(context.Background(), script, "haiku", "hello", "", cw, Options{OutputFormat: OutputFormatJSON})
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			if result != "json done" {
+				t.Errorf("result = %q, want %q", result, "json done")
+			}
+			if len(cw.chunks) != 0 {
+				t.Errorf("chunks = %d, want 0 in json mode", len(cw.chunks))
+			}
+		})
+	}
+}
+
+type testModelReporter struct {
+	testChunkWriter
+	model string
+}
+
+func (w *testModelReporter) ReportModel(model string) {
+	w.model = model
+}
+
+func TestRun_ModelReporter_ReceivesInitModel(t *testing.T) {
+	t.Parallel()
+	script := filepath.Join(t.TempDir(), "init-claude.sh")
+	content := "#!/bin/bash\n" +
+		`echo '{"type":"system","subtype":"hook","model":"ignored"}'` + "\n" +
+		`echo '{"type":"system","subtype":"init","model":"claude-sonnet-fallback","session_id":"s1"}'` + "\n" +
+		`echo '{"type":"result","result":"ok"}'` + "\n"
+	if err := os.WriteFile(script, []byte(content), 0o755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	mr := &testModelReporter{}
+	if _, err := Run(context.Background(), script, "opus", "hello", "", mr, Options{}); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if mr.model != "claude-sonnet-fallback" {
+		t.Errorf("model = %q, want %q", mr.model, "claude-sonnet-fallback")
+	}
+}
+
+type testUsageReporter struct {
+	testChunkWriter
+	usage *Usage
+}
+
+func (w *testUsageReporter) ReportUsage(u Usage) {
+	w.usage = &u
+}
+
+func TestRun_UsageReporter_ReceivesResultUsage(t *testing.T) {
+	t.Parallel()
+	for _, format := range []string{OutputFormatStreamJSON, OutputFormatJSON} {
+		ur := &testUsageReporter{}
+		script := mockClaudePath(t)
+		if format == OutputFormatJSON {
+			script = filepath.Join(t.TempDir(), "json-claude.sh")
+			content := "#!/bin/bash\n" +
+				`echo '{"type":"result","result":"ok","stop_reason":"max_tokens","usage":{"input_tokens":12,"output_tokens":5,"cache_read_input_tokens":40}}'` + "\n"
+			if err := os.WriteFile(script, []byte(content), 0o755); err != nil {
+				t.Fatalf("WriteFile: %v", err)
+			}
+		}
+		if _, err := Run(context.Background(), script, "haiku", "hello", "", ur, Options{OutputFormat: format}); err != nil {
+			t.Fatalf("%s: Run: %v", format, err)
+		}
+		if ur.usage == nil || ur.usage.InputTokens != 12 || ur.usage.OutputTokens != 5 || ur.usage.StopReason == "" {
+			t.Errorf("%s: usage = %+v, want 12 in, 5 out and a stop reason", format, ur.usage)
+		}
+	}
+}
+
+func TestParseLine_ResultModel(t *testing.T) {
+	t.Parallel()
+	sl, ok := parseLine([]byte(`{"type":"result","result":"ok","model":"claude-haiku-4-5-20251001"}`))
+	if !ok || sl.Model != "claude-haiku-4-5-20251001" {
+		t.Errorf("parseLine = %+v, %v; want the result's model", sl, ok)
+	}
+}
+
+func TestParseLine_ResultWithoutUsage(t *testing.T) {
+	t.Parallel()
+	sl, ok := parseLine([]byte(`{"type":"result","result":"ok"}`))
+	if !ok || sl.Usage != nil {
+		t.Errorf("parseLine = %+v, %v; want no usage", sl, ok)
+	}
+}
+
+// Not parallel: SetMaxProcesses changes package-wide state.
+func TestRun_MaxProcesses_WaitsForSlot(t *testing.T) {
+	SetMaxProcesses(1)
+	t.Cleanup(func() { SetMaxProcesses(0) })
+
+	release, err := acquireProcess(context.Background())
+	if err != nil {
+		t.Fatalf("acquireProcess: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := Run(ctx, mockClaudePath(t), "haiku", "say hello", "", &testChunkWriter{}, Options{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Run with no free slot: err = %v, want DeadlineExceeded", err)
+	}
+
+	release()
+	if _, err := Run(context.Background(), mockClaudePath(t), "haiku", "say hello", "", &testChunkWriter{}, Options{}); err != nil {
+		t.Fatalf("Run after release: %v", err)
+	}
+}
+
+func TestReadStream_DedupChunks(t *testing.T) {
+	t.Parallel()
+	const first = "The quick brown fox jumps over the lazy dog."
+	const second = " Then it naps in the afternoon sun."
+	block := func(text string) string {
+		return `{"type":"assistant","message":{"content":[{"type":"text","text":` + strconv.Quote(text) + `}]}}` + "\n"
+	}
+	stream := block(first) +
+		block(first+second) + // restates everything so far, then extends it
+		block(second) + // repeats the tail
+		block("the lazy dog. Then it naps in the afternoon sun. Zzz.") + // overlaps the tail
+		block(".") // short, genuine
+	stream += `{"type":"result","result":"done"}` + "\n"
+
+	cw := &testChunkWriter{}
+	readStream(strings.NewReader(stream), &dedupWriter{w: cw}, reporters{})
+
+	want := []string{first, second, " Zzz.", "."}
+	if !slices.Equal(cw.chunks, want) {
+		t.Errorf("chunks = %q, want %q", cw.chunks, want)
+	}
+	if got := strings.Join(cw.chunks, ""); got != first+second+" Zzz.." {
+		t.Errorf("joined = %q", got)
+	}
+}
+
+// thinkingChunkWriter records chunks and thinking separately.
+type thinkingChunkWriter struct {
+	testChunkWriter
+	thinking []string
+}
+
+func (w *thinkingChunkWriter) WriteThinking(text string) {
+	w.thinking = append(w.thinking, text)
+}
+
+func TestReadStream_ThinkingKeptOutOfChunks(t *testing.T) {
+	t.Parallel()
+	stream := `{"type":"assistant","message":{"content":[{"type":"thinking","thinking":"Let me add them."},{"type":"text","text":"4"}]}}` + "\n" +
+		`{"type":"result","result":"4"}` + "\n"
+
+	cw := &thinkingChunkWriter{}
+	result := readStream(strings.NewReader(stream), cw, reportersOf(cw))
+
+	if result != "4" {
+		t.Errorf("result = %q, want %q", result, "4")
+	}
+	if !slices.Equal(cw.chunks, []string{"4"}) {
+		t.Errorf("chunks = %q, want [4]", cw.chunks)
+	}
+	if !slices.Equal(cw.thinking, []string{"Let me add them."}) {
+		t.Errorf("thinking = %q, want [Let me add them.]", cw.thinking)
+	}
+}
+
+type testSessionReporter struct {
+	testChunkWriter
+	session string
+}
+
+func (w *testSessionReporter) ReportSession(sessionID string) {
+	w.session = sessionID
+}
+
+func TestRun_AllowedTools(t *testing.T) {
+	t.Parallel()
+	// The script answers with its arguments, minus the prompt.
+	script := filepath.Join(t.TempDir(), "args-claude.sh")
+	content := "#!/bin/bash\n" +
+		`args="${*:1:$#-1}"` + "\n" +
+		`printf '{"type":"result","result":"%s"}\n' "$args"` + "\n"
+	if err := os.WriteFile(script, []byte(content), 0o755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name       string
+		opts       Options
+		want, deny string
+	}{
+		{"no tools", Options{PermissionMode: PermissionModeBypass, MCPConfig: "/mcp.json"}, "--dangerously-skip-permissions", "--mcp-config"},
+		{"tools", Options{PermissionMode: PermissionModeBypass, AllowedTools: []string{"Read", "mcp__gh__issue"}, MCPConfig: "/mcp.json"},
+			"--allowedTools Read,mcp__gh__issue --mcp-config /mcp.json", "--dangerously-skip-permissions"},
+		{"plan mode", Options{PermissionMode: "plan"}, "--permission-mode plan", "--dangerously-skip-permissions"},
+		{"cli default", Options{}, "--output-format stream-json", "--permission-mode"},
+	} {
+		result, err := Run(context.Background(), script, "haiku", "prompt", "", &testChunkWriter{}, tt.opts)
+		if err != nil {
+			t.Fatalf("%s: Run: %v", tt.name, err)
+		}
+		if !strings.Contains(result, tt.want) || strings.Contains(result, tt.deny) {
+			t.Errorf("%s: args = %q, want %q without %q", tt.name, result, tt.want, tt.deny)
+		}
+	}
+}
+
+func TestFilterEnv(t *testing.T) {
+	t.Parallel()
+	env := []string{"PATH=/bin", "HOME=/h", "CLAUDECODE=1", "CLAUDE_CONFIG_DIR=/c", "ANTHROPIC_BASE_URL=http://x", "HTTPS_PROXY=http://p", "SECRET=s"}
+
+	for _, tt := range []struct {
+		allow []string
+		want  string
+	}{
+		{nil, "PATH HOME ANTHROPIC_BASE_URL HTTPS_PROXY SECRET"},
+		{[]string{"PATH", "HOME", "ANTHROPIC_*", "HTTPS_PROXY"}, "PATH HOME ANTHROPIC_BASE_URL HTTPS_PROXY"},
+		{[]string{"*"}, "PATH HOME ANTHROPIC_BASE_URL HTTPS_PROXY SECRET"},
+		{[]string{"PATH", "CLAUDE_CONFIG_DIR"}, "PATH CLAUDE_CONFIG_DIR"},
+	} {
+		var names []string
+		for _, kv := range filterEnv(env, tt.allow) {
+			name, _, _ := strings.Cut(kv, "=")
+			names = append(names, name)
+		}
+		if got := strings.Join(names, " "); got != tt.want {
+			t.Errorf("allow %v: got %q, want %q", tt.allow, got, tt.want)
+		}
+	}
+}
+
+func TestRun_ResumeSession(t *testing.T) {
+	t.Parallel()
+	// The script answers with the session it was asked to resume, if any.
+	script := filepath.Join(t.TempDir(), "session-claude.sh")
+	content := "#!/bin/bash\n" +
+		`resume=none; while [ $# -gt 0 ]; do [ "$1" = --resume ] && resume=$2; shift; done` + "\n" +
+		`echo '{"type":"system","subtype":"init","model":"haiku","session_id":"sess-new"}'` + "\n" +
+		`echo '{"type":"result","result":"resumed '$resume'","session_id":"sess-new"}'` + "\n"
+	if err := os.WriteFile(script, []byte(content), 0o755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	sr := &testSessionReporter{}
+	result, err := Run(context.Background(), script, "haiku", "and then?", "", sr, Options{ResumeSessionID: "sess-old"})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if result != "resumed sess-old" {
+		t.Errorf("result = %q, want the CLI to get --resume sess-old", result)
+	}
+	if sr.session != "sess-new" {
+		t.Errorf("session = %q, want %q", sr.session, "sess-new")
+	}
+}
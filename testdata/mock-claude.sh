@@ -10,4 +10,4 @@ sleep 0.1
 
 # Output stream-json format — content is nested under message.content
 echo '{"type":"assistant","message":{"content":[{"type":"text","text":"Hello from mock Claude!"}]}}'
-echo '{"type":"result","result":"Hello from mock Claude!","model":"haiku","stop_reason":"end_turn"}'
+echo '{"type":"result","result":"Hello from mock Claude!","model":"haiku","stop_reason":"end_turn","usage":{"input_tokens":12,"output_tokens":5}}'